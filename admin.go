@@ -0,0 +1,377 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/andy/guachi-pay-line-bot/backup"
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/db"
+	ib "github.com/andy/guachi-pay-line-bot/inbox"
+	sc "github.com/andy/guachi-pay-line-bot/scheduler"
+	"github.com/andy/guachi-pay-line-bot/statement"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// adminCommand is a subcommand for maintainers, the wallet is stored in `dbSrv`
+// ex: ./guachi-pay-line-bot reconcile -repair guachi
+type adminCommand struct {
+	usage   string
+	execute func(dbSrv *db.DB, wallet wl.Wallet, args []string) error
+}
+
+var (
+	adminCommands = map[string]adminCommand{
+		"reconcile": adminCommand{
+			usage:   "reconcile [-repair] [wallet names...]",
+			execute: reconcile,
+		},
+		"assign-owner": adminCommand{
+			usage:   "assign-owner <wallet name> <LINE user ID>",
+			execute: assignOwner,
+		},
+		"import-rates": adminCommand{
+			usage:   "import-rates <file.csv>",
+			execute: importRates,
+		},
+		"import-csv": adminCommand{
+			usage:   "import-csv -caller <LINE user ID> [-date 0 -description 1 -amount 2 -date-format 2006/01/02 -header -negate] <wallet name> <file.csv>",
+			execute: importCSV,
+		},
+		"import-ofx": adminCommand{
+			usage:   "import-ofx -caller <LINE user ID> <wallet name> <file.ofx>",
+			execute: importStatement("import-ofx", statement.ParseOFX),
+		},
+		"import-qif": adminCommand{
+			usage:   "import-qif -caller <LINE user ID> <wallet name> <file.qif>",
+			execute: importStatement("import-qif", statement.ParseQIF),
+		},
+		"export": adminCommand{
+			usage:   "export -caller <LINE user ID> [-format csv|ledger|beancount] <wallet name> <start date> <end date>",
+			execute: exportLogs,
+		},
+		"migrate": adminCommand{
+			usage:   "migrate [-status] [-to <version>]",
+			execute: migrate,
+		},
+		"stuck-events": adminCommand{
+			usage:   "stuck-events",
+			execute: listStuckEvents,
+		},
+		"backup": adminCommand{
+			usage:   "backup [file.json]",
+			execute: backupWallets,
+		},
+		"restore": adminCommand{
+			usage:   "restore <file.json>",
+			execute: restoreWallets,
+		},
+	}
+)
+
+// runAdminCommand runs the subcommand, it returns false if the subcommand doesn't exist
+func runAdminCommand(dbSrv *db.DB, wallet wl.Wallet, args []string) bool {
+	command, ok := adminCommands[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown command "+args[0]+", available commands:")
+		for _, command := range adminCommands {
+			fmt.Fprintln(os.Stderr, "  "+command.usage)
+		}
+		return false
+	}
+
+	if err := command.execute(dbSrv, wallet, args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, args[0]+" failed: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// reconcile compares balances with logs of wallets, all wallets are checked if no wallet name is given
+func reconcile(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "write adjustment logs for wallets with drift")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	drifts, err := wallet.ReconcileAll(*repair, flags.Args()...)
+	if err != nil {
+		return err
+	}
+
+	if len(drifts) == 0 {
+		fmt.Println("no drift is found")
+		return nil
+	}
+
+	for _, drift := range drifts {
+		status := "drifted"
+		if drift.Repaired {
+			status = "repaired"
+		}
+		fmt.Printf("%s\tbalance=%d\tlogs=%d\tdrift=%d\t%s\n", drift.UserID, drift.Balance, drift.Journal, drift.Amount(), status)
+	}
+	return nil
+}
+
+// assignOwner makes the user the owner of the wallet, it's for wallets created before ownership was introduced
+func assignOwner(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: assign-owner <wallet name> <LINE user ID>")
+	}
+
+	if err := wallet.SetOwner(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("%s is the owner of %s\n", args[1], args[0])
+	return nil
+}
+
+// importRates imports exchange rates from the csv file, each line is `date,base,quote,rate`
+// ex: 2019/05/20,USD,TWD,31.5
+func importRates(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import-rates <file.csv>")
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count, err := wallet.ImportRates(file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d rates are imported\n", count)
+	return nil
+}
+
+// importCSV imports the bank statement to the wallet, entries that were imported before are skipped
+// the caller should be an editor of the wallet as it is in chats
+func importCSV(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	flags := flag.NewFlagSet("import-csv", flag.ContinueOnError)
+	callerID := flags.String("caller", "", "LINE user ID of the one who imports the statement")
+	date := flags.Int("date", statement.DefaultMapping.Date, "column of dates, zero-based")
+	description := flags.Int("description", statement.DefaultMapping.Description, "column of descriptions, zero-based")
+	amount := flags.Int("amount", statement.DefaultMapping.Amount, "column of amounts, zero-based")
+	dateFormat := flags.String("date-format", statement.DefaultMapping.DateFormat, "layout of dates in Go")
+	hasHeader := flags.Bool("header", statement.DefaultMapping.HasHeader, "skip the first line")
+	negate := flags.Bool("negate", false, "spending is positive in the statement")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *callerID == "" || flags.NArg() != 2 {
+		return fmt.Errorf("a caller, a wallet name and a file are required")
+	}
+	userID := flags.Arg(0)
+
+	file, err := os.Open(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	currency, err := wallet.GetCurrency(*callerID, userID)
+	if err != nil {
+		return err
+	}
+
+	mapping := statement.Mapping{
+		Date:        *date,
+		Description: *description,
+		Amount:      *amount,
+		DateFormat:  *dateFormat,
+		HasHeader:   *hasHeader,
+		Negate:      *negate,
+	}
+	entries, err := statement.ParseCSV(file, mapping, currency)
+	if err != nil {
+		return err
+	}
+
+	result, err := wallet.ImportEntries(*callerID, userID, entries)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d entries are imported, %d entries are skipped\n", result.Imported, result.Skipped)
+	return nil
+}
+
+// importStatement imports the bank statement to the wallet with the parser, entries that were imported before are skipped
+func importStatement(name string, parse func(reader io.Reader, currency string) ([]*wl.ImportEntry, error)) func(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	return func(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+		flags := flag.NewFlagSet(name, flag.ContinueOnError)
+		callerID := flags.String("caller", "", "LINE user ID of the one who imports the statement")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if *callerID == "" || flags.NArg() != 2 {
+			return fmt.Errorf("a caller, a wallet name and a file are required")
+		}
+		userID := flags.Arg(0)
+
+		file, err := os.Open(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		currency, err := wallet.GetCurrency(*callerID, userID)
+		if err != nil {
+			return err
+		}
+
+		entries, err := parse(file, currency)
+		if err != nil {
+			return err
+		}
+
+		result, err := wallet.ImportEntries(*callerID, userID, entries)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d entries are imported, %d entries are skipped\n", result.Imported, result.Skipped)
+		return nil
+	}
+}
+
+// exportLogs writes logs of the wallet to stdout, both dates are included, ex: 2019/05/01 2019/05/31
+func exportLogs(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	callerID := flags.String("caller", "", "LINE user ID of the one who exports logs")
+	format := flags.String("format", string(wl.ExportCSV), "csv, ledger or beancount")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *callerID == "" || flags.NArg() != 3 {
+		return fmt.Errorf("a caller, a wallet name and dates are required")
+	}
+
+	startTime, err := base.ParseToTimestamp(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	endTime, err := base.ParseToTimestamp(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	// the end date is included
+	timeRange := wl.TimeRange{Start: startTime, End: endTime + 24*60*60}
+	return wallet.ExportLogs(*callerID, flags.Arg(0), timeRange, wl.ExportFormat(*format), os.Stdout)
+}
+
+// backupWallets writes every wallet with its logs, settings, members and recurring rules to the file as JSON, or to stdout if no file is given
+func backupWallets(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: backup [file.json]")
+	}
+
+	writer := io.Writer(os.Stdout)
+	if len(args) == 1 {
+		file, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	document, err := backup.Write(wallet, sc.NewSQLScheduler(dbSrv, wallet), writer)
+	if err != nil {
+		return err
+	}
+	// the summary goes to stderr, so that it doesn't mix with the backup on stdout
+	fmt.Fprintf(os.Stderr, "%d wallets, %d transactions and %d rules are backed up\n",
+		len(document.Snapshot.Wallets), len(document.Snapshot.Transactions), len(document.Rules),
+	)
+	return nil
+}
+
+// restoreWallets loads the backup into the empty database, nothing is written if balances don't match logs
+func restoreWallets(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: restore <file.json>")
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	document, err := backup.Restore(wallet, sc.NewSQLScheduler(dbSrv, wallet), file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d wallets, %d transactions and %d rules are restored\n",
+		len(document.Snapshot.Wallets), len(document.Snapshot.Transactions), len(document.Rules),
+	)
+	return nil
+}
+
+// migrate applies pending migrations of the schema, or migrates it up or down to the version
+func migrate(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	status := flags.Bool("status", false, "list migrations without applying them")
+	to := flags.Int("to", db.LatestVersion(), "the version to migrate to, 0 reverts all migrations")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *status {
+		version, err := db.GetVersion(dbSrv)
+		if err != nil {
+			return err
+		}
+		for _, migration := range db.GetMigrations(dbSrv.Dialect) {
+			state := "pending"
+			if migration.Version <= version {
+				state = "applied"
+			}
+			fmt.Printf("%d\t%s\t%s\n", migration.Version, migration.Name, state)
+		}
+		return nil
+	}
+
+	migrations, err := db.MigrateTo(dbSrv, *to)
+	for _, migration := range migrations {
+		fmt.Printf("%d\t%s\tdone\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema is at version %d\n", *to)
+	return nil
+}
+
+// listStuckEvents lists webhook events that fail too many times, or are processing for too long,
+// maintainers should look into them, as the inbox no longer retries them
+func listStuckEvents(dbSrv *db.DB, wallet wl.Wallet, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: stuck-events")
+	}
+
+	events, err := ib.NewSQLInbox(dbSrv).GetStuckEvents()
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		fmt.Println("no stuck event is found")
+		return nil
+	}
+
+	for _, event := range events {
+		fmt.Printf("%s\t%s\tattempts=%d\treceived=%s\tupdated=%s\t%s\n",
+			event.ID, event.Status, event.Attempts,
+			base.ParseToyyymmddhhmm(event.ReceivedAt), base.ParseToyyymmddhhmm(event.UpdatedAt), event.LastError,
+		)
+	}
+	return nil
+}
@@ -1,27 +1,84 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/chart"
+	"github.com/andy/guachi-pay-line-bot/download"
 	lb "github.com/andy/guachi-pay-line-bot/linebot"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
 )
 
 type handler struct {
 	linebot lb.Linebot
+	wallet  wl.Wallet
+	charts  chart.Store
+	signer  download.Signer
+}
+
+type handlerOption struct {
+	requestTimeout time.Duration
+}
+
+// HandlerOption define optional params of the handler
+type HandlerOption func(*handlerOption)
+
+// WithRequestTimeout means operations of each request are canceled after the timeout, ex: queries to the database
+func WithRequestTimeout(timeout time.Duration) HandlerOption {
+	return func(opt *handlerOption) {
+		opt.requestTimeout = timeout
+	}
+}
+
+func initHandlerOption(options ...HandlerOption) handlerOption {
+	opt := handlerOption{}
+	for _, f := range options {
+		f(&opt)
+	}
+	return opt
+}
+
+// withTimeout cancels the context of the request after the timeout, and handlers pass the context down to the database
+func withTimeout(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
 }
 
 // NewHandler ...
-func NewHandler(route *gin.Engine, linebot lb.Linebot) {
+func NewHandler(route *gin.Engine, linebot lb.Linebot, wallet wl.Wallet, charts chart.Store, signer download.Signer, options ...HandlerOption) {
+	opt := initHandlerOption(options...)
 	hd := handler{
 		linebot: linebot,
+		wallet:  wallet,
+		charts:  charts,
+		signer:  signer,
+	}
+	if opt.requestTimeout > 0 {
+		route.Use(withTimeout(opt.requestTimeout))
 	}
 	route.POST("/callback", hd.handleCallback)
+	route.GET("/charts/:token", hd.handleGetChart)
+	route.GET(download.ExportPath+":userID", hd.handleExportLogs)
+	route.GET(download.ImportPath+":userID", hd.handleImportForm)
+	route.POST(download.ImportPath+":userID", hd.handleImportStatement)
 }
 
 func (hd *handler) handleCallback(c *gin.Context) {
-	if err := hd.linebot.ParseLinebotCallback(c.Writer, c.Request); err != nil {
+	if err := hd.linebot.ParseLinebotCallbackContext(c.Request.Context(), c.Writer, c.Request); err != nil {
 		if err == lb.ErrInvalidSignature {
 			c.JSON(http.StatusUnauthorized, gin.H{})
 			return
@@ -34,3 +91,71 @@ func (hd *handler) handleCallback(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{})
 }
+
+// handleGetChart serves the chart image of the token, and it's not found after the image expires
+func (hd *handler) handleGetChart(c *gin.Context) {
+	image, ok := hd.charts.Get(c.Param("token"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	c.Data(http.StatusOK, "image/png", image)
+}
+
+// handleExportLogs downloads logs of the wallet with the link that linebot signs
+// the caller in the link is who asks for it, so the role of the caller is checked as it's in chats
+func (hd *handler) handleExportLogs(c *gin.Context) {
+	userID := c.Param("userID")
+	query := c.Request.URL.Query()
+	if err := hd.signer.Verify(download.ExportPath+userID, query); err == download.ErrLinkExpired {
+		c.JSON(http.StatusGone, gin.H{
+			"errorMessage": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{})
+		return
+	}
+
+	startTime, err := strconv.ParseInt(query.Get(download.ParamStart), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{})
+		return
+	}
+	endTime, err := strconv.ParseInt(query.Get(download.ParamEnd), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{})
+		return
+	}
+
+	// the file is written to the buffer first, so that errors can still be responded
+	buffer := &bytes.Buffer{}
+	timeRange := wl.TimeRange{Start: startTime, End: endTime}
+	format := wl.ExportFormat(query.Get(download.ParamFormat))
+	if err := hd.wallet.WithContext(c.Request.Context()).ExportLogs(query.Get(download.ParamCaller), userID, timeRange, format, buffer); err == wl.ErrWalletNotFound {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	} else if err == wl.ErrPermissionDenied {
+		c.JSON(http.StatusForbidden, gin.H{})
+		return
+	} else if err == wl.ErrInvalidExportFormat || err == wl.ErrInvalidReport {
+		c.JSON(http.StatusBadRequest, gin.H{})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errorMessage": err.Error(),
+		})
+		return
+	}
+
+	// ex: guachi_20190501_20190531.csv or guachi_20190501_20190531.beancount
+	startDate := strings.Replace(base.ParseToyyymmdd(startTime), "/", "", -1)
+	endDate := strings.Replace(base.ParseToyyymmdd(endTime-1), "/", "", -1)
+	filename := userID + "_" + startDate + "_" + endDate + "." + string(format)
+	c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	contentType := "text/plain; charset=utf-8"
+	if format == wl.ExportCSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	c.Data(http.StatusOK, contentType, buffer.Bytes())
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy/guachi-pay-line-bot/chart"
+	"github.com/andy/guachi-pay-line-bot/download"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	testOwnerID = "owner"
+	testGuestID = "guest"
+)
+
+func newTestRouter(t *testing.T) (*gin.Engine, wl.Wallet, download.Signer) {
+	gin.SetMode(gin.TestMode)
+	route := gin.New()
+	wallet := wl.NewMemoryWallet()
+	signer := download.NewSigner("secret", time.Minute)
+	NewHandler(route, nil, wallet, chart.NewStore(time.Minute), signer)
+
+	if err := wallet.Create(testOwnerID, "guachi"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := wallet.Deposit(testOwnerID, "guachi", 1000, "薪水"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	return route, wallet, signer
+}
+
+// exportURL gets the signed link of exporting logs of the wallet in the last day
+func exportURL(signer download.Signer, callerID, userID string, format wl.ExportFormat) string {
+	now := time.Now().Unix()
+	params := url.Values{}
+	params.Set(download.ParamCaller, callerID)
+	params.Set(download.ParamStart, strconv.FormatInt(now-86400, 10))
+	params.Set(download.ParamEnd, strconv.FormatInt(now+1, 10))
+	params.Set(download.ParamFormat, string(format))
+	return download.ExportPath + userID + "?" + signer.Sign(download.ExportPath+userID, params).Encode()
+}
+
+func serve(route *gin.Engine, method, target string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	route.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	return recorder
+}
+
+func TestHandleExportLogs(t *testing.T) {
+	route, _, signer := newTestRouter(t)
+
+	recorder := serve(route, http.MethodGet, exportURL(signer, testOwnerID, "guachi", wl.ExportCSV))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status is %d, expected %d", recorder.Code, http.StatusOK)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/csv") {
+		t.Fatalf("content type is %s", contentType)
+	}
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], "薪水") {
+		t.Fatalf("exported logs are unexpected:\n%s", recorder.Body.String())
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"unsigned", download.ExportPath + "guachi?caller=owner&start=0&end=1&format=csv", http.StatusUnauthorized},
+		{"others", exportURL(signer, testGuestID, "guachi", wl.ExportCSV), http.StatusForbidden},
+		{"not found", exportURL(signer, testOwnerID, "pay", wl.ExportCSV), http.StatusNotFound},
+		{"invalid format", exportURL(signer, testOwnerID, "guachi", wl.ExportFormat("xlsx")), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if recorder := serve(route, http.MethodGet, tt.target); recorder.Code != tt.status {
+			t.Fatalf("%s: status is %d, expected %d", tt.name, recorder.Code, tt.status)
+		}
+	}
+}
+
+func TestHandleGetChart(t *testing.T) {
+	route, _, _ := newTestRouter(t)
+	if recorder := serve(route, http.MethodGet, "/charts/unknown"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("status is %d, expected %d", recorder.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy/guachi-pay-line-bot/download"
+	"github.com/andy/guachi-pay-line-bot/statement"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	// importForm is the page to upload bank statements, it's posted to the same signed link
+	importForm = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>guachi pay 匯入</title></head>
+<body>
+<h3>匯入銀行對帳單 (CSV/OFX/QIF)</h3>
+<form method="post" enctype="multipart/form-data">
+<p><input type="file" name="file" accept=".csv,.ofx,.qfx,.qif" required></p>
+<p>以下設定只用於 CSV 檔</p>
+<p>日期欄位 <input type="number" name="date" value="0" min="0"></p>
+<p>說明欄位 <input type="number" name="description" value="1" min="0"></p>
+<p>金額欄位 <input type="number" name="amount" value="2" min="0"></p>
+<p>日期格式 <input type="text" name="dateFormat" value="2006/01/02"></p>
+<p><label><input type="checkbox" name="header" checked> 第一行是標題</label></p>
+<p><label><input type="checkbox" name="negate"> 支出為正數</label></p>
+<p><button type="submit">匯入</button></p>
+</form>
+</body>
+</html>`
+)
+
+// verifyImportLink checks the signed link, and it returns false if the response is written
+func (hd *handler) verifyImportLink(c *gin.Context) bool {
+	err := hd.signer.Verify(download.ImportPath+c.Param("userID"), c.Request.URL.Query())
+	if err == download.ErrLinkExpired {
+		c.JSON(http.StatusGone, gin.H{
+			"errorMessage": err.Error(),
+		})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{})
+		return false
+	}
+	return true
+}
+
+// getFormInt gets the column of the form, and `defaultValue` is used if it's not given
+func getFormInt(c *gin.Context, key string, defaultValue int) (int, error) {
+	value := c.PostForm(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func (hd *handler) handleImportForm(c *gin.Context) {
+	if !hd.verifyImportLink(c) {
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(importForm))
+}
+
+// handleImportStatement imports the uploaded bank statement to the wallet
+// the caller in the link is who asks for it, so the role of the caller is checked as it's in chats
+func (hd *handler) handleImportStatement(c *gin.Context) {
+	if !hd.verifyImportLink(c) {
+		return
+	}
+	userID := c.Param("userID")
+	callerID := c.Query(download.ParamCaller)
+	// the wallet is canceled with the request, so that a timed out import changes nothing
+	wallet := hd.wallet.WithContext(c.Request.Context())
+
+	mapping := statement.DefaultMapping
+	var err error
+	if mapping.Date, err = getFormInt(c, "date", mapping.Date); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{})
+		return
+	}
+	if mapping.Description, err = getFormInt(c, "description", mapping.Description); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{})
+		return
+	}
+	if mapping.Amount, err = getFormInt(c, "amount", mapping.Amount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{})
+		return
+	}
+	if dateFormat := c.PostForm("dateFormat"); dateFormat != "" {
+		mapping.DateFormat = dateFormat
+	}
+	// unchecked checkboxes are not posted
+	mapping.HasHeader = c.PostForm("header") != ""
+	mapping.Negate = c.PostForm("negate") != ""
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errorMessage": err.Error(),
+		})
+		return
+	}
+	defer file.Close()
+
+	currency, err := wallet.GetCurrency(callerID, userID)
+	if err == wl.ErrWalletNotFound {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	} else if err == wl.ErrPermissionDenied {
+		c.JSON(http.StatusForbidden, gin.H{})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errorMessage": err.Error(),
+		})
+		return
+	}
+
+	entries, err := statement.Parse(file, fileHeader.Filename, mapping, currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errorMessage": err.Error(),
+		})
+		return
+	}
+
+	result, err := wallet.ImportEntries(callerID, userID, entries)
+	if err == wl.ErrWalletNotFound {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	} else if err == wl.ErrPermissionDenied {
+		c.JSON(http.StatusForbidden, gin.H{})
+		return
+	} else if err == wl.ErrInsufficientBalance {
+		c.JSON(http.StatusConflict, gin.H{
+			"errorMessage": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errorMessage": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"imported": result.Imported,
+		"skipped":  result.Skipped,
+	})
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy/guachi-pay-line-bot/download"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const testStatement = "date,description,amount\n2019/05/20,午餐,-120\n2019/05/21,紅包,600\n"
+
+// importURL gets the signed link of uploading bank statements to the wallet
+func importURL(signer download.Signer, callerID, userID string) string {
+	params := url.Values{}
+	params.Set(download.ParamCaller, callerID)
+	return download.ImportPath + userID + "?" + signer.Sign(download.ImportPath+userID, params).Encode()
+}
+
+// upload posts the file with fields of the form to the link
+func upload(t *testing.T, route *gin.Engine, target, filename, content string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			t.Fatalf("writer.WriteField failed: %v", err)
+		}
+	}
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("writer.CreateFormFile failed: %v", err)
+	}
+	part.Write([]byte(content))
+	writer.Close()
+
+	request := httptest.NewRequest(http.MethodPost, target, body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	route.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func expectImportResult(t *testing.T, recorder *httptest.ResponseRecorder, imported, skipped int) {
+	t.Helper()
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status is %d, expected %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	result := struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if result.Imported != imported || result.Skipped != skipped {
+		t.Fatalf("%d are imported and %d are skipped, expected %d and %d", result.Imported, result.Skipped, imported, skipped)
+	}
+}
+
+func expectWalletBalance(t *testing.T, wallet wl.Wallet, expected int64) {
+	t.Helper()
+	balance, err := wallet.GetBalance(testOwnerID, "guachi")
+	if err != nil {
+		t.Fatalf("GetBalance failed: %v", err)
+	}
+	if balance != expected {
+		t.Fatalf("balance is %d, expected %d", balance, expected)
+	}
+}
+
+func TestHandleImportStatement(t *testing.T) {
+	route, wallet, signer := newTestRouter(t)
+	target := importURL(signer, testOwnerID, "guachi")
+	header := map[string]string{"header": "on"}
+
+	if recorder := serve(route, http.MethodGet, target); recorder.Code != http.StatusOK {
+		t.Fatalf("the form: status is %d, expected %d", recorder.Code, http.StatusOK)
+	}
+
+	expectImportResult(t, upload(t, route, target, "statement.csv", testStatement, header), 2, 0)
+	expectWalletBalance(t, wallet, 1480)
+
+	// uploading the same file again skips every entry
+	expectImportResult(t, upload(t, route, target, "statement.csv", testStatement, header), 0, 2)
+	expectWalletBalance(t, wallet, 1480)
+
+	// columns and the date format of the form are used for CSV files
+	fields := map[string]string{"date": "2", "description": "0", "amount": "1", "dateFormat": "20060102", "negate": "on"}
+	expectImportResult(t, upload(t, route, target, "statement.csv", "電費,80,20190522\n", fields), 1, 0)
+	expectWalletBalance(t, wallet, 1400)
+}
+
+func TestHandleImportStatementInsufficientBalance(t *testing.T) {
+	route, wallet, signer := newTestRouter(t)
+	if err := wallet.SetOverdraft(testOwnerID, "guachi", wl.OverdraftForbid, 0); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+
+	// the refused entry rolls back the whole file
+	content := "date,description,amount\n2019/05/20,紅包,600\n2019/05/21,房租,-2000\n"
+	recorder := upload(t, route, importURL(signer, testOwnerID, "guachi"), "statement.csv", content, map[string]string{"header": "on"})
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("status is %d, expected %d", recorder.Code, http.StatusConflict)
+	}
+	expectWalletBalance(t, wallet, 1000)
+	logs, err := wallet.GetBalanceLogs(testOwnerID, "guachi")
+	if err != nil {
+		t.Fatalf("GetBalanceLogs failed: %v", err)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("%d logs are left after the refused import", len(logs))
+	}
+}
+
+func TestHandleImportStatementErrors(t *testing.T) {
+	route, _, signer := newTestRouter(t)
+	target := importURL(signer, testOwnerID, "guachi")
+	// links signed with the same secret but already expired
+	expired := importURL(download.NewSigner("secret", -1*time.Minute), testOwnerID, "guachi")
+
+	tests := []struct {
+		name     string
+		target   string
+		filename string
+		content  string
+		fields   map[string]string
+		status   int
+	}{
+		{"unsigned", download.ImportPath + "guachi?caller=owner", "statement.csv", testStatement, nil, http.StatusUnauthorized},
+		{"another wallet", download.ImportPath + "pay?" + mustQuery(t, target), "statement.csv", testStatement, nil, http.StatusUnauthorized},
+		{"expired", expired, "statement.csv", testStatement, nil, http.StatusGone},
+		{"invalid column", target, "statement.csv", testStatement, map[string]string{"date": "first"}, http.StatusBadRequest},
+		{"negative column", target, "statement.csv", testStatement, map[string]string{"amount": "-1"}, http.StatusBadRequest},
+		{"mismatched mapping", target, "statement.csv", testStatement, map[string]string{"header": "on", "dateFormat": "01/02/2006"}, http.StatusBadRequest},
+		{"invalid OFX", target, "statement.ofx", "<OFX><CURDEF>USD</CURDEF></OFX>", nil, http.StatusBadRequest},
+		{"others", importURL(signer, testGuestID, "guachi"), "statement.csv", testStatement, nil, http.StatusForbidden},
+		{"not found", importURL(signer, testOwnerID, "pay"), "statement.csv", testStatement, nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if recorder := upload(t, route, tt.target, tt.filename, tt.content, tt.fields); recorder.Code != tt.status {
+			t.Fatalf("%s: status is %d, expected %d", tt.name, recorder.Code, tt.status)
+		}
+	}
+
+	if recorder := serve(route, http.MethodGet, expired); recorder.Code != http.StatusGone {
+		t.Fatalf("the expired form: status is %d, expected %d", recorder.Code, http.StatusGone)
+	}
+}
+
+// mustQuery gets the query of the link
+func mustQuery(t *testing.T, target string) string {
+	t.Helper()
+	parsed, err := url.Parse(target)
+	if err != nil {
+		t.Fatalf("url.Parse failed: %v", err)
+	}
+	return parsed.RawQuery
+}
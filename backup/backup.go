@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/scheduler"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	// Version is the version of the document, it's increased whenever the document changes incompatibly
+	// version 2 adds recurring rules, and documents of version 1 are still read as they have no rule
+	Version = 2
+)
+
+var (
+	// ErrUnsupportedVersion occurs when the document is written by a newer or unknown version
+	ErrUnsupportedVersion = fmt.Errorf("unsupported backup version is found")
+	// ErrInvalidRule occurs when the rule can't run, or its wallet isn't in the snapshot
+	ErrInvalidRule = fmt.Errorf("invalid recurring rule is found")
+)
+
+// Document is the JSON document of the backup
+// it only contains snapshots of wallet.Wallet and scheduler.Scheduler, so it works the same for any storage behind them
+type Document struct {
+	Version int `json:"version"`
+	// CreatedAt is the unix timestamp when the backup is made
+	CreatedAt int64            `json:"createdAt"`
+	Snapshot  *wallet.Snapshot `json:"snapshot"`
+	// Rules are recurring rules of wallets in the snapshot
+	Rules []*scheduler.Rule `json:"rules"`
+}
+
+// Write backs up everything of `wl` and rules of `sc` to `writer` as a JSON document
+func Write(wl wallet.Wallet, sc scheduler.Scheduler, writer io.Writer) (*Document, error) {
+	snapshot, err := wl.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := sc.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	document := &Document{
+		Version:   Version,
+		CreatedAt: time.Now().Unix(),
+		Snapshot:  snapshot,
+		Rules:     rules,
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		logrus.WithField("err", err).Error("encoder.Encode failed in Write")
+		return nil, err
+	}
+	return document, nil
+}
+
+// validateRules makes sure that rules can run, and their wallets are in the snapshot
+func validateRules(document *Document) error {
+	wallets := map[string]bool{}
+	for _, w := range document.Snapshot.Wallets {
+		wallets[w.UserID] = true
+	}
+	for _, rule := range document.Rules {
+		if rule == nil || !wallets[rule.UserID] || rule.Amount == int64(0) {
+			return ErrInvalidRule
+		}
+		if _, err := scheduler.ParseSchedule(rule.Schedule); err != nil {
+			return ErrInvalidRule
+		}
+	}
+	return nil
+}
+
+// Read reads the JSON document, and validates the snapshot and rules in it
+func Read(reader io.Reader) (*Document, error) {
+	document := &Document{}
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(document); err != nil {
+		logrus.WithField("err", err).Error("decoder.Decode failed in Read")
+		return nil, err
+	}
+
+	if document.Version < 1 || document.Version > Version {
+		return nil, ErrUnsupportedVersion
+	}
+	if document.Snapshot == nil {
+		return nil, wallet.ErrInvalidSnapshot
+	}
+	if err := document.Snapshot.Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateRules(document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// Restore reads the JSON document, and loads it into `wl` and `sc`, which should be empty
+// wallets are restored before rules, as rules are checked against them
+func Restore(wl wallet.Wallet, sc scheduler.Scheduler, reader io.Reader) (*Document, error) {
+	document, err := Read(reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := wl.Restore(document.Snapshot); err != nil {
+		return nil, err
+	}
+	if err := sc.Restore(document.Rules); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
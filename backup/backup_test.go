@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+	"github.com/andy/guachi-pay-line-bot/scheduler"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const testOwnerID = "owner"
+
+// newTestStorage creates the wallet and the scheduler in an empty database
+func newTestStorage(t *testing.T) (wallet.Wallet, scheduler.Scheduler) {
+	dbSrv, err := db.Open("sqlite://" + filepath.Join(t.TempDir(), "wallet.db"))
+	if err != nil {
+		t.Fatalf("db.Open failed: %v", err)
+	}
+	t.Cleanup(func() {
+		dbSrv.Close()
+	})
+	if _, err := db.Migrate(dbSrv); err != nil {
+		t.Fatalf("db.Migrate failed: %v", err)
+	}
+
+	wl := wallet.NewSQLWallet(dbSrv)
+	return wl, scheduler.NewSQLScheduler(dbSrv, wl)
+}
+
+// getRules gets rules of the wallet without their IDs, as rules get new IDs when they are restored
+func getRules(t *testing.T, sc scheduler.Scheduler, userID string) []scheduler.Rule {
+	t.Helper()
+	rules, err := sc.GetRules(testOwnerID, userID)
+	if err != nil {
+		t.Fatalf("GetRules failed: %v", err)
+	}
+	values := []scheduler.Rule{}
+	for _, rule := range rules {
+		value := *rule
+		value.ID = 0
+		values = append(values, value)
+	}
+	return values
+}
+
+func writeTestBackup(t *testing.T) ([]byte, []scheduler.Rule) {
+	wl, sc := newTestStorage(t)
+	if err := wl.Create(testOwnerID, "guachi"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := wl.Deposit(testOwnerID, "guachi", 30000, "薪水"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	if err := wl.AddCategory(testOwnerID, "guachi", "居住"); err != nil {
+		t.Fatalf("AddCategory failed: %v", err)
+	}
+	if _, err := sc.AddRule(testOwnerID, "guachi", -12000, "房租", "每月5號",
+		scheduler.WithCategory("居住"), scheduler.WithTags("固定"), scheduler.WithNotifyID("group"),
+	); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	rule, err := sc.AddRule(testOwnerID, "guachi", -390, "串流訂閱", "每天")
+	if err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	if err := sc.PauseRule(testOwnerID, rule.ID); err != nil {
+		t.Fatalf("PauseRule failed: %v", err)
+	}
+
+	buffer := &bytes.Buffer{}
+	document, err := Write(wl, sc, buffer)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if len(document.Snapshot.Wallets) != 1 || len(document.Rules) != 2 {
+		t.Fatalf("%d wallets and %d rules are backed up", len(document.Snapshot.Wallets), len(document.Rules))
+	}
+	return buffer.Bytes(), getRules(t, sc, "guachi")
+}
+
+func TestRoundTrip(t *testing.T) {
+	backup, rules := writeTestBackup(t)
+
+	wl, sc := newTestStorage(t)
+	if _, err := Restore(wl, sc, bytes.NewReader(backup)); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	balance, err := wl.GetBalance(testOwnerID, "guachi")
+	if err != nil || balance != 30000 {
+		t.Fatalf("the restored balance is %d, %v", balance, err)
+	}
+	if restored := getRules(t, sc, "guachi"); !reflect.DeepEqual(restored, rules) {
+		t.Fatalf("restored rules are %+v, expected %+v", restored, rules)
+	}
+
+	// restoring into storage that isn't empty changes nothing
+	if _, err := Restore(wl, sc, bytes.NewReader(backup)); err != wallet.ErrStorageNotEmpty {
+		t.Fatalf("Restore again returned %v", err)
+	}
+	if err := sc.Restore([]*scheduler.Rule{}); err != wallet.ErrStorageNotEmpty {
+		t.Fatalf("Restore of rules again returned %v", err)
+	}
+	if restored := getRules(t, sc, "guachi"); len(restored) != 2 {
+		t.Fatalf("%d rules are left after restoring again", len(restored))
+	}
+}
+
+func TestRestoreInvalidRules(t *testing.T) {
+	backup, _ := writeTestBackup(t)
+	document := &Document{}
+	if err := json.Unmarshal(backup, document); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(rule *scheduler.Rule)
+	}{
+		{"the wallet not in the snapshot", func(rule *scheduler.Rule) { rule.UserID = "pay" }},
+		{"the invalid schedule", func(rule *scheduler.Rule) { rule.Schedule = "每年" }},
+		{"the zero amount", func(rule *scheduler.Rule) { rule.Amount = 0 }},
+	}
+	for _, test := range tests {
+		rule := *document.Rules[0]
+		test.modify(&rule)
+		modified := *document
+		modified.Rules = []*scheduler.Rule{document.Rules[1], &rule}
+		body, err := json.Marshal(&modified)
+		if err != nil {
+			t.Fatalf("json.Marshal failed: %v", err)
+		}
+
+		// nothing is restored, as the document is rejected before it's loaded
+		wl, sc := newTestStorage(t)
+		if _, err := Restore(wl, sc, bytes.NewReader(body)); err != ErrInvalidRule {
+			t.Fatalf("Restore with %s returned %v", test.name, err)
+		}
+		if wl.IsWalletExist("guachi") {
+			t.Fatalf("the wallet is restored with %s", test.name)
+		}
+	}
+
+	// the scheduler also refuses rules of wallets that don't exist, and none of them is added
+	wl, sc := newTestStorage(t)
+	if err := wl.Create(testOwnerID, "guachi"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	ghost := *document.Rules[0]
+	ghost.UserID = "pay"
+	if err := sc.Restore([]*scheduler.Rule{document.Rules[0], &ghost}); err != wallet.ErrWalletNotFound {
+		t.Fatalf("Restore of rules of the unknown wallet returned %v", err)
+	}
+	if rules := getRules(t, sc, "guachi"); len(rules) != 0 {
+		t.Fatalf("%d rules are restored", len(rules))
+	}
+}
+
+func TestReadVersion(t *testing.T) {
+	backup, _ := writeTestBackup(t)
+	document := map[string]interface{}{}
+	if err := json.Unmarshal(backup, &document); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+
+	// documents of version 1 have no rule
+	delete(document, "rules")
+	document["version"] = 1
+	body, _ := json.Marshal(document)
+	read, err := Read(bytes.NewReader(body))
+	if err != nil || len(read.Rules) != 0 {
+		t.Fatalf("Read of version 1 returned %v", err)
+	}
+
+	document["version"] = Version + 1
+	body, _ = json.Marshal(document)
+	if _, err := Read(bytes.NewReader(body)); err != ErrUnsupportedVersion {
+		t.Fatalf("Read of the newer version returned %v", err)
+	}
+}
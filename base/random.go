@@ -0,0 +1,16 @@
+package base
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NewRandomID generates an unguessable hex string of 32 characters
+func NewRandomID() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		// crypto/rand never fails on the supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
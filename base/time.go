@@ -71,3 +71,53 @@ func ParseToyyymmddhhmm(timestamp int64) string {
 	}
 	return fmt.Sprintf("%d/%s/%s %s:%s", temp.Year(), monthStr, dayStr, hourStr, minuteStr)
 }
+
+// GetMonthRange gets the unix timestamp range [start, end) of the month that `t` is in
+// the month is based on Asia/Taipei zone
+func GetMonthRange(t time.Time) (int64, int64) {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	t = t.In(location)
+
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+	return start.Unix(), start.AddDate(0, 1, 0).Unix()
+}
+
+// GetDayStart gets the unix timestamp of the beginning of the day that `t` is in
+// the day is based on Asia/Taipei zone
+func GetDayStart(t time.Time) int64 {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	t = t.In(location)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location).Unix()
+}
+
+// GetDayRange gets the unix timestamp range [start, end) of the day that `t` is in
+// the day is based on Asia/Taipei zone
+func GetDayRange(t time.Time) (int64, int64) {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	t = t.In(location)
+
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	return start.Unix(), start.AddDate(0, 0, 1).Unix()
+}
+
+// GetWeekRange gets the unix timestamp range [start, end) of the week that `t` is in
+// the week starts on Monday, and it's based on Asia/Taipei zone
+func GetWeekRange(t time.Time) (int64, int64) {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	t = t.In(location)
+
+	// time.Sunday is 0, so it's moved to the end of the week
+	offset := (int(t.Weekday()) + 6) % 7
+	start := time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, location)
+	return start.Unix(), start.AddDate(0, 0, 7).Unix()
+}
+
+// GetYearRange gets the unix timestamp range [start, end) of the year that `t` is in
+// the year is based on Asia/Taipei zone
+func GetYearRange(t time.Time) (int64, int64) {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	t = t.In(location)
+
+	start := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, location)
+	return start.Unix(), start.AddDate(1, 0, 0).Unix()
+}
@@ -0,0 +1,259 @@
+package chart
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+)
+
+var (
+	// ErrInvalidKind occurs when the kind of the chart isn't supported
+	ErrInvalidKind = fmt.Errorf("invalid kind of chart is found")
+	// ErrInvalidSize occurs when the image is too small to draw the chart
+	ErrInvalidSize = fmt.Errorf("invalid size of chart is found")
+
+	// Palette are colors of slices of pie charts in order,
+	// and they match 🟥🟧🟨🟩🟦🟪🟫⬛ so that legends can be written in text
+	Palette = []color.RGBA{
+		{R: 0xE5, G: 0x39, B: 0x35, A: 0xFF},
+		{R: 0xFB, G: 0x8C, B: 0x00, A: 0xFF},
+		{R: 0xFD, G: 0xD8, B: 0x35, A: 0xFF},
+		{R: 0x43, G: 0xA0, B: 0x47, A: 0xFF},
+		{R: 0x1E, G: 0x88, B: 0xE5, A: 0xFF},
+		{R: 0x8E, G: 0x24, B: 0xAA, A: 0xFF},
+		{R: 0x6D, G: 0x4C, B: 0x41, A: 0xFF},
+		{R: 0x42, G: 0x42, B: 0x42, A: 0xFF},
+	}
+
+	backgroundColor = color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}
+	axisColor       = color.RGBA{R: 0x75, G: 0x75, B: 0x75, A: 0xFF}
+	gridColor       = color.RGBA{R: 0xE0, G: 0xE0, B: 0xE0, A: 0xFF}
+	// seriesColor is the color of bars and lines
+	seriesColor = color.RGBA{R: 0x1E, G: 0x88, B: 0xE5, A: 0xFF}
+)
+
+const (
+	// gridLines is the number of horizontal lines of bar and line charts
+	gridLines = 4
+	// minSize is the minimum width and height of charts
+	minSize = 64
+)
+
+// Kind defines how the chart is drawn
+type Kind string
+
+const (
+	// KindBar draws a bar for each point from left to right
+	KindBar Kind = "bar"
+	// KindLine connects points from left to right
+	KindLine Kind = "line"
+	// KindPie draws a slice for each point clockwise from 12 o'clock
+	KindPie Kind = "pie"
+)
+
+// IsValid checks if the kind is supported
+func (kind Kind) IsValid() bool {
+	switch kind {
+	case KindBar, KindLine, KindPie:
+		return true
+	}
+	return false
+}
+
+// Point is a value of the chart, negative values are drawn as zero
+type Point struct {
+	Label string
+	Value int64
+}
+
+// Render draws the chart of points, and writes it to `w` as a PNG image
+// there is no text in the image, so labels should be listed next to it, ex: in the message
+func Render(w io.Writer, kind Kind, points []Point, width, height int) error {
+	if !kind.IsValid() {
+		return ErrInvalidKind
+	}
+	if width < minSize || height < minSize {
+		return ErrInvalidSize
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fillRect(img, img.Bounds(), backgroundColor)
+
+	switch kind {
+	case KindBar:
+		drawBars(img, points)
+	case KindLine:
+		drawLine(img, points)
+	case KindPie:
+		drawPie(img, points)
+	}
+	return png.Encode(w, img)
+}
+
+func fillRect(img *image.RGBA, rect image.Rectangle, c color.RGBA) {
+	rect = rect.Intersect(img.Bounds())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+func fillCircle(img *image.RGBA, cx, cy, r int, c color.RGBA) {
+	for y := cy - r; y <= cy+r; y++ {
+		for x := cx - r; x <= cx+r; x++ {
+			if (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r && image.Pt(x, y).In(img.Bounds()) {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+// drawSegment draws a line with `thickness` by stamping circles along it
+func drawSegment(img *image.RGBA, from, to image.Point, thickness int, c color.RGBA) {
+	dx, dy := float64(to.X-from.X), float64(to.Y-from.Y)
+	steps := int(math.Max(math.Abs(dx), math.Abs(dy)))
+	if steps == 0 {
+		fillCircle(img, from.X, from.Y, thickness/2, c)
+		return
+	}
+	for i := 0; i <= steps; i++ {
+		x := from.X + int(math.Round(dx*float64(i)/float64(steps)))
+		y := from.Y + int(math.Round(dy*float64(i)/float64(steps)))
+		fillCircle(img, x, y, thickness/2, c)
+	}
+}
+
+// plotArea is the area inside axes of bar and line charts
+func plotArea(img *image.RGBA) image.Rectangle {
+	bounds := img.Bounds()
+	margin := bounds.Dx() / 12
+	return image.Rect(bounds.Min.X+margin, bounds.Min.Y+margin, bounds.Max.X-margin, bounds.Max.Y-margin)
+}
+
+// drawAxes draws the grid and axes, and gets the value at the top of the plot area
+func drawAxes(img *image.RGBA, area image.Rectangle, points []Point) int64 {
+	maxValue := int64(0)
+	for _, point := range points {
+		if point.Value > maxValue {
+			maxValue = point.Value
+		}
+	}
+	// leave some space above the highest point
+	top := maxValue + maxValue/10
+	if top == int64(0) {
+		top = int64(1)
+	}
+
+	stroke := area.Dx()/300 + 1
+	for i := 1; i <= gridLines; i++ {
+		y := area.Max.Y - area.Dy()*i/gridLines
+		fillRect(img, image.Rect(area.Min.X, y, area.Max.X, y+stroke), gridColor)
+	}
+	fillRect(img, image.Rect(area.Min.X, area.Max.Y-stroke, area.Max.X, area.Max.Y+stroke), axisColor)
+	fillRect(img, image.Rect(area.Min.X-stroke, area.Min.Y, area.Min.X+stroke, area.Max.Y+stroke), axisColor)
+	return top
+}
+
+// valueY gets the y of the value in the plot area
+func valueY(area image.Rectangle, value, top int64) int {
+	if value < int64(0) {
+		value = int64(0)
+	}
+	return area.Max.Y - int(int64(area.Dy())*value/top)
+}
+
+func drawBars(img *image.RGBA, points []Point) {
+	area := plotArea(img)
+	top := drawAxes(img, area, points)
+	if len(points) == 0 {
+		return
+	}
+
+	slot := area.Dx() / len(points)
+	// bars take 70% of their slots, and they are at least 1 pixel wide
+	barWidth := slot * 7 / 10
+	if barWidth < 1 {
+		barWidth = 1
+	}
+	for i, point := range points {
+		left := area.Min.X + slot*i + (slot-barWidth)/2
+		fillRect(img, image.Rect(left, valueY(area, point.Value, top), left+barWidth, area.Max.Y), seriesColor)
+	}
+}
+
+func drawLine(img *image.RGBA, points []Point) {
+	area := plotArea(img)
+	top := drawAxes(img, area, points)
+	if len(points) == 0 {
+		return
+	}
+
+	// points are placed at the middle of their slots as bars are
+	slot := area.Dx() / len(points)
+	thickness := area.Dx()/200 + 2
+	positions := make([]image.Point, len(points))
+	for i, point := range points {
+		positions[i] = image.Pt(area.Min.X+slot*i+slot/2, valueY(area, point.Value, top))
+	}
+	for i := 1; i < len(positions); i++ {
+		drawSegment(img, positions[i-1], positions[i], thickness, seriesColor)
+	}
+	for _, position := range positions {
+		fillCircle(img, position.X, position.Y, thickness*2, seriesColor)
+	}
+}
+
+func drawPie(img *image.RGBA, points []Point) {
+	total := int64(0)
+	for _, point := range points {
+		if point.Value > int64(0) {
+			total += point.Value
+		}
+	}
+
+	bounds := img.Bounds()
+	cx, cy := bounds.Min.X+bounds.Dx()/2, bounds.Min.Y+bounds.Dy()/2
+	r := bounds.Dx() * 2 / 5
+	if bounds.Dy() < bounds.Dx() {
+		r = bounds.Dy() * 2 / 5
+	}
+	if total == int64(0) {
+		fillCircle(img, cx, cy, r, gridColor)
+		return
+	}
+
+	// ends are the cumulative fractions where slices end, clockwise from 12 o'clock
+	ends := make([]float64, len(points))
+	sum := int64(0)
+	for i, point := range points {
+		if point.Value > int64(0) {
+			sum += point.Value
+		}
+		ends[i] = float64(sum) / float64(total)
+	}
+
+	for y := cy - r; y <= cy+r; y++ {
+		for x := cx - r; x <= cx+r; x++ {
+			if (x-cx)*(x-cx)+(y-cy)*(y-cy) > r*r {
+				continue
+			}
+
+			// the angle from 12 o'clock clockwise, as y grows downward in images
+			angle := math.Atan2(float64(x-cx), float64(cy-y))
+			if angle < 0 {
+				angle += 2 * math.Pi
+			}
+			fraction := angle / (2 * math.Pi)
+			for i, end := range ends {
+				if fraction <= end {
+					img.SetRGBA(x, y, Palette[i%len(Palette)])
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package chart
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// renderImage renders the chart, and decodes it back
+func renderImage(t *testing.T, kind Kind, points []Point) image.Image {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	if err := Render(buffer, kind, points, 320, 240); err != nil {
+		t.Fatalf("Render(%s) failed: %v", kind, err)
+	}
+	img, err := png.Decode(buffer)
+	if err != nil {
+		t.Fatalf("png.Decode of %s failed: %v", kind, err)
+	}
+	if img.Bounds().Dx() != 320 || img.Bounds().Dy() != 240 {
+		t.Fatalf("the %s chart is %v", kind, img.Bounds())
+	}
+	return img
+}
+
+// hasColor checks if any pixel of the image is in the color
+func hasColor(img image.Image, c color.RGBA) bool {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if color.RGBAModel.Convert(img.At(x, y)) == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []Point
+		// drawn is whether bars or slices are drawn in seriesColor or the first color of Palette
+		drawn bool
+	}{
+		{"empty", []Point{}, false},
+		{"zero", []Point{{Label: "餐飲", Value: 0}}, false},
+		{"negative", []Point{{Label: "餐飲", Value: -120}}, false},
+		{"single", []Point{{Label: "餐飲", Value: 120}}, true},
+		{"groups", []Point{{Label: "餐飲", Value: 120}, {Label: "交通", Value: -30}, {Label: "娛樂", Value: 500}}, true},
+	}
+
+	for _, kind := range []Kind{KindBar, KindLine, KindPie} {
+		for _, test := range tests {
+			img := renderImage(t, kind, test.points)
+
+			expected := seriesColor
+			if kind == KindPie {
+				expected = Palette[0]
+			}
+			// points of lines are drawn as dots even if they are zero
+			expectedDrawn := test.drawn
+			if kind == KindLine {
+				expectedDrawn = len(test.points) != 0
+			}
+			if drawn := hasColor(img, expected); drawn != expectedDrawn {
+				t.Errorf("the %s chart of %s points is drawn: %v, expected %v", kind, test.name, drawn, expectedDrawn)
+			}
+		}
+	}
+}
+
+func TestRenderInvalid(t *testing.T) {
+	points := []Point{{Label: "餐飲", Value: 120}}
+	if err := Render(&bytes.Buffer{}, Kind("radar"), points, 320, 240); err != ErrInvalidKind {
+		t.Fatalf("Render of the unknown kind returned %v", err)
+	}
+	if err := Render(&bytes.Buffer{}, KindBar, points, minSize-1, 240); err != ErrInvalidSize {
+		t.Fatalf("Render of the small chart returned %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package chart
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tokenBytes is the length of random bytes of tokens, so that URLs of images are unguessable
+	tokenBytes = 16
+)
+
+// Store keeps rendered images in memory, and serves them by random tokens until they expire
+type Store interface {
+	// Put stores the image, and gets the token of it
+	Put(image []byte) (string, error)
+	// Get gets the image of the token, and false is returned if it doesn't exist or it has expired
+	Get(token string) ([]byte, bool)
+}
+
+type storedImage struct {
+	image     []byte
+	expiredAt time.Time
+}
+
+type store struct {
+	ttl    time.Duration
+	lock   sync.Mutex
+	images map[string]*storedImage
+}
+
+// NewStore creates a new Store interface, and images expire after `ttl`
+func NewStore(ttl time.Duration) Store {
+	return &store{
+		ttl:    ttl,
+		images: map[string]*storedImage{},
+	}
+}
+
+func (st *store) Put(image []byte) (string, error) {
+	bytes := make([]byte, tokenBytes)
+	if _, err := rand.Read(bytes); err != nil {
+		logrus.WithField("err", err).Error("rand.Read failed in Put")
+		return "", err
+	}
+	token := hex.EncodeToString(bytes)
+
+	now := time.Now()
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	// expired images are removed whenever a new one is stored, so the store doesn't grow forever
+	for key, stored := range st.images {
+		if now.After(stored.expiredAt) {
+			delete(st.images, key)
+		}
+	}
+	st.images[token] = &storedImage{
+		image:     image,
+		expiredAt: now.Add(st.ttl),
+	}
+	return token, nil
+}
+
+func (st *store) Get(token string) ([]byte, bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	stored, ok := st.images[token]
+	if !ok || time.Now().After(stored.expiredAt) {
+		return nil, false
+	}
+	return stored.image, true
+}
@@ -0,0 +1,65 @@
+package chart
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	st := NewStore(time.Hour)
+	token, err := st.Put([]byte("png"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	other, err := st.Put([]byte("other"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if token == other || len(token) != tokenBytes*2 {
+		t.Fatalf("tokens %q and %q aren't random", token, other)
+	}
+
+	if image, ok := st.Get(token); !ok || !bytes.Equal(image, []byte("png")) {
+		t.Fatalf("Get returned %q, %v", image, ok)
+	}
+	if _, ok := st.Get("unknown"); ok {
+		t.Fatal("Get of the unknown token succeeded")
+	}
+}
+
+func TestStoreExpired(t *testing.T) {
+	st := NewStore(time.Hour).(*store)
+	token, err := st.Put([]byte("png"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// the image is not served after it expires
+	st.images[token].expiredAt = time.Now().Add(-1 * time.Second)
+	if _, ok := st.Get(token); ok {
+		t.Fatal("Get of the expired image succeeded")
+	}
+
+	// and it's removed when the next image is stored
+	next, err := st.Put([]byte("next"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, ok := st.images[token]; ok || len(st.images) != 1 {
+		t.Fatalf("the expired image isn't removed, %d images are left", len(st.images))
+	}
+	if _, ok := st.Get(next); !ok {
+		t.Fatal("Get of the next image failed")
+	}
+
+	// images expire after the ttl
+	expired := NewStore(-1 * time.Second)
+	token, err = expired.Put([]byte("png"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, ok := expired.Get(token); ok {
+		t.Fatal("Get of the image after the ttl succeeded")
+	}
+}
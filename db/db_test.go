@@ -0,0 +1,69 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`SELECT balance FROM "UsersWallet" WHERE "userID" = $1`, `SELECT balance FROM "UsersWallet" WHERE "userID" = ?1`},
+		{`UPDATE "UsersWallet" SET balance = $10 WHERE "userID" = $2;`, `UPDATE "UsersWallet" SET balance = ?10 WHERE "userID" = ?2;`},
+		{`SELECT id FROM "LedgerPosting" WHERE id = $1 FOR UPDATE`, `SELECT id FROM "LedgerPosting" WHERE id = ?1`},
+		// placeholders inside strings and identifiers are kept
+		{`SELECT 'costs $5', "col$1" FROM t WHERE a = $1`, `SELECT 'costs $5', "col$1" FROM t WHERE a = ?1`},
+		{`SELECT 'it''s $1' WHERE a = $2`, `SELECT 'it''s $1' WHERE a = ?2`},
+		// dollars without numbers are not placeholders
+		{`SELECT '$' || $1, $ FROM t`, `SELECT '$' || ?1, $ FROM t`},
+	}
+	for _, tt := range tests {
+		if actual := DialectSQLite.Rebind(tt.query); actual != tt.expected {
+			t.Errorf("Rebind(%q) = %q, expected %q", tt.query, actual, tt.expected)
+		}
+		if actual := DialectPostgres.Rebind(tt.query); actual != tt.query {
+			t.Errorf("Postgres rewrote %q to %q", tt.query, actual)
+		}
+	}
+}
+
+func TestOpenSchemes(t *testing.T) {
+	dir := t.TempDir()
+	for _, scheme := range []string{"sqlite", "sqlite3", "SQLite"} {
+		dbSrv, err := Open(scheme + "://" + filepath.Join(dir, scheme+".db"))
+		if err != nil {
+			t.Fatalf("Open(%s) failed: %v", scheme, err)
+		}
+		if dbSrv.Dialect != DialectSQLite {
+			t.Errorf("Open(%s) chose %s", scheme, dbSrv.Dialect)
+		}
+
+		// foreign keys are turned on, so that deleting transactions cascades
+		foreignKeys := 0
+		if err := dbSrv.QueryRow(`PRAGMA foreign_keys`).Scan(&foreignKeys); err != nil {
+			t.Fatalf("PRAGMA foreign_keys failed: %v", err)
+		}
+		if foreignKeys != 1 {
+			t.Errorf("foreign keys are off for %s", scheme)
+		}
+		dbSrv.Close()
+	}
+
+	for _, databaseURL := range []string{"mysql://user@localhost/wallet", "wallet.db", ""} {
+		if _, err := Open(databaseURL); err != ErrUnknownScheme {
+			t.Errorf("Open(%q) returned %v, expected ErrUnknownScheme", databaseURL, err)
+		}
+	}
+
+	// Postgres is chosen for both of its schemes, and it fails at connecting instead of the scheme
+	for _, scheme := range []string{"postgres", "postgresql"} {
+		if _, err := Open(scheme + "://user@127.0.0.1:1/wallet?sslmode=disable&connect_timeout=1"); err == nil || err == ErrUnknownScheme {
+			t.Errorf("Open(%s) returned %v, expected a connection error", scheme, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SchemaMigration related statements
+	// it records versions of applied migrations, and the current version is the largest one
+	createMigrationTable = `
+		CREATE TABLE IF NOT EXISTS "SchemaMigration" (
+			version     INTEGER PRIMARY KEY,
+			name        TEXT NOT NULL,
+			"appliedAt" BIGINT NOT NULL
+		);
+	`
+	getSchemaVersion = `SELECT COALESCE(MAX(version), 0) FROM "SchemaMigration"`
+	insertMigration  = `INSERT INTO "SchemaMigration" (version, name, "appliedAt") VALUES ($1, $2, $3);`
+	deleteMigration  = `DELETE FROM "SchemaMigration" WHERE version = $1`
+	// the lock is held until the transaction ends, so that instances starting together don't apply the same migration
+	lockMigration = `SELECT pg_advisory_xact_lock($1)`
+)
+
+const (
+	// migrationLockKey is the key of the advisory lock of migrations, it's any number that is unique in the database
+	migrationLockKey = 20190520
+)
+
+var (
+	// ErrUnknownVersion occurs when migrating to a version that doesn't exist,
+	// or the database is migrated by a newer binary
+	ErrUnknownVersion = fmt.Errorf("unknown schema version is found")
+	// ErrCheckFailed occurs when data doesn't pass the check of the migration, and the migration is rolled back
+	ErrCheckFailed = fmt.Errorf("the migration doesn't pass its check")
+)
+
+// Migration changes the schema from Version-1 to Version with Up, and Down reverts it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Check is an optional query run after Up, any row it returns is data that Up failed to convert
+	Check string
+}
+
+// LatestVersion is the version of the schema that the code expects
+func LatestVersion() int {
+	return len(migrations[DialectPostgres])
+}
+
+// GetMigrations will get all migrations of the dialect in the binary
+func GetMigrations(dialect Dialect) []*Migration {
+	return migrations[dialect]
+}
+
+// GetVersion will get the current version of the schema, and it's 0 if no migration is applied
+func GetVersion(db *DB) (int, error) {
+	if _, err := db.Exec(createMigrationTable); err != nil {
+		logrus.WithField("err", err).Error("db.Exec(createMigrationTable) failed in GetVersion")
+		return 0, err
+	}
+
+	version := 0
+	if err := db.QueryRow(getSchemaVersion).Scan(&version); err != nil {
+		logrus.WithField("err", err).Error("db.QueryRow(getSchemaVersion) failed in GetVersion")
+		return 0, err
+	}
+	return version, nil
+}
+
+// Migrate applies all pending migrations, and returns the applied ones
+func Migrate(db *DB) ([]*Migration, error) {
+	return MigrateTo(db, LatestVersion())
+}
+
+// MigrateTo applies up migrations or reverts down migrations until the schema is `version`,
+// each migration runs in its own transaction with its record, and migrations that are run are returned
+func MigrateTo(db *DB, version int) ([]*Migration, error) {
+	if version < 0 || version > LatestVersion() {
+		return nil, ErrUnknownVersion
+	}
+	if _, err := db.Exec(createMigrationTable); err != nil {
+		logrus.WithField("err", err).Error("db.Exec(createMigrationTable) failed in MigrateTo")
+		return nil, err
+	}
+
+	done := []*Migration{}
+	for {
+		migration, err := migrateStep(db, version)
+		if err != nil {
+			return done, err
+		}
+		if migration == nil {
+			return done, nil
+		}
+		done = append(done, migration)
+	}
+}
+
+// migrateStep runs the next migration towards `version`, and it returns nil if the schema is already `version`
+func migrateStep(db *DB, version int) (*Migration, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("db.Begin failed in migrateStep")
+		return nil, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.WithField("err", err).Error("tx.Rollback() failed in migrateStep")
+		}
+	}()
+
+	// SQLite transactions already hold the write lock of the whole database
+	if db.Dialect == DialectPostgres {
+		if _, err := tx.Exec(lockMigration, migrationLockKey); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(lockMigration) failed in migrateStep")
+			return nil, err
+		}
+	}
+
+	// the version is read after the lock is acquired, as another instance may have migrated it
+	current := 0
+	if err := tx.QueryRow(getSchemaVersion).Scan(&current); err != nil {
+		logrus.WithField("err", err).Error("tx.QueryRow(getSchemaVersion) failed in migrateStep")
+		return nil, err
+	}
+	if current > LatestVersion() {
+		return nil, ErrUnknownVersion
+	}
+	if current == version {
+		return nil, nil
+	}
+
+	var migration *Migration
+	if current < version {
+		migration = migrations[db.Dialect][current]
+		if _, err := tx.Exec(migration.Up); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err, "version": migration.Version}).Error("tx.Exec(migration.Up) failed in migrateStep")
+			return nil, err
+		}
+		if err := checkMigration(tx, migration); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(insertMigration, migration.Version, migration.Name, time.Now().Unix()); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(insertMigration) failed in migrateStep")
+			return nil, err
+		}
+	} else {
+		migration = migrations[db.Dialect][current-1]
+		if _, err := tx.Exec(migration.Down); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err, "version": migration.Version}).Error("tx.Exec(migration.Down) failed in migrateStep")
+			return nil, err
+		}
+		if _, err := tx.Exec(deleteMigration, migration.Version); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(deleteMigration) failed in migrateStep")
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in migrateStep")
+		return nil, err
+	}
+	return migration, nil
+}
+
+// checkMigration runs the check of the migration, and fails if the check returns any row
+func checkMigration(tx *Tx, migration *Migration) error {
+	if migration.Check == "" {
+		return nil
+	}
+
+	rows, err := tx.Query(migration.Check)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"err": err, "version": migration.Version}).Error("tx.Query(migration.Check) failed in checkMigration")
+		return err
+	}
+	defer rows.Close()
+
+	failed := rows.Next()
+	if err := rows.Err(); err != nil {
+		logrus.WithField("err", err).Error("rows.Err failed in checkMigration")
+		return err
+	}
+	if failed {
+		logrus.WithField("version", migration.Version).Error("the check of the migration failed in checkMigration")
+		return ErrCheckFailed
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// legacyWallets creates tables and rows as the bot stored them before migrations are introduced
+const legacyWallets = `
+	CREATE TABLE "UsersWallet" ("userID" TEXT PRIMARY KEY, balance BIGINT NOT NULL DEFAULT 0);
+	CREATE TABLE "UsersWalletLog" ("userID" TEXT NOT NULL, reason TEXT NOT NULL DEFAULT '', amount BIGINT NOT NULL, timestamp BIGINT NOT NULL);
+	INSERT INTO "UsersWallet" ("userID", balance) VALUES ('guachi', 300);
+	INSERT INTO "UsersWalletLog" ("userID", reason, amount, timestamp) VALUES ('guachi', '薪水', 500, 1558310400);
+	INSERT INTO "UsersWalletLog" ("userID", reason, amount, timestamp) VALUES ('guachi', '午餐', -200, 1558314000);
+	INSERT INTO "UsersWallet" ("userID", balance) VALUES ('drifted', 100);
+	INSERT INTO "UsersWalletLog" ("userID", reason, amount, timestamp) VALUES ('drifted', '薪水', 50, 1558310400);
+	INSERT INTO "UsersWalletLog" ("userID", reason, amount, timestamp) VALUES ('deleted', '薪水', 70, 1558310400);
+`
+
+func newTestDB(t *testing.T) *DB {
+	dbSrv, err := Open("sqlite://" + filepath.Join(t.TempDir(), "wallet.db"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() {
+		dbSrv.Close()
+	})
+	return dbSrv
+}
+
+func expectVersion(t *testing.T, dbSrv *DB, expected int) {
+	t.Helper()
+	version, err := GetVersion(dbSrv)
+	if err != nil {
+		t.Fatalf("GetVersion failed: %v", err)
+	}
+	if version != expected {
+		t.Fatalf("the version is %d, expected %d", version, expected)
+	}
+}
+
+func TestMigrateLegacyWallets(t *testing.T) {
+	dbSrv := newTestDB(t)
+	if _, err := dbSrv.Exec(legacyWallets); err != nil {
+		t.Fatalf("creating legacy wallets failed: %v", err)
+	}
+
+	done, err := Migrate(dbSrv)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if len(done) != LatestVersion() {
+		t.Fatalf("%d migrations are applied, expected %d", len(done), LatestVersion())
+	}
+	expectVersion(t, dbSrv, LatestVersion())
+
+	// columns added later get defaults for existing wallets
+	balance, ownerID, sourceID, policy, limit, currency := int64(0), "", "", "", int64(0), ""
+	if err := dbSrv.QueryRow(`
+		SELECT balance, "ownerID", "sourceID", "overdraftPolicy", "overdraftLimit", currency FROM "UsersWallet" WHERE "userID" = $1
+	`, "guachi").Scan(&balance, &ownerID, &sourceID, &policy, &limit, &currency); err != nil {
+		t.Fatalf("getting the legacy wallet failed: %v", err)
+	}
+	if balance != 300 || ownerID != "" || sourceID != "" || policy != "allow" || limit != 0 || currency != "TWD" {
+		t.Fatalf("the legacy wallet is %d %q %q %q %d %q", balance, ownerID, sourceID, policy, limit, currency)
+	}
+
+	// every legacy log is a transaction, and the drift of the balance is an adjustment
+	expectSums(t, dbSrv, `SELECT account, SUM(amount) FROM "LedgerPosting" GROUP BY account`, map[string]int64{
+		"wallet:guachi":     300,
+		"wallet:drifted":    100,
+		"equity:closed":     70,
+		"equity:external":   -420,
+		"equity:adjustment": -50,
+	})
+	expectSums(t, dbSrv, `SELECT reason, COUNT(*) FROM "LedgerTransaction" GROUP BY reason`, map[string]int64{
+		"薪水":   3,
+		"午餐":   1,
+		"對帳調整": 1,
+	})
+	expectSums(t, dbSrv, `SELECT currency, COUNT(*) FROM "LedgerPosting" GROUP BY currency`, map[string]int64{
+		"TWD": 10,
+	})
+	expectSums(t, dbSrv, `SELECT kind, COUNT(*) FROM "LedgerAccount" GROUP BY kind`, map[string]int64{
+		"wallet": 2,
+		"equity": 3,
+	})
+
+	// migrating again does nothing
+	if done, err := Migrate(dbSrv); err != nil || len(done) != 0 {
+		t.Fatalf("Migrate again applied %d migrations: %v", len(done), err)
+	}
+}
+
+func TestMigrateCheckFailed(t *testing.T) {
+	dbSrv := newTestDB(t)
+	if _, err := MigrateTo(dbSrv, 9); err != nil {
+		t.Fatalf("MigrateTo(9) failed: %v", err)
+	}
+	// the posting isn't in TWD, which wallets are in after the currency migration
+	if _, err := dbSrv.Exec(`
+		INSERT INTO "UsersWallet" ("userID", balance) VALUES ('guachi', 100);
+		INSERT INTO "LedgerTransaction" (id, reason, timestamp) VALUES (1, '薪水', 1558310400);
+		INSERT INTO "LedgerPosting" ("transactionID", account, amount, currency) VALUES (1, 'wallet:guachi', 100, 'USD');
+		INSERT INTO "LedgerPosting" ("transactionID", account, amount, currency) VALUES (1, 'equity:external', -100, 'USD');
+	`); err != nil {
+		t.Fatalf("creating the wallet failed: %v", err)
+	}
+
+	if _, err := MigrateTo(dbSrv, 10); err != ErrCheckFailed {
+		t.Fatalf("MigrateTo(10) returned %v, expected ErrCheckFailed", err)
+	}
+	expectVersion(t, dbSrv, 9)
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	dbSrv := newTestDB(t)
+	if _, err := Migrate(dbSrv); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	done, err := MigrateTo(dbSrv, 0)
+	if err != nil {
+		t.Fatalf("MigrateTo(0) failed: %v", err)
+	}
+	if len(done) != LatestVersion() {
+		t.Fatalf("%d migrations are reverted, expected %d", len(done), LatestVersion())
+	}
+	expectVersion(t, dbSrv, 0)
+
+	tables := 0
+	if err := dbSrv.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('SchemaMigration', 'sqlite_sequence')`).Scan(&tables); err != nil {
+		t.Fatalf("counting tables failed: %v", err)
+	}
+	if tables != 0 {
+		t.Fatalf("%d tables are left after reverting all migrations", tables)
+	}
+
+	if _, err := Migrate(dbSrv); err != nil {
+		t.Fatalf("Migrate after reverting failed: %v", err)
+	}
+	expectVersion(t, dbSrv, LatestVersion())
+
+	if _, err := MigrateTo(dbSrv, LatestVersion()+1); err != ErrUnknownVersion {
+		t.Fatalf("MigrateTo an unknown version returned %v", err)
+	}
+}
+
+// expectSums runs the query that returns names with numbers, and compares them with `expected`
+func expectSums(t *testing.T, dbSrv *DB, query string, expected map[string]int64) {
+	t.Helper()
+	rows, err := dbSrv.Query(query)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	defer rows.Close()
+
+	actual := map[string]int64{}
+	for rows.Next() {
+		name, sum := "", int64(0)
+		if err := rows.Scan(&name, &sum); err != nil {
+			t.Fatalf("rows.Scan failed: %v", err)
+		}
+		actual[name] = sum
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("%q returned %v, expected %v", query, actual, expected)
+	}
+	for name, sum := range expected {
+		if actual[name] != sum {
+			t.Fatalf("%q returned %v, expected %v", query, actual, expected)
+		}
+	}
+}
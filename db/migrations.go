@@ -0,0 +1,435 @@
+package db
+
+// a migration that is the same in both dialects is named without the dialect,
+// only tables with auto-incremented IDs differ, as SQLite only auto-increments INTEGER PRIMARY KEY
+
+const (
+	// baselineUp creates tables as they were before migrations are introduced,
+	// tables are only created if they don't exist, so that databases created by hand can be migrated as well
+	baselineUp = `
+		CREATE TABLE IF NOT EXISTS "UsersWallet" (
+			"userID" TEXT PRIMARY KEY,
+			balance  BIGINT NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE IF NOT EXISTS "UsersWalletLog" (
+			"userID"  TEXT NOT NULL,
+			reason    TEXT NOT NULL DEFAULT '',
+			amount    BIGINT NOT NULL,
+			timestamp BIGINT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS "UsersWalletLog_userID_idx" ON "UsersWalletLog" ("userID", timestamp);
+	`
+	baselineDown = `
+		DROP TABLE IF EXISTS "UsersWalletLog";
+		DROP TABLE IF EXISTS "UsersWallet";
+	`
+
+	// existing wallets have no owner, and they are left for maintainers to assign
+	walletOwnersUp = `
+		ALTER TABLE "UsersWallet" ADD COLUMN "ownerID" TEXT NOT NULL DEFAULT '';
+	`
+	walletOwnersDown = `
+		ALTER TABLE "UsersWallet" DROP COLUMN "ownerID";
+	`
+
+	walletMembersUp = `
+		ALTER TABLE "UsersWallet" ADD COLUMN "sourceID" TEXT NOT NULL DEFAULT '';
+
+		CREATE TABLE IF NOT EXISTS "UsersWalletMember" (
+			"userID"   TEXT NOT NULL,
+			"memberID" TEXT NOT NULL,
+			role       TEXT NOT NULL,
+			PRIMARY KEY ("userID", "memberID")
+		);
+	`
+	walletMembersDown = `
+		DROP TABLE IF EXISTS "UsersWalletMember";
+		ALTER TABLE "UsersWallet" DROP COLUMN "sourceID";
+	`
+
+	walletCategoriesUp = `
+		CREATE TABLE IF NOT EXISTS "UsersWalletCategory" (
+			"userID" TEXT NOT NULL,
+			name     TEXT NOT NULL,
+			PRIMARY KEY ("userID", name)
+		);
+	`
+	walletCategoriesDown = `
+		DROP TABLE IF EXISTS "UsersWalletCategory";
+	`
+
+	// the category is empty if the budget is for the whole wallet
+	walletBudgetsUp = `
+		CREATE TABLE IF NOT EXISTS "UsersWalletBudget" (
+			"userID"       TEXT NOT NULL,
+			category       TEXT NOT NULL DEFAULT '',
+			"monthlyLimit" BIGINT NOT NULL,
+			PRIMARY KEY ("userID", category)
+		);
+	`
+	walletBudgetsDown = `
+		DROP TABLE IF EXISTS "UsersWalletBudget";
+	`
+
+	postgresRecurringRulesUp = `
+		CREATE TABLE IF NOT EXISTS "RecurringRule" (
+			id          BIGSERIAL PRIMARY KEY,
+			"userID"    TEXT NOT NULL,
+			"ownerID"   TEXT NOT NULL,
+			"notifyID"  TEXT NOT NULL,
+			amount      BIGINT NOT NULL,
+			reason      TEXT NOT NULL DEFAULT '',
+			category    TEXT NOT NULL DEFAULT '',
+			tags        TEXT NOT NULL DEFAULT '',
+			schedule    TEXT NOT NULL,
+			"nextRunAt" BIGINT NOT NULL,
+			paused      BOOLEAN NOT NULL DEFAULT FALSE
+		);
+		CREATE INDEX IF NOT EXISTS "RecurringRule_userID_idx" ON "RecurringRule" ("userID");
+		CREATE INDEX IF NOT EXISTS "RecurringRule_nextRunAt_idx" ON "RecurringRule" ("nextRunAt") WHERE paused = FALSE;
+	`
+	sqliteRecurringRulesUp = `
+		CREATE TABLE IF NOT EXISTS "RecurringRule" (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			"userID"    TEXT NOT NULL,
+			"ownerID"   TEXT NOT NULL,
+			"notifyID"  TEXT NOT NULL,
+			amount      BIGINT NOT NULL,
+			reason      TEXT NOT NULL DEFAULT '',
+			category    TEXT NOT NULL DEFAULT '',
+			tags        TEXT NOT NULL DEFAULT '',
+			schedule    TEXT NOT NULL,
+			"nextRunAt" BIGINT NOT NULL,
+			paused      BOOLEAN NOT NULL DEFAULT FALSE
+		);
+		CREATE INDEX IF NOT EXISTS "RecurringRule_userID_idx" ON "RecurringRule" ("userID");
+		CREATE INDEX IF NOT EXISTS "RecurringRule_nextRunAt_idx" ON "RecurringRule" ("nextRunAt") WHERE paused = FALSE;
+	`
+	recurringRulesDown = `
+		DROP TABLE IF EXISTS "RecurringRule";
+	`
+
+	// existing wallets keep allowing negative balances as they did
+	walletOverdraftUp = `
+		ALTER TABLE "UsersWallet" ADD COLUMN "overdraftPolicy" TEXT NOT NULL DEFAULT 'allow';
+		ALTER TABLE "UsersWallet" ADD COLUMN "overdraftLimit" BIGINT NOT NULL DEFAULT 0;
+	`
+	walletOverdraftDown = `
+		ALTER TABLE "UsersWallet" DROP COLUMN "overdraftLimit";
+		ALTER TABLE "UsersWallet" DROP COLUMN "overdraftPolicy";
+	`
+
+	// postings of deleted wallets are moved to equity:closed before the account is created,
+	// so postings don't reference accounts
+	postgresLedgerUp = `
+		CREATE TABLE IF NOT EXISTS "LedgerAccount" (
+			name TEXT PRIMARY KEY,
+			kind TEXT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS "LedgerTransaction" (
+			id          BIGSERIAL PRIMARY KEY,
+			reason      TEXT NOT NULL DEFAULT '',
+			timestamp   BIGINT NOT NULL,
+			category    TEXT NOT NULL DEFAULT '',
+			tags        TEXT NOT NULL DEFAULT '',
+			"createdBy" TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS "LedgerTransaction_timestamp_idx" ON "LedgerTransaction" (timestamp);
+
+		CREATE TABLE IF NOT EXISTS "LedgerPosting" (
+			id              BIGSERIAL PRIMARY KEY,
+			"transactionID" BIGINT NOT NULL REFERENCES "LedgerTransaction" (id),
+			account         TEXT NOT NULL,
+			amount          BIGINT NOT NULL,
+			currency        TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS "LedgerPosting_transactionID_idx" ON "LedgerPosting" ("transactionID");
+		CREATE INDEX IF NOT EXISTS "LedgerPosting_account_idx" ON "LedgerPosting" (account);
+	`
+	sqliteLedgerUp = `
+		CREATE TABLE IF NOT EXISTS "LedgerAccount" (
+			name TEXT PRIMARY KEY,
+			kind TEXT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS "LedgerTransaction" (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			reason      TEXT NOT NULL DEFAULT '',
+			timestamp   BIGINT NOT NULL,
+			category    TEXT NOT NULL DEFAULT '',
+			tags        TEXT NOT NULL DEFAULT '',
+			"createdBy" TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS "LedgerTransaction_timestamp_idx" ON "LedgerTransaction" (timestamp);
+
+		CREATE TABLE IF NOT EXISTS "LedgerPosting" (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			"transactionID" BIGINT NOT NULL REFERENCES "LedgerTransaction" (id),
+			account         TEXT NOT NULL,
+			amount          BIGINT NOT NULL,
+			currency        TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS "LedgerPosting_transactionID_idx" ON "LedgerPosting" ("transactionID");
+		CREATE INDEX IF NOT EXISTS "LedgerPosting_account_idx" ON "LedgerPosting" (account);
+	`
+	ledgerDown = `
+		DROP TABLE IF EXISTS "LedgerPosting";
+		DROP TABLE IF EXISTS "LedgerTransaction";
+		DROP TABLE IF EXISTS "LedgerAccount";
+	`
+
+	// ledgerLegacyLogsUp turns every legacy log into a balanced transaction between the wallet and equity:external,
+	// logs of wallets that no longer exist are taken over by equity:closed as the ledger does for deleted wallets,
+	// and balances that drifted from their logs are kept with a reconciling transaction against equity:adjustment,
+	// as the cached balance is what users saw. amounts were in TWD before currencies are introduced
+	// it's split at the timestamp of adjustments, as the current time is written differently in each dialect
+	ledgerLegacyLogsUp = `
+		CREATE TEMP TABLE "LegacyTransaction" AS
+			SELECT
+				ROW_NUMBER() OVER (ORDER BY timestamp, "userID", amount, reason) + (SELECT COALESCE(MAX(id), 0) FROM "LedgerTransaction") AS id,
+				"userID", reason, amount, timestamp
+			FROM
+				"UsersWalletLog";
+
+		INSERT INTO "LedgerTransaction" (id, reason, timestamp)
+			SELECT id, reason, timestamp FROM "LegacyTransaction";
+		INSERT INTO "LedgerPosting" ("transactionID", account, amount, currency)
+			SELECT
+				legacy.id,
+				CASE WHEN wallet."userID" IS NULL THEN 'equity:closed' ELSE 'wallet:' || legacy."userID" END,
+				legacy.amount, 'TWD'
+			FROM
+				"LegacyTransaction" legacy
+			LEFT JOIN
+				"UsersWallet" wallet
+			ON
+				wallet."userID" = legacy."userID";
+		INSERT INTO "LedgerPosting" ("transactionID", account, amount, currency)
+			SELECT id, 'equity:external', -1 * amount, 'TWD' FROM "LegacyTransaction";
+		DROP TABLE "LegacyTransaction";
+
+		CREATE TEMP TABLE "LegacyDrift" AS
+			SELECT
+				ROW_NUMBER() OVER (ORDER BY wallet."userID") + (SELECT COALESCE(MAX(id), 0) FROM "LedgerTransaction") AS id,
+				wallet."userID", wallet.balance - COALESCE(SUM(posting.amount), 0) AS amount
+			FROM
+				"UsersWallet" wallet
+			LEFT JOIN
+				"LedgerPosting" posting
+			ON
+				posting.account = 'wallet:' || wallet."userID"
+			GROUP BY
+				wallet."userID", wallet.balance
+			HAVING
+				wallet.balance <> COALESCE(SUM(posting.amount), 0);
+
+		INSERT INTO "LedgerTransaction" (id, reason, timestamp)
+			SELECT id, '對帳調整', `
+	ledgerLegacyLogsDriftUp = ` FROM "LegacyDrift";
+		INSERT INTO "LedgerPosting" ("transactionID", account, amount, currency)
+			SELECT id, 'wallet:' || "userID", amount, 'TWD' FROM "LegacyDrift";
+		INSERT INTO "LedgerPosting" ("transactionID", account, amount, currency)
+			SELECT id, 'equity:adjustment', -1 * amount, 'TWD' FROM "LegacyDrift";
+		DROP TABLE "LegacyDrift";
+
+		-- WHERE is required by SQLite to tell ON CONFLICT from the join of SELECT
+		INSERT INTO "LedgerAccount" (name, kind)
+			SELECT DISTINCT
+				account, CASE WHEN account LIKE 'wallet:%' THEN 'wallet' ELSE 'equity' END
+			FROM
+				"LedgerPosting"
+			WHERE
+				TRUE
+		ON CONFLICT DO NOTHING;
+
+		DROP TABLE "UsersWalletLog";
+	`
+	postgresLedgerLegacyLogsUp = ledgerLegacyLogsUp + `CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT)` + ledgerLegacyLogsDriftUp + `
+		-- rows are inserted with their IDs, so sequences continue after them
+		SELECT setval(pg_get_serial_sequence('"LedgerTransaction"', 'id'), COALESCE(MAX(id), 0) + 1, FALSE) FROM "LedgerTransaction";
+		SELECT setval(pg_get_serial_sequence('"LedgerPosting"', 'id'), COALESCE(MAX(id), 0) + 1, FALSE) FROM "LedgerPosting";
+	`
+	sqliteLedgerLegacyLogsUp = ledgerLegacyLogsUp + `CAST(strftime('%s', 'now') AS INTEGER)` + ledgerLegacyLogsDriftUp
+	// ledgerLegacyLogsCheck finds wallets whose balance isn't the sum of their postings after the conversion
+	ledgerLegacyLogsCheck = `
+		SELECT
+			wallet."userID"
+		FROM
+			"UsersWallet" wallet
+		WHERE
+			wallet.balance <> (
+				SELECT COALESCE(SUM(posting.amount), 0) FROM "LedgerPosting" posting WHERE posting.account = 'wallet:' || wallet."userID"
+			)
+	`
+	// ledgerLegacyLogsDown turns postings of wallets back into legacy logs, and empties the ledger
+	ledgerLegacyLogsDown = `
+		CREATE TABLE IF NOT EXISTS "UsersWalletLog" (
+			"userID"  TEXT NOT NULL,
+			reason    TEXT NOT NULL DEFAULT '',
+			amount    BIGINT NOT NULL,
+			timestamp BIGINT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS "UsersWalletLog_userID_idx" ON "UsersWalletLog" ("userID", timestamp);
+
+		INSERT INTO "UsersWalletLog" ("userID", reason, amount, timestamp)
+			SELECT
+				SUBSTR(posting.account, 8), txn.reason, posting.amount, txn.timestamp
+			FROM
+				"LedgerPosting" posting
+			JOIN
+				"LedgerTransaction" txn
+			ON
+				txn.id = posting."transactionID"
+			WHERE
+				posting.account LIKE 'wallet:%';
+
+		DELETE FROM "LedgerPosting";
+		DELETE FROM "LedgerTransaction";
+		DELETE FROM "LedgerAccount";
+	`
+
+	// walletCurrenciesUp sets TWD as the currency of existing wallets and their postings,
+	// amounts were whole NTD, and TWD has no minor unit in money.DefaultCurrency, so amounts are kept as they are
+	walletCurrenciesUp = `
+		ALTER TABLE "UsersWallet" ADD COLUMN currency TEXT NOT NULL DEFAULT 'TWD';
+		UPDATE "UsersWallet" SET currency = 'TWD' WHERE currency = '';
+		UPDATE "LedgerPosting" SET currency = 'TWD' WHERE currency = '';
+	`
+	// walletCurrenciesCheck finds postings to wallets that aren't in the currency of the wallet
+	walletCurrenciesCheck = `
+		SELECT
+			posting.id
+		FROM
+			"LedgerPosting" posting
+		JOIN
+			"UsersWallet" wallet
+		ON
+			posting.account = 'wallet:' || wallet."userID"
+		WHERE
+			posting.currency <> wallet.currency
+	`
+	walletCurrenciesDown = `
+		ALTER TABLE "UsersWallet" DROP COLUMN currency;
+	`
+
+	// the original amount and the rate are recorded if the transaction is converted from another currency
+	exchangeRatesUp = `
+		CREATE TABLE IF NOT EXISTS "ExchangeRate" (
+			base  TEXT NOT NULL,
+			quote TEXT NOT NULL,
+			date  BIGINT NOT NULL,
+			rate  TEXT NOT NULL,
+			PRIMARY KEY (base, quote, date)
+		);
+
+		ALTER TABLE "LedgerTransaction" ADD COLUMN "originalAmount" BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE "LedgerTransaction" ADD COLUMN "originalCurrency" TEXT NOT NULL DEFAULT '';
+		ALTER TABLE "LedgerTransaction" ADD COLUMN rate TEXT NOT NULL DEFAULT '';
+		ALTER TABLE "LedgerTransaction" ADD COLUMN "rateDate" BIGINT NOT NULL DEFAULT 0;
+	`
+	exchangeRatesDown = `
+		ALTER TABLE "LedgerTransaction" DROP COLUMN "rateDate";
+		ALTER TABLE "LedgerTransaction" DROP COLUMN rate;
+		ALTER TABLE "LedgerTransaction" DROP COLUMN "originalCurrency";
+		ALTER TABLE "LedgerTransaction" DROP COLUMN "originalAmount";
+
+		DROP TABLE IF EXISTS "ExchangeRate";
+	`
+
+	ledgerImportsUp = `
+		CREATE TABLE IF NOT EXISTS "LedgerImport" (
+			"userID"        TEXT NOT NULL,
+			hash            TEXT NOT NULL,
+			"transactionID" BIGINT NOT NULL REFERENCES "LedgerTransaction" (id) ON DELETE CASCADE,
+			PRIMARY KEY ("userID", hash)
+		);
+	`
+	ledgerImportsDown = `
+		DROP TABLE IF EXISTS "LedgerImport";
+	`
+
+	// the transaction isn't a foreign key, so that the key is kept after the log is deleted,
+	// and a request that is repeated after the undo still isn't recorded again
+	idempotencyKeysUp = `
+		CREATE TABLE IF NOT EXISTS "LedgerIdempotencyKey" (
+			"userID"        TEXT NOT NULL,
+			"key"           TEXT NOT NULL,
+			"transactionID" BIGINT NOT NULL,
+			PRIMARY KEY ("userID", "key")
+		);
+	`
+	idempotencyKeysDown = `
+		DROP TABLE IF EXISTS "LedgerIdempotencyKey";
+	`
+
+	// the body is the JSON of the event, so that failed events can be handled again
+	webhookEventsUp = `
+		CREATE TABLE IF NOT EXISTS "WebhookEvent" (
+			"eventID"    TEXT PRIMARY KEY,
+			body         TEXT NOT NULL,
+			status       TEXT NOT NULL,
+			attempts     INTEGER NOT NULL DEFAULT 0,
+			"lastError"  TEXT NOT NULL DEFAULT '',
+			"receivedAt" BIGINT NOT NULL,
+			"updatedAt"  BIGINT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS "WebhookEvent_status_idx" ON "WebhookEvent" (status, "updatedAt");
+	`
+	webhookEventsDown = `
+		DROP TABLE IF EXISTS "WebhookEvent";
+	`
+)
+
+var (
+	// migrations are applied in order of versions, which start from 1 without gaps
+	// a migration should never be changed once it's released, add a new one with the next version instead
+	// every dialect has the same versions, so that backups and the code work with either database
+	migrations = map[Dialect][]*Migration{
+		DialectPostgres: {
+			{Version: 1, Name: "baseline", Up: baselineUp, Down: baselineDown},
+			{Version: 2, Name: "wallet_owners", Up: walletOwnersUp, Down: walletOwnersDown},
+			{Version: 3, Name: "wallet_members", Up: walletMembersUp, Down: walletMembersDown},
+			{Version: 4, Name: "wallet_categories", Up: walletCategoriesUp, Down: walletCategoriesDown},
+			{Version: 5, Name: "wallet_budgets", Up: walletBudgetsUp, Down: walletBudgetsDown},
+			{Version: 6, Name: "recurring_rules", Up: postgresRecurringRulesUp, Down: recurringRulesDown},
+			{Version: 7, Name: "wallet_overdraft", Up: walletOverdraftUp, Down: walletOverdraftDown},
+			{Version: 8, Name: "ledger", Up: postgresLedgerUp, Down: ledgerDown},
+			{
+				Version: 9, Name: "ledger_legacy_logs", Up: postgresLedgerLegacyLogsUp, Down: ledgerLegacyLogsDown,
+				Check: ledgerLegacyLogsCheck,
+			},
+			{
+				Version: 10, Name: "wallet_currencies", Up: walletCurrenciesUp, Down: walletCurrenciesDown,
+				Check: walletCurrenciesCheck,
+			},
+			{Version: 11, Name: "exchange_rates", Up: exchangeRatesUp, Down: exchangeRatesDown},
+			{Version: 12, Name: "ledger_imports", Up: ledgerImportsUp, Down: ledgerImportsDown},
+			{Version: 13, Name: "idempotency_keys", Up: idempotencyKeysUp, Down: idempotencyKeysDown},
+			{Version: 14, Name: "webhook_events", Up: webhookEventsUp, Down: webhookEventsDown},
+		},
+		DialectSQLite: {
+			{Version: 1, Name: "baseline", Up: baselineUp, Down: baselineDown},
+			{Version: 2, Name: "wallet_owners", Up: walletOwnersUp, Down: walletOwnersDown},
+			{Version: 3, Name: "wallet_members", Up: walletMembersUp, Down: walletMembersDown},
+			{Version: 4, Name: "wallet_categories", Up: walletCategoriesUp, Down: walletCategoriesDown},
+			{Version: 5, Name: "wallet_budgets", Up: walletBudgetsUp, Down: walletBudgetsDown},
+			{Version: 6, Name: "recurring_rules", Up: sqliteRecurringRulesUp, Down: recurringRulesDown},
+			{Version: 7, Name: "wallet_overdraft", Up: walletOverdraftUp, Down: walletOverdraftDown},
+			{Version: 8, Name: "ledger", Up: sqliteLedgerUp, Down: ledgerDown},
+			{
+				Version: 9, Name: "ledger_legacy_logs", Up: sqliteLedgerLegacyLogsUp, Down: ledgerLegacyLogsDown,
+				Check: ledgerLegacyLogsCheck,
+			},
+			{
+				Version: 10, Name: "wallet_currencies", Up: walletCurrenciesUp, Down: walletCurrenciesDown,
+				Check: walletCurrenciesCheck,
+			},
+			{Version: 11, Name: "exchange_rates", Up: exchangeRatesUp, Down: exchangeRatesDown},
+			{Version: 12, Name: "ledger_imports", Up: ledgerImportsUp, Down: ledgerImportsDown},
+			{Version: 13, Name: "idempotency_keys", Up: idempotencyKeysUp, Down: idempotencyKeysDown},
+			{Version: 14, Name: "webhook_events", Up: webhookEventsUp, Down: webhookEventsDown},
+		},
+	}
+)
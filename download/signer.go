@@ -0,0 +1,103 @@
+package download
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// ExportPath is the path prefix of links of exported logs, and it's followed by the wallet name
+	ExportPath = "/exports/"
+	// ImportPath is the path prefix of links of uploading bank statements, and it's followed by the wallet name
+	ImportPath = "/imports/"
+
+	// ParamCaller is the LINE user ID of the one who asks for the link
+	ParamCaller = "caller"
+	// ParamStart and ParamEnd are the unix timestamp range [start, end) of exported logs
+	ParamStart = "start"
+	ParamEnd   = "end"
+	// ParamFormat is the file format of exported logs, ex: csv
+	ParamFormat = "format"
+
+	paramExpires   = "expires"
+	paramSignature = "signature"
+)
+
+var (
+	// ErrInvalidSignature occurs when the link is modified or it isn't signed by this server
+	ErrInvalidSignature = fmt.Errorf("invalid signature is found")
+	// ErrLinkExpired occurs when the link is used after it expires
+	ErrLinkExpired = fmt.Errorf("the link has expired")
+)
+
+// Signer signs links of downloading and uploading files, so that users can use them in browsers without logging in
+// the link carries who asks for the file, and it's only valid until it expires
+type Signer interface {
+	// Sign gets the query of the link to `path`, which is `params` with the expiry and the signature
+	// `path` is signed before it's escaped, ex: /exports/guachi
+	Sign(path string, params url.Values) url.Values
+	// Verify checks if `params` of the request to `path` are signed by Sign and the link hasn't expired
+	Verify(path string, params url.Values) error
+}
+
+type signer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewSigner creates a new Signer interface, and links expire after `ttl`
+func NewSigner(secret string, ttl time.Duration) Signer {
+	return &signer{
+		secret: []byte(secret),
+		ttl:    ttl,
+	}
+}
+
+// sign signs the path and params except the signature, and url.Values.Encode sorts params by keys
+func (sg *signer) sign(path string, params url.Values) string {
+	unsigned := url.Values{}
+	for key, values := range params {
+		if key != paramSignature {
+			unsigned[key] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, sg.secret)
+	mac.Write([]byte(path + "?" + unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (sg *signer) Sign(path string, params url.Values) url.Values {
+	signed := url.Values{}
+	for key, values := range params {
+		signed[key] = values
+	}
+	signed.Set(paramExpires, strconv.FormatInt(time.Now().Add(sg.ttl).Unix(), 10))
+	signed.Set(paramSignature, sg.sign(path, signed))
+	return signed
+}
+
+func (sg *signer) Verify(path string, params url.Values) error {
+	signature, err := hex.DecodeString(params.Get(paramSignature))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expected, _ := hex.DecodeString(sg.sign(path, params))
+	if !hmac.Equal(signature, expected) {
+		return ErrInvalidSignature
+	}
+
+	expires, err := strconv.ParseInt(params.Get(paramExpires), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if time.Now().Unix() > expires {
+		return ErrLinkExpired
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package download
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testPath = ExportPath + "guachi"
+
+func signTestLink(sg Signer) url.Values {
+	return sg.Sign(testPath, url.Values{
+		ParamCaller: []string{"owner"},
+		ParamStart:  []string{"1558281600"},
+		ParamEnd:    []string{"1558368000"},
+		ParamFormat: []string{"csv"},
+	})
+}
+
+func TestVerify(t *testing.T) {
+	sg := NewSigner("secret", time.Hour)
+	params := signTestLink(sg)
+	if err := sg.Verify(testPath, params); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	// the link is still valid after it's sent through the URL
+	parsed, err := url.ParseQuery(params.Encode())
+	if err != nil {
+		t.Fatalf("url.ParseQuery failed: %v", err)
+	}
+	if err := sg.Verify(testPath, parsed); err != nil {
+		t.Fatalf("Verify of the parsed link failed: %v", err)
+	}
+
+	// links expire after the ttl
+	expired := NewSigner("secret", -1*time.Minute)
+	if err := expired.Verify(testPath, signTestLink(expired)); err != ErrLinkExpired {
+		t.Fatalf("Verify of the expired link returned %v", err)
+	}
+}
+
+func TestVerifyInvalidSignature(t *testing.T) {
+	sg := NewSigner("secret", time.Hour)
+	tests := []struct {
+		name   string
+		path   string
+		modify func(params url.Values)
+	}{
+		{"another caller", testPath, func(params url.Values) { params.Set(ParamCaller, "guest") }},
+		{"another start", testPath, func(params url.Values) { params.Set(ParamStart, "0") }},
+		{"another path", ExportPath + "pay", func(params url.Values) {}},
+		{"a duplicate param", testPath, func(params url.Values) { params.Add(ParamCaller, "guest") }},
+		{"an added param", testPath, func(params url.Values) { params.Set("repair", "true") }},
+		{"a removed param", testPath, func(params url.Values) { params.Del(ParamFormat) }},
+		{"a later expiry", testPath, func(params url.Values) { params.Set(paramExpires, "9999999999") }},
+		{"a missing signature", testPath, func(params url.Values) { params.Del(paramSignature) }},
+		{"a garbage signature", testPath, func(params url.Values) { params.Set(paramSignature, "not-hex") }},
+		{"a short signature", testPath, func(params url.Values) { params.Set(paramSignature, "abcd") }},
+		{"another secret", testPath, func(params url.Values) {
+			params.Set(paramSignature, NewSigner("other", time.Hour).Sign(testPath, params).Get(paramSignature))
+		}},
+	}
+
+	for _, test := range tests {
+		params := signTestLink(sg)
+		test.modify(params)
+		if err := sg.Verify(test.path, params); err != ErrInvalidSignature {
+			t.Errorf("Verify with %s returned %v", test.name, err)
+		}
+	}
+}
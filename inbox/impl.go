@@ -0,0 +1,239 @@
+package inbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+)
+
+const (
+	// WebhookEvent related statements
+	// the event that is received already is left as it is, so that redeliveries are skipped
+	insertEvent = `
+		INSERT INTO "WebhookEvent" ("eventID", body, status, attempts, "receivedAt", "updatedAt")
+			VALUES ($1, $2, $3, 1, $4, $4)
+		ON CONFLICT DO NOTHING;
+	`
+	updateEventStatus = `UPDATE "WebhookEvent" SET status = $1, "lastError" = $2, "updatedAt" = $3 WHERE "eventID" = $4;`
+	selectEvent       = `
+		SELECT
+			"eventID", body, status, attempts, "lastError", "receivedAt", "updatedAt"
+		FROM
+			"WebhookEvent"
+	`
+	getRetryEvents = selectEvent + `WHERE status = $1 AND attempts < $2 AND "updatedAt" <= $3 ORDER BY "updatedAt"`
+	getStuckEvents = selectEvent + `
+		WHERE
+			(status = $1 AND attempts >= $2) OR (status = $3 AND "updatedAt" <= $4)
+		ORDER BY
+			"receivedAt"
+	`
+	// a retry is claimed by moving "updatedAt" forward, so that it won't be retried twice
+	claimRetry = `
+		UPDATE "WebhookEvent" SET status = $1, attempts = attempts + 1, "updatedAt" = $2
+			WHERE "eventID" = $3 AND status = $4 AND "updatedAt" = $5;
+	`
+	deleteDoneEvents = `DELETE FROM "WebhookEvent" WHERE status = $1 AND "updatedAt" <= $2`
+)
+
+const (
+	// tickInterval is how often the inbox checks failed events
+	tickInterval = time.Minute
+	// retryDelay is how long a failed event waits before it's retried
+	retryDelay = time.Minute
+	// maxAttempts is how many times an event is handled before it's left for maintainers
+	maxAttempts = 5
+	// stuckTimeout is how long an event can be processing, it's longer than requests and retries can take
+	stuckTimeout = 10 * time.Minute
+	// retryTimeout cancels the retry of an event as the request timeout does
+	retryTimeout = 30 * time.Second
+	// doneRetention is how long handled events are kept, LINE redelivers events long before that
+	doneRetention = 7 * 24 * time.Hour
+)
+
+type impl struct {
+	db      *db.DB
+	handler Handler
+
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+// NewInbox creates a new Inbox interface
+func NewInbox() (Inbox, error) {
+	dbSrv, err := db.NewSrv()
+	if err != nil {
+		return nil, fmt.Errorf("db.NewSrv failed in NewInbox")
+	}
+	return NewSQLInbox(dbSrv), nil
+}
+
+// NewSQLInbox creates a new Inbox interface stored in the database, which should be migrated
+func NewSQLInbox(dbSrv *db.DB) Inbox {
+	return &impl{
+		db:       dbSrv,
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+}
+
+func (im *impl) WithContext(ctx context.Context) Inbox {
+	return &impl{
+		db:       im.db.WithContext(ctx),
+		handler:  im.handler,
+		stop:     im.stop,
+		stopOnce: im.stopOnce,
+	}
+}
+
+func scanEvent(scanner interface {
+	Scan(dest ...interface{}) error
+}) (*Event, error) {
+	event := &Event{}
+	body := ""
+	if err := scanner.Scan(
+		&event.ID, &body, &event.Status, &event.Attempts, &event.LastError, &event.ReceivedAt, &event.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	event.Body = []byte(body)
+	return event, nil
+}
+
+func (im *impl) queryEvents(query string, args ...interface{}) ([]*Event, error) {
+	rows, err := im.db.Query(query, args...)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query failed in queryEvents")
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			logrus.WithField("err", err).Error("scanEvent failed in queryEvents")
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (im *impl) Receive(eventID string, body []byte) (bool, error) {
+	result, err := im.db.Exec(insertEvent, eventID, string(body), StatusProcessing, time.Now().Unix())
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(insertEvent) failed in Receive")
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in Receive")
+		return false, err
+	}
+	return rowsAffected == int64(1), nil
+}
+
+func (im *impl) Done(eventID string) error {
+	if _, err := im.db.Exec(updateEventStatus, StatusDone, "", time.Now().Unix(), eventID); err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(updateEventStatus) failed in Done")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) Fail(eventID string, cause error) error {
+	if _, err := im.db.Exec(updateEventStatus, StatusFailed, cause.Error(), time.Now().Unix(), eventID); err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(updateEventStatus) failed in Fail")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) GetStuckEvents() ([]*Event, error) {
+	stuckAt := time.Now().Add(-1 * stuckTimeout).Unix()
+	return im.queryEvents(getStuckEvents, StatusFailed, maxAttempts, StatusProcessing, stuckAt)
+}
+
+func (im *impl) Start(handler Handler) {
+	im.handler = handler
+
+	go func() {
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+
+		// retry events that failed while the service was down right away
+		im.retryEvents(time.Now())
+		for {
+			select {
+			case <-ticker.C:
+				im.retryEvents(time.Now())
+			case <-im.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (im *impl) Stop() {
+	im.stopOnce.Do(func() {
+		close(im.stop)
+	})
+}
+
+// retryEvents retries failed events that are due at `now`, and deletes handled events that are no longer redelivered
+func (im *impl) retryEvents(now time.Time) {
+	if _, err := im.db.Exec(deleteDoneEvents, StatusDone, now.Add(-1*doneRetention).Unix()); err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(deleteDoneEvents) failed in retryEvents")
+	}
+
+	events, err := im.queryEvents(getRetryEvents, StatusFailed, maxAttempts, now.Add(-1*retryDelay).Unix())
+	if err != nil {
+		logrus.WithField("err", err).Error("im.queryEvents(getRetryEvents) failed in retryEvents")
+		return
+	}
+
+	for _, event := range events {
+		im.retryEvent(event, now)
+	}
+}
+
+func (im *impl) retryEvent(event *Event, now time.Time) {
+	// claim the retry first, if it's claimed by others, they will take care of it
+	result, err := im.db.Exec(claimRetry, StatusProcessing, now.Unix(), event.ID, StatusFailed, event.UpdatedAt)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(claimRetry) failed in retryEvent")
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in retryEvent")
+		return
+	} else if rowsAffected == int64(0) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), retryTimeout)
+	defer cancel()
+
+	if err := im.handler.HandleEvent(ctx, event.Body); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err":     err,
+			"eventID": event.ID,
+		}).Warn("im.handler.HandleEvent failed in retryEvent")
+
+		if err := im.Fail(event.ID, err); err != nil {
+			logrus.WithField("err", err).Error("im.Fail failed in retryEvent")
+		}
+		return
+	}
+
+	if err := im.Done(event.ID); err != nil {
+		logrus.WithField("err", err).Error("im.Done failed in retryEvent")
+	}
+}
@@ -0,0 +1,104 @@
+package inbox
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+)
+
+// handlerFunc handles retried events with the function
+type handlerFunc func(ctx context.Context, body []byte) error
+
+func (f handlerFunc) HandleEvent(ctx context.Context, body []byte) error {
+	return f(ctx, body)
+}
+
+func newTestInbox(t *testing.T, handler Handler) *impl {
+	dbSrv, err := db.Open("sqlite://" + filepath.Join(t.TempDir(), "inbox.db"))
+	if err != nil {
+		t.Fatalf("db.Open failed: %v", err)
+	}
+	t.Cleanup(func() {
+		dbSrv.Close()
+	})
+
+	if _, err := db.Migrate(dbSrv); err != nil {
+		t.Fatalf("db.Migrate failed: %v", err)
+	}
+	im := NewSQLInbox(dbSrv).(*impl)
+	im.handler = handler
+	return im
+}
+
+func expectReceived(t *testing.T, im *impl, eventID string, expected bool) {
+	t.Helper()
+	received, err := im.Receive(eventID, []byte(`{"webhookEventId":"`+eventID+`"}`))
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if received != expected {
+		t.Fatalf("Receive(%s) returned %v, expected %v", eventID, received, expected)
+	}
+}
+
+func TestRetryFailedEvent(t *testing.T) {
+	bodies := []string{}
+	im := newTestInbox(t, handlerFunc(func(ctx context.Context, body []byte) error {
+		bodies = append(bodies, string(body))
+		return nil
+	}))
+
+	expectReceived(t, im, "event", true)
+	expectReceived(t, im, "event", false)
+	if err := im.Fail("event", fmt.Errorf("timeout")); err != nil {
+		t.Fatalf("Fail failed: %v", err)
+	}
+
+	// the failed event waits for retryDelay before it's retried
+	im.retryEvents(time.Now())
+	if len(bodies) != 0 {
+		t.Fatalf("the event is retried before retryDelay")
+	}
+	im.retryEvents(time.Now().Add(retryDelay + time.Second))
+	if len(bodies) != 1 || bodies[0] != `{"webhookEventId":"event"}` {
+		t.Fatalf("retried bodies are %v", bodies)
+	}
+
+	// the handled event is skipped when it's delivered again
+	expectReceived(t, im, "event", false)
+	im.retryEvents(time.Now().Add(time.Hour))
+	if len(bodies) != 1 {
+		t.Fatalf("the handled event is retried again")
+	}
+}
+
+func TestStuckEvent(t *testing.T) {
+	im := newTestInbox(t, handlerFunc(func(ctx context.Context, body []byte) error {
+		return fmt.Errorf("wallet is down")
+	}))
+
+	expectReceived(t, im, "event", true)
+	if err := im.Fail("event", fmt.Errorf("wallet is down")); err != nil {
+		t.Fatalf("Fail failed: %v", err)
+	}
+	for i := 1; i <= maxAttempts; i++ {
+		im.retryEvents(time.Now().Add(time.Duration(i) * time.Hour))
+	}
+
+	events, err := im.GetStuckEvents()
+	if err != nil {
+		t.Fatalf("GetStuckEvents failed: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d stuck events are found, expected 1", len(events))
+	}
+	if event := events[0]; event.ID != "event" || event.Status != StatusFailed || event.Attempts != maxAttempts || event.LastError != "wallet is down" {
+		t.Fatalf("stuck event is %+v", event)
+	}
+}
@@ -0,0 +1,59 @@
+package inbox
+
+import (
+	"context"
+)
+
+// Status is the processing status of the event
+type Status string
+
+const (
+	// StatusProcessing means the event is being handled, or the service went down while handling it
+	StatusProcessing Status = "processing"
+	// StatusDone means the event is handled, and it's skipped if it's delivered again
+	StatusDone Status = "done"
+	// StatusFailed means the event failed, and it's retried in background
+	StatusFailed Status = "failed"
+)
+
+// Event is a LINE webhook event in the inbox
+type Event struct {
+	// ID is the webhook event ID, and it's the same when LINE redelivers the event
+	ID string
+	// Body is the JSON of the event in the callback
+	Body   []byte
+	Status Status
+	// Attempts is the number of times that the event is handled, including the first one
+	Attempts  int
+	LastError string
+	// ReceivedAt and UpdatedAt are unix timestamps
+	ReceivedAt int64
+	UpdatedAt  int64
+}
+
+// Handler handles events that are retried from the inbox
+type Handler interface {
+	// HandleEvent handles the event again, `body` is the JSON of the event in the callback
+	// the event is retried again if an error is returned, so it should be returned only if retrying is safe
+	HandleEvent(ctx context.Context, body []byte) error
+}
+
+// Inbox records webhook events with their processing status, so that each event is handled once,
+// and failed events are retried in background
+type Inbox interface {
+	// WithContext gets the inbox whose operations are canceled with `ctx`
+	WithContext(ctx context.Context) Inbox
+	// Receive records the event as processing, it returns false if the event is received already,
+	// ex: LINE redelivers it, and then it should be skipped
+	Receive(eventID string, body []byte) (bool, error)
+	// Done marks the event as handled
+	Done(eventID string) error
+	// Fail marks the event as failed with the cause, it's retried until it fails maxAttempts times
+	Fail(eventID string, cause error) error
+	// GetStuckEvents gets events that fail maxAttempts times, or are processing longer than stuckTimeout
+	GetStuckEvents() ([]*Event, error)
+	// Start retries failed events in background with the handler
+	Start(handler Handler)
+	// Stop stops retrying events
+	Stop()
+}
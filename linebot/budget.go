@@ -0,0 +1,155 @@
+package linebot
+
+import (
+	"strconv"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	// budgetAllCategories is the category name that users type for the budget of the whole wallet
+	budgetAllCategories = "全部"
+)
+
+var (
+	// budgetThresholds defines the percentages of the budget that users will be warned when spending crosses them
+	budgetThresholds = []int64{100, 80}
+)
+
+func getBudgetCategoryName(category string) string {
+	if category == "" {
+		return budgetAllCategories
+	}
+	return category
+}
+
+// getBudgetWarnings checks if the spending of `amount` in the category makes any budget cross its thresholds
+func getBudgetWarnings(budgets []*wallet.Budget, category string, amount int64, currency string) []string {
+	warnings := []string{}
+	for _, budget := range budgets {
+		// only the budget of the whole wallet and the budget of the category are affected
+		if budget.Category != "" && budget.Category != category {
+			continue
+		}
+
+		spentBefore := budget.Spent - amount
+		for _, threshold := range budgetThresholds {
+			// compare in percentage to avoid rounding, ex: spent / limit >= threshold / 100
+			crossed := budget.Spent*100 >= budget.Limit*threshold && spentBefore*100 < budget.Limit*threshold
+			if !crossed {
+				continue
+			}
+
+			name := getBudgetCategoryName(budget.Category)
+			spent := money.Format(budget.Spent, currency)
+			limit := money.Format(budget.Limit, currency)
+			if threshold >= 100 {
+				warnings = append(warnings, "🚨 "+name+" 本月已花費 "+spent+"，超出預算 "+limit)
+			} else {
+				warnings = append(warnings, "⚠️ "+name+" 本月已花費 "+spent+"，超過預算 "+limit+" 的 "+strconv.FormatInt(threshold, 10)+"%")
+			}
+			// only warn the highest threshold that is crossed
+			break
+		}
+	}
+	return warnings
+}
+
+func (im *impl) budget(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+
+	// if the command looks like `預算 guachi`
+	// we will display the remaining budget of this month
+	if len(args) == 1 {
+		return im.getBudgets(caller, userID)
+	}
+
+	category := args[1]
+	if category == budgetAllCategories {
+		category = ""
+	}
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in budget")
+		return nil, err
+	}
+
+	limit, err := parseAmount(args[2:], currency)
+	if err == wallet.ErrCurrencyMismatch {
+		return getCurrencyMismatchResponse(currency), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := im.wallet.SetBudget(caller.userID, userID, category, limit); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrCategoryNotFound {
+		return getCategoryNotFoundResponse(category), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.SetBudget failed in budget")
+		return nil, err
+	}
+
+	text := "已將 " + userID + " " + args[1] + " 的每月預算設為 " + money.Format(limit, currency)
+	if limit == int64(0) {
+		text = "已取消 " + userID + " " + args[1] + " 的每月預算"
+	}
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(text),
+		},
+	}, nil
+}
+
+func (im *impl) getBudgets(caller *commandCaller, userID string) (*response, error) {
+	budgets, err := im.wallet.GetBudgets(caller.userID, userID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetBudgets failed in getBudgets")
+		return nil, err
+	}
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in getBudgets")
+		return nil, err
+	}
+
+	if len(budgets) == 0 {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage(userID + " 還沒有設定預算"),
+			},
+		}, nil
+	}
+
+	texts := ""
+	for i, budget := range budgets {
+		texts += getBudgetCategoryName(budget.Category) +
+			" 已花費 " + money.Format(budget.Spent, currency) + " / " + money.Format(budget.Limit, currency) +
+			"，剩餘 " + money.Format(budget.Limit-budget.Spent, currency)
+		if i != len(budgets)-1 {
+			texts += "\n"
+		}
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(userID + " 本月預算 :\n" + texts),
+		},
+	}, nil
+}
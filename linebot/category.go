@@ -0,0 +1,138 @@
+package linebot
+
+import (
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	// categorySeparator separates the reason, the category and tags
+	// ex: 晚餐#餐飲#聚餐
+	categorySeparator = "#"
+)
+
+// parseReason parses text like `晚餐#餐飲#聚餐#週末`
+// into reason `晚餐`, category `餐飲` and tags [`聚餐`, `週末`]
+func parseReason(text string) (reason, category string, tags []string) {
+	texts := strings.Split(text, categorySeparator)
+	reason = texts[0]
+	if len(texts) > 1 {
+		category = texts[1]
+	}
+	if len(texts) > 2 {
+		tags = texts[2:]
+	}
+	return reason, category, tags
+}
+
+// splitWalletCategory parses text like `guachi#餐飲` into userID `guachi` and category `餐飲`
+func splitWalletCategory(text string) (userID, category string) {
+	texts := strings.SplitN(text, categorySeparator, 2)
+	if len(texts) == 1 {
+		return texts[0], ""
+	}
+	return texts[0], texts[1]
+}
+
+// formatReason formats the reason of the log as the way users type it
+func formatReason(balanceLog *wallet.BalanceLog) string {
+	text := balanceLog.Reason
+	if balanceLog.Category == "" && len(balanceLog.Tags) == 0 {
+		return text
+	}
+
+	text += categorySeparator + balanceLog.Category
+	for _, tag := range balanceLog.Tags {
+		text += categorySeparator + tag
+	}
+	return text
+}
+
+func getCategoryNotFoundResponse(category string) *response {
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("分類 " + category + " 不存在，請先新增分類"),
+		},
+	}
+}
+
+func (im *impl) addCategory(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	category := args[1]
+	if strings.Contains(category, categorySeparator) {
+		return nil, ErrInvalidArgument
+	}
+
+	if err := im.wallet.AddCategory(caller.userID, userID, category); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrCategoryExist {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage("分類 " + category + " 已經存在囉"),
+			},
+		}, nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.AddCategory failed in addCategory")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("已新增分類 " + category + " 到 " + userID),
+		},
+	}, nil
+}
+
+func (im *impl) removeCategory(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	category := args[1]
+	if err := im.wallet.RemoveCategory(caller.userID, userID, category); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrCategoryNotFound {
+		return getCategoryNotFoundResponse(category), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.RemoveCategory failed in removeCategory")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("已從 " + userID + " 刪除分類 " + category),
+		},
+	}, nil
+}
+
+func (im *impl) getCategories(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	categories, err := im.wallet.GetCategories(caller.userID, userID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCategories failed in getCategories")
+		return nil, err
+	}
+
+	if len(categories) == 0 {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage(userID + " 還沒有任何分類"),
+			},
+		}, nil
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(userID + " 的分類 :\n" + strings.Join(categories, "\n")),
+		},
+	}, nil
+}
@@ -0,0 +1,155 @@
+package linebot
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/chart"
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	// chartSize is the width and height of the original image, and chartPreviewSize is the one of the preview
+	chartSize        = 1024
+	chartPreviewSize = 240
+)
+
+var (
+	// chartKinds are the kinds of charts that users type, ex: 圖表 guachi 本月 長條
+	chartKinds = map[string]chart.Kind{
+		"長條": chart.KindBar,
+		"折線": chart.KindLine,
+		"圓餅": chart.KindPie,
+	}
+
+	// chartLegends are emojis of chart.Palette in the same order
+	chartLegends = []string{"🟥", "🟧", "🟨", "🟩", "🟦", "🟪", "🟫", "⬛"}
+)
+
+// getChartGroupBy gets the grouping of the chart, pie charts are split by categories,
+// and bars and lines go through days, or months if the range is longer than a month
+func getChartGroupBy(kind chart.Kind, timeRange wallet.TimeRange) wallet.GroupBy {
+	if kind == chart.KindPie {
+		return wallet.GroupByCategory
+	}
+	if time.Duration(timeRange.End-timeRange.Start)*time.Second > 31*24*time.Hour {
+		return wallet.GroupByMonth
+	}
+	return wallet.GroupByDay
+}
+
+// getChartPoints gets expenses of groups, and small slices of pie charts are merged as 其他,
+// so that every slice has its own color
+func getChartPoints(kind chart.Kind, summary *wallet.Summary) []chart.Point {
+	points := []chart.Point{}
+	for _, group := range summary.Groups {
+		if group.Expense == int64(0) {
+			continue
+		}
+
+		label := group.Key
+		if label == "" && summary.GroupBy == wallet.GroupByCategory {
+			label = reportUncategorized
+		}
+		points = append(points, chart.Point{Label: label, Value: group.Expense})
+	}
+
+	// groups of categories are sorted by the expense, so the tail is merged
+	if kind != chart.KindPie || len(points) <= len(chart.Palette) {
+		return points
+	}
+	others := chart.Point{Label: "其他"}
+	for _, point := range points[len(chart.Palette)-1:] {
+		others.Value += point.Value
+	}
+	return append(points[:len(chart.Palette)-1], others)
+}
+
+// putChart renders the chart in the size, and gets the URL of the image
+func (im *impl) putChart(kind chart.Kind, points []chart.Point, size int) (string, error) {
+	buffer := &bytes.Buffer{}
+	if err := chart.Render(buffer, kind, points, size, size); err != nil {
+		logrus.WithField("err", err).Error("chart.Render failed in putChart")
+		return "", err
+	}
+
+	token, err := im.charts.Put(buffer.Bytes())
+	if err != nil {
+		logrus.WithField("err", err).Error("im.charts.Put failed in putChart")
+		return "", err
+	}
+	return strings.TrimSuffix(im.baseURL, "/") + "/charts/" + token, nil
+}
+
+func (im *impl) drawChart(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	getRange, ok := reportRanges[args[1]]
+	if !ok {
+		return nil, ErrInvalidArgument
+	}
+
+	kind := chart.KindPie
+	if len(args) > 2 {
+		if kind, ok = chartKinds[args[2]]; !ok {
+			return nil, ErrInvalidArgument
+		}
+	}
+
+	timeRange := getRange(time.Now())
+	summary, err := im.wallet.Summarize(caller.userID, userID, timeRange, getChartGroupBy(kind, timeRange))
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.Summarize failed in drawChart")
+		return nil, err
+	}
+
+	points := getChartPoints(kind, summary)
+	if len(points) == 0 {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage(userID + " " + args[1] + "沒有任何支出紀錄"),
+			},
+		}, nil
+	}
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in drawChart")
+		return nil, err
+	}
+
+	originalURL, err := im.putChart(kind, points, chartSize)
+	if err != nil {
+		return nil, err
+	}
+	previewURL, err := im.putChart(kind, points, chartPreviewSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// there is no text in the image, so the legend is sent as a text message
+	legend := userID + " " + args[1] + "支出 " + money.Format(summary.Expense, currency)
+	for i, point := range points {
+		marker := strconv.Itoa(i+1) + "."
+		if kind == chart.KindPie {
+			marker = chartLegends[i%len(chartLegends)]
+		}
+		legend += "\n" + marker + " " + point.Label + " " + money.Format(point.Value, currency)
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewImageMessage(originalURL, previewURL),
+			linebot.NewTextMessage(legend),
+		},
+	}, nil
+}
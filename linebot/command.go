@@ -2,7 +2,6 @@ package linebot
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
@@ -10,6 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/money"
 	"github.com/andy/guachi-pay-line-bot/wallet"
 )
 
@@ -18,6 +18,7 @@ const (
 	
 您還沒有錢包嗎? 可以參考這個指令唷 ~
 💰 新增錢包【錢包名稱】
+💱 新增錢包【錢包名稱】【幣別】
 
 如果已經有，請輸入您的【錢包名稱】，我們將為您服務 🙂
 
@@ -25,6 +26,8 @@ const (
 💵 錢包:
 1. 清空錢包【錢包名稱】
 2. 刪除錢包【錢包名稱】
+3. 透支【錢包名稱】【允許/禁止/最多透支多少元】
+4. 對帳【錢包名稱】
 	
 🔎 查詢:
 1. 查詢餘額【錢包名稱】
@@ -32,13 +35,74 @@ const (
 
 📋 記帳:
 1.【錢包名稱】【原因】+【多少元】
-2.【錢包名稱】【原因】-【多少元】`
+2.【錢包名稱】【原因】-【多少元】
+3.【錢包名稱】【原因】->【錢包名稱】【多少元】
+原因後面可以加上 #分類#標籤，ex: guachi 晚餐#餐飲#聚餐 - 120
+金額後面可以加上幣別，ex: travel 午餐 - 12.50 USD
+與錢包不同的幣別會依匯率換算
+4. 復原【錢包名稱】
+
+💱 匯率:
+1. 匯率【幣別】【幣別】【匯率】
+2. 查詢匯率【幣別】【幣別】
+
+🔁 定期:
+1. 新增定期【錢包名稱】【原因】【+/-】【多少元】【排程】
+2. 定期【錢包名稱】
+3. 暫停定期【編號】
+4. 恢復定期【編號】
+5. 刪除定期【編號】
+
+💸 預算:
+1. 預算【錢包名稱】【分類/全部】【每月多少元】
+2. 預算【錢包名稱】
+
+📊 報表:
+1. 報表【錢包名稱】【今天/本週/上週/本月/上月/今年】
+2. 報表【錢包名稱】【期間】【每日/每週/每月/原因/分類】
+3. 圖表【錢包名稱】【期間】【圓餅/長條/折線】
+4. 匯出【錢包名稱】【起日】【迄日】
+5. 匯入【錢包名稱】
+
+🏷 分類:
+1. 新增分類【錢包名稱】【分類】
+2. 刪除分類【錢包名稱】【分類】
+3. 查詢分類【錢包名稱】
+
+👥 成員:
+1. 新增成員【錢包名稱】【成員ID】【編輯者/檢視者】
+2. 移除成員【錢包名稱】【成員ID】
+3. 查詢成員【錢包名稱】
+4. 我的ID`
 )
 
 type response struct {
 	messages []linebot.SendingMessage
 }
 
+// commandCaller describes who sends the command, and where the command is sent from
+type commandCaller struct {
+	// userID is the LINE user ID of the one who sends the command
+	userID string
+	// sourceID is the ID of the group or the room if the command is sent in it, otherwise it's empty
+	sourceID string
+	// webhookEventID and messageID identify the message that the command is sent in,
+	// and they are the same when LINE redelivers the message
+	webhookEventID string
+	messageID      string
+}
+
+// idempotencyKey is the key of records of the command, so that the redelivered message isn't recorded twice
+// it's empty if the command isn't sent in a message, and then records are never deduplicated
+func (caller *commandCaller) idempotencyKey() string {
+	if caller.messageID == "" {
+		return ""
+	} else if caller.webhookEventID == "" {
+		return caller.messageID
+	}
+	return caller.webhookEventID + ":" + caller.messageID
+}
+
 type command struct {
 	// commandIndex defines the index that the main command name is placed at in strings.Split(text, " ")
 	commandIndex int
@@ -51,7 +115,7 @@ type command struct {
 	// because the second date is optional, so the value of `optionalArgsAllowed` should be 1
 	optionalArgsAllowed int
 	// execFunc is the execution function
-	execFunc func(im *impl, args ...string) (*response, error)
+	execFunc func(im *impl, caller *commandCaller, args ...string) (*response, error)
 	// helpDesc describe how this command works, and it will display when the user calls `!help`
 	helpDesc string
 }
@@ -61,12 +125,36 @@ const (
 	commandCreateWallet   = "新增錢包"
 	commandDeleteWallet   = "刪除錢包"
 	commandEmptyWallet    = "清空錢包"
+	commandOverdraft      = "透支"
+	commandReconcile      = "對帳"
+	commandSetRate        = "匯率"
+	commandGetRate        = "查詢匯率"
 	commandGetBalance     = "查詢餘額"
 	commandGetBalanceLogs = "歷史紀錄"
 	commandDepositMoney1  = "儲值"
 	commandDepositMoney2  = "+"
 	commandSpendMoney1    = "花費"
 	commandSpendMoney2    = "-"
+	commandTransferMoney1 = "轉帳"
+	commandTransferMoney2 = "->"
+	commandUndo           = "復原"
+	commandAddRule        = "新增定期"
+	commandGetRules       = "定期"
+	commandPauseRule      = "暫停定期"
+	commandResumeRule     = "恢復定期"
+	commandDeleteRule     = "刪除定期"
+	commandBudget         = "預算"
+	commandReport         = "報表"
+	commandChart          = "圖表"
+	commandExportLogs     = "匯出"
+	commandImport         = "匯入"
+	commandAddCategory    = "新增分類"
+	commandRemoveCategory = "刪除分類"
+	commandGetCategories  = "查詢分類"
+	commandAddMember      = "新增成員"
+	commandRemoveMember   = "移除成員"
+	commandGetMembers     = "查詢成員"
+	commandGetMyID        = "我的ID"
 )
 
 var (
@@ -78,11 +166,13 @@ var (
 	// commands defines the allowed commands
 	commands = map[string]command{
 		// ex: 新增錢包 guachi
+		// ex: 新增錢包 travel USD
 		commandCreateWallet: command{
-			commandIndex: 0,
-			argsAllowed:  1,
-			execFunc:     (*impl).createWallet,
-			helpDesc:     "新增錢包【錢包名稱】\nex: 新增錢包 guachi",
+			commandIndex:        0,
+			argsAllowed:         1,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).createWallet,
+			helpDesc:            "新增錢包【錢包名稱】【幣別】\n沒有指定幣別時預設為 TWD\nex: 新增錢包 guachi\nex: 新增錢包 travel USD",
 		},
 
 		// ex: 刪除錢包 guachi
@@ -101,6 +191,45 @@ var (
 			helpDesc:     "請輸入:\n清空錢包【錢包名稱】\n\nex: 清空錢包 guachi",
 		},
 
+		// ex: 透支 guachi
+		// ex: 透支 guachi 禁止
+		// ex: 透支 guachi 5000
+		commandOverdraft: command{
+			commandIndex:        0,
+			argsAllowed:         1,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).overdraft,
+			helpDesc:            "請輸入:\n透支【錢包名稱】【允許/禁止/最多透支多少元】\n\n只輸入錢包名稱可以查看目前的設定，只有擁有者可以修改\n\nex: 透支 guachi 禁止\nex: 透支 guachi 5000",
+		},
+
+		// ex: 對帳 guachi
+		// ex: 對帳 guachi 修正
+		commandReconcile: command{
+			commandIndex:        0,
+			argsAllowed:         1,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).reconcile,
+			helpDesc:            "請輸入:\n對帳【錢包名稱】【修正】\n\n檢查餘額與紀錄加總是否一致，加上「修正」會新增一筆對帳調整紀錄，只有擁有者可以使用\n\nex: 對帳 guachi\nex: 對帳 guachi 修正",
+		},
+
+		// ex: 匯率 USD TWD 30.5
+		// ex: 匯率 USD TWD 30.5 2019/05/20
+		commandSetRate: command{
+			commandIndex:        0,
+			argsAllowed:         3,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).setRate,
+			helpDesc:            "請輸入:\n匯率【幣別】【幣別】【匯率】【日期】\n\n1 單位的前一個幣別可以換多少後一個幣別，沒有指定日期時從今天開始生效\n\nex: 匯率 USD TWD 30.5\nex: 匯率 JPY TWD 0.28 2019/05/20",
+		},
+
+		// ex: 查詢匯率 USD TWD
+		commandGetRate: command{
+			commandIndex: 0,
+			argsAllowed:  2,
+			execFunc:     (*impl).getRate,
+			helpDesc:     "請輸入:\n查詢匯率【幣別】【幣別】\n\nex: 查詢匯率 USD TWD",
+		},
+
 		// ex: 查詢餘額 guachi
 		commandGetBalance: command{
 			commandIndex: 0,
@@ -116,39 +245,217 @@ var (
 			argsAllowed:         1,
 			optionalArgsAllowed: 2,
 			execFunc:            (*impl).getBalanceLogs,
-			helpDesc:            "請輸入:\n歷史紀錄【錢包名稱】【起日】【迄日】\n\nex: 歷史紀錄 guachi 2019/05/20 2019/06/20",
+			helpDesc:            "請輸入:\n歷史紀錄【錢包名稱】【起日】【迄日】\n\n只想看某個分類的話，可以在錢包名稱後面加上 #分類\n\nex: 歷史紀錄 guachi 2019/05/20 2019/06/20\nex: 歷史紀錄 guachi#餐飲 2019/05/20 2019/06/20",
 		},
 
 		// ex: guachi 中樂透 (儲值 or +) 100
 		commandDepositMoney1: command{
-			commandIndex: 2,
-			argsAllowed:  3,
-			execFunc:     (*impl).depositMoney,
-			helpDesc:     "請輸入:\n【錢包名稱】【原因】+【多少錢】\n\nex: guachi 中樂透 + 100",
+			commandIndex:        2,
+			argsAllowed:         3,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).depositMoney,
+			helpDesc:            "請輸入:\n【錢包名稱】【原因】+【多少錢】【幣別】\n\nex: guachi 中樂透 + 100\nex: travel 中樂透 + 12.50 USD",
 		},
 
 		// ex: guachi 中樂透 (儲值 or +) 100
 		commandDepositMoney2: command{
-			commandIndex: 2,
-			argsAllowed:  3,
-			execFunc:     (*impl).depositMoney,
-			helpDesc:     "請輸入:\n【錢包名稱】【原因】+【多少錢】\n\nex: guachi 中樂透 + 100",
+			commandIndex:        2,
+			argsAllowed:         3,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).depositMoney,
+			helpDesc:            "請輸入:\n【錢包名稱】【原因】+【多少錢】【幣別】\n\nex: guachi 中樂透 + 100\nex: travel 中樂透 + 12.50 USD",
 		},
 
 		// ex: guachi 晚餐 (花費 or -) 100
 		commandSpendMoney1: command{
-			commandIndex: 2,
-			argsAllowed:  3,
-			execFunc:     (*impl).spendMoney,
-			helpDesc:     "請輸入:\n【錢包名稱】【原因】-【多少錢】\n\nex: guachi 晚餐 - 100",
+			commandIndex:        2,
+			argsAllowed:         3,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).spendMoney,
+			helpDesc:            "請輸入:\n【錢包名稱】【原因】-【多少錢】【幣別】\n\nex: guachi 晚餐 - 100\nex: travel 午餐 - 12.50 USD",
 		},
 
 		// ex: guachi 晚餐 (花費 or -) 100
 		commandSpendMoney2: command{
-			commandIndex: 2,
-			argsAllowed:  3,
-			execFunc:     (*impl).spendMoney,
-			helpDesc:     "請輸入:\n【錢包名稱】【原因】-【多少錢】\n\nex: guachi 晚餐 - 100",
+			commandIndex:        2,
+			argsAllowed:         3,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).spendMoney,
+			helpDesc:            "請輸入:\n【錢包名稱】【原因】-【多少錢】【幣別】\n\nex: guachi 晚餐 - 100\nex: travel 午餐 - 12.50 USD",
+		},
+
+		// ex: guachi 存錢 (轉帳 or ->) savings 500
+		commandTransferMoney1: command{
+			commandIndex:        2,
+			argsAllowed:         4,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).transferMoney,
+			helpDesc:            "請輸入:\n【錢包名稱】【原因】->【錢包名稱】【多少錢】\n\nex: guachi 存錢 -> savings 500",
+		},
+
+		// ex: guachi 存錢 (轉帳 or ->) savings 500
+		commandTransferMoney2: command{
+			commandIndex:        2,
+			argsAllowed:         4,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).transferMoney,
+			helpDesc:            "請輸入:\n【錢包名稱】【原因】->【錢包名稱】【多少錢】\n\nex: guachi 存錢 -> savings 500",
+		},
+
+		// ex: 復原 guachi
+		commandUndo: command{
+			commandIndex: 0,
+			argsAllowed:  1,
+			execFunc:     (*impl).undo,
+			helpDesc:     "請輸入:\n復原【錢包名稱】\n\n會刪除您在這個錢包的最後一筆紀錄\n\nex: 復原 guachi",
+		},
+
+		// ex: 新增定期 guachi 房租 - 15000 每月5號
+		commandAddRule: command{
+			commandIndex: 0,
+			argsAllowed:  5,
+			execFunc:     (*impl).addRule,
+			helpDesc: "請輸入:\n新增定期【錢包名稱】【原因】【+/-】【多少元】【排程】\n\n" +
+				"排程可以是:\n每天\n每週一 ~ 每週日\n每月1號 ~ 每月31號\ncron:分_時_日_月_星期\n\n" +
+				"ex: 新增定期 guachi 房租 - 15000 每月5號\nex: 新增定期 guachi 零用錢 + 500 每週一",
+		},
+
+		// ex: 定期 guachi
+		commandGetRules: command{
+			commandIndex: 0,
+			argsAllowed:  1,
+			execFunc:     (*impl).getRules,
+			helpDesc:     "請輸入:\n定期【錢包名稱】\n\nex: 定期 guachi",
+		},
+
+		// ex: 暫停定期 3
+		commandPauseRule: command{
+			commandIndex: 0,
+			argsAllowed:  1,
+			execFunc:     (*impl).pauseRule,
+			helpDesc:     "請輸入:\n暫停定期【編號】\n\nex: 暫停定期 3",
+		},
+
+		// ex: 恢復定期 3
+		commandResumeRule: command{
+			commandIndex: 0,
+			argsAllowed:  1,
+			execFunc:     (*impl).resumeRule,
+			helpDesc:     "請輸入:\n恢復定期【編號】\n\nex: 恢復定期 3",
+		},
+
+		// ex: 刪除定期 3
+		commandDeleteRule: command{
+			commandIndex: 0,
+			argsAllowed:  1,
+			execFunc:     (*impl).deleteRule,
+			helpDesc:     "請輸入:\n刪除定期【編號】\n\nex: 刪除定期 3",
+		},
+
+		// ex: 預算 guachi
+		// ex: 預算 guachi 餐飲 6000
+		commandBudget: command{
+			commandIndex:        0,
+			argsAllowed:         1,
+			optionalArgsAllowed: 2,
+			execFunc:            (*impl).budget,
+			helpDesc:            "請輸入:\n預算【錢包名稱】【分類/全部】【每月多少元】\n\n設定為 0 元即可取消預算，只輸入錢包名稱可以查看本月剩餘的預算\n\nex: 預算 guachi 餐飲 6000\nex: 預算 guachi",
+		},
+
+		// ex: 報表 guachi 本月
+		// ex: 報表 guachi 今年 每月
+		commandReport: command{
+			commandIndex:        0,
+			argsAllowed:         2,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).report,
+			helpDesc:            "請輸入:\n報表【錢包名稱】【今天/本週/上週/本月/上月/今年】【每日/每週/每月/原因/分類】\n\n沒有指定時依分類統計，轉帳不會算進收支\n\nex: 報表 guachi 本月\nex: 報表 guachi 今年 每月",
+		},
+
+		// ex: 圖表 guachi 本月
+		// ex: 圖表 guachi 今年 長條
+		commandChart: command{
+			commandIndex:        0,
+			argsAllowed:         2,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).drawChart,
+			helpDesc:            "請輸入:\n圖表【錢包名稱】【今天/本週/上週/本月/上月/今年】【圓餅/長條/折線】\n\n圓餅圖依分類統計支出，長條圖與折線圖依日期統計支出，沒有指定時為圓餅圖\n\nex: 圖表 guachi 本月\nex: 圖表 guachi 今年 長條",
+		},
+
+		// ex: 匯出 guachi 2019/05/01 2019/05/31
+		// ex: 匯出 guachi 2019/05/01 2019/05/31 beancount
+		commandExportLogs: command{
+			commandIndex:        0,
+			argsAllowed:         3,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).exportLogs,
+			helpDesc:            "請輸入:\n匯出【錢包名稱】【起日】【迄日】【csv/ledger/beancount】\n\n會回覆下載檔案的連結，連結在一小時後失效，沒有指定格式時為 CSV 檔\n\nex: 匯出 guachi 2019/05/01 2019/05/31\nex: 匯出 guachi 2019/05/01 2019/05/31 beancount",
+		},
+
+		// ex: 匯入 guachi
+		commandImport: command{
+			commandIndex: 0,
+			argsAllowed:  1,
+			execFunc:     (*impl).importStatement,
+			helpDesc:     "請輸入:\n匯入【錢包名稱】\n\n會回覆上傳銀行對帳單 (CSV/OFX/QIF) 的連結，連結在一小時後失效\n\nex: 匯入 guachi",
+		},
+
+		// ex: 新增分類 guachi 餐飲
+		commandAddCategory: command{
+			commandIndex: 0,
+			argsAllowed:  2,
+			execFunc:     (*impl).addCategory,
+			helpDesc:     "請輸入:\n新增分類【錢包名稱】【分類】\n\nex: 新增分類 guachi 餐飲",
+		},
+
+		// ex: 刪除分類 guachi 餐飲
+		commandRemoveCategory: command{
+			commandIndex: 0,
+			argsAllowed:  2,
+			execFunc:     (*impl).removeCategory,
+			helpDesc:     "請輸入:\n刪除分類【錢包名稱】【分類】\n\nex: 刪除分類 guachi 餐飲",
+		},
+
+		// ex: 查詢分類 guachi
+		commandGetCategories: command{
+			commandIndex: 0,
+			argsAllowed:  1,
+			execFunc:     (*impl).getCategories,
+			helpDesc:     "請輸入:\n查詢分類【錢包名稱】\n\nex: 查詢分類 guachi",
+		},
+
+		// ex: 新增成員 guachi Uxxxxxxxx
+		// ex: 新增成員 guachi Uxxxxxxxx 檢視者
+		commandAddMember: command{
+			commandIndex:        0,
+			argsAllowed:         2,
+			optionalArgsAllowed: 1,
+			execFunc:            (*impl).addMember,
+			helpDesc:            "請輸入:\n新增成員【錢包名稱】【成員ID】【編輯者/檢視者】\n\n成員ID 可以請對方輸入「我的ID」取得，沒有指定身分時預設為編輯者\n\nex: 新增成員 guachi Uxxxxxxxx 檢視者",
+		},
+
+		// ex: 移除成員 guachi Uxxxxxxxx
+		commandRemoveMember: command{
+			commandIndex: 0,
+			argsAllowed:  2,
+			execFunc:     (*impl).removeMember,
+			helpDesc:     "請輸入:\n移除成員【錢包名稱】【成員ID】\n\nex: 移除成員 guachi Uxxxxxxxx",
+		},
+
+		// ex: 查詢成員 guachi
+		commandGetMembers: command{
+			commandIndex: 0,
+			argsAllowed:  1,
+			execFunc:     (*impl).getMembers,
+			helpDesc:     "請輸入:\n查詢成員【錢包名稱】\n\nex: 查詢成員 guachi",
+		},
+
+		// ex: 我的ID
+		commandGetMyID: command{
+			commandIndex: 0,
+			argsAllowed:  0,
+			execFunc:     (*impl).getMyID,
+			helpDesc:     "請輸入:\n我的ID",
 		},
 	}
 )
@@ -161,7 +468,24 @@ func getWalletNotFoundResponse() *response {
 	}
 }
 
-func (im *impl) procCommand(text string) (*response, error) {
+func getPermissionDeniedResponse() *response {
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("您沒有權限操作這個錢包唷"),
+		},
+	}
+}
+
+// getRecordedResponse replies the redelivered message whose record has been deleted
+func getRecordedResponse() *response {
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("這筆紀錄已經記錄過了唷"),
+		},
+	}
+}
+
+func (im *impl) procCommand(caller *commandCaller, text string) (*response, error) {
 	texts := strings.Split(text, " ")
 	if len(texts) == 0 {
 		return nil, ErrCommandNotExist
@@ -187,12 +511,19 @@ func (im *impl) procCommand(text string) (*response, error) {
 	if !found || (found && !validArgs) {
 		return nil, ErrCommandNotExist
 	}
-	return targetCommand.execFunc(im, args...)
+	return targetCommand.execFunc(im, caller, args...)
 }
 
-func (im *impl) createWallet(args ...string) (*response, error) {
+func (im *impl) createWallet(caller *commandCaller, args ...string) (*response, error) {
 	userID := args[0]
-	if err := im.wallet.Create(userID); err != nil && err != wallet.ErrWalletExist {
+	options := []wallet.CreateOption{
+		wallet.WithSourceID(caller.sourceID),
+	}
+	if len(args) == 2 {
+		options = append(options, wallet.WithCurrency(args[1]))
+	}
+
+	if err := im.wallet.Create(caller.userID, userID, options...); err != nil && err != wallet.ErrWalletExist && err != wallet.ErrInvalidCurrency {
 		logrus.WithField("err", err).Error("wallet.Create failed in createWallet")
 		return nil, err
 	} else if err == wallet.ErrWalletExist {
@@ -201,6 +532,12 @@ func (im *impl) createWallet(args ...string) (*response, error) {
 				linebot.NewTextMessage("錢包已經存在囉"),
 			},
 		}, nil
+	} else if err == wallet.ErrInvalidCurrency {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage("不支援幣別 " + args[1] + " 唷"),
+			},
+		}, nil
 	}
 
 	return &response{
@@ -210,10 +547,12 @@ func (im *impl) createWallet(args ...string) (*response, error) {
 	}, nil
 }
 
-func (im *impl) deleteWallet(args ...string) (*response, error) {
+func (im *impl) deleteWallet(caller *commandCaller, args ...string) (*response, error) {
 	userID := args[0]
-	if err := im.wallet.Delete(userID); err == wallet.ErrWalletNotFound {
+	if err := im.wallet.Delete(caller.userID, userID); err == wallet.ErrWalletNotFound {
 		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
 	} else if err != nil {
 		logrus.WithField("err", err).Error("wallet.Delete failed in deleteWallet")
 		return nil, err
@@ -226,10 +565,12 @@ func (im *impl) deleteWallet(args ...string) (*response, error) {
 	}, nil
 }
 
-func (im *impl) emptyBalance(args ...string) (*response, error) {
+func (im *impl) emptyBalance(caller *commandCaller, args ...string) (*response, error) {
 	userID := args[0]
-	if err := im.wallet.EmptyBalance(userID); err == wallet.ErrWalletNotFound {
+	if err := im.wallet.EmptyBalance(caller.userID, userID); err == wallet.ErrWalletNotFound {
 		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
 	} else if err != nil {
 		logrus.WithField("err", err).Error("wallet.EmptyBalance failed in emptyBalance")
 		return nil, err
@@ -242,26 +583,42 @@ func (im *impl) emptyBalance(args ...string) (*response, error) {
 	}, nil
 }
 
-func (im *impl) getBalance(args ...string) (*response, error) {
+func (im *impl) getBalance(caller *commandCaller, args ...string) (*response, error) {
 	userID := args[0]
-	balance, err := im.wallet.GetBalance(userID)
+	balance, err := im.wallet.GetBalance(caller.userID, userID)
 	if err == wallet.ErrWalletNotFound {
 		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
 	} else if err != nil {
 		logrus.WithField("err", err).Error("wallet.GetBalance failed in getBalance")
 		return nil, err
 	}
 
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in getBalance")
+		return nil, err
+	}
+
 	return &response{
 		messages: []linebot.SendingMessage{
-			linebot.NewTextMessage("目前餘額 " + strconv.FormatInt(balance, 10) + "元"),
+			newBalanceMessage("目前餘額 "+money.Format(balance, currency), userID, balance, currency),
 		},
 	}, nil
 }
 
-func (im *impl) getBalanceLogsTemplateMessage(userID string) (*response, error) {
-	if !im.wallet.IsWalletExist(userID) {
+// getBalanceLogsTemplateMessage displays the TemplateMessage of `歷史紀錄`
+// target is the wallet name, and it may be followed by the category, ex: guachi#餐飲
+func (im *impl) getBalanceLogsTemplateMessage(caller *commandCaller, target string) (*response, error) {
+	userID, _ := splitWalletCategory(target)
+	if err := im.wallet.Authorize(caller.userID, userID, wallet.RoleViewer); err == wallet.ErrWalletNotFound {
 		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.Authorize failed in getBalanceLogsTemplateMessage")
+		return nil, err
 	}
 
 	location, _ := time.LoadLocation("Asia/Taipei")
@@ -270,7 +627,7 @@ func (im *impl) getBalanceLogsTemplateMessage(userID string) (*response, error)
 	todayStartTime := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location).Unix()
 	todayEndTime := todayStartTime + int64(86400)
 
-	postbackReceiver := getPostbackReceiver(commandGetBalanceLogs, userID)
+	postbackReceiver := getPostbackReceiver(commandGetBalanceLogs, target)
 	bytesToday := postbackReceiver.withTimeRange(todayStartTime, todayEndTime).toJSONBytes()
 	bytesLast3Days := postbackReceiver.withTimeRange(todayStartTime-int64(2*86400), todayEndTime).toJSONBytes()
 	bytesLast7Days := postbackReceiver.withTimeRange(todayStartTime-int64(6*86400), todayEndTime).toJSONBytes()
@@ -288,13 +645,15 @@ func (im *impl) getBalanceLogsTemplateMessage(userID string) (*response, error)
 	}, nil
 }
 
-func (im *impl) getBalanceLogs(args ...string) (*response, error) {
-	userID := args[0]
+func (im *impl) getBalanceLogs(caller *commandCaller, args ...string) (*response, error) {
+	// if the command looks like `歷史紀錄 guachi#餐飲`
+	// we will only get logs that belong to 餐飲
+	userID, category := splitWalletCategory(args[0])
 
 	// if the command looks like `歷史紀錄 guachi`
 	// we will display `TemplateMessage` for users, and let them choose what to do next
 	if len(args) == 1 {
-		return im.getBalanceLogsTemplateMessage(userID)
+		return im.getBalanceLogsTemplateMessage(caller, args[0])
 	}
 
 	startTime, err := base.ParseToTimestamp(args[1])
@@ -311,49 +670,99 @@ func (im *impl) getBalanceLogs(args ...string) (*response, error) {
 	options := []wallet.GetLogsOption{
 		wallet.WithStartTime(startTime),
 		wallet.WithEndTime(endTime),
+		wallet.WithCategory(category),
 	}
 
-	balanceLogs, err := im.wallet.GetBalanceLogs(userID, options...)
-	if err != nil {
+	balanceLogs, err := im.wallet.GetBalanceLogs(caller.userID, userID, options...)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
 		logrus.WithField("err", err).Error("wallet.GetBalanceLogs failed in getBalanceLogs")
 		return nil, err
 	}
 
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in getBalanceLogs")
+		return nil, err
+	}
+
 	texts := ""
 	for i, balanceLog := range balanceLogs {
-		texts += balanceLog.Timestamp + " " + balanceLog.Reason + " " + strconv.FormatInt(balanceLog.Amount, 10) + "元"
+		texts += balanceLog.Timestamp + " " + formatReason(balanceLog) + " " + money.Format(balanceLog.Amount, currency) + formatConversion(balanceLog.Conversion)
+		// the log is one side of a transfer
+		if balanceLog.CounterpartyID != "" && balanceLog.Amount < int64(0) {
+			texts += " → " + balanceLog.CounterpartyID
+		} else if balanceLog.CounterpartyID != "" {
+			texts += " ← " + balanceLog.CounterpartyID
+		}
 		if i != len(balanceLogs)-1 {
 			texts += "\n"
 		}
 	}
 
+	texts = "歷史紀錄 :\n" + texts
+	if len(balanceLogs) == 0 {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage(texts),
+			},
+		}, nil
+	}
 	return &response{
 		messages: []linebot.SendingMessage{
-			linebot.NewTextMessage("歷史紀錄 :\n" + texts),
+			newHistoryMessage(texts, userID, balanceLogs, currency),
 		},
 	}, nil
 }
 
-func (im *impl) depositMoney(args ...string) (*response, error) {
+func (im *impl) depositMoney(caller *commandCaller, args ...string) (*response, error) {
 	userID := args[0]
 
 	// get original balance first
-	originalBalance, err := im.wallet.GetBalance(userID)
+	originalBalance, err := im.wallet.GetBalance(caller.userID, userID)
 	if err == wallet.ErrWalletNotFound {
 		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
 	} else if err != nil {
 		logrus.WithField("err", err).Error("wallet.GetBalance failed in depositMoney")
 		return nil, err
 	}
 
-	reason := args[1]
-	amount, err := strconv.ParseInt(args[2], 10, 64)
-	if err != nil || (err == nil && amount < int64(0)) {
-		return nil, ErrInvalidArgument
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in depositMoney")
+		return nil, err
 	}
 
-	if err := im.wallet.Deposit(userID, amount, reason); err == wallet.ErrWalletNotFound {
+	reason, category, tags := parseReason(args[1])
+	m, err := parseMoney(args[2:], currency)
+	if err != nil {
+		return nil, err
+	}
+	amount := m.Amount
+
+	options := []wallet.RecordOption{
+		wallet.InCategory(category),
+		wallet.WithTags(tags...),
+		wallet.InCurrency(m.Currency),
+		wallet.WithIdempotencyKey(caller.idempotencyKey()),
+	}
+	if err := im.wallet.Deposit(caller.userID, userID, amount, reason, options...); err == wallet.ErrWalletNotFound {
 		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrCategoryNotFound {
+		return getCategoryNotFoundResponse(category), nil
+	} else if err == wallet.ErrInvalidTag {
+		return nil, ErrInvalidArgument
+	} else if err == wallet.ErrRateNotFound {
+		return getRateNotFoundResponse(m.Currency, currency), nil
+	} else if err == wallet.ErrDuplicateRequest {
+		return im.getRecordedReceiptResponse(caller, "儲值", userID, args[1], m, currency)
 	} else if err != nil {
 		logrus.WithField("err", err).Error("wallet.Deposit failed in depositMoney")
 		return nil, err
@@ -361,42 +770,73 @@ func (im *impl) depositMoney(args ...string) (*response, error) {
 
 	// get resulted balance after finish deposting
 	// as we have check if wallet does exist above, we don't need to specially handle here
-	resultedBalance, err := im.wallet.GetBalance(userID)
+	resultedBalance, err := im.wallet.GetBalance(caller.userID, userID)
 	if err != nil {
 		logrus.WithField("err", err).Error("wallet.GetBalance failed in depositMoney")
 		return nil, err
 	}
 
-	line1 := "上次餘額 " + strconv.FormatInt(originalBalance, 10) + "元"
-	line2 := reason + " +" + args[2] + "元"
-	line3 := "目前餘額 " + strconv.FormatInt(resultedBalance, 10) + "元"
+	receipt := newRecordReceipt(
+		"儲值", userID, args[1],
+		money.Money{Amount: amount, Currency: m.Currency},
+		money.Money{Amount: resultedBalance - originalBalance, Currency: currency},
+		originalBalance, resultedBalance,
+	)
 	return &response{
 		messages: []linebot.SendingMessage{
-			linebot.NewTextMessage(line1 + "\n" + line2 + "\n---\n" + line3),
+			receipt,
 		},
 	}, nil
 }
 
-func (im *impl) spendMoney(args ...string) (*response, error) {
+func (im *impl) spendMoney(caller *commandCaller, args ...string) (*response, error) {
 	userID := args[0]
 
 	// get original balance first
-	originalBalance, err := im.wallet.GetBalance(userID)
+	originalBalance, err := im.wallet.GetBalance(caller.userID, userID)
 	if err == wallet.ErrWalletNotFound {
 		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
 	} else if err != nil {
 		logrus.WithField("err", err).Error("wallet.GetBalance failed in spendMoney")
 		return nil, err
 	}
 
-	reason := args[1]
-	amount, err := strconv.ParseInt(args[2], 10, 64)
-	if err != nil || (err == nil && amount < int64(0)) {
-		return nil, ErrInvalidArgument
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in spendMoney")
+		return nil, err
 	}
 
-	if err := im.wallet.Spend(userID, amount, reason); err == wallet.ErrWalletNotFound {
+	reason, category, tags := parseReason(args[1])
+	m, err := parseMoney(args[2:], currency)
+	if err != nil {
+		return nil, err
+	}
+	amount := m.Amount
+
+	options := []wallet.RecordOption{
+		wallet.InCategory(category),
+		wallet.WithTags(tags...),
+		wallet.InCurrency(m.Currency),
+		wallet.WithIdempotencyKey(caller.idempotencyKey()),
+	}
+	if err := im.wallet.Spend(caller.userID, userID, amount, reason, options...); err == wallet.ErrWalletNotFound {
 		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrCategoryNotFound {
+		return getCategoryNotFoundResponse(category), nil
+	} else if err == wallet.ErrInvalidTag {
+		return nil, ErrInvalidArgument
+	} else if err == wallet.ErrInsufficientBalance {
+		return im.getInsufficientBalanceResponse(caller, userID)
+	} else if err == wallet.ErrRateNotFound {
+		return getRateNotFoundResponse(m.Currency, currency), nil
+	} else if err == wallet.ErrDuplicateRequest {
+		// budgets have been warned when the spending is recorded
+		return im.getRecordedReceiptResponse(caller, "花費", userID, args[1], money.Money{Amount: -1 * m.Amount, Currency: m.Currency}, currency)
 	} else if err != nil {
 		logrus.WithField("err", err).Error("wallet.Spend failed in spendMoney")
 		return nil, err
@@ -404,18 +844,166 @@ func (im *impl) spendMoney(args ...string) (*response, error) {
 
 	// get resulted balance after finish deposting
 	// as we have check if wallet does exist above, we don't need to specially handle here
-	resultedBalance, err := im.wallet.GetBalance(userID)
+	resultedBalance, err := im.wallet.GetBalance(caller.userID, userID)
 	if err != nil {
 		logrus.WithField("err", err).Error("wallet.GetBalance failed in spendMoney")
 		return nil, err
 	}
 
-	line1 := "上次餘額 " + strconv.FormatInt(originalBalance, 10) + "元"
-	line2 := reason + " -" + args[2] + "元"
-	line3 := "目前餘額 " + strconv.FormatInt(resultedBalance, 10) + "元"
+	// the amount that budgets count is in the currency of the wallet
+	if m.Currency != currency {
+		amount = originalBalance - resultedBalance
+	}
+
+	receipt := newRecordReceipt(
+		"花費", userID, args[1],
+		money.Money{Amount: -1 * m.Amount, Currency: m.Currency},
+		money.Money{Amount: -1 * amount, Currency: currency},
+		originalBalance, resultedBalance,
+	)
+	messages := []linebot.SendingMessage{
+		receipt,
+	}
+
+	// warn users if the spending crosses the budget
+	budgets, err := im.wallet.GetBudgets(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetBudgets failed in spendMoney")
+		return nil, err
+	}
+	if warnings := getBudgetWarnings(budgets, category, amount, currency); len(warnings) != 0 {
+		messages = append(messages, linebot.NewTextMessage(strings.Join(warnings, "\n")))
+	}
+
+	return &response{
+		messages: messages,
+	}, nil
+}
+
+// newRecordReceipt renders the receipt of depositing or spending, `text` is the reason that users typed
+func newRecordReceipt(title, userID, text string, amount, converted money.Money, originalBalance, resultedBalance int64) *linebot.FlexMessage {
+	line1 := "上次餘額 " + money.Format(originalBalance, converted.Currency)
+	line2 := text + " " + money.FormatSigned(amount.Amount, amount.Currency)
+	if amount.Currency != converted.Currency {
+		line2 += " (" + money.FormatSigned(converted.Amount, converted.Currency) + ")"
+	}
+	line3 := "目前餘額 " + money.Format(resultedBalance, converted.Currency)
+	return newReceiptMessage(line1+"\n"+line2+"\n---\n"+line3, title, userID, text, amount, converted, originalBalance, resultedBalance)
+}
+
+// getRecordedReceiptResponse replies the redelivered message with the receipt of the record that it has made,
+// `amount` is signed as it's typed, and the balances are the ones right after the record
+func (im *impl) getRecordedReceiptResponse(caller *commandCaller, title, userID, text string, amount money.Money, currency string) (*response, error) {
+	receipt, err := im.wallet.GetReceipt(caller.userID, userID, caller.idempotencyKey())
+	if err == wallet.ErrLogNotFound {
+		return getRecordedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetReceipt failed in getRecordedReceiptResponse")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			newRecordReceipt(
+				title, userID, text, amount,
+				money.Money{Amount: receipt.Log.Amount, Currency: currency},
+				receipt.Balance-receipt.Log.Amount, receipt.Balance,
+			),
+		},
+	}, nil
+}
+
+func (im *impl) transferMoney(caller *commandCaller, args ...string) (*response, error) {
+	fromUserID := args[0]
+	reason := args[1]
+	toUserID := args[2]
+
+	// the amount is in the currency of the source wallet
+	currency, err := im.wallet.GetCurrency(caller.userID, fromUserID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in transferMoney")
+		return nil, err
+	}
+
+	amount, err := parseAmount(args[3:], currency)
+	if err == wallet.ErrCurrencyMismatch {
+		return getCurrencyMismatchResponse(currency), nil
+	} else if err != nil {
+		return nil, err
+	} else if amount == int64(0) {
+		return nil, ErrInvalidArgument
+	}
+
+	if err := im.wallet.Transfer(
+		caller.userID, fromUserID, toUserID, amount, reason, wallet.WithIdempotencyKey(caller.idempotencyKey()),
+	); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrInvalidAmount {
+		return nil, ErrInvalidArgument
+	} else if err == wallet.ErrInvalidTransfer {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage("不能轉帳給同一個錢包唷"),
+			},
+		}, nil
+	} else if err == wallet.ErrInsufficientBalance {
+		return im.getInsufficientBalanceResponse(caller, fromUserID)
+	} else if err == wallet.ErrRateNotFound {
+		toCurrency, err := im.wallet.GetCurrency(caller.userID, toUserID)
+		if err != nil {
+			logrus.WithField("err", err).Error("wallet.GetCurrency failed in transferMoney")
+			return nil, err
+		}
+		return getRateNotFoundResponse(currency, toCurrency), nil
+	} else if err == wallet.ErrDuplicateRequest {
+		// the message is redelivered, so reply with the balances right after the transfer
+		receipt, err := im.wallet.GetReceipt(caller.userID, fromUserID, caller.idempotencyKey())
+		if err == wallet.ErrLogNotFound {
+			return getRecordedResponse(), nil
+		} else if err != nil {
+			logrus.WithField("err", err).Error("wallet.GetReceipt failed in transferMoney")
+			return nil, err
+		}
+		return im.getTransferResponse(caller, fromUserID, toUserID, reason, -1*receipt.Log.Amount, currency, receipt.Balance, receipt.CounterpartyBalance)
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.Transfer failed in transferMoney")
+		return nil, err
+	}
+
+	// get resulted balances after finish transferring
+	fromBalance, err := im.wallet.GetBalance(caller.userID, fromUserID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetBalance failed in transferMoney")
+		return nil, err
+	}
+	toBalance, err := im.wallet.GetBalance(caller.userID, toUserID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetBalance failed in transferMoney")
+		return nil, err
+	}
+	return im.getTransferResponse(caller, fromUserID, toUserID, reason, amount, currency, fromBalance, toBalance)
+}
+
+// getTransferResponse replies the transfer with the resulted balances of both wallets
+func (im *impl) getTransferResponse(caller *commandCaller, fromUserID, toUserID, reason string, amount int64, currency string, fromBalance, toBalance int64) (*response, error) {
+	toCurrency, err := im.wallet.GetCurrency(caller.userID, toUserID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in getTransferResponse")
+		return nil, err
+	}
+
+	line1 := fromUserID + " " + reason + " " + money.FormatSigned(-1*amount, currency) + " → " + toUserID
+	line2 := fromUserID + " 目前餘額 " + money.Format(fromBalance, currency)
+	line3 := toUserID + " 目前餘額 " + money.Format(toBalance, toCurrency)
 	return &response{
 		messages: []linebot.SendingMessage{
-			linebot.NewTextMessage(line1 + "\n" + line2 + "\n---\n" + line3),
+			linebot.NewTextMessage(line1 + "\n---\n" + line2 + "\n" + line3),
 		},
 	}, nil
 }
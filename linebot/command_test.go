@@ -0,0 +1,153 @@
+package linebot
+
+import (
+	"testing"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	testOwnerID  = "owner"
+	testViewerID = "viewer"
+	testGuestID  = "guest"
+)
+
+func newTestLinebot() *impl {
+	return &impl{
+		wallet: wl.NewMemoryWallet(),
+	}
+}
+
+// procText runs the command, and gets the text of the only message that is replied
+func procText(t *testing.T, im *impl, callerID, text string) string {
+	t.Helper()
+	response, err := im.procCommand(&commandCaller{userID: callerID}, text)
+	if err != nil {
+		t.Fatalf("procCommand(%s) failed: %v", text, err)
+	}
+	if len(response.messages) != 1 {
+		t.Fatalf("procCommand(%s) replied %d messages", text, len(response.messages))
+	}
+	message, ok := response.messages[0].(*linebot.TextMessage)
+	if !ok {
+		t.Fatalf("procCommand(%s) replied %T", text, response.messages[0])
+	}
+	return message.Text
+}
+
+// proc runs the command that may reply any message
+func proc(t *testing.T, im *impl, callerID, text string) {
+	t.Helper()
+	if _, err := im.procCommand(&commandCaller{userID: callerID}, text); err != nil {
+		t.Fatalf("procCommand(%s) failed: %v", text, err)
+	}
+}
+
+func expectText(t *testing.T, actual, expected string) {
+	t.Helper()
+	if actual != expected {
+		t.Fatalf("replied %q, expected %q", actual, expected)
+	}
+}
+
+func TestCreateWallet(t *testing.T) {
+	im := newTestLinebot()
+	expectText(t, procText(t, im, testOwnerID, "新增錢包 guachi"), "建立 guachi 的錢包成功")
+	expectText(t, procText(t, im, testOwnerID, "新增錢包 guachi"), "錢包已經存在囉")
+	expectText(t, procText(t, im, testOwnerID, "新增錢包 travel XXX"), "不支援幣別 XXX 唷")
+
+	if !im.wallet.IsWalletExist("guachi") || im.wallet.IsWalletExist("travel") {
+		t.Fatal("wallets are not created as commands say")
+	}
+}
+
+func TestRecordAndUndo(t *testing.T) {
+	im := newTestLinebot()
+	proc(t, im, testOwnerID, "新增錢包 guachi")
+	proc(t, im, testOwnerID, "guachi 薪水 + 1000")
+	proc(t, im, testOwnerID, "guachi 晚餐 - 120")
+
+	balance, err := im.wallet.GetBalance(testOwnerID, "guachi")
+	if err != nil {
+		t.Fatalf("GetBalance failed: %v", err)
+	}
+	if balance != 880 {
+		t.Fatalf("balance is %d, expected 880", balance)
+	}
+
+	// undo deletes the last log of the caller
+	proc(t, im, testOwnerID, "復原 guachi")
+	balance, err = im.wallet.GetBalance(testOwnerID, "guachi")
+	if err != nil {
+		t.Fatalf("GetBalance failed: %v", err)
+	}
+	if balance != 1000 {
+		t.Fatalf("balance after undo is %d, expected 1000", balance)
+	}
+}
+
+func TestRedeliveredMessage(t *testing.T) {
+	im := newTestLinebot()
+	proc(t, im, testOwnerID, "新增錢包 guachi")
+
+	// the redelivered message has the same IDs, so it's replied with the same receipt but not recorded again
+	caller := &commandCaller{userID: testOwnerID, webhookEventID: "event", messageID: "message"}
+	receipts := []string{}
+	for i := 0; i < 2; i++ {
+		res, err := im.procCommand(caller, "guachi 薪水 + 1000")
+		if err != nil {
+			t.Fatalf("procCommand failed: %v", err)
+		}
+		receipts = append(receipts, res.messages[0].(*linebot.FlexMessage).AltText)
+		proc(t, im, testOwnerID, "guachi 紅包 + 200")
+	}
+	if receipts[0] != "上次餘額 0元\n薪水 +1000元\n---\n目前餘額 1000元" || receipts[1] != receipts[0] {
+		t.Fatalf("the receipts are %q", receipts)
+	}
+
+	balance, err := im.wallet.GetBalance(testOwnerID, "guachi")
+	if err != nil {
+		t.Fatalf("GetBalance failed: %v", err)
+	}
+	if balance != 1400 {
+		t.Fatalf("balance is %d, expected 1400", balance)
+	}
+
+	// the transfer is replied with the balances right after it
+	proc(t, im, testOwnerID, "新增錢包 pay")
+	caller = &commandCaller{userID: testOwnerID, webhookEventID: "event-2", messageID: "message-2"}
+	for i := 0; i < 2; i++ {
+		res, err := im.procCommand(caller, "guachi 零用錢 轉帳 pay 100")
+		if err != nil {
+			t.Fatalf("procCommand failed: %v", err)
+		}
+		expectText(t, res.messages[0].(*linebot.TextMessage).Text, "guachi 零用錢 -100元 → pay\n---\nguachi 目前餘額 1300元\npay 目前餘額 100元")
+		proc(t, im, testOwnerID, "guachi 紅包 + 200")
+	}
+}
+
+func TestWalletNotFoundAndPermissionDenied(t *testing.T) {
+	im := newTestLinebot()
+	proc(t, im, testOwnerID, "新增錢包 guachi")
+
+	expectText(t, procText(t, im, testOwnerID, "刪除錢包 pay"), "錢包不存在，請先建立錢包")
+	expectText(t, procText(t, im, testGuestID, "刪除錢包 guachi"), "您沒有權限操作這個錢包唷")
+	expectText(t, procText(t, im, testGuestID, "guachi 晚餐 - 120"), "您沒有權限操作這個錢包唷")
+
+	// viewers can see the wallet, but they can't record
+	expectText(t, procText(t, im, testOwnerID, "新增成員 guachi viewer 檢視者"), "已將 viewer 設為 guachi 的檢視者")
+	proc(t, im, testViewerID, "查詢餘額 guachi")
+	expectText(t, procText(t, im, testViewerID, "guachi 晚餐 - 120"), "您沒有權限操作這個錢包唷")
+	expectText(t, procText(t, im, testViewerID, "查詢成員 guachi"), "guachi 的成員 :\n擁有者 owner\n檢視者 viewer")
+}
+
+func TestCommandNotExist(t *testing.T) {
+	im := newTestLinebot()
+	for _, text := range []string{"", "guachi", "新增錢包", "查詢餘額 guachi pay"} {
+		if _, err := im.procCommand(&commandCaller{userID: testOwnerID}, text); err != ErrCommandNotExist {
+			t.Fatalf("procCommand(%q) returned %v, expected ErrCommandNotExist", text, err)
+		}
+	}
+}
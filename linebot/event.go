@@ -0,0 +1,172 @@
+package linebot
+
+import (
+	"context"
+
+	"github.com/andy/guachi-pay-line-bot/scheduler"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// eventState is what handling the event has done so far
+type eventState struct {
+	// committed is true once a change of wallets or rules is made,
+	// and then the event isn't retried, as not every command can be repeated safely, ex: 復原
+	committed bool
+}
+
+// replyError occurs when replying or pushing messages fails,
+// the event isn't retried for it, as the command may have been done and only users don't know it
+type replyError struct {
+	err error
+}
+
+func (e *replyError) Error() string {
+	return "reply failed: " + e.err.Error()
+}
+
+// isRetryable checks if handling the event again can make a difference without repeating what has been done
+func isRetryable(err error, state *eventState) bool {
+	if err == nil || isUserError(err) || state.committed {
+		return false
+	}
+	_, ok := err.(*replyError)
+	return !ok
+}
+
+// committingWallet marks the event committed once a change of the wallet succeeds
+type committingWallet struct {
+	wl.Wallet
+	state *eventState
+}
+
+func (cw *committingWallet) commit(err error) error {
+	if err == nil {
+		cw.state.committed = true
+	}
+	return err
+}
+
+func (cw *committingWallet) WithContext(ctx context.Context) wl.Wallet {
+	return &committingWallet{Wallet: cw.Wallet.WithContext(ctx), state: cw.state}
+}
+
+func (cw *committingWallet) WithSource(sourceID string) wl.Wallet {
+	return &committingWallet{Wallet: cw.Wallet.WithSource(sourceID), state: cw.state}
+}
+
+func (cw *committingWallet) SetRate(base, quote string, timestamp int64, rate string) error {
+	return cw.commit(cw.Wallet.SetRate(base, quote, timestamp, rate))
+}
+
+func (cw *committingWallet) Create(callerID, userID string, options ...wl.CreateOption) error {
+	return cw.commit(cw.Wallet.Create(callerID, userID, options...))
+}
+
+func (cw *committingWallet) Delete(callerID, userID string) error {
+	return cw.commit(cw.Wallet.Delete(callerID, userID))
+}
+
+func (cw *committingWallet) EmptyBalance(callerID, userID string) error {
+	return cw.commit(cw.Wallet.EmptyBalance(callerID, userID))
+}
+
+func (cw *committingWallet) Deposit(callerID, userID string, amount int64, reason string, options ...wl.RecordOption) error {
+	return cw.commit(cw.Wallet.Deposit(callerID, userID, amount, reason, options...))
+}
+
+func (cw *committingWallet) Spend(callerID, userID string, amount int64, reason string, options ...wl.RecordOption) error {
+	return cw.commit(cw.Wallet.Spend(callerID, userID, amount, reason, options...))
+}
+
+func (cw *committingWallet) Transfer(callerID, fromUserID, toUserID string, amount int64, reason string, options ...wl.RecordOption) error {
+	return cw.commit(cw.Wallet.Transfer(callerID, fromUserID, toUserID, amount, reason, options...))
+}
+
+func (cw *committingWallet) UpdateLog(callerID, userID string, logID int64, amount int64, reason string) error {
+	return cw.commit(cw.Wallet.UpdateLog(callerID, userID, logID, amount, reason))
+}
+
+func (cw *committingWallet) DeleteLog(callerID, userID string, logID int64) error {
+	return cw.commit(cw.Wallet.DeleteLog(callerID, userID, logID))
+}
+
+func (cw *committingWallet) AddMember(callerID, userID, memberID string, role wl.Role) error {
+	return cw.commit(cw.Wallet.AddMember(callerID, userID, memberID, role))
+}
+
+func (cw *committingWallet) RemoveMember(callerID, userID, memberID string) error {
+	return cw.commit(cw.Wallet.RemoveMember(callerID, userID, memberID))
+}
+
+func (cw *committingWallet) AddCategory(callerID, userID, category string) error {
+	return cw.commit(cw.Wallet.AddCategory(callerID, userID, category))
+}
+
+func (cw *committingWallet) RemoveCategory(callerID, userID, category string) error {
+	return cw.commit(cw.Wallet.RemoveCategory(callerID, userID, category))
+}
+
+func (cw *committingWallet) SetBudget(callerID, userID, category string, limit int64) error {
+	return cw.commit(cw.Wallet.SetBudget(callerID, userID, category, limit))
+}
+
+func (cw *committingWallet) SetOverdraft(callerID, userID string, policy wl.OverdraftPolicy, limit int64) error {
+	return cw.commit(cw.Wallet.SetOverdraft(callerID, userID, policy, limit))
+}
+
+func (cw *committingWallet) Reconcile(callerID, userID string, repair bool) (*wl.Drift, error) {
+	drift, err := cw.Wallet.Reconcile(callerID, userID, repair)
+	if repair {
+		err = cw.commit(err)
+	}
+	return drift, err
+}
+
+// committingScheduler marks the event committed once a change of rules succeeds
+type committingScheduler struct {
+	scheduler.Scheduler
+	state *eventState
+}
+
+func (cs *committingScheduler) commit(err error) error {
+	if err == nil {
+		cs.state.committed = true
+	}
+	return err
+}
+
+func (cs *committingScheduler) WithContext(ctx context.Context) scheduler.Scheduler {
+	return &committingScheduler{Scheduler: cs.Scheduler.WithContext(ctx), state: cs.state}
+}
+
+func (cs *committingScheduler) WithSource(sourceID string) scheduler.Scheduler {
+	return &committingScheduler{Scheduler: cs.Scheduler.WithSource(sourceID), state: cs.state}
+}
+
+func (cs *committingScheduler) AddRule(callerID, userID string, amount int64, reason, spec string, options ...scheduler.AddRuleOption) (*scheduler.Rule, error) {
+	rule, err := cs.Scheduler.AddRule(callerID, userID, amount, reason, spec, options...)
+	return rule, cs.commit(err)
+}
+
+func (cs *committingScheduler) PauseRule(callerID string, ruleID int64) error {
+	return cs.commit(cs.Scheduler.PauseRule(callerID, ruleID))
+}
+
+func (cs *committingScheduler) ResumeRule(callerID string, ruleID int64) error {
+	return cs.commit(cs.Scheduler.ResumeRule(callerID, ruleID))
+}
+
+func (cs *committingScheduler) DeleteRule(callerID string, ruleID int64) error {
+	return cs.commit(cs.Scheduler.DeleteRule(callerID, ruleID))
+}
+
+// withEvent gets the linebot that records what handling an event has done in its state
+func (im *impl) withEvent() *impl {
+	bound := *im
+	bound.state = &eventState{}
+	bound.wallet = &committingWallet{Wallet: im.wallet, state: bound.state}
+	if im.scheduler != nil {
+		bound.scheduler = &committingScheduler{Scheduler: im.scheduler, state: bound.state}
+	}
+	return &bound
+}
@@ -0,0 +1,36 @@
+package linebot
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEventCommitted(t *testing.T) {
+	im := newTestLinebot()
+	proc(t, im, testOwnerID, "新增錢包 guachi")
+
+	// reading and refused changes commit nothing, so the event can be retried
+	bound := im.withEvent().withSource("")
+	proc(t, bound, testOwnerID, "查詢餘額 guachi")
+	expectText(t, procText(t, bound, testGuestID, "guachi 晚餐 - 120"), "您沒有權限操作這個錢包唷")
+	if bound.state.committed || !isRetryable(fmt.Errorf("timeout"), bound.state) {
+		t.Fatal("the event is committed without changes")
+	}
+	if isRetryable(ErrInvalidArgument, bound.state) || isRetryable(&replyError{err: fmt.Errorf("timeout")}, bound.state) {
+		t.Fatal("the event is retried for what retrying can't fix")
+	}
+
+	// once the change is made, the event isn't retried even if it fails later
+	proc(t, bound, testOwnerID, "guachi 晚餐 - 120")
+	if !bound.state.committed || isRetryable(fmt.Errorf("timeout"), bound.state) {
+		t.Fatal("the event isn't committed after the change")
+	}
+
+	// the state belongs to each event
+	if next := im.withEvent(); next.state.committed {
+		t.Fatal("the state of the last event is shared")
+	}
+	if _, ok := im.wallet.(*committingWallet); ok {
+		t.Fatal("the wallet of the linebot is changed by withEvent")
+	}
+}
@@ -0,0 +1,102 @@
+package linebot
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/download"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	// secondsPerDay is added to the end date, so that logs of the end date are exported as well
+	secondsPerDay = int64(24 * 60 * 60)
+)
+
+// getSignedLink gets the link of `path` followed by the wallet name, which is signed with the caller
+func (im *impl) getSignedLink(path, userID string, params url.Values) string {
+	// the wallet name is escaped in the link, and it's signed as it is
+	query := im.signer.Sign(path+userID, params)
+	return strings.TrimSuffix(im.baseURL, "/") + path + url.PathEscape(userID) + "?" + query.Encode()
+}
+
+// exportLogs replies a link to download logs of the wallet as a file, the link expires after a while
+func (im *impl) exportLogs(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	startTime, err := base.ParseToTimestamp(args[1])
+	if err != nil {
+		logrus.WithField("err", err).Error("parseToTimestamp failed in exportLogs")
+		return nil, ErrInvalidArgument
+	}
+	endTime, err := base.ParseToTimestamp(args[2])
+	if err != nil {
+		logrus.WithField("err", err).Error("parseToTimestamp failed in exportLogs")
+		return nil, ErrInvalidArgument
+	}
+	endTime += secondsPerDay
+	if startTime >= endTime {
+		return nil, ErrInvalidArgument
+	}
+
+	// logs are exported as CSV unless another format is given, ex: 匯出 guachi 2019/05/01 2019/05/31 beancount
+	format := wallet.ExportCSV
+	if len(args) > 3 {
+		format = wallet.ExportFormat(strings.ToLower(args[3]))
+		if !format.IsValid() {
+			return nil, ErrInvalidArgument
+		}
+	}
+
+	// check the role before the link is given, the role is checked again when the file is downloaded
+	if err := im.wallet.Authorize(caller.userID, userID, wallet.RoleViewer); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.Authorize failed in exportLogs")
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set(download.ParamCaller, caller.userID)
+	params.Set(download.ParamStart, strconv.FormatInt(startTime, 10))
+	params.Set(download.ParamEnd, strconv.FormatInt(endTime, 10))
+	params.Set(download.ParamFormat, string(format))
+
+	link := im.getSignedLink(download.ExportPath, userID, params)
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(userID + " " + args[1] + " ~ " + args[2] + " 的紀錄已經準備好了，請在一小時內下載:\n" + link),
+		},
+	}, nil
+}
+
+// importStatement replies a link to upload bank statements to the wallet, the link expires after a while
+func (im *impl) importStatement(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	// check the role before the link is given, the role is checked again when the file is uploaded
+	if err := im.wallet.Authorize(caller.userID, userID, wallet.RoleEditor); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.Authorize failed in importStatement")
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set(download.ParamCaller, caller.userID)
+	link := im.getSignedLink(download.ImportPath, userID, params)
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("請在一小時內上傳 " + userID + " 的銀行對帳單 (CSV/OFX/QIF)，已經匯入過的紀錄會自動略過:\n" + link),
+		},
+	}, nil
+}
@@ -0,0 +1,310 @@
+package linebot
+
+import (
+	"strconv"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// the rendering layer turns wallet results into Flex Messages,
+// and the text that used to be replied is kept as `altText`, which is shown in notifications and old clients
+
+const (
+	// maxAltTextLength is the limit of `altText` of LINE messages
+	maxAltTextLength = 400
+	// historyPageSize is the number of logs in a bubble of the history carousel
+	historyPageSize = 10
+	// maxHistoryPages is the limit of bubbles in a carousel, only the latest pages are displayed if there are more
+	maxHistoryPages = 10
+
+	flexColorIncome  = "#1DB446"
+	flexColorExpense = "#E53935"
+	flexColorMuted   = "#AAAAAA"
+)
+
+// flexRow is a line of `label ... value` in cards
+type flexRow struct {
+	label string
+	value string
+	// color is the color of the value, it's the default text color if it's empty
+	color string
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// truncateAltText cuts the text to fit `altText`, the text is counted in characters instead of bytes
+func truncateAltText(text string) string {
+	runes := []rune(text)
+	if len(runes) <= maxAltTextLength {
+		return text
+	}
+	return string(runes[:maxAltTextLength-1]) + "…"
+}
+
+// getAmountColor gets the color of the signed amount
+func getAmountColor(amount int64) string {
+	if amount < int64(0) {
+		return flexColorExpense
+	}
+	return flexColorIncome
+}
+
+func newFlexRow(row flexRow) *linebot.BoxComponent {
+	return &linebot.BoxComponent{
+		Type:   linebot.FlexComponentTypeBox,
+		Layout: linebot.FlexBoxLayoutTypeHorizontal,
+		Contents: []linebot.FlexComponent{
+			&linebot.TextComponent{
+				Type:  linebot.FlexComponentTypeText,
+				Text:  row.label,
+				Size:  linebot.FlexTextSizeTypeSm,
+				Color: flexColorMuted,
+				Flex:  intPtr(3),
+				Wrap:  true,
+			},
+			&linebot.TextComponent{
+				Type:  linebot.FlexComponentTypeText,
+				Text:  row.value,
+				Size:  linebot.FlexTextSizeTypeSm,
+				Color: row.color,
+				Align: linebot.FlexComponentAlignTypeEnd,
+				Flex:  intPtr(2),
+			},
+		},
+	}
+}
+
+func newSeparator() *linebot.SeparatorComponent {
+	return &linebot.SeparatorComponent{
+		Type:   linebot.FlexComponentTypeSeparator,
+		Margin: linebot.FlexComponentMarginTypeMd,
+	}
+}
+
+// newCardHeader is the header of cards, ex: `儲值` with `guachi` below it
+func newCardHeader(title, subtitle string) *linebot.BoxComponent {
+	return &linebot.BoxComponent{
+		Type:   linebot.FlexComponentTypeBox,
+		Layout: linebot.FlexBoxLayoutTypeVertical,
+		Contents: []linebot.FlexComponent{
+			&linebot.TextComponent{
+				Type:   linebot.FlexComponentTypeText,
+				Text:   title,
+				Size:   linebot.FlexTextSizeTypeXs,
+				Weight: linebot.FlexTextWeightTypeBold,
+				Color:  flexColorIncome,
+			},
+			&linebot.TextComponent{
+				Type:   linebot.FlexComponentTypeText,
+				Text:   subtitle,
+				Size:   linebot.FlexTextSizeTypeXl,
+				Weight: linebot.FlexTextWeightTypeBold,
+				Margin: linebot.FlexComponentMarginTypeSm,
+				Wrap:   true,
+			},
+		},
+	}
+}
+
+// newReceiptMessage renders the receipt after depositing or spending
+// `amount` is signed, and `converted` is the amount in the currency of the wallet if it's recorded in another currency
+func newReceiptMessage(altText, title, userID, reason string, amount, converted money.Money, originalBalance, resultedBalance int64) *linebot.FlexMessage {
+	rows := []linebot.FlexComponent{
+		newFlexRow(flexRow{label: "上次餘額", value: money.Format(originalBalance, converted.Currency)}),
+		newFlexRow(flexRow{label: reason, value: money.FormatSigned(amount.Amount, amount.Currency), color: getAmountColor(amount.Amount)}),
+	}
+	if amount.Currency != converted.Currency {
+		rows = append(rows, newFlexRow(flexRow{label: "換算", value: money.FormatSigned(converted.Amount, converted.Currency), color: getAmountColor(converted.Amount)}))
+	}
+	rows = append(rows,
+		newSeparator(),
+		&linebot.BoxComponent{
+			Type:   linebot.FlexComponentTypeBox,
+			Layout: linebot.FlexBoxLayoutTypeHorizontal,
+			Margin: linebot.FlexComponentMarginTypeMd,
+			Contents: []linebot.FlexComponent{
+				&linebot.TextComponent{
+					Type:   linebot.FlexComponentTypeText,
+					Text:   "目前餘額",
+					Size:   linebot.FlexTextSizeTypeMd,
+					Weight: linebot.FlexTextWeightTypeBold,
+				},
+				&linebot.TextComponent{
+					Type:   linebot.FlexComponentTypeText,
+					Text:   money.Format(resultedBalance, converted.Currency),
+					Size:   linebot.FlexTextSizeTypeMd,
+					Weight: linebot.FlexTextWeightTypeBold,
+					Align:  linebot.FlexComponentAlignTypeEnd,
+				},
+			},
+		},
+	)
+
+	return linebot.NewFlexMessage(truncateAltText(altText), &linebot.BubbleContainer{
+		Type:   linebot.FlexContainerTypeBubble,
+		Header: newCardHeader(title, userID),
+		Body: &linebot.BoxComponent{
+			Type:     linebot.FlexComponentTypeBox,
+			Layout:   linebot.FlexBoxLayoutTypeVertical,
+			Spacing:  linebot.FlexComponentSpacingTypeSm,
+			Contents: rows,
+		},
+	})
+}
+
+// newBalanceMessage renders the balance of the wallet
+func newBalanceMessage(altText, userID string, balance int64, currency string) *linebot.FlexMessage {
+	return linebot.NewFlexMessage(truncateAltText(altText), &linebot.BubbleContainer{
+		Type:   linebot.FlexContainerTypeBubble,
+		Header: newCardHeader("目前餘額", userID),
+		Body: &linebot.BoxComponent{
+			Type:   linebot.FlexComponentTypeBox,
+			Layout: linebot.FlexBoxLayoutTypeVertical,
+			Contents: []linebot.FlexComponent{
+				&linebot.TextComponent{
+					Type:   linebot.FlexComponentTypeText,
+					Text:   money.Format(balance, currency),
+					Size:   linebot.FlexTextSizeTypeXxl,
+					Weight: linebot.FlexTextWeightTypeBold,
+					Color:  getAmountColor(balance),
+					Align:  linebot.FlexComponentAlignTypeEnd,
+				},
+				&linebot.TextComponent{
+					Type:  linebot.FlexComponentTypeText,
+					Text:  currency,
+					Size:  linebot.FlexTextSizeTypeXs,
+					Color: flexColorMuted,
+					Align: linebot.FlexComponentAlignTypeEnd,
+				},
+			},
+		},
+	})
+}
+
+// newHistoryRow renders a log as the reason and the time on the left, and the amount on the right
+func newHistoryRow(balanceLog *wallet.BalanceLog, currency string) *linebot.BoxComponent {
+	reason := formatReason(balanceLog)
+	// the log is one side of a transfer
+	if balanceLog.CounterpartyID != "" && balanceLog.Amount < int64(0) {
+		reason += " → " + balanceLog.CounterpartyID
+	} else if balanceLog.CounterpartyID != "" {
+		reason += " ← " + balanceLog.CounterpartyID
+	}
+
+	amount := []linebot.FlexComponent{
+		&linebot.TextComponent{
+			Type:  linebot.FlexComponentTypeText,
+			Text:  money.FormatSigned(balanceLog.Amount, currency),
+			Size:  linebot.FlexTextSizeTypeSm,
+			Color: getAmountColor(balanceLog.Amount),
+			Align: linebot.FlexComponentAlignTypeEnd,
+		},
+	}
+	if balanceLog.Conversion != nil {
+		amount = append(amount, &linebot.TextComponent{
+			Type:  linebot.FlexComponentTypeText,
+			Text:  money.FormatSigned(balanceLog.Conversion.Amount, balanceLog.Conversion.Currency),
+			Size:  linebot.FlexTextSizeTypeXxs,
+			Color: flexColorMuted,
+			Align: linebot.FlexComponentAlignTypeEnd,
+		})
+	}
+
+	return &linebot.BoxComponent{
+		Type:   linebot.FlexComponentTypeBox,
+		Layout: linebot.FlexBoxLayoutTypeHorizontal,
+		Margin: linebot.FlexComponentMarginTypeMd,
+		Contents: []linebot.FlexComponent{
+			&linebot.BoxComponent{
+				Type:   linebot.FlexComponentTypeBox,
+				Layout: linebot.FlexBoxLayoutTypeVertical,
+				Flex:   intPtr(3),
+				Contents: []linebot.FlexComponent{
+					&linebot.TextComponent{
+						Type: linebot.FlexComponentTypeText,
+						Text: reason,
+						Size: linebot.FlexTextSizeTypeSm,
+						Wrap: true,
+					},
+					&linebot.TextComponent{
+						Type:  linebot.FlexComponentTypeText,
+						Text:  balanceLog.Timestamp,
+						Size:  linebot.FlexTextSizeTypeXxs,
+						Color: flexColorMuted,
+					},
+				},
+			},
+			&linebot.BoxComponent{
+				Type:     linebot.FlexComponentTypeBox,
+				Layout:   linebot.FlexBoxLayoutTypeVertical,
+				Flex:     intPtr(2),
+				Contents: amount,
+			},
+		},
+	}
+}
+
+// newHistoryMessage renders logs as a carousel, and every bubble is a page of `historyPageSize` logs
+// it returns nil if there is no log, as a carousel can't be empty
+func newHistoryMessage(altText, userID string, balanceLogs []*wallet.BalanceLog, currency string) *linebot.FlexMessage {
+	if len(balanceLogs) == 0 {
+		return nil
+	}
+
+	pages := (len(balanceLogs) + historyPageSize - 1) / historyPageSize
+	// logs are sorted by time, so the earlier pages are dropped
+	firstPage := 0
+	if pages > maxHistoryPages {
+		firstPage = pages - maxHistoryPages
+	}
+
+	bubbles := []*linebot.BubbleContainer{}
+	for page := firstPage; page < pages; page++ {
+		end := (page + 1) * historyPageSize
+		if end > len(balanceLogs) {
+			end = len(balanceLogs)
+		}
+
+		rows := []linebot.FlexComponent{}
+		for i, balanceLog := range balanceLogs[page*historyPageSize : end] {
+			if i != 0 {
+				rows = append(rows, newSeparator())
+			}
+			rows = append(rows, newHistoryRow(balanceLog, currency))
+		}
+
+		pageText := "第 " + strconv.Itoa(page+1) + " / " + strconv.Itoa(pages) + " 頁"
+		bubbles = append(bubbles, &linebot.BubbleContainer{
+			Type:   linebot.FlexContainerTypeBubble,
+			Header: newCardHeader("歷史紀錄", userID),
+			Body: &linebot.BoxComponent{
+				Type:     linebot.FlexComponentTypeBox,
+				Layout:   linebot.FlexBoxLayoutTypeVertical,
+				Contents: rows,
+			},
+			Footer: &linebot.BoxComponent{
+				Type:   linebot.FlexComponentTypeBox,
+				Layout: linebot.FlexBoxLayoutTypeVertical,
+				Contents: []linebot.FlexComponent{
+					&linebot.TextComponent{
+						Type:  linebot.FlexComponentTypeText,
+						Text:  pageText,
+						Size:  linebot.FlexTextSizeTypeXs,
+						Color: flexColorMuted,
+						Align: linebot.FlexComponentAlignTypeCenter,
+					},
+				},
+			},
+		})
+	}
+
+	return linebot.NewFlexMessage(truncateAltText(altText), &linebot.CarouselContainer{
+		Type:     linebot.FlexContainerTypeCarousel,
+		Contents: bubbles,
+	})
+}
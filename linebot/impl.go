@@ -1,8 +1,11 @@
 package linebot
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
@@ -11,12 +14,29 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/chart"
+	"github.com/andy/guachi-pay-line-bot/download"
+	"github.com/andy/guachi-pay-line-bot/inbox"
+	"github.com/andy/guachi-pay-line-bot/scheduler"
 	wl "github.com/andy/guachi-pay-line-bot/wallet"
 )
 
 type impl struct {
-	linebot *linebot.Client
-	wallet  wl.Wallet
+	linebot   *linebot.Client
+	wallet    wl.Wallet
+	scheduler scheduler.Scheduler
+	charts    chart.Store
+	signer    download.Signer
+	// baseURL is where this server is served, ex: https://guachi-pay.herokuapp.com
+	// it's used to build URLs of images that LINE fetches from this server
+	baseURL string
+	inbox   inbox.Inbox
+	// ctx cancels operations of the callback, ex: when the request times out
+	ctx context.Context
+	// pushTo is where replies are pushed to when the event is retried, as its reply token is expired
+	pushTo string
+	// state is what handling the event has done, it's nil unless the linebot is got by withEvent
+	state *eventState
 }
 
 func initLinebot() (*linebot.Client, error) {
@@ -36,6 +56,10 @@ func initLinebot() (*linebot.Client, error) {
 // NewLinebot creates a new Linebot interface
 func NewLinebot(
 	wallet wl.Wallet,
+	scheduler scheduler.Scheduler,
+	charts chart.Store,
+	signer download.Signer,
+	inbox inbox.Inbox,
 ) (Linebot, error) {
 	linebot, err := initLinebot()
 	if err != nil {
@@ -43,19 +67,131 @@ func NewLinebot(
 	}
 
 	return &impl{
-		linebot: linebot,
-		wallet:  wallet,
+		linebot:   linebot,
+		wallet:    wallet,
+		scheduler: scheduler,
+		charts:    charts,
+		signer:    signer,
+		baseURL:   os.Getenv("baseURL"),
+		inbox:     inbox,
+		ctx:       context.Background(),
 	}, nil
 }
 
-func (im *impl) handleEventTypePostback(replyToken string, postback *linebot.Postback) error {
+// withContext gets the linebot whose replies and operations to wallets, rules and the inbox are canceled with `ctx`
+func (im *impl) withContext(ctx context.Context) *impl {
+	bound := *im
+	bound.wallet = im.wallet.WithContext(ctx)
+	if im.scheduler != nil {
+		bound.scheduler = im.scheduler.WithContext(ctx)
+	}
+	if im.inbox != nil {
+		bound.inbox = im.inbox.WithContext(ctx)
+	}
+	bound.ctx = ctx
+	return &bound
+}
+
+// withSource gets the linebot whose operations to wallets and rules are from the group or the room,
+// or from a 1:1 chat if `sourceID` is empty
+func (im *impl) withSource(sourceID string) *impl {
+	bound := *im
+	bound.wallet = im.wallet.WithSource(sourceID)
+	if im.scheduler != nil {
+		bound.scheduler = im.scheduler.WithSource(sourceID)
+	}
+	return &bound
+}
+
+// reply replies messages of the event, or pushes them to where the event is from if the event is retried
+// the error is a replyError, so that the event isn't retried for it
+func (im *impl) reply(replyToken string, messages ...linebot.SendingMessage) error {
+	var err error
+	if im.pushTo != "" {
+		_, err = im.linebot.PushMessage(im.pushTo, messages...).WithContext(im.ctx).Do()
+	} else {
+		_, err = im.linebot.ReplyMessage(replyToken, messages...).WithContext(im.ctx).Do()
+	}
+	if err != nil {
+		return &replyError{err: err}
+	}
+	return nil
+}
+
+// getCommandCaller gets who triggers the event, and where the event is triggered from
+func getCommandCaller(source *linebot.EventSource) *commandCaller {
+	caller := &commandCaller{}
+	if source == nil {
+		return caller
+	}
+
+	caller.userID = source.UserID
+	switch source.Type {
+	case linebot.EventSourceTypeGroup:
+		caller.sourceID = source.GroupID
+	case linebot.EventSourceTypeRoom:
+		caller.sourceID = source.RoomID
+	}
+	return caller
+}
+
+// webhookEvent is what the SDK doesn't parse from events of the callback
+type webhookEvent struct {
+	WebhookEventID  string `json:"webhookEventId"`
+	DeliveryContext struct {
+		// IsRedelivery is true if LINE delivers the event again, as the callback didn't respond in time
+		IsRedelivery bool `json:"isRedelivery"`
+	} `json:"deliveryContext"`
+	// body is the JSON of the event, and it's recorded in the inbox
+	body []byte
+}
+
+// parseWebhookEvent parses the JSON of an event
+func parseWebhookEvent(body []byte) (*webhookEvent, error) {
+	event := &webhookEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, err
+	}
+	event.body = body
+	return event, nil
+}
+
+// parseWebhookEvents parses events of the callback body in the same order as ParseRequest does,
+// events are empty if the body can't be parsed, and then they are handled without webhook event IDs
+func parseWebhookEvents(body []byte) []*webhookEvent {
+	request := struct {
+		Events []json.RawMessage `json:"events"`
+	}{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		logrus.WithField("err", err).Warn("json.Unmarshal failed in parseWebhookEvents")
+		return []*webhookEvent{}
+	}
+
+	events := []*webhookEvent{}
+	for _, raw := range request.Events {
+		event, err := parseWebhookEvent(raw)
+		if err != nil {
+			logrus.WithField("err", err).Warn("parseWebhookEvent failed in parseWebhookEvents")
+			return []*webhookEvent{}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// isUserError checks if the event failed because of what users typed, and then handling it again makes no difference
+func isUserError(err error) bool {
+	return err == ErrCommandNotExist || err == ErrInvalidArgument || err == wl.ErrCurrencyMismatch
+}
+
+func (im *impl) handleEventTypePostback(replyToken string, caller *commandCaller, postback *linebot.Postback) error {
 	postbackReceiver := postbackReceiver{}
 	if err := json.Unmarshal([]byte(postback.Data), &postbackReceiver); err != nil {
 		logrus.WithField("err", err).Error("json.Unmarshal failed in handleEventTypePostback")
 
 		text := "系統錯誤，請重新試試"
-		if _, err := im.linebot.ReplyMessage(replyToken, linebot.NewTextMessage(text)).Do(); err != nil {
-			logrus.WithField("err", err).Warn("im.linebot.ReplyMessage failed in handleEventTypePostback")
+		if err := im.reply(replyToken, linebot.NewTextMessage(text)); err != nil {
+			logrus.WithField("err", err).Warn("im.reply failed in handleEventTypePostback")
 		}
 		return err
 	}
@@ -71,18 +207,18 @@ func (im *impl) handleEventTypePostback(replyToken string, postback *linebot.Pos
 	}
 
 	// modify to the valid message, and handle it
-	response, err := im.procCommand(text)
+	response, err := im.procCommand(caller, text)
 	if err != nil {
 		text := "系統錯誤，請重新試試"
-		if _, err := im.linebot.ReplyMessage(replyToken, linebot.NewTextMessage(text)).Do(); err != nil {
-			logrus.WithField("err", err).Warn("im.linebot.ReplyMessage failed in handleEventTypePostback")
+		if err := im.reply(replyToken, linebot.NewTextMessage(text)); err != nil {
+			logrus.WithField("err", err).Warn("im.reply failed in handleEventTypePostback")
 		}
 		return err
 	}
 
 	// we will reply back accroding to the response after processing the command
-	if _, err := im.linebot.ReplyMessage(replyToken, response.messages...).Do(); err != nil {
-		logrus.WithField("err", err).Error("ReplyMessage failed in handleEventTypePostback")
+	if err := im.reply(replyToken, response.messages...); err != nil {
+		logrus.WithField("err", err).Error("im.reply failed in handleEventTypePostback")
 		return err
 	}
 	return nil
@@ -100,21 +236,34 @@ func getHelpDesc(commandName string) string {
 	return command.helpDesc
 }
 
-func (im *impl) handleEventTypeMessage(replyToken string, messageInterface linebot.Message) error {
+func (im *impl) handleEventTypeMessage(replyToken string, caller *commandCaller, messageInterface linebot.Message) error {
 	switch message := messageInterface.(type) {
 	case *linebot.TextMessage:
+		caller.messageID = message.ID
 		texts := strings.Split(message.Text, " ")
 		// if the command looks like `help 查詢餘額`
 		if len(texts) == 2 && texts[0] == commandHelp {
 			commandName := texts[1]
 			// then, we will reply back helpDesc of this command
-			if _, err := im.linebot.ReplyMessage(replyToken, linebot.NewTextMessage(getHelpDesc(commandName))).Do(); err != nil {
-				logrus.WithField("err", err).Error("im.linebot.ReplyMessage failed in handleEventTypeMessage")
+			if err := im.reply(replyToken, linebot.NewTextMessage(getHelpDesc(commandName))); err != nil {
+				logrus.WithField("err", err).Error("im.reply failed in handleEventTypeMessage")
 				return err
 			}
 			return nil
 		} else if len(texts) == 1 && im.wallet.IsWalletExist(texts[0]) {
 			userID := texts[0]
+			// the wallet exists, but only its members are allowed to operate it
+			if err := im.wallet.Authorize(caller.userID, userID, wl.RoleViewer); err == wl.ErrPermissionDenied {
+				if err := im.reply(replyToken, getPermissionDeniedResponse().messages...); err != nil {
+					logrus.WithField("err", err).Error("im.reply failed in handleEventTypeMessage")
+					return err
+				}
+				return nil
+			} else if err != nil {
+				logrus.WithField("err", err).Error("im.wallet.Authorize failed in handleEventTypeMessage")
+				return err
+			}
+
 			message := linebot.NewTemplateMessage("欲知詳情", linebot.NewCarouselTemplate(
 				linebot.NewCarouselColumn("https://upload.cc/i1/2019/06/30/gsQh9N.jpg", "記帳", "選擇一個想做的事吧!",
 					linebot.NewMessageAction("儲值", "help 儲值"),
@@ -143,8 +292,8 @@ func (im *impl) handleEventTypeMessage(replyToken string, messageInterface lineb
 			))
 
 			// reply template message to user
-			if _, err := im.linebot.ReplyMessage(replyToken, message).Do(); err != nil {
-				logrus.WithField("err", err).Error("im.linebot.ReplyMessage failed in handleEventTypeMessage")
+			if err := im.reply(replyToken, message); err != nil {
+				logrus.WithField("err", err).Error("im.reply failed in handleEventTypeMessage")
 				return err
 			}
 			return nil
@@ -152,29 +301,29 @@ func (im *impl) handleEventTypeMessage(replyToken string, messageInterface lineb
 
 		// if `texts` from `linebot.TextMessage` doesn't match the cases above,
 		// then we check if it is the allowed command, and handle it
-		response, err := im.procCommand(message.Text)
+		response, err := im.procCommand(caller, message.Text)
 		if err != nil {
-			if _, err := im.linebot.ReplyMessage(replyToken, linebot.NewTextMessage(getHelpDesc(""))).Do(); err != nil {
-				logrus.WithField("err", err).Warn("im.linebot.ReplyMessage failed in handleEventTypeMessage")
+			if err := im.reply(replyToken, linebot.NewTextMessage(getHelpDesc(""))); err != nil {
+				logrus.WithField("err", err).Warn("im.reply failed in handleEventTypeMessage")
 			}
 			return err
 		}
 
 		// we will reply back accroding to the response after processing the command
-		if _, err := im.linebot.ReplyMessage(replyToken, response.messages...).Do(); err != nil {
-			logrus.WithField("err", err).Error("im.linebot.ReplyMessage failed in handleEventTypeMessage")
+		if err := im.reply(replyToken, response.messages...); err != nil {
+			logrus.WithField("err", err).Error("im.reply failed in handleEventTypeMessage")
 			return err
 		}
 	case *linebot.StickerMessage:
 		stickerMessage := linebot.NewStickerMessage(getSticker())
 		// we will reply back a sticker randomly if we get also a sticker
-		if _, err := im.linebot.ReplyMessage(replyToken, stickerMessage).Do(); err != nil {
-			logrus.WithField("err", err).Error("im.linebot.ReplyMessage failed in handleEventTypeMessage")
+		if err := im.reply(replyToken, stickerMessage); err != nil {
+			logrus.WithField("err", err).Error("im.reply failed in handleEventTypeMessage")
 			return err
 		}
 	default:
-		if _, err := im.linebot.ReplyMessage(replyToken, linebot.NewTextMessage(getHelpDesc(""))).Do(); err != nil {
-			logrus.WithField("err", err).Warn("im.linebot.ReplyMessage failed in handleEventTypeMessage")
+		if err := im.reply(replyToken, linebot.NewTextMessage(getHelpDesc(""))); err != nil {
+			logrus.WithField("err", err).Warn("im.reply failed in handleEventTypeMessage")
 		}
 	}
 	return nil
@@ -182,27 +331,151 @@ func (im *impl) handleEventTypeMessage(replyToken string, messageInterface lineb
 
 // ParseLinebotCallback parses the callback from line and do corresponding logic
 func (im *impl) ParseLinebotCallback(w http.ResponseWriter, r *http.Request) error {
+	return im.ParseLinebotCallbackContext(r.Context(), w, r)
+}
+
+func (im *impl) ParseLinebotCallbackContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	// the body is kept for parseWebhookEvents, as ParseRequest reads it
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logrus.WithField("err", err).Error("ioutil.ReadAll failed in ParseLinebotCallbackContext")
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
 	events, err := im.linebot.ParseRequest(r)
 	if err != nil {
-		logrus.WithField("err", err).Error("ParseRequest failed in ParseLinebotCallback")
+		logrus.WithField("err", err).Error("ParseRequest failed in ParseLinebotCallbackContext")
 		return err
 	}
+	webhookEvents := parseWebhookEvents(body)
 
-	for _, event := range events {
-		switch event.Type {
-		case linebot.EventTypeMessage:
-			if err := im.handleEventTypeMessage(event.ReplyToken, event.Message); err != nil {
-				logrus.WithField("err", err).Error("handleEventTypeMessage failed in ParseLinebotCallback")
-			}
-		case linebot.EventTypePostback:
-			if err := im.handleEventTypePostback(event.ReplyToken, event.Postback); err != nil {
-				logrus.WithField("err", err).Error("handleEventTypePostback failed in ParseLinebotCallback")
-			}
-		default:
-			if _, err := im.linebot.ReplyMessage(event.ReplyToken, linebot.NewTextMessage(getHelpDesc(""))).Do(); err != nil {
-				logrus.WithField("err", err).Warn("im.linebot.ReplyMessage failed in ParseLinebotCallback")
-			}
+	bound := im.withContext(ctx)
+	for i, event := range events {
+		webhookEvent := &webhookEvent{}
+		if i < len(webhookEvents) {
+			webhookEvent = webhookEvents[i]
+		}
+		bound.receiveEvent(event, webhookEvent)
+	}
+	return nil
+}
+
+// receiveEvent records the event in the inbox, and handles it unless it's received already
+// events without webhook event IDs are handled without the inbox, as they can't be told apart
+func (im *impl) receiveEvent(event *linebot.Event, webhookEvent *webhookEvent) {
+	eventID := webhookEvent.WebhookEventID
+	if im.inbox == nil || eventID == "" {
+		if err := im.handleEvent(event, webhookEvent); err != nil && !isUserError(err) {
+			logrus.WithField("err", err).Error("im.handleEvent failed in receiveEvent")
+		}
+		return
+	}
+
+	received, err := im.inbox.Receive(eventID, webhookEvent.body)
+	if err != nil {
+		// the event is handled anyway, as records of it are deduplicated by idempotency keys
+		logrus.WithField("err", err).Error("im.inbox.Receive failed in receiveEvent")
+		if err := im.handleEvent(event, webhookEvent); err != nil && !isUserError(err) {
+			logrus.WithField("err", err).Error("im.handleEvent failed in receiveEvent")
+		}
+		return
+	} else if !received {
+		logrus.WithFields(logrus.Fields{
+			"eventID":      eventID,
+			"isRedelivery": webhookEvent.DeliveryContext.IsRedelivery,
+		}).Info("duplicate event is skipped in receiveEvent")
+		return
+	}
+
+	// the status is recorded even if the request times out, so that the timed out event is retried
+	status := im.inbox.WithContext(context.Background())
+	bound := im.withEvent()
+	err = bound.handleEvent(event, webhookEvent)
+	if isRetryable(err, bound.state) {
+		logrus.WithFields(logrus.Fields{
+			"err":     err,
+			"eventID": eventID,
+		}).Error("im.handleEvent failed in receiveEvent")
+
+		// the failed event is retried by the inbox in background, as nothing is changed by it yet
+		if err := status.Fail(eventID, err); err != nil {
+			logrus.WithField("err", err).Error("im.inbox.Fail failed in receiveEvent")
+		}
+		return
+	} else if err != nil && !isUserError(err) {
+		// the event is done, as changes are committed or the reply is sent, and handling it again may repeat them
+		logrus.WithFields(logrus.Fields{
+			"err":       err,
+			"eventID":   eventID,
+			"committed": bound.state.committed,
+		}).Error("im.handleEvent failed after it's done in receiveEvent")
+	}
+
+	if err := status.Done(eventID); err != nil {
+		logrus.WithField("err", err).Error("im.inbox.Done failed in receiveEvent")
+	}
+}
+
+// handleEvent handles the event by its type
+func (im *impl) handleEvent(event *linebot.Event, webhookEvent *webhookEvent) error {
+	caller := getCommandCaller(event.Source)
+	caller.webhookEventID = webhookEvent.WebhookEventID
+	// wallets attached to a group or a room are only operated from it
+	bound := im.withSource(caller.sourceID)
+
+	switch event.Type {
+	case linebot.EventTypeMessage:
+		return bound.handleEventTypeMessage(event.ReplyToken, caller, event.Message)
+	case linebot.EventTypePostback:
+		return bound.handleEventTypePostback(event.ReplyToken, caller, event.Postback)
+	default:
+		if err := im.reply(event.ReplyToken, linebot.NewTextMessage(getHelpDesc(""))); err != nil {
+			logrus.WithField("err", err).Warn("im.reply failed in handleEvent")
 		}
 	}
 	return nil
 }
+
+// HandleEvent handles the event that is retried from the inbox,
+// replies are pushed to where the event is from, as the reply token expires soon after the event is delivered
+func (im *impl) HandleEvent(ctx context.Context, body []byte) error {
+	event := &linebot.Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		logrus.WithField("err", err).Error("json.Unmarshal failed in HandleEvent")
+		return err
+	}
+	webhookEvent, err := parseWebhookEvent(body)
+	if err != nil {
+		logrus.WithField("err", err).Error("parseWebhookEvent failed in HandleEvent")
+		return err
+	}
+
+	bound := im.withContext(ctx).withEvent()
+	caller := getCommandCaller(event.Source)
+	bound.pushTo = caller.userID
+	if caller.sourceID != "" {
+		bound.pushTo = caller.sourceID
+	}
+
+	// the inbox retries the event only if it returns an error
+	err = bound.handleEvent(event, webhookEvent)
+	if isRetryable(err, bound.state) {
+		return err
+	} else if err != nil && !isUserError(err) {
+		logrus.WithFields(logrus.Fields{
+			"err":       err,
+			"committed": bound.state.committed,
+		}).Error("bound.handleEvent failed after it's done in HandleEvent")
+	}
+	return nil
+}
+
+// Notify pushes a text message to a LINE user, group or room
+func (im *impl) Notify(to, text string) error {
+	if _, err := im.linebot.PushMessage(to, linebot.NewTextMessage(text)).WithContext(im.ctx).Do(); err != nil {
+		logrus.WithField("err", err).Error("im.linebot.PushMessage failed in Notify")
+		return err
+	}
+	return nil
+}
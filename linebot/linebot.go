@@ -1,6 +1,7 @@
 package linebot
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
@@ -66,4 +67,11 @@ func (receiver *postbackReceiver) toJSONBytes() []byte {
 type Linebot interface {
 	// ParseLinebotCallback parses the callback from line and do corresponding logic
 	ParseLinebotCallback(w http.ResponseWriter, r *http.Request) error
+	// ParseLinebotCallbackContext is ParseLinebotCallback whose replies and operations are canceled with `ctx`
+	ParseLinebotCallbackContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	// Notify pushes a text message to a LINE user, group or room
+	Notify(to, text string) error
+	// HandleEvent handles the event that is retried from the inbox, replies are pushed instead
+	// an error is returned only if nothing is changed by the event, so that retrying it doesn't repeat changes
+	HandleEvent(ctx context.Context, body []byte) error
 }
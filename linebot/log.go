@@ -0,0 +1,64 @@
+package linebot
+
+import (
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// undo deletes the last log that the caller recorded in the wallet
+func (im *impl) undo(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	balanceLog, err := im.wallet.GetLastLog(caller.userID, userID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrLogNotFound {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage("您在 " + userID + " 沒有可以復原的紀錄"),
+			},
+		}, nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetLastLog failed in undo")
+		return nil, err
+	}
+
+	if err := im.wallet.DeleteLog(caller.userID, userID, balanceLog.ID); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrInsufficientBalance {
+		// undoing a deposit or a transfer decreases the balance, so the overdraft policy is enforced as well
+		return im.getInsufficientBalanceResponse(caller, userID)
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.DeleteLog failed in undo")
+		return nil, err
+	}
+
+	balance, err := im.wallet.GetBalance(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetBalance failed in undo")
+		return nil, err
+	}
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in undo")
+		return nil, err
+	}
+
+	line1 := "已復原 " + balanceLog.Timestamp + " " + formatReason(balanceLog) + " " + money.FormatSigned(balanceLog.Amount, currency) + formatConversion(balanceLog.Conversion)
+	if balanceLog.CounterpartyID != "" {
+		line1 += "\n(與 " + balanceLog.CounterpartyID + " 之間的轉帳也一併復原)"
+	}
+	line2 := "目前餘額 " + money.Format(balance, currency)
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(line1 + "\n---\n" + line2),
+		},
+	}, nil
+}
@@ -0,0 +1,122 @@
+package linebot
+
+import (
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+var (
+	// roleNames maps the role name that users type to wallet.Role
+	roleNames = map[string]wallet.Role{
+		"擁有者": wallet.RoleOwner,
+		"編輯者": wallet.RoleEditor,
+		"檢視者": wallet.RoleViewer,
+	}
+)
+
+func getRoleName(role wallet.Role) string {
+	for name, r := range roleNames {
+		if r == role {
+			return name
+		}
+	}
+	return string(role)
+}
+
+func (im *impl) addMember(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	memberID := args[1]
+
+	// members are editors by default
+	role := wallet.RoleEditor
+	if len(args) == 3 {
+		r, ok := roleNames[args[2]]
+		if !ok {
+			return nil, ErrInvalidArgument
+		}
+		role = r
+	}
+
+	if err := im.wallet.AddMember(caller.userID, userID, memberID, role); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrInvalidRole {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage("成員只能是編輯者或檢視者唷"),
+			},
+		}, nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.AddMember failed in addMember")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("已將 " + memberID + " 設為 " + userID + " 的" + getRoleName(role)),
+		},
+	}, nil
+}
+
+func (im *impl) removeMember(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	memberID := args[1]
+	if err := im.wallet.RemoveMember(caller.userID, userID, memberID); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrMemberNotFound {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage(memberID + " 不是 " + userID + " 的成員"),
+			},
+		}, nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.RemoveMember failed in removeMember")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("已將 " + memberID + " 從 " + userID + " 移除"),
+		},
+	}, nil
+}
+
+func (im *impl) getMembers(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	members, err := im.wallet.GetMembers(caller.userID, userID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetMembers failed in getMembers")
+		return nil, err
+	}
+
+	texts := ""
+	for i, member := range members {
+		texts += getRoleName(member.Role) + " " + member.MemberID
+		if i != len(members)-1 {
+			texts += "\n"
+		}
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(userID + " 的成員 :\n" + texts),
+		},
+	}, nil
+}
+
+func (im *impl) getMyID(caller *commandCaller, args ...string) (*response, error) {
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(caller.userID),
+		},
+	}, nil
+}
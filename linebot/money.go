@@ -0,0 +1,58 @@
+package linebot
+
+import (
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// parseMoney parses the amount that users type, and the currency of the wallet is used if it's not given
+// the amount may be followed by its currency, ex: [`12.50`] or [`12.50`, `USD`]
+func parseMoney(texts []string, currency string) (money.Money, error) {
+	m, err := money.ParseMoney(strings.Join(texts, " "), currency)
+	if err != nil || m.Amount < int64(0) {
+		return money.Money{}, ErrInvalidArgument
+	}
+	return m, nil
+}
+
+// parseAmount parses the amount that users type into minor units of the currency of the wallet
+// wallet.ErrCurrencyMismatch is returned if the amount is in another currency
+func parseAmount(texts []string, currency string) (int64, error) {
+	m, err := parseMoney(texts, currency)
+	if err != nil {
+		return int64(0), err
+	}
+
+	if m.Currency != currency {
+		return int64(0), wallet.ErrCurrencyMismatch
+	}
+	return m.Amount, nil
+}
+
+// formatConversion formats how the log is converted, ex: ` (-500 JPY @ 0.22)`
+func formatConversion(conversion *wallet.Conversion) string {
+	if conversion == nil {
+		return ""
+	}
+	return " (" + money.FormatSigned(conversion.Amount, conversion.Currency) + " @ " + conversion.Rate.Value + ")"
+}
+
+func getRateNotFoundResponse(from, to string) *response {
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("找不到 " + from + " 對 " + to + " 的匯率，請先輸入:\n匯率 " + from + " " + to + "【匯率】"),
+		},
+	}
+}
+
+func getCurrencyMismatchResponse(currency string) *response {
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("這個錢包的幣別是 " + currency + "，請用 " + currency + " 記帳唷"),
+		},
+	}
+}
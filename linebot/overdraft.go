@@ -0,0 +1,115 @@
+package linebot
+
+import (
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+var (
+	// overdraftPolicyNames are the policy names that users type
+	overdraftPolicyNames = map[string]wallet.OverdraftPolicy{
+		"允許": wallet.OverdraftAllow,
+		"禁止": wallet.OverdraftForbid,
+	}
+)
+
+func formatOverdraft(overdraft *wallet.Overdraft, currency string) string {
+	switch overdraft.Policy {
+	case wallet.OverdraftForbid:
+		return "不允許透支"
+	case wallet.OverdraftLimit:
+		return "最多透支 " + money.Format(overdraft.Limit, currency)
+	default:
+		return "允許透支"
+	}
+}
+
+// getInsufficientBalanceResponse explains why the spending from user's wallet is refused
+func (im *impl) getInsufficientBalanceResponse(caller *commandCaller, userID string) (*response, error) {
+	overdraft, err := im.wallet.GetOverdraft(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetOverdraft failed in getInsufficientBalanceResponse")
+		return nil, err
+	}
+
+	balance, err := im.wallet.GetBalance(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetBalance failed in getInsufficientBalanceResponse")
+		return nil, err
+	}
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in getInsufficientBalanceResponse")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("餘額不足，" + userID + " " + formatOverdraft(overdraft, currency) + "\n目前餘額 " + money.Format(balance, currency)),
+		},
+	}, nil
+}
+
+func (im *impl) overdraft(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in overdraft")
+		return nil, err
+	}
+
+	// if the command looks like `透支 guachi`
+	// we will display the current overdraft policy
+	if len(args) == 1 {
+		overdraft, err := im.wallet.GetOverdraft(caller.userID, userID)
+		if err != nil {
+			logrus.WithField("err", err).Error("wallet.GetOverdraft failed in overdraft")
+			return nil, err
+		}
+
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage(userID + " 目前" + formatOverdraft(overdraft, currency)),
+			},
+		}, nil
+	}
+
+	// the policy is either one of `overdraftPolicyNames`, or the limit, ex: 透支 guachi 5000
+	policy, ok := overdraftPolicyNames[args[1]]
+	limit := int64(0)
+	if !ok {
+		l, err := parseAmount(args[1:], currency)
+		if err == wallet.ErrCurrencyMismatch {
+			return getCurrencyMismatchResponse(currency), nil
+		} else if err != nil || l == int64(0) {
+			return nil, ErrInvalidArgument
+		}
+		policy = wallet.OverdraftLimit
+		limit = l
+	}
+
+	if err := im.wallet.SetOverdraft(caller.userID, userID, policy, limit); err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == wallet.ErrInvalidOverdraft {
+		return nil, ErrInvalidArgument
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.SetOverdraft failed in overdraft")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("已設定 " + userID + " " + formatOverdraft(&wallet.Overdraft{Policy: policy, Limit: limit}, currency)),
+		},
+	}, nil
+}
@@ -0,0 +1,73 @@
+package linebot
+
+import (
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+func getInvalidCurrencyResponse() *response {
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("不支援這個幣別唷，請輸入像是 TWD、USD、JPY 的幣別"),
+		},
+	}
+}
+
+// setRate sets how much 1 unit of the base currency is worth in the quote currency
+// the rate applies from the given date, and it's today if the date is not given
+func (im *impl) setRate(caller *commandCaller, args ...string) (*response, error) {
+	timestamp := time.Now().Unix()
+	if len(args) > 3 {
+		t, err := base.ParseToTimestamp(args[3])
+		if err != nil {
+			logrus.WithField("err", err).Error("parseToTimestamp failed in setRate")
+			return nil, ErrInvalidArgument
+		}
+		timestamp = t
+	}
+
+	if err := im.wallet.SetRate(args[0], args[1], timestamp, args[2]); err == wallet.ErrInvalidCurrency {
+		return getInvalidCurrencyResponse(), nil
+	} else if err == wallet.ErrInvalidRate {
+		return nil, ErrInvalidArgument
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.SetRate failed in setRate")
+		return nil, err
+	}
+
+	rate, err := im.wallet.GetRate(args[0], args[1], timestamp)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetRate failed in setRate")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("設定成功 !\n" + base.ParseToyyymmdd(rate.Date) + " 起 1 " + rate.Base + " = " + rate.Value + " " + rate.Quote),
+		},
+	}, nil
+}
+
+// getRate gets the latest rate between two currencies
+func (im *impl) getRate(caller *commandCaller, args ...string) (*response, error) {
+	rate, err := im.wallet.GetRate(args[0], args[1], time.Now().Unix())
+	if err == wallet.ErrInvalidCurrency {
+		return getInvalidCurrencyResponse(), nil
+	} else if err == wallet.ErrRateNotFound {
+		return getRateNotFoundResponse(args[0], args[1]), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetRate failed in getRate")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("1 " + rate.Base + " = " + rate.Value + " " + rate.Quote + "\n(" + base.ParseToyyymmdd(rate.Date) + " 的匯率)"),
+		},
+	}, nil
+}
@@ -0,0 +1,65 @@
+package linebot
+
+import (
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	// reconcileRepair is the arg that users type to repair the drift
+	reconcileRepair = "修正"
+)
+
+func (im *impl) reconcile(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	repair := false
+	if len(args) == 2 {
+		if args[1] != reconcileRepair {
+			return nil, ErrInvalidArgument
+		}
+		repair = true
+	}
+
+	drift, err := im.wallet.Reconcile(caller.userID, userID, repair)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.Reconcile failed in reconcile")
+		return nil, err
+	}
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in reconcile")
+		return nil, err
+	}
+
+	balance := money.Format(drift.Balance, currency)
+	if drift.Amount() == int64(0) {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage("✅ " + userID + " 的餘額與紀錄一致，目前餘額 " + balance),
+			},
+		}, nil
+	}
+
+	text := "⚠️ " + userID + " 的餘額與紀錄不一致\n" +
+		"目前餘額 " + balance + "\n" +
+		"紀錄加總 " + money.Format(drift.Journal, currency) + "\n" +
+		"差額 " + money.Format(drift.Amount(), currency)
+	if drift.Repaired {
+		text += "\n---\n已新增一筆對帳調整紀錄"
+	} else {
+		text += "\n---\n輸入「對帳 " + userID + " " + reconcileRepair + "」可以新增一筆對帳調整紀錄"
+	}
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(text),
+		},
+	}, nil
+}
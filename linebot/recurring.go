@@ -0,0 +1,168 @@
+package linebot
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/scheduler"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+func getRuleNotFoundResponse() *response {
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("定期紀錄不存在"),
+		},
+	}
+}
+
+func formatRule(rule *scheduler.Rule, currency string) string {
+	reason := formatReason(&wallet.BalanceLog{
+		Reason:   rule.Reason,
+		Category: rule.Category,
+		Tags:     rule.Tags,
+	})
+
+	text := "#" + strconv.FormatInt(rule.ID, 10) + " " + rule.Schedule + " " + reason + " " + money.FormatSigned(rule.Amount, currency)
+	if rule.Paused {
+		return text + " (暫停中)"
+	}
+	return text + "\n下次執行 " + base.ParseToyyymmddhhmm(rule.NextRunAt)
+}
+
+func (im *impl) addRule(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	reason, category, tags := parseReason(args[1])
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in addRule")
+		return nil, err
+	}
+
+	amount, err := parseAmount(args[3:4], currency)
+	if err != nil || amount == int64(0) {
+		return nil, ErrInvalidArgument
+	}
+
+	switch args[2] {
+	case commandDepositMoney1, commandDepositMoney2:
+	case commandSpendMoney1, commandSpendMoney2:
+		amount = -1 * amount
+	default:
+		return nil, ErrInvalidArgument
+	}
+
+	options := []scheduler.AddRuleOption{
+		scheduler.WithCategory(category),
+		scheduler.WithTags(tags...),
+	}
+	// the result of each run is pushed to the group if the rule is added in it
+	if caller.sourceID != "" {
+		options = append(options, scheduler.WithNotifyID(caller.sourceID))
+	}
+
+	rule, err := im.scheduler.AddRule(caller.userID, userID, amount, reason, args[4], options...)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err == scheduler.ErrInvalidSchedule {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage("看不懂這個排程唷，請輸入 help 新增定期 查看範例"),
+			},
+		}, nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("scheduler.AddRule failed in addRule")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage("已新增定期紀錄\n" + formatRule(rule, currency)),
+		},
+	}, nil
+}
+
+func (im *impl) getRules(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	rules, err := im.scheduler.GetRules(caller.userID, userID)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("scheduler.GetRules failed in getRules")
+		return nil, err
+	}
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in getRules")
+		return nil, err
+	}
+
+	if len(rules) == 0 {
+		return &response{
+			messages: []linebot.SendingMessage{
+				linebot.NewTextMessage(userID + " 還沒有定期紀錄"),
+			},
+		}, nil
+	}
+
+	texts := []string{}
+	for _, rule := range rules {
+		texts = append(texts, formatRule(rule, currency))
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(userID + " 的定期紀錄 :\n" + strings.Join(texts, "\n\n")),
+		},
+	}, nil
+}
+
+// updateRule applies `updateFunc` to the rule, and replies `text` if it succeeds
+func (im *impl) updateRule(caller *commandCaller, ruleIDStr, text string, updateFunc func(callerID string, ruleID int64) error) (*response, error) {
+	ruleID, err := strconv.ParseInt(strings.TrimPrefix(ruleIDStr, "#"), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidArgument
+	}
+
+	if err := updateFunc(caller.userID, ruleID); err == scheduler.ErrRuleNotFound || err == wallet.ErrWalletNotFound {
+		return getRuleNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("updateFunc failed in updateRule")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(text + " #" + strconv.FormatInt(ruleID, 10)),
+		},
+	}, nil
+}
+
+func (im *impl) pauseRule(caller *commandCaller, args ...string) (*response, error) {
+	return im.updateRule(caller, args[0], "已暫停定期紀錄", im.scheduler.PauseRule)
+}
+
+func (im *impl) resumeRule(caller *commandCaller, args ...string) (*response, error) {
+	return im.updateRule(caller, args[0], "已恢復定期紀錄", im.scheduler.ResumeRule)
+}
+
+func (im *impl) deleteRule(caller *commandCaller, args ...string) (*response, error) {
+	return im.updateRule(caller, args[0], "已刪除定期紀錄", im.scheduler.DeleteRule)
+}
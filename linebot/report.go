@@ -0,0 +1,125 @@
+package linebot
+
+import (
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+var (
+	// reportRanges are the time ranges that users type, ex: 報表 guachi 本月
+	reportRanges = map[string]func(now time.Time) wallet.TimeRange{
+		"今天": func(now time.Time) wallet.TimeRange {
+			start, end := base.GetDayRange(now)
+			return wallet.TimeRange{Start: start, End: end}
+		},
+		"本週": func(now time.Time) wallet.TimeRange {
+			start, end := base.GetWeekRange(now)
+			return wallet.TimeRange{Start: start, End: end}
+		},
+		"上週": func(now time.Time) wallet.TimeRange {
+			start, end := base.GetWeekRange(now.AddDate(0, 0, -7))
+			return wallet.TimeRange{Start: start, End: end}
+		},
+		"本月": func(now time.Time) wallet.TimeRange {
+			start, end := base.GetMonthRange(now)
+			return wallet.TimeRange{Start: start, End: end}
+		},
+		"上月": func(now time.Time) wallet.TimeRange {
+			start, _ := base.GetMonthRange(now)
+			start, end := base.GetMonthRange(time.Unix(start, 0).AddDate(0, 0, -1))
+			return wallet.TimeRange{Start: start, End: end}
+		},
+		"今年": func(now time.Time) wallet.TimeRange {
+			start, end := base.GetYearRange(now)
+			return wallet.TimeRange{Start: start, End: end}
+		},
+	}
+
+	// reportGroupBys are the groupings that users type, ex: 報表 guachi 本月 每日
+	reportGroupBys = map[string]wallet.GroupBy{
+		"每日": wallet.GroupByDay,
+		"每週": wallet.GroupByWeek,
+		"每月": wallet.GroupByMonth,
+		"原因": wallet.GroupByReason,
+		"分類": wallet.GroupByCategory,
+	}
+)
+
+const (
+	// reportUncategorized is the name of the group of logs without category
+	reportUncategorized = "未分類"
+)
+
+func (im *impl) report(caller *commandCaller, args ...string) (*response, error) {
+	userID := args[0]
+	getRange, ok := reportRanges[args[1]]
+	if !ok {
+		return nil, ErrInvalidArgument
+	}
+
+	groupBy := wallet.GroupByCategory
+	if len(args) > 2 {
+		if groupBy, ok = reportGroupBys[args[2]]; !ok {
+			return nil, ErrInvalidArgument
+		}
+	}
+
+	summary, err := im.wallet.Summarize(caller.userID, userID, getRange(time.Now()), groupBy)
+	if err == wallet.ErrWalletNotFound {
+		return getWalletNotFoundResponse(), nil
+	} else if err == wallet.ErrPermissionDenied {
+		return getPermissionDeniedResponse(), nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("wallet.Summarize failed in report")
+		return nil, err
+	}
+
+	currency, err := im.wallet.GetCurrency(caller.userID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("wallet.GetCurrency failed in report")
+		return nil, err
+	}
+
+	return &response{
+		messages: []linebot.SendingMessage{
+			linebot.NewTextMessage(formatSummary(userID, args[1], summary, currency)),
+		},
+	}, nil
+}
+
+func formatSummary(userID, rangeName string, summary *wallet.Summary, currency string) string {
+	texts := userID + " " + rangeName + "報表\n"
+	// the end of the range is exclusive, so the last day is the day before it
+	texts += base.ParseToyyymmdd(summary.TimeRange.Start) + " ~ " + base.ParseToyyymmdd(summary.TimeRange.End-1) + "\n"
+	texts += "---\n"
+	texts += "收入 " + money.Format(summary.Income, currency) + "\n"
+	texts += "支出 " + money.Format(summary.Expense, currency) + "\n"
+	texts += "淨額 " + money.FormatSigned(summary.Net(), currency)
+
+	if len(summary.Groups) == 0 {
+		return texts + "\n---\n這段期間沒有任何收支紀錄"
+	}
+
+	texts += "\n---"
+	for _, group := range summary.Groups {
+		key := group.Key
+		if key == "" && summary.GroupBy == wallet.GroupByCategory {
+			key = reportUncategorized
+		}
+
+		texts += "\n" + key
+		if group.Income != int64(0) {
+			texts += " +" + money.Format(group.Income, currency)
+		}
+		if group.Expense != int64(0) {
+			texts += " -" + money.Format(group.Expense, currency)
+		}
+	}
+	return texts
+}
@@ -1,37 +1,110 @@
 package main
 
 import (
+	"os"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 
 	"github.com/andy/guachi-pay-line-bot/api"
+	"github.com/andy/guachi-pay-line-bot/chart"
+	"github.com/andy/guachi-pay-line-bot/db"
+	"github.com/andy/guachi-pay-line-bot/download"
+	ib "github.com/andy/guachi-pay-line-bot/inbox"
 	lb "github.com/andy/guachi-pay-line-bot/linebot"
+	sc "github.com/andy/guachi-pay-line-bot/scheduler"
 	wl "github.com/andy/guachi-pay-line-bot/wallet"
 )
 
+// defaultRequestTimeout is how long operations of a request can take unless requestTimeout is set
+const defaultRequestTimeout = 30 * time.Second
+
 func main() {
 	// set the standard logger formatter
 	logrus.SetFormatter(&logrus.TextFormatter{ForceColors: true})
 
-	wallet, err := wl.NewWallet()
+	// the wallet, the scheduler and the inbox share one connection pool of DATABASE_URL
+	dbSrv, err := db.NewSrv()
 	if err != nil {
-		logrus.Fatal("NewWallet failed")
+		logrus.Fatal("db.NewSrv failed")
+		return
+	}
+	defer dbSrv.Close()
+	wallet := wl.NewSQLWallet(dbSrv)
+
+	// run the admin command instead of serving if there is any, ex: ./guachi-pay-line-bot reconcile
+	if len(os.Args) > 1 {
+		if !runAdminCommand(dbSrv, wallet, os.Args[1:]) {
+			dbSrv.Close()
+			os.Exit(1)
+		}
 		return
 	}
 
-	linebot, err := lb.NewLinebot(wallet)
+	// pending migrations are applied before serving, so that the schema is what the code expects
+	if err := migrateSchema(dbSrv); err != nil {
+		logrus.Fatal("migrateSchema failed")
+		return
+	}
+
+	scheduler := sc.NewSQLScheduler(dbSrv, wallet)
+
+	// chart images are kept for a day, LINE fetches them again when users open old messages
+	charts := chart.NewStore(24 * time.Hour)
+
+	// download links are signed with the channel secret unless a secret is given for them
+	downloadSecret := os.Getenv("downloadSecret")
+	if downloadSecret == "" {
+		downloadSecret = os.Getenv("channelSecret")
+	}
+	signer := download.NewSigner(downloadSecret, time.Hour)
+
+	// webhook events are recorded in the inbox, so that redeliveries are skipped and failed events are retried
+	inbox := ib.NewSQLInbox(dbSrv)
+
+	linebot, err := lb.NewLinebot(wallet, scheduler, charts, signer, inbox)
 	if err != nil {
 		logrus.Fatal("NewLinebot failed")
 		return
 	}
 
+	// run recurring rules in background, and push the results through linebot
+	scheduler.Start(linebot)
+	defer scheduler.Stop()
+
+	// retry failed events in background, and push the replies through linebot
+	inbox.Start(linebot)
+	defer inbox.Stop()
+
 	gin.SetMode(gin.ReleaseMode)
 
+	// operations of each request are canceled after the timeout, ex: requestTimeout=10s
+	requestTimeout := defaultRequestTimeout
+	if value := os.Getenv("requestTimeout"); value != "" {
+		if requestTimeout, err = time.ParseDuration(value); err != nil {
+			logrus.Fatal("time.ParseDuration failed for requestTimeout")
+			return
+		}
+	}
+
 	route := gin.Default()
-	api.NewHandler(route, linebot)
+	api.NewHandler(route, linebot, wallet, charts, signer, api.WithRequestTimeout(requestTimeout))
 
 	logrus.Info("start serving https request")
 	route.Run()
 	return
 }
+
+func migrateSchema(dbSrv *db.DB) error {
+	migrations, err := db.Migrate(dbSrv)
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		logrus.WithField("version", migration.Version).Info("migration " + migration.Name + " is applied")
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package money
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultCurrency is the currency of wallets created before currencies were introduced
+	DefaultCurrency = "TWD"
+)
+
+var (
+	// ErrUnknownCurrency occurs when the currency code isn't one of the supported currencies
+	ErrUnknownCurrency = fmt.Errorf("unknown currency is found")
+	// ErrInvalidAmount occurs when the amount can't be parsed, or it has more decimal places than the currency allows
+	ErrInvalidAmount = fmt.Errorf("invalid amount is found")
+)
+
+// Currency defines how amounts of the currency are stored and displayed
+type Currency struct {
+	// Code is the ISO 4217 code, ex: USD
+	Code string
+	// Exponent is the number of decimal places of minor units, ex: 2 for USD as 1 USD is 100 cents
+	Exponent int
+	// Unit is displayed after the amount
+	Unit string
+}
+
+var (
+	// currencies are the supported currencies
+	// TWD has no minor unit, so amounts recorded before currencies were introduced remain the same
+	currencies = map[string]*Currency{
+		"TWD": &Currency{Code: "TWD", Exponent: 0, Unit: "元"},
+		"USD": &Currency{Code: "USD", Exponent: 2, Unit: " USD"},
+		"EUR": &Currency{Code: "EUR", Exponent: 2, Unit: " EUR"},
+		"GBP": &Currency{Code: "GBP", Exponent: 2, Unit: " GBP"},
+		"JPY": &Currency{Code: "JPY", Exponent: 0, Unit: " JPY"},
+		"KRW": &Currency{Code: "KRW", Exponent: 0, Unit: " KRW"},
+		"CNY": &Currency{Code: "CNY", Exponent: 2, Unit: " CNY"},
+		"HKD": &Currency{Code: "HKD", Exponent: 2, Unit: " HKD"},
+		"SGD": &Currency{Code: "SGD", Exponent: 2, Unit: " SGD"},
+		"THB": &Currency{Code: "THB", Exponent: 2, Unit: " THB"},
+	}
+	// currencyAliases are other names that users type
+	currencyAliases = map[string]string{
+		"NTD": "TWD",
+		"元":   "TWD",
+		"台幣":  "TWD",
+		"美金":  "USD",
+		"日圓":  "JPY",
+		"日幣":  "JPY",
+		"歐元":  "EUR",
+		"韓元":  "KRW",
+		"人民幣": "CNY",
+		"港幣":  "HKD",
+	}
+)
+
+// GetCurrency gets the currency by its code or alias, codes are case-insensitive
+func GetCurrency(code string) (*Currency, error) {
+	if alias, ok := currencyAliases[code]; ok {
+		code = alias
+	}
+
+	currency, ok := currencies[strings.ToUpper(code)]
+	if !ok {
+		return nil, ErrUnknownCurrency
+	}
+	return currency, nil
+}
+
+// Money is an amount in minor units of the currency, ex: {1250, USD} is 12.50 USD
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// ParseMoney parses text like `12.50 USD`, `12.50USD` or `12.50`
+// `defaultCurrency` is used if the text doesn't have a currency
+func ParseMoney(text, defaultCurrency string) (Money, error) {
+	text = strings.TrimSpace(text)
+	i := strings.IndexFunc(text, func(r rune) bool {
+		return !(r >= '0' && r <= '9') && r != '.' && r != '-' && r != '+'
+	})
+
+	code := defaultCurrency
+	if i != -1 {
+		code = strings.TrimSpace(text[i:])
+		text = strings.TrimSpace(text[:i])
+	}
+
+	currency, err := GetCurrency(code)
+	if err != nil {
+		return Money{}, err
+	}
+
+	amount, err := Parse(text, currency.Code)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: currency.Code}, nil
+}
+
+// Parse parses the decimal text like `12.50` into minor units of the currency without rounding
+func Parse(text, code string) (int64, error) {
+	currency, err := GetCurrency(code)
+	if err != nil {
+		return int64(0), err
+	}
+
+	// at most one sign is allowed, and the rest should be digits
+	negative := strings.HasPrefix(text, "-")
+	if negative || strings.HasPrefix(text, "+") {
+		text = text[1:]
+	}
+
+	parts := strings.SplitN(text, ".", 2)
+	integer := parts[0]
+	fraction := ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if integer == "" && fraction == "" || len(fraction) > currency.Exponent {
+		return int64(0), ErrInvalidAmount
+	}
+
+	digits := integer + fraction + strings.Repeat("0", currency.Exponent-len(fraction))
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return int64(0), ErrInvalidAmount
+		}
+	}
+
+	amount, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return int64(0), ErrInvalidAmount
+	}
+	if negative {
+		amount = -1 * amount
+	}
+	return amount, nil
+}
+
+// Format formats minor units of the currency, ex: 1250 USD is `12.50 USD`, and 120 TWD is `120元`
+func Format(amount int64, code string) string {
+	currency, err := GetCurrency(code)
+	if err != nil {
+		return strconv.FormatInt(amount, 10) + " " + code
+	}
+	return FormatDecimal(amount, currency.Code) + currency.Unit
+}
+
+// FormatDecimal formats minor units of the currency as a plain decimal without the unit, ex: 1250 USD is `12.50`
+// it's for machines, ex: exported files, and Parse parses it back
+func FormatDecimal(amount int64, code string) string {
+	currency, err := GetCurrency(code)
+	if err != nil {
+		return strconv.FormatInt(amount, 10)
+	}
+
+	sign := ""
+	if amount < int64(0) {
+		sign = "-"
+		amount = -1 * amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	if currency.Exponent == 0 {
+		return sign + digits
+	}
+
+	if len(digits) <= currency.Exponent {
+		digits = strings.Repeat("0", currency.Exponent-len(digits)+1) + digits
+	}
+	point := len(digits) - currency.Exponent
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// FormatSigned formats as Format does, and positive amounts are prefixed with `+`
+func FormatSigned(amount int64, code string) string {
+	if amount > int64(0) {
+		return "+" + Format(amount, code)
+	}
+	return Format(amount, code)
+}
+
+// String formats the money as Format does
+func (m Money) String() string {
+	return Format(m.Amount, m.Currency)
+}
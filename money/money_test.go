@@ -0,0 +1,119 @@
+package money
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text     string
+		code     string
+		expected int64
+		err      error
+	}{
+		{"120", "TWD", 120, nil},
+		{"+120", "TWD", 120, nil},
+		{"-120", "TWD", -120, nil},
+		{"12.50", "USD", 1250, nil},
+		{"12.5", "USD", 1250, nil},
+		{"12", "USD", 1200, nil},
+		{".5", "USD", 50, nil},
+		{"-0.05", "USD", -5, nil},
+		{"12.", "USD", 1200, nil},
+		{"12.50", "usd", 1250, nil},
+		{"12.50", "美金", 1250, nil},
+		{"120", "NTD", 120, nil},
+		// more decimal places than the currency allows
+		{"12.5", "TWD", 0, ErrInvalidAmount},
+		{"12.505", "USD", 0, ErrInvalidAmount},
+		// signs
+		{"--5", "TWD", 0, ErrInvalidAmount},
+		{"+-5", "TWD", 0, ErrInvalidAmount},
+		{"-+5", "TWD", 0, ErrInvalidAmount},
+		{"5-", "TWD", 0, ErrInvalidAmount},
+		{"-", "TWD", 0, ErrInvalidAmount},
+		// others that aren't numbers
+		{"", "TWD", 0, ErrInvalidAmount},
+		{".", "USD", 0, ErrInvalidAmount},
+		{"1.2.3", "USD", 0, ErrInvalidAmount},
+		{"1,000", "TWD", 0, ErrInvalidAmount},
+		{"12a", "TWD", 0, ErrInvalidAmount},
+		// overflow
+		{strconv.FormatInt(math.MaxInt64, 10), "TWD", math.MaxInt64, nil},
+		{"9223372036854775808", "TWD", 0, ErrInvalidAmount},
+		{"92233720368547758.08", "USD", 0, ErrInvalidAmount},
+		{"120", "XXX", 0, ErrUnknownCurrency},
+	}
+
+	for _, test := range tests {
+		amount, err := Parse(test.text, test.code)
+		if err != test.err || amount != test.expected {
+			t.Errorf("Parse(%q, %s) returned %d, %v, expected %d, %v", test.text, test.code, amount, err, test.expected, test.err)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Money
+		err      error
+	}{
+		{"120", Money{Amount: 120, Currency: "TWD"}, nil},
+		{"12.50 USD", Money{Amount: 1250, Currency: "USD"}, nil},
+		{"12.50USD", Money{Amount: 1250, Currency: "USD"}, nil},
+		{"1000 日幣", Money{Amount: 1000, Currency: "JPY"}, nil},
+		{"120元", Money{Amount: 120, Currency: "TWD"}, nil},
+		{"--12.50 USD", Money{}, ErrInvalidAmount},
+		{"12.50 XXX", Money{}, ErrUnknownCurrency},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMoney(test.text, DefaultCurrency)
+		if err != test.err || m != test.expected {
+			t.Errorf("ParseMoney(%q) returned %+v, %v, expected %+v, %v", test.text, m, err, test.expected, test.err)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		amount    int64
+		code      string
+		decimal   string
+		formatted string
+	}{
+		{120, "TWD", "120", "120元"},
+		{-120, "TWD", "-120", "-120元"},
+		{0, "TWD", "0", "0元"},
+		{1250, "USD", "12.50", "12.50 USD"},
+		{5, "USD", "0.05", "0.05 USD"},
+		{-5, "USD", "-0.05", "-0.05 USD"},
+		{0, "USD", "0.00", "0.00 USD"},
+		{1000, "JPY", "1000", "1000 JPY"},
+		{math.MaxInt64, "USD", "92233720368547758.07", "92233720368547758.07 USD"},
+	}
+
+	for _, test := range tests {
+		if decimal := FormatDecimal(test.amount, test.code); decimal != test.decimal {
+			t.Errorf("FormatDecimal(%d, %s) returned %q, expected %q", test.amount, test.code, decimal, test.decimal)
+		}
+		if formatted := Format(test.amount, test.code); formatted != test.formatted {
+			t.Errorf("Format(%d, %s) returned %q, expected %q", test.amount, test.code, formatted, test.formatted)
+		}
+
+		// the decimal is parsed back into the same amount
+		if amount, err := Parse(test.decimal, test.code); err != nil || amount != test.amount {
+			t.Errorf("Parse(%q, %s) returned %d, %v, expected %d", test.decimal, test.code, amount, err, test.amount)
+		}
+	}
+
+	if signed := FormatSigned(1250, "USD"); signed != "+12.50 USD" {
+		t.Errorf("FormatSigned returned %q", signed)
+	}
+	if formatted := Format(120, "XXX"); formatted != "120 XXX" {
+		t.Errorf("Format of the unknown currency returned %q", formatted)
+	}
+}
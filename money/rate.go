@@ -0,0 +1,68 @@
+package money
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	// rateDecimalPlaces is the number of decimal places that rates are formatted with
+	rateDecimalPlaces = 10
+)
+
+var (
+	// ErrInvalidRate occurs when the rate can't be parsed or it isn't positive
+	ErrInvalidRate = fmt.Errorf("invalid rate is found")
+)
+
+// ParseRate parses the decimal text like `31.5` into an exact rate
+func ParseRate(text string) (*big.Rat, error) {
+	rate, ok := new(big.Rat).SetString(strings.TrimSpace(text))
+	if !ok || rate.Sign() <= 0 {
+		return nil, ErrInvalidRate
+	}
+	return rate, nil
+}
+
+// FormatRate formats the rate as a decimal without trailing zeros
+func FormatRate(rate *big.Rat) string {
+	text := rate.FloatString(rateDecimalPlaces)
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	}
+	return text
+}
+
+// Convert converts minor units of `from` into minor units of `to`,
+// `rate` is how many `to` one `from` is worth, and the result is rounded half away from zero
+func Convert(amount int64, from, to string, rate *big.Rat) (int64, error) {
+	fromCurrency, err := GetCurrency(from)
+	if err != nil {
+		return int64(0), err
+	}
+	toCurrency, err := GetCurrency(to)
+	if err != nil {
+		return int64(0), err
+	}
+
+	// amount / 10^fromExponent * rate * 10^toExponent
+	result := new(big.Rat).SetInt64(amount)
+	result.Mul(result, rate)
+	result.Mul(result, new(big.Rat).SetFrac(pow10(toCurrency.Exponent), pow10(fromCurrency.Exponent)))
+
+	quotient, remainder := new(big.Int).QuoRem(result.Num(), result.Denom(), new(big.Int))
+	// round half away from zero, ex: 2.5 -> 3, -2.5 -> -3
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(result.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(result.Num().Sign())))
+	}
+
+	if !quotient.IsInt64() {
+		return int64(0), ErrInvalidAmount
+	}
+	return quotient.Int64(), nil
+}
+
+func pow10(exponent int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+}
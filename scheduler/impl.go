@@ -0,0 +1,444 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/db"
+	"github.com/andy/guachi-pay-line-bot/money"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	// RecurringRule related statements
+	insertRule = `
+		INSERT INTO "RecurringRule" ("userID", "ownerID", "notifyID", amount, reason, category, tags, schedule, "nextRunAt", paused)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, FALSE)
+		RETURNING id;
+	`
+	selectRule = `
+		SELECT
+			id, "userID", "ownerID", "notifyID", amount, reason, category, tags, schedule, "nextRunAt", paused
+		FROM
+			"RecurringRule"
+	`
+	getRule     = selectRule + `WHERE id = $1`
+	getRules    = selectRule + `WHERE "userID" = $1 ORDER BY id`
+	getDueRules = selectRule + `WHERE paused = FALSE AND "nextRunAt" <= $1 ORDER BY "nextRunAt"`
+	getAllRules = selectRule + `ORDER BY id`
+	// restoreRule keeps whether the rule is paused, as it's in the backup
+	restoreRule = `
+		INSERT INTO "RecurringRule" ("userID", "ownerID", "notifyID", amount, reason, category, tags, schedule, "nextRunAt", paused)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);
+	`
+	checkIfRulesExist = `SELECT 1 FROM "RecurringRule" LIMIT 1`
+	// a run is claimed by moving "nextRunAt" forward after it's recorded, so that it won't be run again
+	claimRun   = `UPDATE "RecurringRule" SET "nextRunAt" = $1 WHERE id = $2 AND "nextRunAt" = $3 AND paused = FALSE;`
+	pauseRule  = `UPDATE "RecurringRule" SET paused = TRUE WHERE id = $1;`
+	resumeRule = `UPDATE "RecurringRule" SET paused = FALSE, "nextRunAt" = $1 WHERE id = $2;`
+	deleteRule = `DELETE FROM "RecurringRule" WHERE id = $1`
+)
+
+const (
+	// tickInterval is how often the scheduler checks due rules
+	tickInterval = time.Minute
+	// tags are stored as a single string separated by tagSeparator
+	tagSeparator = ","
+)
+
+type impl struct {
+	db       *db.DB
+	wallet   wl.Wallet
+	notifier Notifier
+
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+// NewScheduler creates a new Scheduler interface
+func NewScheduler(wallet wl.Wallet) (Scheduler, error) {
+	dbSrv, err := db.NewSrv()
+	if err != nil {
+		return nil, fmt.Errorf("db.NewSrv failed in NewScheduler")
+	}
+	return NewSQLScheduler(dbSrv, wallet), nil
+}
+
+// NewSQLScheduler creates a new Scheduler interface stored in the database, which should be migrated
+func NewSQLScheduler(dbSrv *db.DB, wallet wl.Wallet) Scheduler {
+	return &impl{
+		db:       dbSrv,
+		wallet:   wallet,
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+}
+
+func (im *impl) WithContext(ctx context.Context) Scheduler {
+	return &impl{
+		db:       im.db.WithContext(ctx),
+		wallet:   im.wallet.WithContext(ctx),
+		notifier: im.notifier,
+		stop:     im.stop,
+		stopOnce: im.stopOnce,
+	}
+}
+
+func (im *impl) WithSource(sourceID string) Scheduler {
+	return &impl{
+		db:       im.db,
+		wallet:   im.wallet.WithSource(sourceID),
+		notifier: im.notifier,
+		stop:     im.stop,
+		stopOnce: im.stopOnce,
+	}
+}
+
+func scanRule(scanner interface {
+	Scan(dest ...interface{}) error
+}) (*Rule, error) {
+	rule := &Rule{}
+	tags := ""
+	if err := scanner.Scan(
+		&rule.ID, &rule.UserID, &rule.OwnerID, &rule.NotifyID, &rule.Amount,
+		&rule.Reason, &rule.Category, &tags, &rule.Schedule, &rule.NextRunAt, &rule.Paused,
+	); err != nil {
+		return nil, err
+	}
+
+	rule.Tags = []string{}
+	if tags != "" {
+		rule.Tags = strings.Split(tags, tagSeparator)
+	}
+	return rule, nil
+}
+
+func (im *impl) queryRules(query string, args ...interface{}) ([]*Rule, error) {
+	rows, err := im.db.Query(query, args...)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query failed in queryRules")
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*Rule{}
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			logrus.WithField("err", err).Error("scanRule failed in queryRules")
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// getAuthorizedRule gets the rule, and makes sure that the caller is an editor of its wallet
+func (im *impl) getAuthorizedRule(callerID string, ruleID int64) (*Rule, error) {
+	rule, err := scanRule(im.db.QueryRow(getRule, ruleID))
+	if err == sql.ErrNoRows {
+		return nil, ErrRuleNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("scanRule failed in getAuthorizedRule")
+		return nil, err
+	}
+
+	if err := im.wallet.Authorize(callerID, rule.UserID, wl.RoleEditor); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (im *impl) AddRule(callerID, userID string, amount int64, reason, spec string, options ...AddRuleOption) (*Rule, error) {
+	option := initAddRuleOption(options...)
+	if amount == int64(0) {
+		return nil, ErrInvalidAmount
+	}
+
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := im.wallet.Authorize(callerID, userID, wl.RoleEditor); err != nil {
+		return nil, err
+	}
+
+	notifyID := option.notifyID
+	if notifyID == "" {
+		notifyID = callerID
+	}
+
+	rule := &Rule{
+		UserID:    userID,
+		OwnerID:   callerID,
+		NotifyID:  notifyID,
+		Amount:    amount,
+		Reason:    reason,
+		Category:  option.category,
+		Tags:      option.tags,
+		Schedule:  spec,
+		NextRunAt: schedule.Next(time.Now()).Unix(),
+	}
+	if rule.Tags == nil {
+		rule.Tags = []string{}
+	}
+
+	if err := im.db.QueryRow(insertRule,
+		rule.UserID, rule.OwnerID, rule.NotifyID, rule.Amount, rule.Reason,
+		rule.Category, strings.Join(rule.Tags, tagSeparator), rule.Schedule, rule.NextRunAt,
+	).Scan(&rule.ID); err != nil {
+		logrus.WithField("err", err).Error("im.db.QueryRow(insertRule) failed in AddRule")
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (im *impl) GetRules(callerID, userID string) ([]*Rule, error) {
+	if err := im.wallet.Authorize(callerID, userID, wl.RoleViewer); err != nil {
+		return nil, err
+	}
+	return im.queryRules(getRules, userID)
+}
+
+func (im *impl) PauseRule(callerID string, ruleID int64) error {
+	if _, err := im.getAuthorizedRule(callerID, ruleID); err != nil {
+		return err
+	}
+
+	if _, err := im.db.Exec(pauseRule, ruleID); err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(pauseRule) failed in PauseRule")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) ResumeRule(callerID string, ruleID int64) error {
+	rule, err := im.getAuthorizedRule(callerID, ruleID)
+	if err != nil {
+		return err
+	}
+
+	schedule, err := ParseSchedule(rule.Schedule)
+	if err != nil {
+		return err
+	}
+
+	// runs missed during the pause are skipped
+	if _, err := im.db.Exec(resumeRule, schedule.Next(time.Now()).Unix(), ruleID); err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(resumeRule) failed in ResumeRule")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) DeleteRule(callerID string, ruleID int64) error {
+	if _, err := im.getAuthorizedRule(callerID, ruleID); err != nil {
+		return err
+	}
+
+	if _, err := im.db.Exec(deleteRule, ruleID); err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(deleteRule) failed in DeleteRule")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) Snapshot() ([]*Rule, error) {
+	return im.queryRules(getAllRules)
+}
+
+func (im *impl) Restore(rules []*Rule) error {
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in Restore")
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.WithField("err", err).Error("tx.Rollback failed in Restore")
+		}
+	}()
+
+	exist := 0
+	if err := tx.QueryRow(checkIfRulesExist).Scan(&exist); err == nil {
+		return wl.ErrStorageNotEmpty
+	} else if err != sql.ErrNoRows {
+		logrus.WithField("err", err).Error("tx.QueryRow(checkIfRulesExist) failed in Restore")
+		return err
+	}
+
+	for _, rule := range rules {
+		if !im.wallet.IsWalletExist(rule.UserID) {
+			return wl.ErrWalletNotFound
+		}
+		if _, err := tx.Exec(restoreRule,
+			rule.UserID, rule.OwnerID, rule.NotifyID, rule.Amount, rule.Reason,
+			rule.Category, strings.Join(rule.Tags, tagSeparator), rule.Schedule, rule.NextRunAt, rule.Paused,
+		); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(restoreRule) failed in Restore")
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit failed in Restore")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) Start(notifier Notifier) {
+	im.notifier = notifier
+
+	go func() {
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+
+		// run rules missed while the service was down right away
+		im.runDueRules()
+		for {
+			select {
+			case <-ticker.C:
+				im.runDueRules()
+			case <-im.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (im *impl) Stop() {
+	im.stopOnce.Do(func() {
+		close(im.stop)
+	})
+}
+
+func (im *impl) runDueRules() {
+	now := time.Now()
+	rules, err := im.queryRules(getDueRules, now.Unix())
+	if err != nil {
+		logrus.WithField("err", err).Error("im.queryRules(getDueRules) failed in runDueRules")
+		return
+	}
+
+	for _, rule := range rules {
+		im.runRule(rule, now)
+	}
+}
+
+// runRule runs the rule until it's not due, so that runs missed while the service was down are caught up
+func (im *impl) runRule(rule *Rule, now time.Time) {
+	schedule, err := ParseSchedule(rule.Schedule)
+	if err != nil {
+		logrus.WithField("ruleID", rule.ID).Error("ParseSchedule failed in runRule")
+		im.pauseWithNotice(rule, "排程格式錯誤")
+		return
+	}
+
+	for rule.NextRunAt <= now.Unix() {
+		runAt := rule.NextRunAt
+		nextRunAt := schedule.Next(time.Unix(runAt, 0)).Unix()
+
+		// the run is recorded with its own idempotency key before it's claimed, so a run that fails halfway
+		// is retried on the next tick, and a run that is recorded by others or before a crash isn't recorded twice
+		err := im.execRule(rule, runAt)
+		switch err {
+		case nil, wl.ErrDuplicateRequest:
+			if !im.claimRun(rule, runAt, nextRunAt) {
+				return
+			}
+			if err == nil {
+				im.notify(rule, "🔁 定期紀錄 #"+strconv.FormatInt(rule.ID, 10)+" 已執行\n"+im.formatRule(rule, runAt))
+			}
+		case wl.ErrWalletNotFound, wl.ErrPermissionDenied, wl.ErrCategoryNotFound:
+			// the rule will never succeed again, so we stop it
+			im.pauseWithNotice(rule, err.Error())
+			return
+		case wl.ErrInsufficientBalance:
+			// the rule may succeed next time, so we skip the run and only let users know
+			if !im.claimRun(rule, runAt, nextRunAt) {
+				return
+			}
+			im.notify(rule, "🔁 定期紀錄 #"+strconv.FormatInt(rule.ID, 10)+" 餘額不足，未執行\n"+im.formatRule(rule, runAt))
+		default:
+			// the run isn't claimed, so it's retried on the next tick
+			logrus.WithFields(logrus.Fields{
+				"err":    err,
+				"ruleID": rule.ID,
+			}).Error("im.execRule failed in runRule")
+			return
+		}
+	}
+}
+
+// claimRun moves the rule to the next run, it returns false if the run is claimed by others or fails,
+// in which case they will take care of the rest runs, or the rest runs are retried on the next tick
+func (im *impl) claimRun(rule *Rule, runAt, nextRunAt int64) bool {
+	result, err := im.db.Exec(claimRun, nextRunAt, rule.ID, runAt)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(claimRun) failed in claimRun")
+		return false
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in claimRun")
+		return false
+	} else if rowsAffected == int64(0) {
+		return false
+	}
+	rule.NextRunAt = nextRunAt
+	return true
+}
+
+// runKey is the idempotency key of the run of the rule at `runAt`
+func runKey(rule *Rule, runAt int64) string {
+	return "rule:" + strconv.FormatInt(rule.ID, 10) + ":" + strconv.FormatInt(runAt, 10)
+}
+
+func (im *impl) execRule(rule *Rule, runAt int64) error {
+	options := []wl.RecordOption{
+		wl.InCategory(rule.Category),
+		wl.WithTags(rule.Tags...),
+		wl.WithTimestamp(runAt),
+		wl.WithIdempotencyKey(runKey(rule, runAt)),
+	}
+	if rule.Amount > int64(0) {
+		return im.wallet.Deposit(rule.OwnerID, rule.UserID, rule.Amount, rule.Reason, options...)
+	}
+	return im.wallet.Spend(rule.OwnerID, rule.UserID, -1*rule.Amount, rule.Reason, options...)
+}
+
+func (im *impl) pauseWithNotice(rule *Rule, reason string) {
+	if _, err := im.db.Exec(pauseRule, rule.ID); err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(pauseRule) failed in pauseWithNotice")
+		return
+	}
+	im.notify(rule, "🔁 定期紀錄 #"+strconv.FormatInt(rule.ID, 10)+" 無法執行，已暫停 ("+reason+")")
+}
+
+func (im *impl) notify(rule *Rule, text string) {
+	if im.notifier == nil {
+		return
+	}
+
+	if err := im.notifier.Notify(rule.NotifyID, text); err != nil {
+		logrus.WithField("err", err).Warn("im.notifier.Notify failed in notify")
+	}
+}
+
+func (im *impl) formatRule(rule *Rule, runAt int64) string {
+	currency, err := im.wallet.GetCurrency(rule.OwnerID, rule.UserID)
+	if err != nil {
+		logrus.WithField("err", err).Warn("wallet.GetCurrency failed in formatRule")
+		currency = money.DefaultCurrency
+	}
+	return base.ParseToyyymmddhhmm(runAt) + " " + rule.UserID + " " + rule.Reason + " " + money.FormatSigned(rule.Amount, currency)
+}
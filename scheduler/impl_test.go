@@ -0,0 +1,105 @@
+package scheduler
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// flakyWallet fails deposits until `failures` runs out, like the database is down for a while
+type flakyWallet struct {
+	wl.Wallet
+	failures int
+}
+
+func (fw *flakyWallet) Deposit(callerID, userID string, amount int64, reason string, options ...wl.RecordOption) error {
+	if fw.failures > 0 {
+		fw.failures--
+		return fmt.Errorf("the database is down")
+	}
+	return fw.Wallet.Deposit(callerID, userID, amount, reason, options...)
+}
+
+func newTestScheduler(t *testing.T, failures int) (*impl, *flakyWallet) {
+	dbSrv, err := db.Open("sqlite://" + filepath.Join(t.TempDir(), "wallet.db"))
+	if err != nil {
+		t.Fatalf("db.Open failed: %v", err)
+	}
+	t.Cleanup(func() {
+		dbSrv.Close()
+	})
+	if _, err := db.Migrate(dbSrv); err != nil {
+		t.Fatalf("db.Migrate failed: %v", err)
+	}
+
+	wallet := &flakyWallet{Wallet: wl.NewSQLWallet(dbSrv), failures: failures}
+	if err := wallet.Create("owner", "guachi"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	return NewSQLScheduler(dbSrv, wallet).(*impl), wallet
+}
+
+// addDueRule adds a daily rule whose last `runs` runs are missed
+func addDueRule(t *testing.T, im *impl, runs int) *Rule {
+	rule, err := im.AddRule("owner", "guachi", 100, "零用錢", "每天")
+	if err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	rule.NextRunAt -= int64(runs) * int64(24*time.Hour/time.Second)
+	if _, err := im.db.Exec(`UPDATE "RecurringRule" SET "nextRunAt" = $1 WHERE id = $2`, rule.NextRunAt, rule.ID); err != nil {
+		t.Fatalf("updating nextRunAt failed: %v", err)
+	}
+	return rule
+}
+
+func expectRun(t *testing.T, im *impl, rule *Rule, balance, nextRunAt int64) {
+	t.Helper()
+	actual, err := im.wallet.GetBalance("owner", "guachi")
+	if err != nil {
+		t.Fatalf("GetBalance failed: %v", err)
+	}
+	rules, err := im.GetRules("owner", "guachi")
+	if err != nil {
+		t.Fatalf("GetRules failed: %v", err)
+	}
+	if actual != balance || rules[0].NextRunAt != nextRunAt {
+		t.Fatalf("balance is %d and the next run is at %d, expected %d and %d", actual, rules[0].NextRunAt, balance, nextRunAt)
+	}
+}
+
+func TestRunRuleRetriesFailedRun(t *testing.T) {
+	im, wallet := newTestScheduler(t, 1)
+	rule := addDueRule(t, im, 2)
+	runAt := rule.NextRunAt
+	day := int64(24 * time.Hour / time.Second)
+
+	// the failed run isn't claimed, so it isn't lost
+	im.runDueRules()
+	expectRun(t, im, rule, 0, runAt)
+
+	im.runDueRules()
+	expectRun(t, im, rule, 200, runAt+2*day)
+	if wallet.failures != 0 {
+		t.Fatalf("%d failures are left", wallet.failures)
+	}
+}
+
+func TestRunRuleRecordsOnce(t *testing.T) {
+	im, _ := newTestScheduler(t, 0)
+	rule := addDueRule(t, im, 1)
+	runAt := rule.NextRunAt
+
+	// the run is recorded but not claimed, ex: the service crashes in between
+	if err := im.execRule(rule, runAt); err != nil {
+		t.Fatalf("execRule failed: %v", err)
+	}
+
+	im.runDueRules()
+	expectRun(t, im, rule, 100, runAt+int64(24*time.Hour/time.Second))
+}
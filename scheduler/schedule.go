@@ -0,0 +1,260 @@
+package scheduler
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// runHour is the hour of the day that daily, weekly and monthly rules run at
+	runHour = 9
+	// cronMaxIterations prevents an impossible cron expression from looping forever
+	cronMaxIterations = 100000
+)
+
+var (
+	weekdayNames = map[string]time.Weekday{
+		"日": time.Sunday,
+		"天": time.Sunday,
+		"一": time.Monday,
+		"二": time.Tuesday,
+		"三": time.Wednesday,
+		"四": time.Thursday,
+		"五": time.Friday,
+		"六": time.Saturday,
+	}
+)
+
+// Schedule decides when a rule runs, all times are based on Asia/Taipei zone
+type Schedule interface {
+	// Next gets the first run time that is after `t`
+	Next(t time.Time) time.Time
+}
+
+// ParseSchedule parses the schedule that users type
+//
+// allowed formats:
+// (1) daily: 每天, daily
+// (2) weekly: 每週一 ~ 每週日, weekly:0 ~ weekly:6 (0 is Sunday)
+// (3) monthly: 每月1號 ~ 每月31號, monthly:1 ~ monthly:31 (the last day is used if the month is shorter)
+// (4) cron-like: cron:0_9_*_*_1 (fields are minute, hour, day, month and weekday, separated by `_` or spaces)
+func ParseSchedule(spec string) (Schedule, error) {
+	var schedule Schedule
+	switch {
+	case spec == "每天" || spec == "daily":
+		schedule = &dailySchedule{}
+	case strings.HasPrefix(spec, "每週"):
+		weekday, ok := weekdayNames[strings.TrimPrefix(spec, "每週")]
+		if !ok {
+			return nil, ErrInvalidSchedule
+		}
+		schedule = &weeklySchedule{weekday: weekday}
+	case strings.HasPrefix(spec, "weekly:"):
+		weekday, err := strconv.Atoi(strings.TrimPrefix(spec, "weekly:"))
+		if err != nil || weekday < 0 || weekday > 6 {
+			return nil, ErrInvalidSchedule
+		}
+		schedule = &weeklySchedule{weekday: time.Weekday(weekday)}
+	case strings.HasPrefix(spec, "每月") && strings.HasSuffix(spec, "號"):
+		day, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(spec, "每月"), "號"))
+		if err != nil || day < 1 || day > 31 {
+			return nil, ErrInvalidSchedule
+		}
+		schedule = &monthlySchedule{day: day}
+	case strings.HasPrefix(spec, "monthly:"):
+		day, err := strconv.Atoi(strings.TrimPrefix(spec, "monthly:"))
+		if err != nil || day < 1 || day > 31 {
+			return nil, ErrInvalidSchedule
+		}
+		schedule = &monthlySchedule{day: day}
+	case strings.HasPrefix(spec, "cron:"):
+		cron, err := parseCron(strings.TrimPrefix(spec, "cron:"))
+		if err != nil {
+			return nil, err
+		}
+		schedule = cron
+	default:
+		return nil, ErrInvalidSchedule
+	}
+
+	// the schedule never runs, ex: cron:0_0_31_2_*
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, ErrInvalidSchedule
+	}
+	return schedule, nil
+}
+
+func getLocation() *time.Location {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	return location
+}
+
+type dailySchedule struct{}
+
+func (schedule *dailySchedule) Next(t time.Time) time.Time {
+	t = t.In(getLocation())
+	next := time.Date(t.Year(), t.Month(), t.Day(), runHour, 0, 0, 0, t.Location())
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+type weeklySchedule struct {
+	weekday time.Weekday
+}
+
+func (schedule *weeklySchedule) Next(t time.Time) time.Time {
+	t = t.In(getLocation())
+	days := (int(schedule.weekday) - int(t.Weekday()) + 7) % 7
+	next := time.Date(t.Year(), t.Month(), t.Day()+days, runHour, 0, 0, 0, t.Location())
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+type monthlySchedule struct {
+	day int
+}
+
+func (schedule *monthlySchedule) Next(t time.Time) time.Time {
+	t = t.In(getLocation())
+	for months := 0; ; months++ {
+		firstDay := time.Date(t.Year(), t.Month()+time.Month(months), 1, runHour, 0, 0, 0, t.Location())
+		// use the last day of the month if the month doesn't have the day
+		lastDay := firstDay.AddDate(0, 1, -1).Day()
+		day := schedule.day
+		if day > lastDay {
+			day = lastDay
+		}
+
+		next := time.Date(firstDay.Year(), firstDay.Month(), day, runHour, 0, 0, 0, t.Location())
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+// cronSchedule is a cron expression, each field is a bitset of allowed values
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// like cron, if both days and weekdays are restricted, either of them matches is fine
+	daysRestricted     bool
+	weekdaysRestricted bool
+}
+
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(strings.Replace(expression, "_", " ", -1))
+	if len(fields) != 5 {
+		return nil, ErrInvalidSchedule
+	}
+
+	cron := &cronSchedule{
+		daysRestricted:     fields[2] != "*",
+		weekdaysRestricted: fields[4] != "*",
+	}
+	bounds := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{bits: &cron.minutes, min: 0, max: 59},
+		{bits: &cron.hours, min: 0, max: 23},
+		{bits: &cron.days, min: 1, max: 31},
+		{bits: &cron.months, min: 1, max: 12},
+		// 7 is also Sunday
+		{bits: &cron.weekdays, min: 0, max: 7},
+	}
+	for i, bound := range bounds {
+		bits, err := parseCronField(fields[i], bound.min, bound.max)
+		if err != nil {
+			return nil, err
+		}
+		*bound.bits = bits
+	}
+
+	if cron.weekdays&(1<<7) != 0 {
+		cron.weekdays |= 1 << 0
+	}
+	return cron, nil
+}
+
+// parseCronField parses a field like `*`, `*/5`, `1,15`, `1-5` or `0-30/10`
+func parseCronField(field string, min, max int) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, ErrInvalidSchedule
+			}
+			step = s
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			s, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, ErrInvalidSchedule
+			}
+			start, end = s, s
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, ErrInvalidSchedule
+				}
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, ErrInvalidSchedule
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func (cron *cronSchedule) matchDay(t time.Time) bool {
+	dayMatched := cron.days&(1<<uint(t.Day())) != 0
+	weekdayMatched := cron.weekdays&(1<<uint(t.Weekday())) != 0
+	if cron.daysRestricted && cron.weekdaysRestricted {
+		return dayMatched || weekdayMatched
+	}
+	return dayMatched && weekdayMatched
+}
+
+func (cron *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(getLocation())
+	// cron runs at the beginning of minutes, so start from the next minute
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+
+	for i := 0; i < cronMaxIterations; i++ {
+		if cron.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cron.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cron.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,112 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+)
+
+var (
+	// ErrRuleNotFound occurs when trying to do operation to the non-exist rule
+	ErrRuleNotFound = fmt.Errorf("the rule doesn't exist")
+	// ErrInvalidSchedule occurs when the schedule can't be parsed
+	ErrInvalidSchedule = fmt.Errorf("invalid schedule is found")
+	// ErrInvalidAmount occurs when the amount of the rule is zero
+	ErrInvalidAmount = fmt.Errorf("invalid amount is found")
+)
+
+// Rule is a recurring transaction of a wallet
+type Rule struct {
+	ID     int64  `json:"id"`
+	UserID string `json:"userID"`
+	// OwnerID is the LINE user ID of the one who adds the rule, and the rule runs on behalf of the owner
+	OwnerID string `json:"ownerID"`
+	// NotifyID is where the result of each run is pushed to, a LINE user ID, group ID or room ID
+	NotifyID string `json:"notifyID"`
+	// Amount is positive for deposits and negative for spending
+	Amount   int64    `json:"amount"`
+	Reason   string   `json:"reason"`
+	Category string   `json:"category"`
+	Tags     []string `json:"tags"`
+	// Schedule is the spec that users type, ex: 每月5號
+	Schedule string `json:"schedule"`
+	// NextRunAt is the unix timestamp of the next run
+	NextRunAt int64 `json:"nextRunAt"`
+	Paused    bool  `json:"paused"`
+}
+
+// Notifier pushes the result of runs to users
+type Notifier interface {
+	// Notify pushes a text message to a LINE user, group or room
+	Notify(to, text string) error
+}
+
+// Scheduler stores recurring rules, and runs them through wallet.Wallet when they are due
+//
+// `callerID` is the LINE user ID of the one who operates the rule,
+// the caller should be an editor of the wallet that the rule belongs to
+type Scheduler interface {
+	// WithContext gets the scheduler whose operations on rules are canceled with `ctx`
+	// rules that are run in background are never canceled by it
+	WithContext(ctx context.Context) Scheduler
+	// WithSource gets the scheduler whose rules are authorized by wallet.WithSource,
+	// so that rules of wallets in a group or a room are only operated from it
+	WithSource(sourceID string) Scheduler
+	// AddRule adds a recurring rule to user's wallet
+	AddRule(callerID, userID string, amount int64, reason, schedule string, options ...AddRuleOption) (*Rule, error)
+	// GetRules will get all rules of user's wallet
+	GetRules(callerID, userID string) ([]*Rule, error)
+	// PauseRule stops the rule from running until it's resumed
+	PauseRule(callerID string, ruleID int64) error
+	// ResumeRule resumes the paused rule, runs missed during the pause are skipped
+	ResumeRule(callerID string, ruleID int64) error
+	// DeleteRule deletes the rule
+	DeleteRule(callerID string, ruleID int64) error
+	// Snapshot gets rules of all wallets, it's used to back up rules with wallets, and it's for maintainers only
+	Snapshot() ([]*Rule, error)
+	// Restore adds rules of Snapshot in a single transaction, and rules get new IDs
+	// wallet.ErrStorageNotEmpty is returned if there is any rule already,
+	// and wallet.ErrWalletNotFound is returned if the wallet of any rule doesn't exist, so wallets should be restored first
+	Restore(rules []*Rule) error
+	// Start starts running due rules in background, including runs missed while the service was down
+	Start(notifier Notifier)
+	// Stop stops running rules
+	Stop()
+}
+
+type addRuleOption struct {
+	notifyID string
+	category string
+	tags     []string
+}
+
+// AddRuleOption define optional params of adding a rule
+type AddRuleOption func(*addRuleOption)
+
+// WithNotifyID means the result of each run is pushed to notifyID instead of the caller
+func WithNotifyID(notifyID string) AddRuleOption {
+	return func(opt *addRuleOption) {
+		opt.notifyID = notifyID
+	}
+}
+
+// WithCategory means logs of the rule belong to the category
+func WithCategory(category string) AddRuleOption {
+	return func(opt *addRuleOption) {
+		opt.category = category
+	}
+}
+
+// WithTags means logs of the rule are tagged with tags
+func WithTags(tags ...string) AddRuleOption {
+	return func(opt *addRuleOption) {
+		opt.tags = append(opt.tags, tags...)
+	}
+}
+
+func initAddRuleOption(options ...AddRuleOption) addRuleOption {
+	opt := addRuleOption{}
+	for _, f := range options {
+		f(&opt)
+	}
+	return opt
+}
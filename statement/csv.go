@@ -0,0 +1,125 @@
+package statement
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+var (
+	// ErrInvalidMapping occurs when columns of the mapping are negative or the date format is empty
+	ErrInvalidMapping = fmt.Errorf("invalid column mapping is found")
+	// ErrInvalidLine occurs when a line of the statement doesn't match the mapping
+	ErrInvalidLine = fmt.Errorf("invalid line of statement is found")
+)
+
+// Mapping defines where fields are in lines of bank statements, columns are zero-based
+type Mapping struct {
+	Date        int
+	Description int
+	Amount      int
+	// DateFormat is the layout of time.Parse, ex: 2006/01/02, and dates are based on Asia/Taipei zone
+	DateFormat string
+	// HasHeader means the first line is the header, and it's skipped
+	HasHeader bool
+	// Negate means spending is positive in the statement, so amounts are negated
+	Negate bool
+}
+
+// DefaultMapping is `date,description,amount` with a header line
+var DefaultMapping = Mapping{
+	Date:        0,
+	Description: 1,
+	Amount:      2,
+	DateFormat:  "2006/01/02",
+	HasHeader:   true,
+}
+
+// LineError tells which line of the statement is invalid
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (err *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.Line, err.Err.Error())
+}
+
+func (mapping Mapping) isValid() bool {
+	return mapping.Date >= 0 && mapping.Description >= 0 && mapping.Amount >= 0 && mapping.DateFormat != ""
+}
+
+// parseAmount parses amounts of statements, ex: `-1,234.00`
+// thousands separators are removed, and zeros after the decimal point are trimmed for currencies without minor units
+func parseAmount(text, currency string) (int64, error) {
+	text = strings.Replace(strings.TrimSpace(text), ",", "", -1)
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	}
+	return money.Parse(text, currency)
+}
+
+// ParseCSV parses the CSV bank statement into entries of the wallet in `currency`
+// lines with empty amounts are skipped, ex: lines of balances
+func ParseCSV(reader io.Reader, mapping Mapping, currency string) ([]*wallet.ImportEntry, error) {
+	if !mapping.isValid() {
+		return nil, ErrInvalidMapping
+	}
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	csvReader := csv.NewReader(reader)
+	// statements may have lines of summaries with fewer fields
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	entries := []*wallet.ImportEntry{}
+	for line := 1; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err":  err,
+				"line": line,
+			}).Error("csvReader.Read failed in ParseCSV")
+			return nil, &LineError{Line: line, Err: err}
+		}
+
+		if line == 1 && mapping.HasHeader {
+			continue
+		}
+		if len(record) <= mapping.Date || len(record) <= mapping.Description || len(record) <= mapping.Amount {
+			return nil, &LineError{Line: line, Err: ErrInvalidLine}
+		}
+		if strings.TrimSpace(record[mapping.Amount]) == "" {
+			continue
+		}
+
+		date, err := time.ParseInLocation(mapping.DateFormat, strings.TrimSpace(record[mapping.Date]), location)
+		if err != nil {
+			return nil, &LineError{Line: line, Err: err}
+		}
+
+		amount, err := parseAmount(record[mapping.Amount], currency)
+		if err != nil {
+			return nil, &LineError{Line: line, Err: err}
+		}
+		if mapping.Negate {
+			amount = -1 * amount
+		}
+
+		entries = append(entries, &wallet.ImportEntry{
+			Timestamp: date.Unix(),
+			Reason:    strings.TrimSpace(record[mapping.Description]),
+			Amount:    amount,
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,107 @@
+package statement
+
+import (
+	"html"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// ofxElement is a tag with its value, ex: <TRNAMT>-120.00 is {TRNAMT, -120.00}
+// closing tags are kept with `/`, ex: </STMTTRN> is {/STMTTRN, ""}
+type ofxElement struct {
+	tag   string
+	value string
+}
+
+// scanOFX scans elements of OFX, it works for both SGML of OFX 1.x, whose tags may not be closed, and XML of OFX 2.x
+// entities of values are decoded, ex: A &amp; B is A & B
+func scanOFX(text string) []ofxElement {
+	elements := []ofxElement{}
+	for _, token := range strings.Split(text, "<")[1:] {
+		parts := strings.SplitN(token, ">", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		elements = append(elements, ofxElement{
+			tag:   strings.ToUpper(strings.TrimSpace(parts[0])),
+			value: html.UnescapeString(strings.TrimSpace(parts[1])),
+		})
+	}
+	return elements
+}
+
+// parseOFXDate parses dates like 20190520, 20190520120000 or 20190520120000.000[+8:CST],
+// only the date is used, and it's based on Asia/Taipei zone
+func parseOFXDate(text string) (int64, error) {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	if len(text) < 8 {
+		return int64(0), ErrInvalidLine
+	}
+	date, err := time.ParseInLocation("20060102", text[:8], location)
+	if err != nil {
+		return int64(0), err
+	}
+	return date.Unix(), nil
+}
+
+// ParseOFX parses transactions of the OFX bank statement into entries of the wallet in `currency`
+// the reason is the name of the transaction, or its memo if there is no name
+// wallet.ErrCurrencyMismatch is returned if the statement is in another currency
+func ParseOFX(reader io.Reader, currency string) ([]*wallet.ImportEntry, error) {
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		logrus.WithField("err", err).Error("ioutil.ReadAll failed in ParseOFX")
+		return nil, err
+	}
+
+	entries := []*wallet.ImportEntry{}
+	var transaction map[string]string
+	count := 0
+	for _, element := range scanOFX(string(bytes)) {
+		switch element.tag {
+		case "CURDEF":
+			if c, err := money.GetCurrency(element.value); err != nil || c.Code != currency {
+				return nil, wallet.ErrCurrencyMismatch
+			}
+		case "STMTTRN":
+			transaction = map[string]string{}
+		case "/STMTTRN":
+			if transaction == nil {
+				continue
+			}
+			count++
+
+			timestamp, err := parseOFXDate(transaction["DTPOSTED"])
+			if err != nil {
+				return nil, &LineError{Line: count, Err: err}
+			}
+			amount, err := parseAmount(transaction["TRNAMT"], currency)
+			if err != nil {
+				return nil, &LineError{Line: count, Err: err}
+			}
+
+			reason := transaction["NAME"]
+			if reason == "" {
+				reason = transaction["MEMO"]
+			}
+			entries = append(entries, &wallet.ImportEntry{
+				Timestamp: timestamp,
+				Reason:    reason,
+				Amount:    amount,
+			})
+			transaction = nil
+		default:
+			if transaction != nil && !strings.HasPrefix(element.tag, "/") {
+				transaction[element.tag] = element.value
+			}
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,106 @@
+package statement
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+var (
+	// qifDateLayouts are date formats that QIF files are usually written in, and the first one that matches is used
+	qifDateLayouts = []string{"2006/01/02", "2006-01-02", "01/02/2006", "1/2/2006", "01/02'06", "1/2'06", "01/02/06", "1/2/06"}
+)
+
+func parseQIFDate(text string) (int64, error) {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	// some programs pad days with spaces, ex: 5/ 1'19
+	text = strings.Replace(strings.TrimSpace(text), " ", "0", -1)
+	for _, layout := range qifDateLayouts {
+		if date, err := time.ParseInLocation(layout, text, location); err == nil {
+			return date.Unix(), nil
+		}
+	}
+	return int64(0), ErrInvalidLine
+}
+
+// parseQIFRecord parses fields of a record into the entry, ex: {D: 5/20'19, T: -120.00, P: 午餐}
+func parseQIFRecord(fields map[byte]string, currency string) (*wallet.ImportEntry, error) {
+	timestamp, err := parseQIFDate(fields['D'])
+	if err != nil {
+		return nil, err
+	}
+	amountText := fields['T']
+	if amountText == "" {
+		amountText = fields['U']
+	}
+	amount, err := parseAmount(amountText, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	reason := fields['P']
+	if reason == "" {
+		reason = fields['M']
+	}
+	// categories in brackets are transfers between accounts, ex: [Savings]
+	category := fields['L']
+	if strings.HasPrefix(category, "[") {
+		category = ""
+	}
+
+	return &wallet.ImportEntry{
+		Timestamp: timestamp,
+		Reason:    reason,
+		Amount:    amount,
+		Category:  wallet.AccountCategory(category),
+	}, nil
+}
+
+// ParseQIF parses records of the QIF bank statement into entries of the wallet in `currency`
+// the reason is the payee of the record, or its memo if there is no payee,
+// and the category is mapped by wallet.AccountCategory, ex: Expenses:餐飲 is 餐飲
+// the last record is parsed even if the file ends without `^`, as some programs don't write it
+func ParseQIF(reader io.Reader, currency string) ([]*wallet.ImportEntry, error) {
+	scanner := bufio.NewScanner(reader)
+	entries := []*wallet.ImportEntry{}
+	fields := map[byte]string{}
+	line := 1
+	for ; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		// headers like !Type:Bank and empty lines are skipped
+		if text == "" || strings.HasPrefix(text, "!") {
+			continue
+		}
+
+		if text != "^" {
+			fields[text[0]] = strings.TrimSpace(text[1:])
+			continue
+		}
+
+		// `^` ends the record
+		entry, err := parseQIFRecord(fields, currency)
+		if err != nil {
+			return nil, &LineError{Line: line, Err: err}
+		}
+		entries = append(entries, entry)
+		fields = map[byte]string{}
+	}
+	if err := scanner.Err(); err != nil {
+		logrus.WithField("err", err).Error("scanner.Scan failed in ParseQIF")
+		return nil, err
+	}
+
+	if len(fields) != 0 {
+		entry, err := parseQIFRecord(fields, currency)
+		if err != nil {
+			return nil, &LineError{Line: line - 1, Err: err}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
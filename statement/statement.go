@@ -0,0 +1,22 @@
+package statement
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// Parse parses the bank statement by the extension of its filename,
+// OFX and QIF files are supported, and other files are parsed as CSV with the mapping
+func Parse(reader io.Reader, filename string, mapping Mapping, currency string) ([]*wallet.ImportEntry, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".ofx", ".qfx":
+		return ParseOFX(reader, currency)
+	case ".qif":
+		return ParseQIF(reader, currency)
+	default:
+		return ParseCSV(reader, mapping, currency)
+	}
+}
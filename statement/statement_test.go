@@ -0,0 +1,247 @@
+package statement
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// date gets the timestamp of the day in Asia/Taipei zone, which dates of statements are based on
+func date(year int, month time.Month, day int) int64 {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	return time.Date(year, month, day, 0, 0, 0, 0, location).Unix()
+}
+
+func expectEntries(t *testing.T, name string, actual []*wallet.ImportEntry, err error, expected []*wallet.ImportEntry) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s failed: %v", name, err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("%s parsed %d entries, expected %d", name, len(actual), len(expected))
+	}
+	for i := range expected {
+		if *actual[i] != *expected[i] {
+			t.Fatalf("%s parsed %+v at %d, expected %+v", name, *actual[i], i, *expected[i])
+		}
+	}
+}
+
+func expectLineError(t *testing.T, name string, err error, line int) {
+	t.Helper()
+	lineErr, ok := err.(*LineError)
+	if !ok || lineErr.Line != line {
+		t.Fatalf("%s returned %v, expected the error at line %d", name, err, line)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		mapping  Mapping
+		currency string
+		expected []*wallet.ImportEntry
+	}{
+		{
+			name:     "default mapping",
+			text:     "date,description,amount\n2019/05/20,午餐,-120\n2019/05/21, 薪水 ,\"1,000\"\n2019/05/22,balance,\n",
+			mapping:  DefaultMapping,
+			currency: "TWD",
+			expected: []*wallet.ImportEntry{
+				{Timestamp: date(2019, 5, 20), Reason: "午餐", Amount: -120},
+				{Timestamp: date(2019, 5, 21), Reason: "薪水", Amount: 1000},
+			},
+		},
+		{
+			name:     "columns, format and negated amounts",
+			text:     "12.50,05-20-2019,coffee\n1000.00,05-21-2019,rent\n",
+			mapping:  Mapping{Date: 1, Description: 2, Amount: 0, DateFormat: "01-02-2006", Negate: true},
+			currency: "USD",
+			expected: []*wallet.ImportEntry{
+				{Timestamp: date(2019, 5, 20), Reason: "coffee", Amount: -1250},
+				{Timestamp: date(2019, 5, 21), Reason: "rent", Amount: -100000},
+			},
+		},
+		{
+			name:     "zeros after the decimal point of TWD",
+			text:     "2019/05/20,午餐,-120.00\n",
+			mapping:  Mapping{Date: 0, Description: 1, Amount: 2, DateFormat: "2006/01/02"},
+			currency: "TWD",
+			expected: []*wallet.ImportEntry{
+				{Timestamp: date(2019, 5, 20), Reason: "午餐", Amount: -120},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		entries, err := ParseCSV(strings.NewReader(test.text), test.mapping, test.currency)
+		expectEntries(t, test.name, entries, err, test.expected)
+	}
+}
+
+func TestParseCSVErrors(t *testing.T) {
+	_, err := ParseCSV(strings.NewReader(""), Mapping{Date: -1, DateFormat: "2006/01/02"}, "TWD")
+	if err != ErrInvalidMapping {
+		t.Fatalf("the negative column returned %v", err)
+	}
+	_, err = ParseCSV(strings.NewReader(""), Mapping{}, "TWD")
+	if err != ErrInvalidMapping {
+		t.Fatalf("the empty date format returned %v", err)
+	}
+
+	tests := []struct {
+		name string
+		text string
+		line int
+	}{
+		{"too few fields", "date,description,amount\n2019/05/20,午餐\n", 2},
+		{"invalid date", "date,description,amount\n2019/05/20,午餐,-120\n20190521,晚餐,-120\n", 3},
+		{"invalid amount", "date,description,amount\n2019/05/20,午餐,abc\n", 2},
+		{"minor units that the currency doesn't have", "date,description,amount\n2019/05/20,午餐,-120.5\n", 2},
+	}
+	for _, test := range tests {
+		_, err := ParseCSV(strings.NewReader(test.text), DefaultMapping, "TWD")
+		expectLineError(t, test.name, err, test.line)
+	}
+}
+
+const (
+	// sgmlOFX is OFX 1.x, whose headers aren't XML and whose tags of values aren't closed
+	sgmlOFX = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+
+<OFX>
+<BANKMSGSRSV1><STMTTRNRS><STMTRS>
+<CURDEF>TWD
+<BANKTRANLIST>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20190520120000.000[+8:CST]
+<TRNAMT>-1,200.00
+<NAME>A &amp; B
+<MEMO>dinner
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20190521
+<TRNAMT>30000
+<MEMO>薪水
+</STMTTRN>
+</BANKTRANLIST>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`
+	// xmlOFX is OFX 2.x
+	xmlOFX = `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="211"?>
+<OFX>
+  <CREDITCARDMSGSRSV1><CCSTMTTRNRS><CCSTMTRS>
+    <CURDEF>USD</CURDEF>
+    <BANKTRANLIST>
+      <STMTTRN>
+        <TRNTYPE>DEBIT</TRNTYPE>
+        <DTPOSTED>20190520</DTPOSTED>
+        <TRNAMT>-12.50</TRNAMT>
+        <NAME>Tom &lt;3 &quot;Jerry&quot;</NAME>
+      </STMTTRN>
+    </BANKTRANLIST>
+  </CCSTMTRS></CCSTMTTRNRS></CREDITCARDMSGSRSV1>
+</OFX>
+`
+)
+
+func TestParseOFX(t *testing.T) {
+	entries, err := ParseOFX(strings.NewReader(sgmlOFX), "TWD")
+	expectEntries(t, "SGML", entries, err, []*wallet.ImportEntry{
+		{Timestamp: date(2019, 5, 20), Reason: "A & B", Amount: -1200},
+		{Timestamp: date(2019, 5, 21), Reason: "薪水", Amount: 30000},
+	})
+
+	entries, err = ParseOFX(strings.NewReader(xmlOFX), "USD")
+	expectEntries(t, "XML", entries, err, []*wallet.ImportEntry{
+		{Timestamp: date(2019, 5, 20), Reason: `Tom <3 "Jerry"`, Amount: -1250},
+	})
+
+	// the statement should be in the currency of the wallet
+	if _, err := ParseOFX(strings.NewReader(xmlOFX), "TWD"); err != wallet.ErrCurrencyMismatch {
+		t.Fatalf("the statement in USD returned %v for TWD", err)
+	}
+	if _, err := ParseOFX(strings.NewReader(strings.Replace(sgmlOFX, "<CURDEF>TWD", "<CURDEF>XXX", 1)), "TWD"); err != wallet.ErrCurrencyMismatch {
+		t.Fatalf("the statement in the unknown currency returned %v", err)
+	}
+
+	// transactions are counted for errors, as lines of SGML and XML are different
+	invalid := strings.Replace(sgmlOFX, "<DTPOSTED>20190521", "<DTPOSTED>2019", 1)
+	_, err = ParseOFX(strings.NewReader(invalid), "TWD")
+	expectLineError(t, "the invalid date", err, 2)
+}
+
+func TestParseQIF(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []*wallet.ImportEntry
+	}{
+		{
+			name: "date layouts",
+			text: "!Type:Bank\nD2019/05/20\nT-120\nP午餐\n^\nD2019-05-21\nT-1,200.00\nMdinner\n^\nD05/22/2019\nT1\n^\n" +
+				"D5/23'19\nT2\n^\nD 5/ 4'19\nT3\n^\nD05/25/19\nU4\n^\n",
+			expected: []*wallet.ImportEntry{
+				{Timestamp: date(2019, 5, 20), Reason: "午餐", Amount: -120},
+				{Timestamp: date(2019, 5, 21), Reason: "dinner", Amount: -1200},
+				{Timestamp: date(2019, 5, 22), Amount: 1},
+				{Timestamp: date(2019, 5, 23), Amount: 2},
+				{Timestamp: date(2019, 5, 4), Amount: 3},
+				{Timestamp: date(2019, 5, 25), Amount: 4},
+			},
+		},
+		{
+			name: "categories",
+			text: "!Type:Bank\nD2019/05/20\nT-120\nP午餐\nLExpenses:餐飲\n^\nD2019/05/20\nT-500\nPsavings\nL[Savings]\n^\n" +
+				"D2019/05/20\nT-60\nPcoffee\nL餐飲\n^\nD2019/05/20\nT-1\nPfee\nLExpenses:Uncategorized\n^\n",
+			expected: []*wallet.ImportEntry{
+				{Timestamp: date(2019, 5, 20), Reason: "午餐", Amount: -120, Category: "餐飲"},
+				{Timestamp: date(2019, 5, 20), Reason: "savings", Amount: -500},
+				{Timestamp: date(2019, 5, 20), Reason: "coffee", Amount: -60, Category: "餐飲"},
+				{Timestamp: date(2019, 5, 20), Reason: "fee", Amount: -1},
+			},
+		},
+		{
+			name: "missing terminator",
+			text: "!Type:Bank\nD2019/05/20\nT-120\nP午餐\n^\nD2019/05/21\nT-60\nPcoffee\n",
+			expected: []*wallet.ImportEntry{
+				{Timestamp: date(2019, 5, 20), Reason: "午餐", Amount: -120},
+				{Timestamp: date(2019, 5, 21), Reason: "coffee", Amount: -60},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		entries, err := ParseQIF(strings.NewReader(test.text), "TWD")
+		expectEntries(t, test.name, entries, err, test.expected)
+	}
+
+	_, err := ParseQIF(strings.NewReader("!Type:Bank\nD2019/05/20\nT-120\n^\nD20190521\nT-60\n^\n"), "TWD")
+	expectLineError(t, "the invalid date", err, 7)
+	_, err = ParseQIF(strings.NewReader("!Type:Bank\nD2019/05/20\nT-120\n^\nD2019/05/21\nTabc\n"), "TWD")
+	expectLineError(t, "the invalid amount of the last record without terminator", err, 6)
+}
+
+func TestParse(t *testing.T) {
+	entries, err := Parse(strings.NewReader(sgmlOFX), "statement.QFX", DefaultMapping, "TWD")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Parse of OFX returned %d entries, %v", len(entries), err)
+	}
+	entries, err = Parse(strings.NewReader("D2019/05/20\nT-120\n^\n"), "statement.qif", DefaultMapping, "TWD")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Parse of QIF returned %d entries, %v", len(entries), err)
+	}
+	entries, err = Parse(strings.NewReader("date,description,amount\n2019/05/20,午餐,-120\n"), "statement.txt", DefaultMapping, "TWD")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Parse of CSV returned %d entries, %v", len(entries), err)
+	}
+}
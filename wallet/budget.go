@@ -0,0 +1,106 @@
+package wallet
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+)
+
+const (
+	// UsersWalletBudget related statements
+	upsertBudget = `
+		INSERT INTO "UsersWalletBudget" ("userID", category, "monthlyLimit")
+			VALUES ($1, $2, $3)
+		ON CONFLICT ("userID", category) DO UPDATE SET "monthlyLimit" = $3;
+	`
+	deleteBudget     = `DELETE FROM "UsersWalletBudget" WHERE "userID" = $1 AND category = $2`
+	deleteAllBudgets = `DELETE FROM "UsersWalletBudget" WHERE "userID" = $1`
+	// spending is the negative amount of postings to the wallet account whose other side is equityExternal,
+	// so transfers and emptying wallets are not counted
+	getBudgets = `
+		SELECT
+			budget.category, budget."monthlyLimit", COALESCE(SUM(-posting.amount), 0)
+		FROM
+			"UsersWalletBudget" budget
+		LEFT JOIN (
+			"LedgerPosting" posting
+			JOIN "LedgerTransaction" txn ON txn.id = posting."transactionID"
+			JOIN "LedgerPosting" external ON external."transactionID" = posting."transactionID" AND external.account = $2
+		)
+		ON
+			posting.account = $3
+			AND (budget.category = '' OR txn.category = budget.category)
+			AND posting.amount < 0
+			AND txn.timestamp >= $4 AND txn.timestamp < $5
+		WHERE
+			budget."userID" = $1
+		GROUP BY
+			budget.category, budget."monthlyLimit"
+		ORDER BY
+			budget.category
+	`
+)
+
+func (im *impl) SetBudget(callerID, userID, category string, limit int64) error {
+	if limit < int64(0) {
+		return ErrInvalidBudget
+	}
+
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in SetBudget")
+		return err
+	}
+	defer execRollBack(tx)
+
+	if err := im.checkRole(tx, callerID, userID, RoleEditor); err != nil {
+		return err
+	}
+
+	if err := checkCategory(tx, userID, category); err != nil {
+		return err
+	}
+
+	if limit == int64(0) {
+		if _, err := tx.Exec(deleteBudget, userID, category); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(deleteBudget) failed in SetBudget")
+			return err
+		}
+	} else if _, err := tx.Exec(upsertBudget, userID, category, limit); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(upsertBudget) failed in SetBudget")
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in SetBudget")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) GetBudgets(callerID, userID string) ([]*Budget, error) {
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	startTime, endTime := base.GetMonthRange(time.Now())
+	rows, err := im.db.Query(getBudgets, userID, equityExternal, walletAccount(userID), startTime, endTime)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query(getBudgets) failed in GetBudgets")
+		return nil, err
+	}
+	defer rows.Close()
+
+	budgets := []*Budget{}
+	for rows.Next() {
+		budget := &Budget{}
+		if err := rows.Scan(&budget.Category, &budget.Limit, &budget.Spent); err != nil {
+			logrus.WithField("err", err).Error("rows.Scan failed in GetBudgets")
+			return nil, err
+		}
+		budgets = append(budgets, budget)
+	}
+	return budgets, nil
+}
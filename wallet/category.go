@@ -0,0 +1,127 @@
+package wallet
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// UsersWalletCategory related statements
+	checkIfCategoryExists = `SELECT 1 FROM "UsersWalletCategory" WHERE "userID" = $1 AND name = $2`
+	insertCategory        = `
+		INSERT INTO "UsersWalletCategory" ("userID", name)
+			VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;
+	`
+	deleteCategory      = `DELETE FROM "UsersWalletCategory" WHERE "userID" = $1 AND name = $2`
+	deleteAllCategories = `DELETE FROM "UsersWalletCategory" WHERE "userID" = $1`
+	getCategories       = `SELECT name FROM "UsersWalletCategory" WHERE "userID" = $1 ORDER BY name`
+)
+
+const (
+	// tags are stored as a single string separated by tagSeparator
+	tagSeparator = ","
+)
+
+// checkCategory makes sure that the category is one of the categories of user's wallet
+// empty category means the log doesn't belong to any category
+func checkCategory(exec executor, userID, category string) error {
+	if category == "" {
+		return nil
+	}
+
+	exist := 0
+	if err := exec.QueryRow(checkIfCategoryExists, userID, category).Scan(&exist); err == sql.ErrNoRows {
+		return ErrCategoryNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(checkIfCategoryExists) failed in checkCategory")
+		return err
+	}
+	return nil
+}
+
+func joinTags(tags []string) (string, error) {
+	for _, tag := range tags {
+		if tag == "" || strings.Contains(tag, tagSeparator) {
+			return "", ErrInvalidTag
+		}
+	}
+	return strings.Join(tags, tagSeparator), nil
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, tagSeparator)
+}
+
+func (im *impl) AddCategory(callerID, userID, category string) error {
+	if category == "" {
+		return ErrCategoryNotFound
+	}
+
+	if err := im.checkRole(im.db, callerID, userID, RoleEditor); err != nil {
+		return err
+	}
+
+	result, err := im.db.Exec(insertCategory, userID, category)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(insertCategory) failed in AddCategory")
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in AddCategory")
+		return err
+	} else if rowsAffected == int64(0) {
+		return ErrCategoryExist
+	}
+	return nil
+}
+
+func (im *impl) RemoveCategory(callerID, userID, category string) error {
+	if err := im.checkRole(im.db, callerID, userID, RoleEditor); err != nil {
+		return err
+	}
+
+	result, err := im.db.Exec(deleteCategory, userID, category)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Exec(deleteCategory) failed in RemoveCategory")
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in RemoveCategory")
+		return err
+	} else if rowsAffected == int64(0) {
+		return ErrCategoryNotFound
+	}
+	return nil
+}
+
+func (im *impl) GetCategories(callerID, userID string) ([]string, error) {
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	rows, err := im.db.Query(getCategories, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query(getCategories) failed in GetCategories")
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []string{}
+	for rows.Next() {
+		category := ""
+		if err := rows.Scan(&category); err != nil {
+			logrus.WithField("err", err).Error("rows.Scan failed in GetCategories")
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, nil
+}
@@ -0,0 +1,277 @@
+package wallet
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/money"
+)
+
+const (
+	// ExchangeRate related statements
+	upsertRate = `
+		INSERT INTO "ExchangeRate" (base, quote, date, rate)
+			VALUES ($1, $2, $3, $4)
+		ON CONFLICT (base, quote, date) DO UPDATE SET rate = $4;
+	`
+	getRate = `
+		SELECT
+			date, rate
+		FROM
+			"ExchangeRate"
+		WHERE
+			base = $1 AND quote = $2 AND date <= $3
+		ORDER BY
+			date DESC
+		LIMIT 1
+	`
+)
+
+const (
+	// equityExchange is the account that converts money between currencies
+	equityExchange = "equity:exchange"
+)
+
+var (
+	// rateDateLayouts are allowed date formats of imported rates
+	rateDateLayouts = []string{"2006/01/02", "2006-01-02"}
+)
+
+// conversion is the original amount of the log that is recorded in another currency
+type conversion struct {
+	// amount is signed as the amount posted to the wallet
+	amount   int64
+	currency string
+	rate     *Rate
+}
+
+// stored gets the original amount, the original currency, the rate and its date that are stored with the transaction,
+// they are empty if `c` is nil, and the original amount is stored without sign, as it's shared by both sides of a transfer
+func (c *conversion) stored() (int64, string, string, int64) {
+	if c == nil {
+		return int64(0), "", "", int64(0)
+	}
+
+	amount := c.amount
+	if amount < int64(0) {
+		amount = -1 * amount
+	}
+	return amount, c.currency, c.rate.Value, c.rate.Date
+}
+
+// parseRate normalizes currencies and the rate that users give
+func parseRate(baseCode, quoteCode, rate string) (string, string, *big.Rat, error) {
+	baseCurrency, err := money.GetCurrency(baseCode)
+	if err != nil {
+		return "", "", nil, ErrInvalidCurrency
+	}
+	quoteCurrency, err := money.GetCurrency(quoteCode)
+	if err != nil {
+		return "", "", nil, ErrInvalidCurrency
+	}
+
+	value, err := money.ParseRate(rate)
+	if err != nil {
+		return "", "", nil, ErrInvalidRate
+	}
+	return baseCurrency.Code, quoteCurrency.Code, value, nil
+}
+
+// newRate normalizes the rate of the day that `timestamp` is in
+func newRate(baseCode, quoteCode string, timestamp int64, rate string) (*Rate, error) {
+	baseCode, quoteCode, value, err := parseRate(baseCode, quoteCode, rate)
+	if err != nil {
+		return nil, err
+	}
+	if baseCode == quoteCode {
+		return nil, ErrInvalidRate
+	}
+	return &Rate{
+		Base:  baseCode,
+		Quote: quoteCode,
+		Date:  base.GetDayStart(time.Unix(timestamp, 0)),
+		Value: money.FormatRate(value),
+	}, nil
+}
+
+func setRate(exec executor, baseCode, quoteCode string, timestamp int64, rate string) error {
+	r, err := newRate(baseCode, quoteCode, timestamp, rate)
+	if err != nil {
+		return err
+	}
+
+	if _, err := exec.Exec(upsertRate, r.Base, r.Quote, r.Date, r.Value); err != nil {
+		logrus.WithField("err", err).Error("exec.Exec(upsertRate) failed in setRate")
+		return err
+	}
+	return nil
+}
+
+// rateLookup gets the latest rate of the direction on or before `date` that is stored,
+// and ErrRateNotFound is returned if there is none
+type rateLookup func(baseCode, quoteCode string, date int64) (*Rate, error)
+
+// storedRates looks up rates stored in the database
+func storedRates(exec executor) rateLookup {
+	return func(baseCode, quoteCode string, date int64) (*Rate, error) {
+		return getStoredRate(exec, baseCode, quoteCode, date)
+	}
+}
+
+// getStoredRate gets the rate of the direction that is stored
+func getStoredRate(exec executor, baseCode, quoteCode string, date int64) (*Rate, error) {
+	rate := &Rate{Base: baseCode, Quote: quoteCode}
+	if err := exec.QueryRow(getRate, baseCode, quoteCode, date).Scan(&rate.Date, &rate.Value); err == sql.ErrNoRows {
+		return nil, ErrRateNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(getRate) failed in getStoredRate")
+		return nil, err
+	}
+	return rate, nil
+}
+
+func getLatestRate(lookup rateLookup, baseCode, quoteCode string, timestamp int64) (*Rate, error) {
+	baseCurrency, err := money.GetCurrency(baseCode)
+	if err != nil {
+		return nil, ErrInvalidCurrency
+	}
+	quoteCurrency, err := money.GetCurrency(quoteCode)
+	if err != nil {
+		return nil, ErrInvalidCurrency
+	}
+	baseCode, quoteCode = baseCurrency.Code, quoteCurrency.Code
+
+	date := base.GetDayStart(time.Unix(timestamp, 0))
+	if baseCode == quoteCode {
+		return &Rate{Base: baseCode, Quote: quoteCode, Date: date, Value: "1"}, nil
+	}
+
+	if rate, err := lookup(baseCode, quoteCode, date); err != ErrRateNotFound {
+		return rate, err
+	}
+
+	// invert the rate of the opposite direction
+	inverse, err := lookup(quoteCode, baseCode, date)
+	if err != nil {
+		return nil, err
+	}
+	value, err := money.ParseRate(inverse.Value)
+	if err != nil {
+		logrus.WithField("rate", inverse.Value).Error("money.ParseRate failed in getLatestRate")
+		return nil, ErrInvalidRate
+	}
+	return &Rate{Base: baseCode, Quote: quoteCode, Date: inverse.Date, Value: money.FormatRate(value.Inv(value))}, nil
+}
+
+func convert(lookup rateLookup, amount int64, from, to string, timestamp int64) (int64, *Rate, error) {
+	rate, err := getLatestRate(lookup, from, to, timestamp)
+	if err != nil {
+		return int64(0), nil, err
+	}
+
+	value, err := money.ParseRate(rate.Value)
+	if err != nil {
+		return int64(0), nil, ErrInvalidRate
+	}
+
+	converted, err := money.Convert(amount, rate.Base, rate.Quote, value)
+	if err != nil {
+		return int64(0), nil, err
+	}
+	return converted, rate, nil
+}
+
+// parseRateDate parses the date of imported rates, the date is based on Asia/Taipei zone
+func parseRateDate(text string) (int64, error) {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	for _, layout := range rateDateLayouts {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(text), location); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return int64(0), ErrInvalidRate
+}
+
+func (im *impl) SetRate(baseCode, quoteCode string, timestamp int64, rate string) error {
+	return setRate(im.db, baseCode, quoteCode, timestamp, rate)
+}
+
+func (im *impl) GetRate(baseCode, quoteCode string, timestamp int64) (*Rate, error) {
+	return getLatestRate(storedRates(im.db), baseCode, quoteCode, timestamp)
+}
+
+func (im *impl) Convert(amount int64, from, to string, timestamp int64) (int64, *Rate, error) {
+	return convert(storedRates(im.db), amount, from, to, timestamp)
+}
+
+// parseRates parses CSV rows of date, base, quote and rate into normalized rates, and the first row may be the header
+func parseRates(reader io.Reader) ([]*Rate, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = 4
+	csvReader.TrimLeadingSpace = true
+
+	rates := []*Rate{}
+	for line := 1; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err":  err,
+				"line": line,
+			}).Error("csvReader.Read failed in parseRates")
+			return nil, ErrInvalidRate
+		}
+
+		timestamp, err := parseRateDate(record[0])
+		// the first line may be the header
+		if err != nil && line == 1 {
+			continue
+		} else if err != nil {
+			logrus.WithField("line", line).Error("parseRateDate failed in parseRates")
+			return nil, err
+		}
+
+		rate, err := newRate(record[1], record[2], timestamp, record[3])
+		if err != nil {
+			logrus.WithField("line", line).Error("newRate failed in parseRates")
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+func (im *impl) ImportRates(reader io.Reader) (int, error) {
+	rates, err := parseRates(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in ImportRates")
+		return 0, err
+	}
+	defer execRollBack(tx)
+
+	for _, rate := range rates {
+		if _, err := tx.Exec(upsertRate, rate.Base, rate.Quote, rate.Date, rate.Value); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(upsertRate) failed in ImportRates")
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in ImportRates")
+		return 0, err
+	}
+	return len(rates), nil
+}
@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"encoding/csv"
+	"io"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/money"
+)
+
+const (
+	// the running balance is summed over all postings of the wallet account,
+	// so it's filtered by the time range after the window is computed
+	exportLogs = `
+		SELECT
+			logs.timestamp, logs.reason, logs.category, logs.tags, logs.amount, logs.currency, logs.counterparty, logs.balance
+		FROM (
+			SELECT
+				posting.id, txn.timestamp, txn.reason, txn.category, txn.tags, posting.amount, posting.currency,
+				COALESCE(counterparty.account, '') AS counterparty,
+				SUM(posting.amount) OVER (ORDER BY txn.timestamp, posting.id) AS balance
+			FROM
+				"LedgerPosting" posting
+			JOIN
+				"LedgerTransaction" txn
+			ON
+				txn.id = posting."transactionID"
+			LEFT JOIN
+				"LedgerPosting" counterparty
+			ON
+				counterparty."transactionID" = posting."transactionID"
+				AND counterparty.id <> posting.id
+				AND counterparty.account LIKE 'wallet:%'
+			WHERE
+				posting.account = $1
+		) logs
+		WHERE
+			logs.timestamp >= $2 AND logs.timestamp < $3
+		ORDER BY
+			logs.timestamp, logs.id
+	`
+)
+
+var (
+	// exportCSVHeader is the first line of exported CSV files
+	exportCSVHeader = []string{"timestamp", "reason", "category", "tags", "amount", "currency", "counterparty", "balance"}
+)
+
+func (im *impl) ExportLogs(callerID, userID string, timeRange TimeRange, format ExportFormat, writer io.Writer) error {
+	if !format.IsValid() {
+		return ErrInvalidExportFormat
+	}
+	if timeRange.Start >= timeRange.End {
+		return ErrInvalidReport
+	}
+
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return err
+	}
+
+	if format == ExportLedger || format == ExportBeancount {
+		return im.exportJournal(userID, timeRange, format, writer)
+	}
+	return im.exportCSV(userID, timeRange, writer)
+}
+
+// exportRow is a log with the running balance right after it
+type exportRow struct {
+	logRow
+	balance int64
+}
+
+// writeCSV writes the header and rows of exported logs
+func writeCSV(writer io.Writer, rows []*exportRow) error {
+	csvWriter := csv.NewWriter(writer)
+	if err := csvWriter.Write(exportCSVHeader); err != nil {
+		logrus.WithField("err", err).Error("csvWriter.Write failed in writeCSV")
+		return err
+	}
+
+	for _, row := range rows {
+		// amounts are decimals of the currency, so that spreadsheets read them as numbers
+		record := []string{
+			base.ParseToyyymmddhhmm(row.timestamp), row.reason, row.category, row.tags,
+			money.FormatDecimal(row.amount, row.currency), row.currency, walletUserID(row.counterparty), money.FormatDecimal(row.balance, row.currency),
+		}
+		if err := csvWriter.Write(record); err != nil {
+			logrus.WithField("err", err).Error("csvWriter.Write failed in writeCSV")
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		logrus.WithField("err", err).Error("csvWriter.Flush failed in writeCSV")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) exportCSV(userID string, timeRange TimeRange, writer io.Writer) error {
+	rows, err := im.db.Query(exportLogs, walletAccount(userID), timeRange.Start, timeRange.End)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query(exportLogs) failed in exportCSV")
+		return err
+	}
+	defer rows.Close()
+
+	exportRows := []*exportRow{}
+	for rows.Next() {
+		row := &exportRow{}
+		if err := rows.Scan(&row.timestamp, &row.reason, &row.category, &row.tags, &row.amount, &row.currency, &row.counterparty, &row.balance); err != nil {
+			logrus.WithField("err", err).Error("rows.Scan failed in exportCSV")
+			return err
+		}
+		exportRows = append(exportRows, row)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithField("err", err).Error("rows.Err failed in exportCSV")
+		return err
+	}
+	return writeCSV(writer, exportRows)
+}
@@ -0,0 +1,9 @@
+package wallet
+
+// AddMemoryBalance changes the cached balance of the in-memory wallet without any log, so that tests can make drift
+func AddMemoryBalance(wallet Wallet, userID string, amount int64) {
+	mem := wallet.(*memoryImpl)
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+	mem.wallets[userID].balance += amount
+}
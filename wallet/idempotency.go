@@ -0,0 +1,114 @@
+package wallet
+
+import (
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// LedgerIdempotencyKey related statements
+	// it records idempotency keys of deposits, spends and transfers of each wallet, so that the same request isn't recorded twice
+	checkIfKeyRecorded = `SELECT 1 FROM "LedgerIdempotencyKey" WHERE "userID" = $1 AND "key" = $2`
+	// the insert waits for the concurrent request with the same key, and does nothing if that one is committed
+	insertIdempotencyKey = `
+		INSERT INTO "LedgerIdempotencyKey" ("userID", "key", "transactionID")
+			VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING;
+	`
+	deleteAllIdempotencyKeys = `DELETE FROM "LedgerIdempotencyKey" WHERE "userID" = $1`
+	getKeyTransaction        = `SELECT "transactionID" FROM "LedgerIdempotencyKey" WHERE "userID" = $1 AND "key" = $2`
+
+	// the receipt is the log of the keyed transaction, and balances are sums of postings up to it,
+	// as IDs of postings increase in the order that they are posted
+	getTransactionLog = selectBalanceLogs + `
+		WHERE
+			posting."transactionID" = $1 AND posting.account = $2
+	`
+	getBalanceAfterPosting = `
+		SELECT
+			COALESCE(SUM(posting.amount), 0)
+		FROM
+			"LedgerPosting" posting
+		WHERE
+			posting.account = $1 AND posting.id <= (
+				SELECT id FROM "LedgerPosting" WHERE "transactionID" = $2 AND account = $1
+			)
+	`
+)
+
+func isKeyRecorded(exec executor, userID, key string) (bool, error) {
+	exist := 0
+	if err := exec.QueryRow(checkIfKeyRecorded, userID, key).Scan(&exist); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(checkIfKeyRecorded) failed in isKeyRecorded")
+		return false, err
+	}
+	return true, nil
+}
+
+// recordKey records the key of the transaction, and it returns false if the key is recorded by another request
+func recordKey(exec executor, userID, key string, transactionID int64) (bool, error) {
+	result, err := exec.Exec(insertIdempotencyKey, userID, key, transactionID)
+	if err != nil {
+		logrus.WithField("err", err).Error("exec.Exec(insertIdempotencyKey) failed in recordKey")
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in recordKey")
+		return false, err
+	}
+	return affected == int64(1), nil
+}
+
+func (im *impl) GetReceipt(callerID, userID, key string) (*Receipt, error) {
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in GetReceipt")
+		return nil, err
+	}
+	defer execRollBack(tx)
+
+	if err := im.checkRole(tx, callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	transactionID := int64(0)
+	if err := tx.QueryRow(getKeyTransaction, userID, key).Scan(&transactionID); err == sql.ErrNoRows {
+		return nil, ErrLogNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("tx.QueryRow(getKeyTransaction) failed in GetReceipt")
+		return nil, err
+	}
+
+	balanceLog, err := scanBalanceLog(tx.QueryRow(getTransactionLog, transactionID, walletAccount(userID)))
+	if err == sql.ErrNoRows {
+		return nil, ErrLogNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("scanBalanceLog failed in GetReceipt")
+		return nil, err
+	}
+
+	receipt := &Receipt{Log: balanceLog}
+	if err := tx.QueryRow(getBalanceAfterPosting, walletAccount(userID), transactionID).Scan(&receipt.Balance); err != nil {
+		logrus.WithField("err", err).Error("tx.QueryRow(getBalanceAfterPosting) failed in GetReceipt")
+		return nil, err
+	}
+	if balanceLog.CounterpartyID != "" {
+		if err := tx.QueryRow(
+			getBalanceAfterPosting, walletAccount(balanceLog.CounterpartyID), transactionID,
+		).Scan(&receipt.CounterpartyBalance); err != nil {
+			logrus.WithField("err", err).Error("tx.QueryRow(getBalanceAfterPosting) failed in GetReceipt")
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in GetReceipt")
+		return nil, err
+	}
+	return receipt, nil
+}
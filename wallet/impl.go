@@ -1,118 +1,183 @@
 package wallet
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
-	"github.com/andy/guachi-pay-line-bot/base"
 	"github.com/andy/guachi-pay-line-bot/db"
+	"github.com/andy/guachi-pay-line-bot/money"
 )
 
 const (
 	// UsersWallet related statements
 	checkIfWalletExists = `SELECT 1 FROM "UsersWallet" WHERE "userID" = $1`
 	createWallet        = `
-		INSERT INTO "UsersWallet" ("userID", "balance")
-		VALUES ($1, $2);
+		INSERT INTO "UsersWallet" ("userID", "balance", "ownerID", "sourceID", currency)
+		VALUES ($1, $2, $3, $4, $5);
 	`
+	getOwner          = `SELECT "ownerID" FROM "UsersWallet" WHERE "userID" = $1`
+	getOwnerAndSource = `SELECT "ownerID", "sourceID" FROM "UsersWallet" WHERE "userID" = $1`
+	// wallets created before ownership was introduced have no owner until maintainers assign one
+	setOwner     = `UPDATE "UsersWallet" SET "ownerID" = $1 WHERE "userID" = $2;`
 	deleteWallet = `
 		DELETE FROM "UsersWallet" WHERE "userID" = $1
 	`
-	patchWallet       = `UPDATE "UsersWallet" SET balance = $1 WHERE "userID" = $2;`
 	atomicPatchWallet = `UPDATE "UsersWallet" SET balance = balance + $1 WHERE "userID" = $2;`
 	getBalance        = `SELECT balance FROM "UsersWallet" WHERE "userID" = $1`
+	getCurrency       = `SELECT currency FROM "UsersWallet" WHERE "userID" = $1`
 
-	// UsersWalletLog related statements
-	insertWalletLog = `
-		INSERT INTO "UsersWalletLog" ("userID", reason, amount, timestamp)
-			VALUES ($1, $2, $3, $4);
-	`
-	deleteAllWalletLogs = `DELETE FROM "UsersWalletLog" WHERE "userID" = $1`
-	getWalletLogs       = `
-		SELECT 
-			reason, amount, timestamp 
-		FROM 
-			"UsersWalletLog"
-		WHERE 
-			"userID" = $1 AND timestamp >= $2 AND timestamp <= $3 
+	// the balance is locked, so that it won't be changed before the wallet is emptied
+	getBalanceForUpdate = `SELECT balance, currency FROM "UsersWallet" WHERE "userID" = $1 FOR UPDATE`
+
+	getWalletLogs = selectBalanceLogs + `
+		WHERE
+			posting.account = $1 AND txn.timestamp >= $2 AND txn.timestamp <= $3
+			AND ($4 = '' OR txn.category = $4)
 		ORDER BY
-			timestamp
+			txn.timestamp, posting.id
 	`
 )
 
 type impl struct {
-	db *sql.DB
+	db *db.DB
+	// source is where the caller operates wallets from, and it's nil if the wallet isn't bound to any source
+	source *string
+}
+
+// executor is implemented by both *db.DB and *db.Tx
+type executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 // NewWallet creates a new Wallet interface
 func NewWallet() (Wallet, error) {
-	dbSrv, err := db.NewPostgresSrv()
+	dbSrv, err := db.NewSrv()
 	if err != nil {
-		return nil, fmt.Errorf("db.GetPostgresSrv failed in NewWallet")
+		return nil, fmt.Errorf("db.NewSrv failed in NewWallet")
 	}
+	return NewSQLWallet(dbSrv), nil
+}
 
+// NewSQLWallet creates a new Wallet interface stored in the database, which should be migrated already
+func NewSQLWallet(dbSrv *db.DB) Wallet {
 	return &impl{
 		db: dbSrv,
-	}, nil
+	}
 }
 
-func execRollBack(tx *sql.Tx) {
+func (im *impl) WithContext(ctx context.Context) Wallet {
+	return &impl{
+		db:     im.db.WithContext(ctx),
+		source: im.source,
+	}
+}
+
+func (im *impl) WithSource(sourceID string) Wallet {
+	return &impl{
+		db:     im.db,
+		source: &sourceID,
+	}
+}
+
+func execRollBack(tx *db.Tx) {
 	if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
 		logrus.WithField("err", err).Error("tx.Rollback() failed in Deposit")
 	}
 	return
 }
 
-func (im *impl) Create(userID string) error {
-	result, err := im.db.Exec(checkIfWalletExists, userID)
-	if err != nil {
-		logrus.WithField("err", err).Error("im.db.Exec(checkIfWalletExists) failed in Create")
-		return err
+// checkRole makes sure that the caller has `role` of user's wallet
+// the owner has all roles, and the role of other members is recorded in UsersWalletMember
+// the wallet attached to a group or a room is only operated from it if the caller is bound to a source
+func (im *impl) checkRole(exec executor, callerID, userID string, role Role) error {
+	if callerID == "" {
+		return ErrPermissionDenied
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in Create")
+	ownerID, sourceID := "", ""
+	if err := exec.QueryRow(getOwnerAndSource, userID).Scan(&ownerID, &sourceID); err == sql.ErrNoRows {
+		return ErrWalletNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(getOwnerAndSource) failed in checkRole")
 		return err
 	}
 
-	if rowsAffected == int64(1) {
-		return ErrWalletExist
+	if im.source != nil && sourceID != "" && sourceID != *im.source {
+		return ErrPermissionDenied
 	}
 
-	result, err = im.db.Exec(createWallet, userID, int64(0))
-	if err != nil {
-		logrus.WithField("err", err).Error("im.db.Exec(createWallet) failed in Create")
-		return err
+	// nobody is allowed to operate wallets without owner, until maintainers assign the owner by SetOwner
+	if ownerID == "" {
+		return ErrPermissionDenied
+	} else if ownerID == callerID {
+		return nil
 	}
 
-	if rowsAffected, err = result.RowsAffected(); err != nil || err == nil && rowsAffected == int64(0) {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in Create")
+	memberRole := Role("")
+	if err := exec.QueryRow(getMemberRole, userID, callerID).Scan(&memberRole); err == sql.ErrNoRows {
+		return ErrPermissionDenied
+	} else if err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(getMemberRole) failed in checkRole")
 		return err
 	}
+
+	if !memberRole.covers(role) {
+		return ErrPermissionDenied
+	}
 	return nil
 }
 
-func (im *impl) Delete(userID string) error {
-	result, err := im.db.Exec(checkIfWalletExists, userID)
+// isWalletExist checks the wallet by querying the row,
+// as not every driver reports selected rows as affected rows
+func isWalletExist(exec executor, userID string) (bool, error) {
+	exist := 0
+	if err := exec.QueryRow(checkIfWalletExists, userID).Scan(&exist); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(checkIfWalletExists) failed in isWalletExist")
+		return false, err
+	}
+	return true, nil
+}
+
+func (im *impl) Create(callerID, userID string, options ...CreateOption) error {
+	if callerID == "" {
+		return ErrPermissionDenied
+	}
+	option := initCreateOption(options...)
+	currency, err := money.GetCurrency(option.currency)
+	if err != nil {
+		return ErrInvalidCurrency
+	}
+
+	exist, err := isWalletExist(im.db, userID)
 	if err != nil {
-		logrus.WithField("err", err).Error("im.db.Exec(checkIfWalletExists) failed in Delete")
 		return err
 	}
+	if exist {
+		return ErrWalletExist
+	}
 
-	rowsAffected, err := result.RowsAffected()
+	result, err := im.db.Exec(createWallet, userID, int64(0), callerID, option.sourceID, currency.Code)
 	if err != nil {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in Delete")
+		logrus.WithField("err", err).Error("im.db.Exec(createWallet) failed in Create")
 		return err
 	}
 
-	if rowsAffected == int64(0) {
-		return ErrWalletNotFound
+	if rowsAffected, err := result.RowsAffected(); err != nil || err == nil && rowsAffected == int64(0) {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in Create")
+		return err
 	}
+	return nil
+}
 
+func (im *impl) Delete(callerID, userID string) error {
 	tx, err := im.db.Begin()
 	if err != nil {
 		logrus.WithField("err", err).Error("im.db.Begin failed in Delete")
@@ -120,13 +185,53 @@ func (im *impl) Delete(userID string) error {
 	}
 	defer execRollBack(tx)
 
+	if err := im.checkRole(tx, callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
 	if _, err := tx.Exec(deleteWallet, userID); err != nil {
 		logrus.WithField("err", err).Error("tx.Exec(deleteWallet) failed in Delete")
 		return err
 	}
 
-	if _, err := tx.Exec(deleteAllWalletLogs, userID); err != nil {
-		logrus.WithField("err", err).Error("tx.Exec(deleteAllWalletLogs failed in Delete")
+	// history of the wallet is kept in the journal, but it's no longer attached to the wallet name
+	if _, err := tx.Exec(closePostings, equityClosed, walletAccount(userID)); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(closePostings) failed in Delete")
+		return err
+	}
+
+	if _, err := tx.Exec(insertAccount, equityClosed, accountKindEquity); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(insertAccount) failed in Delete")
+		return err
+	}
+
+	if _, err := tx.Exec(deleteAccount, walletAccount(userID)); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteAccount) failed in Delete")
+		return err
+	}
+
+	if _, err := tx.Exec(deleteAllMembers, userID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteAllMembers) failed in Delete")
+		return err
+	}
+
+	if _, err := tx.Exec(deleteAllCategories, userID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteAllCategories) failed in Delete")
+		return err
+	}
+
+	if _, err := tx.Exec(deleteAllBudgets, userID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteAllBudgets) failed in Delete")
+		return err
+	}
+
+	// the wallet may be created again with the same name, and its imports and keys should start over
+	if _, err := tx.Exec(deleteAllImports, userID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteAllImports) failed in Delete")
+		return err
+	}
+	if _, err := tx.Exec(deleteAllIdempotencyKeys, userID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteAllIdempotencyKeys) failed in Delete")
 		return err
 	}
 
@@ -137,7 +242,7 @@ func (im *impl) Delete(userID string) error {
 	return nil
 }
 
-func (im *impl) EmptyBalance(userID string) error {
+func (im *impl) EmptyBalance(callerID, userID string) error {
 	tx, err := im.db.Begin()
 	if err != nil {
 		logrus.WithField("err", err).Error("im.db.Begin failed in EmptyBalance")
@@ -145,22 +250,32 @@ func (im *impl) EmptyBalance(userID string) error {
 	}
 	defer execRollBack(tx)
 
-	result, err := tx.Exec(patchWallet, int64(0), userID)
-	if err != nil {
-		logrus.WithField("err", err).Error("tx.Exec(patchWallet) failed in EmptyBalance")
+	if err := im.checkRole(tx, callerID, userID, RoleOwner); err != nil {
 		return err
 	}
 
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in EmptyBalance")
-		return err
-	} else if rowsAffected == int64(0) {
+	balance := int64(0)
+	currency := ""
+	if err := tx.QueryRow(getBalanceForUpdate, userID).Scan(&balance, &currency); err == sql.ErrNoRows {
 		return ErrWalletNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("tx.QueryRow(getBalanceForUpdate) failed in EmptyBalance")
+		return err
 	}
 
-	if _, err := tx.Exec(deleteAllWalletLogs, userID); err != nil {
-		logrus.WithField("err", err).Error("tx.Exec(deleteAllWalletLogs) failed in EmptyBalance")
-		return err
+	// the balance is moved to equityAdjustment instead of deleting history
+	if balance != int64(0) {
+		if _, err := postTransaction(tx, &journalEntry{
+			reason:    emptyBalanceReason,
+			timestamp: time.Now().Unix(),
+			createdBy: callerID,
+			postings: []posting{
+				{account: walletAccount(userID), amount: -1 * balance, currency: currency},
+				{account: equityAdjustment, amount: balance, currency: currency},
+			},
+		}); err != nil {
+			return err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -170,7 +285,11 @@ func (im *impl) EmptyBalance(userID string) error {
 	return nil
 }
 
-func (im *impl) GetBalance(userID string) (int64, error) {
+func (im *impl) GetBalance(callerID, userID string) (int64, error) {
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return int64(0), err
+	}
+
 	balance := int64(0)
 	if err := im.db.QueryRow(getBalance, userID).Scan(
 		&balance,
@@ -183,7 +302,30 @@ func (im *impl) GetBalance(userID string) (int64, error) {
 	return balance, nil
 }
 
-func (im *impl) GetBalanceLogs(userID string, options ...GetLogsOption) ([]*BalanceLog, error) {
+// getWalletCurrency gets the currency code of user's wallet
+func getWalletCurrency(exec executor, userID string) (string, error) {
+	currency := ""
+	if err := exec.QueryRow(getCurrency, userID).Scan(&currency); err == sql.ErrNoRows {
+		return "", ErrWalletNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(getCurrency) failed in getWalletCurrency")
+		return "", err
+	}
+	return currency, nil
+}
+
+func (im *impl) GetCurrency(callerID, userID string) (string, error) {
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return "", err
+	}
+	return getWalletCurrency(im.db, userID)
+}
+
+func (im *impl) GetBalanceLogs(callerID, userID string, options ...GetLogsOption) ([]*BalanceLog, error) {
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
 	option := initOption(options...)
 
 	startTime := option.startTime
@@ -192,32 +334,32 @@ func (im *impl) GetBalanceLogs(userID string, options ...GetLogsOption) ([]*Bala
 		endTime = time.Now().Unix()
 	}
 
-	rows, err := im.db.Query(getWalletLogs, userID, startTime, endTime)
+	rows, err := im.db.Query(getWalletLogs, walletAccount(userID), startTime, endTime, option.category)
 	if err != nil {
 		logrus.WithField("err", err).Error("im.db.Query(getWalletLogs) failed in GetBalanceLogs")
 		return nil, err
 	}
+	defer rows.Close()
 
 	balanceLogs := []*BalanceLog{}
 	for rows.Next() {
-		reason := ""
-		amount := int64(0)
-		timestamp := int64(0)
-		if err := rows.Scan(&reason, &amount, &timestamp); err != nil {
-			logrus.WithField("err", err).Error("rows.Scan failed in GetBalanceLogs")
+		balanceLog, err := scanBalanceLog(rows)
+		if err != nil {
+			logrus.WithField("err", err).Error("scanBalanceLog failed in GetBalanceLogs")
 			return nil, err
 		}
-
-		balanceLogs = append(balanceLogs, &BalanceLog{
-			Amount:    amount,
-			Reason:    reason,
-			Timestamp: base.ParseToyyymmddhhmm(timestamp),
-		})
+		balanceLogs = append(balanceLogs, balanceLog)
 	}
 	return balanceLogs, nil
 }
 
-func (im *impl) Deposit(userID string, amount int64, reason string) error {
+func (im *impl) Deposit(callerID, userID string, amount int64, reason string, options ...RecordOption) error {
+	option := initRecordOption(options...)
+	tags, err := joinTags(option.tags)
+	if err != nil {
+		return err
+	}
+
 	tx, err := im.db.Begin()
 	if err != nil {
 		logrus.WithField("err", err).Error("im.db.Begin failed in Deposit")
@@ -225,30 +367,66 @@ func (im *impl) Deposit(userID string, amount int64, reason string) error {
 	}
 	defer execRollBack(tx)
 
-	result, err := tx.Exec(atomicPatchWallet, amount, userID)
-	if err != nil {
-		logrus.WithField("err", err).Error("tx.Exec(atomicPatchWallet) failed in Deposit")
+	if err := im.checkRole(tx, callerID, userID, RoleEditor); err != nil {
 		return err
 	}
 
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in Deposit")
+	// the request with the same key is recorded already, so nothing is recorded again
+	if option.idempotencyKey != "" {
+		recorded, err := isKeyRecorded(tx, userID, option.idempotencyKey)
+		if err != nil {
+			return err
+		}
+		if recorded {
+			return ErrDuplicateRequest
+		}
+	}
+
+	if err := checkCategory(tx, userID, option.category); err != nil {
 		return err
-	} else if err == nil && rowsAffected == int64(0) {
-		return ErrWalletNotFound
 	}
 
-	result, err = tx.Exec(insertWalletLog, userID, reason, amount, time.Now().Unix())
+	currency, err := getWalletCurrency(tx, userID)
 	if err != nil {
-		logrus.WithField("err", err).Error("tx.Exec(insertWalletLog) failed in Deposit")
 		return err
 	}
 
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in Deposit")
+	// convert the amount into the currency of the wallet if it's recorded in another currency
+	walletAmount := amount
+	var c *conversion
+	if option.currency != "" {
+		converted, rate, err := convert(storedRates(tx), walletAmount, option.currency, currency, option.timestamp)
+		if err != nil {
+			return err
+		}
+		if rate.Base != rate.Quote {
+			c = &conversion{amount: walletAmount, currency: rate.Base, rate: rate}
+			walletAmount = converted
+		}
+	}
+
+	transactionID, err := postTransaction(tx, &journalEntry{
+		reason:     reason,
+		timestamp:  option.timestamp,
+		category:   option.category,
+		tags:       tags,
+		createdBy:  callerID,
+		postings:   recordPostings(userID, currency, walletAmount, c),
+		conversion: c,
+	})
+	if err != nil {
 		return err
-	} else if err == nil && rowsAffected == int64(0) {
-		return ErrWalletNotFound
+	}
+
+	if option.idempotencyKey != "" {
+		recorded, err := recordKey(tx, userID, option.idempotencyKey, transactionID)
+		if err != nil {
+			return err
+		}
+		if !recorded {
+			// the concurrent request with the same key is committed first, so this one is rolled back
+			return ErrDuplicateRequest
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -258,7 +436,13 @@ func (im *impl) Deposit(userID string, amount int64, reason string) error {
 	return nil
 }
 
-func (im *impl) Spend(userID string, amount int64, reason string) error {
+func (im *impl) Spend(callerID, userID string, amount int64, reason string, options ...RecordOption) error {
+	option := initRecordOption(options...)
+	tags, err := joinTags(option.tags)
+	if err != nil {
+		return err
+	}
+
 	tx, err := im.db.Begin()
 	if err != nil {
 		logrus.WithField("err", err).Error("im.db.Begin failed in Spend")
@@ -266,30 +450,66 @@ func (im *impl) Spend(userID string, amount int64, reason string) error {
 	}
 	defer execRollBack(tx)
 
-	result, err := im.db.Exec(atomicPatchWallet, -1*amount, userID)
-	if err != nil {
-		logrus.WithField("err", err).Error("im.db.Exec(atomicPatchWallet) failed in Spend")
+	if err := im.checkRole(tx, callerID, userID, RoleEditor); err != nil {
 		return err
 	}
 
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in Spend")
+	// the request with the same key is recorded already, so nothing is recorded again
+	if option.idempotencyKey != "" {
+		recorded, err := isKeyRecorded(tx, userID, option.idempotencyKey)
+		if err != nil {
+			return err
+		}
+		if recorded {
+			return ErrDuplicateRequest
+		}
+	}
+
+	if err := checkCategory(tx, userID, option.category); err != nil {
 		return err
-	} else if err == nil && rowsAffected == int64(0) {
-		return ErrWalletNotFound
 	}
 
-	result, err = tx.Exec(insertWalletLog, userID, reason, -1*amount, time.Now().Unix())
+	currency, err := getWalletCurrency(tx, userID)
 	if err != nil {
-		logrus.WithField("err", err).Error("tx.Exec(insertWalletLog) failed in Spend")
 		return err
 	}
 
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in Spend")
+	// convert the amount into the currency of the wallet if it's recorded in another currency
+	walletAmount := -1 * amount
+	var c *conversion
+	if option.currency != "" {
+		converted, rate, err := convert(storedRates(tx), walletAmount, option.currency, currency, option.timestamp)
+		if err != nil {
+			return err
+		}
+		if rate.Base != rate.Quote {
+			c = &conversion{amount: walletAmount, currency: rate.Base, rate: rate}
+			walletAmount = converted
+		}
+	}
+
+	transactionID, err := postTransaction(tx, &journalEntry{
+		reason:     reason,
+		timestamp:  option.timestamp,
+		category:   option.category,
+		tags:       tags,
+		createdBy:  callerID,
+		postings:   recordPostings(userID, currency, walletAmount, c),
+		conversion: c,
+	})
+	if err != nil {
 		return err
-	} else if err == nil && rowsAffected == int64(0) {
-		return ErrWalletNotFound
+	}
+
+	if option.idempotencyKey != "" {
+		recorded, err := recordKey(tx, userID, option.idempotencyKey, transactionID)
+		if err != nil {
+			return err
+		}
+		if !recorded {
+			// the concurrent request with the same key is committed first, so this one is rolled back
+			return ErrDuplicateRequest
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -299,21 +519,157 @@ func (im *impl) Spend(userID string, amount int64, reason string) error {
 	return nil
 }
 
-func (im *impl) IsWalletExist(userID string) bool {
-	result, err := im.db.Exec(checkIfWalletExists, userID)
+// balancePatch is the change of the balance of a wallet
+type balancePatch struct {
+	userID string
+	amount int64
+}
+
+// applyBalancePatches patches balances of wallets
+// wallets are always locked in the same order, so that two opposite transactions won't deadlock
+// patches that decrease the balance are only applied if the overdraft policy allows them
+func applyBalancePatches(exec executor, patches []balancePatch) error {
+	sort.Slice(patches, func(i, j int) bool {
+		return patches[i].userID < patches[j].userID
+	})
+
+	for _, patch := range patches {
+		statement := atomicPatchWallet
+		if patch.amount < int64(0) {
+			statement = withdrawWallet
+		}
+
+		result, err := exec.Exec(statement, patch.amount, patch.userID)
+		if err != nil {
+			logrus.WithField("err", err).Error("exec.Exec(statement) failed in applyBalancePatches")
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			logrus.WithField("err", err).Error("result.RowsAffected failed in applyBalancePatches")
+			return err
+		} else if rowsAffected != int64(0) {
+			continue
+		}
+
+		// nothing is patched, either the wallet doesn't exist or the overdraft policy refuses it
+		exist := 0
+		if err := exec.QueryRow(checkIfWalletExists, patch.userID).Scan(&exist); err == sql.ErrNoRows {
+			return ErrWalletNotFound
+		} else if err != nil {
+			logrus.WithField("err", err).Error("exec.QueryRow(checkIfWalletExists) failed in applyBalancePatches")
+			return err
+		}
+		return ErrInsufficientBalance
+	}
+	return nil
+}
+
+func (im *impl) Transfer(callerID, fromUserID, toUserID string, amount int64, reason string, options ...RecordOption) error {
+	if fromUserID == toUserID {
+		return ErrInvalidTransfer
+	}
+	// money only moves from the source wallet, where the idempotency key is recorded
+	if amount <= int64(0) {
+		return ErrInvalidAmount
+	}
+	option := initRecordOption(options...)
+
+	tx, err := im.db.Begin()
 	if err != nil {
-		logrus.WithField("err", err).Error("im.db.Exec(checkIfWalletExists) failed in Create")
-		return false
+		logrus.WithField("err", err).Error("im.db.Begin failed in Transfer")
+		return err
+	}
+	defer execRollBack(tx)
+
+	if err := im.checkRole(tx, callerID, fromUserID, RoleEditor); err != nil {
+		return err
+	}
+	if err := im.checkRole(tx, callerID, toUserID, RoleEditor); err != nil {
+		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	// the request with the same key is recorded already, so nothing is recorded again
+	if option.idempotencyKey != "" {
+		recorded, err := isKeyRecorded(tx, fromUserID, option.idempotencyKey)
+		if err != nil {
+			return err
+		}
+		if recorded {
+			return ErrDuplicateRequest
+		}
+	}
+
+	currency, err := getWalletCurrency(tx, fromUserID)
 	if err != nil {
-		logrus.WithField("err", err).Error("result.RowsAffected failed in Create")
-		return false
+		return err
+	}
+	toCurrency, err := getWalletCurrency(tx, toUserID)
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	postings := []posting{
+		{account: walletAccount(fromUserID), amount: -1 * amount, currency: currency},
+		{account: walletAccount(toUserID), amount: amount, currency: currency},
 	}
 
-	if rowsAffected == int64(0) {
+	// the money is converted through equityExchange if currencies of wallets are different
+	var c *conversion
+	if toCurrency != currency {
+		converted, rate, err := convert(storedRates(tx), amount, currency, toCurrency, timestamp)
+		if err != nil {
+			return err
+		}
+		c = &conversion{amount: amount, currency: currency, rate: rate}
+		postings = []posting{
+			{account: walletAccount(fromUserID), amount: -1 * amount, currency: currency},
+			{account: equityExchange, amount: amount, currency: currency},
+			{account: equityExchange, amount: -1 * converted, currency: toCurrency},
+			{account: walletAccount(toUserID), amount: converted, currency: toCurrency},
+		}
+	}
+
+	// both wallets are posted in the same transaction, so they are the counterparty of each other
+	transactionID, err := postTransaction(tx, &journalEntry{
+		reason:     reason,
+		timestamp:  timestamp,
+		createdBy:  callerID,
+		postings:   postings,
+		conversion: c,
+	})
+	if err != nil {
+		return err
+	}
+
+	if option.idempotencyKey != "" {
+		recorded, err := recordKey(tx, fromUserID, option.idempotencyKey, transactionID)
+		if err != nil {
+			return err
+		}
+		if !recorded {
+			// the concurrent request with the same key is committed first, so this one is rolled back
+			return ErrDuplicateRequest
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in Transfer")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) IsWalletExist(userID string) bool {
+	exist, err := isWalletExist(im.db, userID)
+	if err != nil {
 		return false
 	}
-	return true
+	return exist
+}
+
+func (im *impl) Authorize(callerID, userID string, role Role) error {
+	return im.checkRole(im.db, callerID, userID, role)
 }
@@ -0,0 +1,101 @@
+package wallet_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+	"github.com/andy/guachi-pay-line-bot/wallet/wallettest"
+)
+
+const (
+	// addBalance changes the cached balance without any posting, so that tests can make drift
+	addBalance = `UPDATE "UsersWallet" SET balance = balance + $1 WHERE "userID" = $2`
+)
+
+// sqlDrift makes drift in `*dbSrv`, which is the database of the wallet created last
+func sqlDrift(dbSrv **db.DB) wallettest.Drift {
+	return func(t *testing.T, wallet wl.Wallet, userID string, amount int64) {
+		if _, err := (*dbSrv).Exec(addBalance, amount, userID); err != nil {
+			t.Fatalf("dbSrv.Exec(addBalance) failed: %v", err)
+		}
+	}
+}
+
+func TestSQLiteWallet(t *testing.T) {
+	var current *db.DB
+	wallettest.Run(t, func(t *testing.T) wl.Wallet {
+		dbSrv, err := db.Open("sqlite://" + filepath.Join(t.TempDir(), "wallet.db"))
+		if err != nil {
+			t.Fatalf("db.Open failed: %v", err)
+		}
+		t.Cleanup(func() {
+			dbSrv.Close()
+		})
+
+		if _, err := db.Migrate(dbSrv); err != nil {
+			t.Fatalf("db.Migrate failed: %v", err)
+		}
+		current = dbSrv
+		return wl.NewSQLWallet(dbSrv)
+	}, wallettest.WithDrift(sqlDrift(&current)))
+}
+
+// TestPostgresWallet drops all tables of TEST_DATABASE_URL, so it should never be a database in use
+func TestPostgresWallet(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	dbSrv, err := db.Open(databaseURL)
+	if err != nil {
+		t.Fatalf("db.Open failed: %v", err)
+	}
+	defer dbSrv.Close()
+
+	wallettest.Run(t, func(t *testing.T) wl.Wallet {
+		if _, err := db.MigrateTo(dbSrv, 0); err != nil {
+			t.Fatalf("db.MigrateTo(0) failed: %v", err)
+		}
+		if _, err := db.Migrate(dbSrv); err != nil {
+			t.Fatalf("db.Migrate failed: %v", err)
+		}
+		return wl.NewSQLWallet(dbSrv)
+	}, wallettest.WithDrift(sqlDrift(&dbSrv)))
+}
+
+// TestSQLiteLegacyWallet migrates wallets stored before the journal, and their logs should agree with balances
+func TestSQLiteLegacyWallet(t *testing.T) {
+	dbSrv, err := db.Open("sqlite://" + filepath.Join(t.TempDir(), "wallet.db"))
+	if err != nil {
+		t.Fatalf("db.Open failed: %v", err)
+	}
+	defer dbSrv.Close()
+
+	if _, err := dbSrv.Exec(`
+		CREATE TABLE "UsersWallet" ("userID" TEXT PRIMARY KEY, balance BIGINT NOT NULL DEFAULT 0);
+		CREATE TABLE "UsersWalletLog" ("userID" TEXT NOT NULL, reason TEXT NOT NULL DEFAULT '', amount BIGINT NOT NULL, timestamp BIGINT NOT NULL);
+		INSERT INTO "UsersWallet" ("userID", balance) VALUES ('guachi', 250);
+		INSERT INTO "UsersWalletLog" ("userID", reason, amount, timestamp) VALUES ('guachi', '薪水', 500, 1558310400);
+		INSERT INTO "UsersWalletLog" ("userID", reason, amount, timestamp) VALUES ('guachi', '午餐', -200, 1558314000);
+	`); err != nil {
+		t.Fatalf("creating legacy wallets failed: %v", err)
+	}
+	if _, err := db.Migrate(dbSrv); err != nil {
+		t.Fatalf("db.Migrate failed: %v", err)
+	}
+
+	drifts, err := wl.NewSQLWallet(dbSrv).ReconcileAll(false)
+	if err != nil {
+		t.Fatalf("ReconcileAll failed: %v", err)
+	}
+	if len(drifts) != 0 {
+		t.Fatalf("legacy wallets drift after the migration: %+v", drifts[0])
+	}
+}
@@ -0,0 +1,115 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+)
+
+const (
+	// LedgerImport related statements
+	// it records hashes of imported entries of each wallet, so that the same entry isn't imported twice
+	checkIfImported = `SELECT 1 FROM "LedgerImport" WHERE "userID" = $1 AND hash = $2`
+	insertImport    = `
+		INSERT INTO "LedgerImport" ("userID", hash, "transactionID")
+			VALUES ($1, $2, $3);
+	`
+	deleteAllImports = `DELETE FROM "LedgerImport" WHERE "userID" = $1`
+)
+
+// getImportHash hashes the date, the amount and the reason of the entry
+// `occurrence` tells identical entries apart, ex: two cups of coffee of the same price on the same day,
+// so that they are both imported, and both of them are skipped when the same file is imported again
+func getImportHash(entry *ImportEntry, occurrence int) string {
+	text := base.ParseToyyymmdd(entry.Timestamp) + "|" + strconv.FormatInt(entry.Amount, 10) + "|" + entry.Reason + "|" + strconv.Itoa(occurrence)
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+func isImported(exec executor, userID, hash string) (bool, error) {
+	exist := 0
+	if err := exec.QueryRow(checkIfImported, userID, hash).Scan(&exist); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(checkIfImported) failed in isImported")
+		return false, err
+	}
+	return true, nil
+}
+
+func (im *impl) ImportEntries(callerID, userID string, entries []*ImportEntry) (*ImportResult, error) {
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in ImportEntries")
+		return nil, err
+	}
+	defer execRollBack(tx)
+
+	if err := im.checkRole(tx, callerID, userID, RoleEditor); err != nil {
+		return nil, err
+	}
+
+	currency, err := getWalletCurrency(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	occurrences := map[string]int{}
+	for _, entry := range entries {
+		if entry.Amount == int64(0) {
+			result.Skipped++
+			continue
+		}
+
+		key := getImportHash(entry, 0)
+		occurrences[key]++
+		hash := getImportHash(entry, occurrences[key])
+
+		imported, err := isImported(tx, userID, hash)
+		if err != nil {
+			return nil, err
+		}
+		if imported {
+			result.Skipped++
+			continue
+		}
+
+		// categories of statements are added to the wallet, so that logs can still be filtered by them
+		if entry.Category != "" {
+			if _, err := tx.Exec(insertCategory, userID, entry.Category); err != nil {
+				logrus.WithField("err", err).Error("tx.Exec(insertCategory) failed in ImportEntries")
+				return nil, err
+			}
+		}
+
+		// the overdraft policy is enforced by postTransaction, and the refused entry rolls back the whole import
+		transactionID, err := postTransaction(tx, &journalEntry{
+			reason:    entry.Reason,
+			timestamp: entry.Timestamp,
+			category:  entry.Category,
+			createdBy: callerID,
+			postings:  recordPostings(userID, currency, entry.Amount, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec(insertImport, userID, hash, transactionID); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(insertImport) failed in ImportEntries")
+			return nil, err
+		}
+		result.Imported++
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in ImportEntries")
+		return nil, err
+	}
+	return result, nil
+}
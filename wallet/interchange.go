@@ -0,0 +1,274 @@
+package wallet
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	"github.com/andy/guachi-pay-line-bot/money"
+)
+
+// logs are exported to ledger-cli and beancount as plain-text accounts
+// (1) the wallet is Assets:Wallet:<wallet name>, and the other wallet of a transfer is the same as well
+// (2) deposits go from Income:<category> and spending goes to Expenses:<category>, it's Uncategorized without category
+// (3) logs before the time range are summed as the opening balance from Equity:Opening-Balances
+
+const (
+	getOpeningBalance = `
+		SELECT
+			COALESCE(SUM(posting.amount), 0)
+		FROM
+			"LedgerPosting" posting
+		JOIN
+			"LedgerTransaction" txn
+		ON
+			txn.id = posting."transactionID"
+		WHERE
+			posting.account = $1 AND txn.timestamp < $2
+	`
+)
+
+const (
+	accountWalletPrefix    = "Assets:Wallet:"
+	accountIncomePrefix    = "Income:"
+	accountExpensesPrefix  = "Expenses:"
+	accountUncategorized   = "Uncategorized"
+	accountOpeningBalances = "Equity:Opening-Balances"
+	openingBalanceReason   = "期初餘額"
+)
+
+// CategoryAccount gets the account name of the category, ex: spending in 餐飲 is Expenses:餐飲
+// `amount` is signed as BalanceLog.Amount, and deposits come from Income accounts
+func CategoryAccount(category string, amount int64) string {
+	if category == "" {
+		category = accountUncategorized
+	}
+	if amount > int64(0) {
+		return accountIncomePrefix + category
+	}
+	return accountExpensesPrefix + category
+}
+
+// AccountCategory gets the category of the account name, and it's the reverse of CategoryAccount
+// ex: Expenses:餐飲 is 餐飲, and names without Income or Expenses are used as they are
+func AccountCategory(account string) string {
+	account = strings.TrimSpace(account)
+	for _, prefix := range []string{accountIncomePrefix, accountExpensesPrefix} {
+		if strings.HasPrefix(account, prefix) {
+			account = strings.TrimPrefix(account, prefix)
+			break
+		}
+	}
+	if account == accountUncategorized {
+		return ""
+	}
+	return account
+}
+
+// journalAccount makes the account name valid in the format
+// components can't contain spaces or `:`, and components of beancount should start with a capital letter or a digit
+func journalAccount(account string, format ExportFormat) string {
+	components := strings.Split(account, ":")
+	for i, component := range components {
+		component = strings.Replace(component, " ", "-", -1)
+		if format == ExportBeancount && component != "" {
+			first := []rune(component)[0]
+			if first < unicode.MaxASCII && !unicode.IsUpper(first) && !unicode.IsDigit(first) {
+				if unicode.IsLower(first) {
+					component = string(unicode.ToUpper(first)) + string([]rune(component)[1:])
+				} else {
+					component = "X" + component
+				}
+			}
+		}
+		components[i] = component
+	}
+	return strings.Join(components, ":")
+}
+
+// journalPosting is a line of a journal entry
+type journalPosting struct {
+	account string
+	amount  string
+}
+
+// journalTransaction is a journal entry of ledger-cli or beancount
+type journalTransaction struct {
+	// date is formatted as 2019/05/20
+	date     string
+	reason   string
+	tags     []string
+	postings []journalPosting
+}
+
+func formatJournalAmount(amount int64, currency string) string {
+	return money.FormatDecimal(amount, currency) + " " + currency
+}
+
+// getJournalTransaction turns the log into a journal entry,
+// and the other side of the converted log is in the original currency with the total price in the currency of the wallet
+func getJournalTransaction(userID, currency string, balanceLog *BalanceLog) *journalTransaction {
+	other := CategoryAccount(balanceLog.Category, balanceLog.Amount)
+	if balanceLog.CounterpartyID != "" {
+		other = accountWalletPrefix + balanceLog.CounterpartyID
+	}
+
+	otherAmount := formatJournalAmount(-1*balanceLog.Amount, currency)
+	if c := balanceLog.Conversion; c != nil {
+		price := balanceLog.Amount
+		if price < int64(0) {
+			price = -1 * price
+		}
+		otherAmount = formatJournalAmount(-1*c.Amount, c.Currency) + " @@ " + formatJournalAmount(price, currency)
+	}
+
+	return &journalTransaction{
+		date:   strings.SplitN(balanceLog.Timestamp, " ", 2)[0],
+		reason: balanceLog.Reason,
+		tags:   balanceLog.Tags,
+		postings: []journalPosting{
+			{account: accountWalletPrefix + userID, amount: formatJournalAmount(balanceLog.Amount, currency)},
+			{account: other, amount: otherAmount},
+		},
+	}
+}
+
+func writeLedger(writer io.Writer, transactions []*journalTransaction) error {
+	for _, txn := range transactions {
+		header := txn.date + " * " + txn.reason
+		if len(txn.tags) != 0 {
+			header += "  ; :" + strings.Join(txn.tags, ":") + ":"
+		}
+		if _, err := fmt.Fprintln(writer, header); err != nil {
+			return err
+		}
+
+		for _, p := range txn.postings {
+			if _, err := fmt.Fprintln(writer, "    "+journalAccount(p.account, ExportLedger)+"  "+p.amount); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(writer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBeancount(writer io.Writer, transactions []*journalTransaction) error {
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	// accounts should be opened before they are used, so all of them are opened on the first date
+	accounts := map[string]bool{}
+	for _, txn := range transactions {
+		for _, p := range txn.postings {
+			accounts[journalAccount(p.account, ExportBeancount)] = true
+		}
+	}
+	names := []string{}
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	firstDate := strings.Replace(transactions[0].date, "/", "-", -1)
+	for _, name := range names {
+		if _, err := fmt.Fprintln(writer, firstDate+" open "+name); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(writer); err != nil {
+		return err
+	}
+
+	for _, txn := range transactions {
+		header := strings.Replace(txn.date, "/", "-", -1) + ` * "` + strings.Replace(txn.reason, `"`, `\"`, -1) + `"`
+		for _, tag := range txn.tags {
+			header += " #" + strings.Replace(tag, " ", "-", -1)
+		}
+		if _, err := fmt.Fprintln(writer, header); err != nil {
+			return err
+		}
+
+		for _, p := range txn.postings {
+			if _, err := fmt.Fprintln(writer, "  "+journalAccount(p.account, ExportBeancount)+"  "+p.amount); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(writer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportJournal writes logs of the wallet in the time range as ledger-cli or beancount journal
+func (im *impl) exportJournal(userID string, timeRange TimeRange, format ExportFormat, writer io.Writer) error {
+	currency, err := getWalletCurrency(im.db, userID)
+	if err != nil {
+		return err
+	}
+
+	// logs before the time range are summed as the opening balance
+	opening := int64(0)
+	if err := im.db.QueryRow(getOpeningBalance, walletAccount(userID), timeRange.Start).Scan(&opening); err != nil {
+		logrus.WithField("err", err).Error("im.db.QueryRow(getOpeningBalance) failed in exportJournal")
+		return err
+	}
+
+	// getWalletLogs includes the end of the range
+	rows, err := im.db.Query(getWalletLogs, walletAccount(userID), timeRange.Start, timeRange.End-1, "")
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query(getWalletLogs) failed in exportJournal")
+		return err
+	}
+	defer rows.Close()
+
+	balanceLogs := []*BalanceLog{}
+	for rows.Next() {
+		balanceLog, err := scanBalanceLog(rows)
+		if err != nil {
+			logrus.WithField("err", err).Error("scanBalanceLog failed in exportJournal")
+			return err
+		}
+		balanceLogs = append(balanceLogs, balanceLog)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithField("err", err).Error("rows.Err failed in exportJournal")
+		return err
+	}
+	return writeJournal(writer, userID, currency, opening, balanceLogs, timeRange, format)
+}
+
+// writeJournal writes logs of the wallet in the time range as ledger-cli or beancount journal,
+// and `opening` is the sum of logs before the time range
+func writeJournal(writer io.Writer, userID, currency string, opening int64, balanceLogs []*BalanceLog, timeRange TimeRange, format ExportFormat) error {
+	transactions := []*journalTransaction{}
+	for _, balanceLog := range balanceLogs {
+		transactions = append(transactions, getJournalTransaction(userID, currency, balanceLog))
+	}
+
+	if opening != int64(0) {
+		openingTransaction := &journalTransaction{
+			date:   base.ParseToyyymmdd(timeRange.Start),
+			reason: openingBalanceReason,
+			postings: []journalPosting{
+				{account: accountWalletPrefix + userID, amount: formatJournalAmount(opening, currency)},
+				{account: accountOpeningBalances, amount: formatJournalAmount(-1*opening, currency)},
+			},
+		}
+		transactions = append([]*journalTransaction{openingTransaction}, transactions...)
+	}
+
+	if format == ExportBeancount {
+		return writeBeancount(writer, transactions)
+	}
+	return writeLedger(writer, transactions)
+}
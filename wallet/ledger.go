@@ -0,0 +1,268 @@
+package wallet
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+)
+
+// the wallet is stored as a double-entry journal
+// (1) every wallet has an account, and money comes from or goes to equity accounts outside of wallets
+// (2) a transaction is what users record, ex: a deposit, a spending or a transfer
+// (3) a transaction has postings to accounts, and amounts of its postings in each currency always sum to zero
+// the balance in UsersWallet is only a cache of the sum of postings to the wallet account,
+// and it's updated in the same transaction as postings
+
+const (
+	// LedgerAccount related statements
+	insertAccount = `
+		INSERT INTO "LedgerAccount" (name, kind)
+			VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;
+	`
+	deleteAccount = `DELETE FROM "LedgerAccount" WHERE name = $1`
+
+	// LedgerTransaction related statements
+	// the original amount and the rate are recorded if the transaction is converted from another currency
+	insertTransaction = `
+		INSERT INTO "LedgerTransaction" (
+			reason, timestamp, category, tags, "createdBy", "originalAmount", "originalCurrency", rate, "rateDate"
+		)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id;
+	`
+	updateTransactionReason = `UPDATE "LedgerTransaction" SET reason = $1 WHERE id = $2;`
+	deleteTransaction       = `DELETE FROM "LedgerTransaction" WHERE id = $1`
+
+	// LedgerPosting related statements
+	insertPosting = `
+		INSERT INTO "LedgerPosting" ("transactionID", account, amount, currency)
+			VALUES ($1, $2, $3, $4);
+	`
+	getPostingForUpdate  = `SELECT "transactionID" FROM "LedgerPosting" WHERE id = $1 AND account = $2 FOR UPDATE`
+	getPostingsForUpdate = `
+		SELECT
+			id, account, amount, currency
+		FROM
+			"LedgerPosting"
+		WHERE
+			"transactionID" = $1
+		ORDER BY
+			id
+		FOR UPDATE
+	`
+	updatePostingAmount = `UPDATE "LedgerPosting" SET amount = $1 WHERE id = $2;`
+	deletePostings      = `DELETE FROM "LedgerPosting" WHERE "transactionID" = $1`
+	// postings of the deleted wallet are taken over by equityClosed, so that transactions remain balanced
+	closePostings = `UPDATE "LedgerPosting" SET account = $1 WHERE account = $2;`
+
+	// a balance log is a posting to the wallet account,
+	// and the counterparty is the other wallet account of the same transaction if it's a transfer
+	selectBalanceLogs = `
+		SELECT
+			posting.id, txn.reason, posting.amount, txn.timestamp,
+			COALESCE(counterparty.account, ''), txn.category, txn.tags,
+			posting.currency, txn."originalAmount", txn."originalCurrency", txn.rate, txn."rateDate"
+		FROM
+			"LedgerPosting" posting
+		JOIN
+			"LedgerTransaction" txn
+		ON
+			txn.id = posting."transactionID"
+		LEFT JOIN
+			"LedgerPosting" counterparty
+		ON
+			counterparty."transactionID" = posting."transactionID"
+			AND counterparty.id <> posting.id
+			AND counterparty.account LIKE 'wallet:%'
+	`
+)
+
+const (
+	accountKindWallet = "wallet"
+	accountKindEquity = "equity"
+
+	// walletAccountPrefix is the prefix of wallet account names, ex: wallet:guachi
+	walletAccountPrefix = "wallet:"
+	// equityExternal is the other side of deposits and spending
+	equityExternal = "equity:external"
+	// equityAdjustment is the other side of emptying wallets
+	equityAdjustment = "equity:adjustment"
+	// equityClosed takes over postings of deleted wallets
+	equityClosed = "equity:closed"
+
+	// emptyBalanceReason is the reason of the transaction that empties the wallet
+	emptyBalanceReason = "清空錢包"
+	// reconcileReason is the reason of the transaction that repairs drift
+	reconcileReason = "對帳調整"
+)
+
+var (
+	// errUnbalancedTransaction occurs when amounts of postings don't sum to zero, it's a bug if it happens
+	errUnbalancedTransaction = fmt.Errorf("the transaction is unbalanced")
+)
+
+// posting is the change of an account in a transaction
+type posting struct {
+	id      int64
+	account string
+	// amount is minor units of the currency, and wallet accounts are always posted in the currency of the wallet
+	amount   int64
+	currency string
+}
+
+// journalEntry is a transaction that is going to be posted
+type journalEntry struct {
+	reason    string
+	timestamp int64
+	category  string
+	tags      string
+	createdBy string
+	postings  []posting
+	// conversion is nil unless the transaction is converted from another currency
+	conversion *conversion
+	// balanceCached means cached balances already include the transaction, it's only used to repair drift
+	balanceCached bool
+}
+
+func walletAccount(userID string) string {
+	return walletAccountPrefix + userID
+}
+
+func isWalletAccount(account string) bool {
+	return strings.HasPrefix(account, walletAccountPrefix)
+}
+
+func accountKind(account string) string {
+	if isWalletAccount(account) {
+		return accountKindWallet
+	}
+	return accountKindEquity
+}
+
+// walletUserID gets the wallet name of the wallet account, and empty string for other accounts
+func walletUserID(account string) string {
+	if !isWalletAccount(account) {
+		return ""
+	}
+	return strings.TrimPrefix(account, walletAccountPrefix)
+}
+
+// recordPostings builds postings of moving `amount` between equityExternal and user's wallet,
+// `amount` is signed as BalanceLog.Amount, and the money is converted through equityExchange if `c` is not nil
+func recordPostings(userID, currency string, amount int64, c *conversion) []posting {
+	if c == nil {
+		return []posting{
+			{account: walletAccount(userID), amount: amount, currency: currency},
+			{account: equityExternal, amount: -1 * amount, currency: currency},
+		}
+	}
+
+	return []posting{
+		{account: walletAccount(userID), amount: amount, currency: currency},
+		{account: equityExchange, amount: -1 * amount, currency: currency},
+		{account: equityExchange, amount: c.amount, currency: c.currency},
+		{account: equityExternal, amount: -1 * c.amount, currency: c.currency},
+	}
+}
+
+// postTransaction writes the transaction with its postings, and patches cached balances of wallets
+func postTransaction(exec executor, entry *journalEntry) (int64, error) {
+	sums := map[string]int64{}
+	patches := []balancePatch{}
+	for _, p := range entry.postings {
+		sums[p.currency] += p.amount
+		if isWalletAccount(p.account) {
+			patches = append(patches, balancePatch{userID: walletUserID(p.account), amount: p.amount})
+		}
+	}
+	for _, sum := range sums {
+		if sum != int64(0) {
+			logrus.WithField("postings", entry.postings).Error("unbalanced transaction is found in postTransaction")
+			return int64(0), errUnbalancedTransaction
+		}
+	}
+
+	// balances are patched first, so that the overdraft policy refuses the transaction before anything is written
+	if !entry.balanceCached {
+		if err := applyBalancePatches(exec, patches); err != nil {
+			return int64(0), err
+		}
+	}
+
+	originalAmount, originalCurrency, rate, rateDate := entry.conversion.stored()
+
+	transactionID := int64(0)
+	if err := exec.QueryRow(insertTransaction,
+		entry.reason, entry.timestamp, entry.category, entry.tags, entry.createdBy,
+		originalAmount, originalCurrency, rate, rateDate,
+	).Scan(&transactionID); err != nil {
+		logrus.WithField("err", err).Error("exec.QueryRow(insertTransaction) failed in postTransaction")
+		return int64(0), err
+	}
+
+	for _, p := range entry.postings {
+		// accounts are created lazily, as wallets and equity accounts may exist before the journal does
+		if _, err := exec.Exec(insertAccount, p.account, accountKind(p.account)); err != nil {
+			logrus.WithField("err", err).Error("exec.Exec(insertAccount) failed in postTransaction")
+			return int64(0), err
+		}
+
+		if _, err := exec.Exec(insertPosting, transactionID, p.account, p.amount, p.currency); err != nil {
+			logrus.WithField("err", err).Error("exec.Exec(insertPosting) failed in postTransaction")
+			return int64(0), err
+		}
+	}
+	return transactionID, nil
+}
+
+// getTransactionPostings locks the transaction that the posting of user's wallet belongs to, and gets all its postings
+// the caller should be an editor of all wallets that the transaction posts to
+func (im *impl) getTransactionPostings(tx *db.Tx, callerID, userID string, postingID int64) (int64, []*posting, error) {
+	if err := im.checkRole(tx, callerID, userID, RoleEditor); err != nil {
+		return int64(0), nil, err
+	}
+
+	transactionID := int64(0)
+	if err := tx.QueryRow(getPostingForUpdate, postingID, walletAccount(userID)).Scan(&transactionID); err == sql.ErrNoRows {
+		return int64(0), nil, ErrLogNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("tx.QueryRow(getPostingForUpdate) failed in getTransactionPostings")
+		return int64(0), nil, err
+	}
+
+	rows, err := tx.Query(getPostingsForUpdate, transactionID)
+	if err != nil {
+		logrus.WithField("err", err).Error("tx.Query(getPostingsForUpdate) failed in getTransactionPostings")
+		return int64(0), nil, err
+	}
+	defer rows.Close()
+
+	postings := []*posting{}
+	for rows.Next() {
+		p := &posting{}
+		if err := rows.Scan(&p.id, &p.account, &p.amount, &p.currency); err != nil {
+			logrus.WithField("err", err).Error("rows.Scan failed in getTransactionPostings")
+			return int64(0), nil, err
+		}
+		postings = append(postings, p)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithField("err", err).Error("rows.Err failed in getTransactionPostings")
+		return int64(0), nil, err
+	}
+
+	for _, p := range postings {
+		if !isWalletAccount(p.account) || p.account == walletAccount(userID) {
+			continue
+		}
+		if err := im.checkRole(tx, callerID, walletUserID(p.account), RoleEditor); err != nil {
+			return int64(0), nil, err
+		}
+	}
+	return transactionID, postings, nil
+}
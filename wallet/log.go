@@ -0,0 +1,191 @@
+package wallet
+
+import (
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+)
+
+const (
+	getLastLog = selectBalanceLogs + `
+		WHERE
+			posting.account = $1 AND txn."createdBy" = $2
+		ORDER BY
+			posting.id DESC
+		LIMIT 1
+	`
+)
+
+// logRow is a posting to the wallet account with its transaction, as it's stored
+type logRow struct {
+	id        int64
+	reason    string
+	amount    int64
+	timestamp int64
+	// counterparty is the other wallet account of the transaction if it's a transfer
+	counterparty string
+	category     string
+	tags         string
+	currency     string
+	// the original amount is unsigned, and these fields are empty unless the transaction is converted
+	originalAmount   int64
+	originalCurrency string
+	rate             string
+	rateDate         int64
+}
+
+func (row *logRow) toBalanceLog() *BalanceLog {
+	balanceLog := &BalanceLog{
+		ID:             row.id,
+		Amount:         row.amount,
+		Reason:         row.reason,
+		Timestamp:      base.ParseToyyymmddhhmm(row.timestamp),
+		CounterpartyID: walletUserID(row.counterparty),
+		Category:       row.category,
+		Tags:           splitTags(row.tags),
+	}
+
+	// the source side of a transfer is in the original currency, so it's not converted
+	if row.originalCurrency != "" && row.originalCurrency != row.currency {
+		conversion := &Conversion{
+			Amount:   row.originalAmount,
+			Currency: row.originalCurrency,
+			Rate: &Rate{
+				Base:  row.originalCurrency,
+				Quote: row.currency,
+				Date:  row.rateDate,
+				Value: row.rate,
+			},
+		}
+		if balanceLog.Amount < int64(0) {
+			conversion.Amount = -1 * conversion.Amount
+		}
+		balanceLog.Conversion = conversion
+	}
+	return balanceLog
+}
+
+func scanBalanceLog(scanner interface {
+	Scan(dest ...interface{}) error
+}) (*BalanceLog, error) {
+	row := &logRow{}
+	if err := scanner.Scan(
+		&row.id, &row.reason, &row.amount, &row.timestamp,
+		&row.counterparty, &row.category, &row.tags,
+		&row.currency, &row.originalAmount, &row.originalCurrency, &row.rate, &row.rateDate,
+	); err != nil {
+		return nil, err
+	}
+	return row.toBalanceLog(), nil
+}
+
+func (im *impl) GetLastLog(callerID, userID string) (*BalanceLog, error) {
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	balanceLog, err := scanBalanceLog(im.db.QueryRow(getLastLog, walletAccount(userID), callerID))
+	if err == sql.ErrNoRows {
+		return nil, ErrLogNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("scanBalanceLog failed in GetLastLog")
+		return nil, err
+	}
+	return balanceLog, nil
+}
+
+func (im *impl) UpdateLog(callerID, userID string, logID int64, amount int64, reason string) error {
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in UpdateLog")
+		return err
+	}
+	defer execRollBack(tx)
+
+	transactionID, postings, err := im.getTransactionPostings(tx, callerID, userID, logID)
+	if err != nil {
+		return err
+	}
+
+	// transactions that are not converted have two postings in the same currency,
+	// so the other posting simply gets the opposite amount to keep the transaction balanced
+	if len(postings) != 2 {
+		return ErrLogNotEditable
+	}
+
+	patches := []balancePatch{}
+	for _, p := range postings {
+		newAmount := amount
+		if p.id != logID {
+			newAmount = -1 * amount
+		}
+
+		if _, err := tx.Exec(updatePostingAmount, newAmount, p.id); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(updatePostingAmount) failed in UpdateLog")
+			return err
+		}
+		if isWalletAccount(p.account) {
+			patches = append(patches, balancePatch{userID: walletUserID(p.account), amount: newAmount - p.amount})
+		}
+	}
+
+	if err := applyBalancePatches(tx, patches); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(updateTransactionReason, reason, transactionID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(updateTransactionReason) failed in UpdateLog")
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in UpdateLog")
+		return err
+	}
+	return nil
+}
+
+// DeleteLog removes the whole transaction that the log belongs to,
+// as it's used to correct mistakes, the transaction is dropped instead of being reversed
+func (im *impl) DeleteLog(callerID, userID string, logID int64) error {
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in DeleteLog")
+		return err
+	}
+	defer execRollBack(tx)
+
+	transactionID, postings, err := im.getTransactionPostings(tx, callerID, userID, logID)
+	if err != nil {
+		return err
+	}
+
+	patches := []balancePatch{}
+	for _, p := range postings {
+		if isWalletAccount(p.account) {
+			patches = append(patches, balancePatch{userID: walletUserID(p.account), amount: -1 * p.amount})
+		}
+	}
+
+	if err := applyBalancePatches(tx, patches); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(deletePostings, transactionID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deletePostings) failed in DeleteLog")
+		return err
+	}
+
+	if _, err := tx.Exec(deleteTransaction, transactionID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteTransaction) failed in DeleteLog")
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in DeleteLog")
+		return err
+	}
+	return nil
+}
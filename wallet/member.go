@@ -0,0 +1,170 @@
+package wallet
+
+import (
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// UsersWalletMember related statements
+	getMemberRole = `SELECT role FROM "UsersWalletMember" WHERE "userID" = $1 AND "memberID" = $2`
+	upsertMember  = `
+		INSERT INTO "UsersWalletMember" ("userID", "memberID", role)
+			VALUES ($1, $2, $3)
+		ON CONFLICT ("userID", "memberID") DO UPDATE SET role = $3;
+	`
+	deleteMember     = `DELETE FROM "UsersWalletMember" WHERE "userID" = $1 AND "memberID" = $2`
+	deleteAllMembers = `DELETE FROM "UsersWalletMember" WHERE "userID" = $1`
+	getMembers       = `
+		SELECT
+			"memberID", role
+		FROM
+			"UsersWalletMember"
+		WHERE
+			"userID" = $1
+		ORDER BY
+			"memberID"
+	`
+)
+
+func (im *impl) AddMember(callerID, userID, memberID string, role Role) error {
+	// the ownership can't be transferred by adding a member
+	if role != RoleEditor && role != RoleViewer {
+		return ErrInvalidRole
+	}
+
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in AddMember")
+		return err
+	}
+	defer execRollBack(tx)
+
+	if err := im.checkRole(tx, callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
+	// the owner has all roles already
+	if memberID == "" || memberID == callerID {
+		return ErrInvalidRole
+	}
+
+	if _, err := tx.Exec(upsertMember, userID, memberID, role); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(upsertMember) failed in AddMember")
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in AddMember")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) RemoveMember(callerID, userID, memberID string) error {
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in RemoveMember")
+		return err
+	}
+	defer execRollBack(tx)
+
+	if err := im.checkRole(tx, callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(deleteMember, userID, memberID)
+	if err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteMember) failed in RemoveMember")
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in RemoveMember")
+		return err
+	} else if rowsAffected == int64(0) {
+		return ErrMemberNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in RemoveMember")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) SetOwner(userID, ownerID string) error {
+	if ownerID == "" {
+		return ErrInvalidRole
+	}
+
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in SetOwner")
+		return err
+	}
+	defer execRollBack(tx)
+
+	result, err := tx.Exec(setOwner, ownerID, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(setOwner) failed in SetOwner")
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		logrus.WithField("err", err).Error("result.RowsAffected failed in SetOwner")
+		return err
+	} else if rowsAffected == int64(0) {
+		return ErrWalletNotFound
+	}
+
+	// the owner has all roles already, so the owner isn't a member
+	if _, err := tx.Exec(deleteMember, userID, ownerID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(deleteMember) failed in SetOwner")
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in SetOwner")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) GetMembers(callerID, userID string) ([]*Member, error) {
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	ownerID := ""
+	if err := im.db.QueryRow(getOwner, userID).Scan(&ownerID); err == sql.ErrNoRows {
+		return nil, ErrWalletNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("im.db.QueryRow(getOwner) failed in GetMembers")
+		return nil, err
+	}
+
+	rows, err := im.db.Query(getMembers, userID)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query(getMembers) failed in GetMembers")
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Member{
+		&Member{
+			MemberID: ownerID,
+			Role:     RoleOwner,
+		},
+	}
+	for rows.Next() {
+		member := &Member{}
+		if err := rows.Scan(&member.MemberID, &member.Role); err != nil {
+			logrus.WithField("err", err).Error("rows.Scan failed in GetMembers")
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
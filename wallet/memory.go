@@ -0,0 +1,1031 @@
+package wallet
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andy/guachi-pay-line-bot/money"
+)
+
+// the in-memory wallet keeps the same double-entry journal as the database does, but in maps and slices
+// (1) every method holds the mutex until it returns, so that it's as atomic as a database transaction
+// (2) changes are checked before anything is written, so that a failed method leaves nothing behind
+// it's used by tests and local development, and everything is gone when the process exits
+
+// memoryWallet is a row of UsersWallet with its members, categories, budgets and imports
+type memoryWallet struct {
+	userID    string
+	ownerID   string
+	sourceID  string
+	currency  string
+	balance   int64
+	overdraft Overdraft
+	// members don't include the owner
+	members    map[string]Role
+	categories map[string]bool
+	// budgets are monthly limits, and the key is the category, empty for the whole wallet
+	budgets map[string]int64
+	// imports are hashes of imported entries, and the value is the ID of the transaction
+	imports map[string]int64
+	// keys are idempotency keys of deposits, spends and transfers, and they are kept after their logs are deleted
+	keys map[string]int64
+}
+
+// allows checks if the overdraft policy allows the balance
+// OverdraftForbid is stored with zero limit as it is in the database
+func (w *memoryWallet) allows(balance int64) bool {
+	return w.overdraft.Policy == OverdraftAllow || balance >= -1*w.overdraft.Limit
+}
+
+// memoryTransaction is a row of LedgerTransaction with its postings
+type memoryTransaction struct {
+	id        int64
+	reason    string
+	timestamp int64
+	category  string
+	tags      string
+	createdBy string
+	// the original amount is unsigned, and these fields are empty unless the transaction is converted
+	originalAmount   int64
+	originalCurrency string
+	rate             string
+	rateDate         int64
+	postings         []*posting
+}
+
+// logRow gets the balance log of the posting to the wallet account as selectBalanceLogs does
+func (txn *memoryTransaction) logRow(p *posting) *logRow {
+	row := &logRow{
+		id:               p.id,
+		reason:           txn.reason,
+		amount:           p.amount,
+		timestamp:        txn.timestamp,
+		category:         txn.category,
+		tags:             txn.tags,
+		currency:         p.currency,
+		originalAmount:   txn.originalAmount,
+		originalCurrency: txn.originalCurrency,
+		rate:             txn.rate,
+		rateDate:         txn.rateDate,
+	}
+	for _, other := range txn.postings {
+		if other.id != p.id && isWalletAccount(other.account) {
+			row.counterparty = other.account
+			break
+		}
+	}
+	return row
+}
+
+// hasPosting checks if the transaction posts to the account
+func (txn *memoryTransaction) hasPosting(account string) bool {
+	for _, p := range txn.postings {
+		if p.account == account {
+			return true
+		}
+	}
+	return false
+}
+
+// rateKey is the primary key of ExchangeRate
+type rateKey struct {
+	base  string
+	quote string
+	date  int64
+}
+
+// memoryStore is what the database stores
+type memoryStore struct {
+	mutex   sync.Mutex
+	wallets map[string]*memoryWallet
+	// transactions are ordered by ID, and IDs of transactions and postings are never reused
+	transactions      []*memoryTransaction
+	rates             map[rateKey]string
+	lastTransactionID int64
+	lastPostingID     int64
+}
+
+type memoryImpl struct {
+	*memoryStore
+	// ctx is only checked before operations start, as operations never wait for I/O
+	ctx context.Context
+	// source is where the caller operates wallets from as impl.source
+	source *string
+}
+
+// NewMemoryWallet creates a new Wallet interface stored in memory, it's safe for concurrent use
+func NewMemoryWallet() Wallet {
+	return &memoryImpl{
+		memoryStore: &memoryStore{
+			wallets:      map[string]*memoryWallet{},
+			transactions: []*memoryTransaction{},
+			rates:        map[rateKey]string{},
+		},
+		ctx: context.Background(),
+	}
+}
+
+func (mem *memoryImpl) WithContext(ctx context.Context) Wallet {
+	return &memoryImpl{
+		memoryStore: mem.memoryStore,
+		ctx:         ctx,
+		source:      mem.source,
+	}
+}
+
+func (mem *memoryImpl) WithSource(sourceID string) Wallet {
+	return &memoryImpl{
+		memoryStore: mem.memoryStore,
+		ctx:         mem.ctx,
+		source:      &sourceID,
+	}
+}
+
+// lock locks the store unless the context is done, as canceled operations never start in the database either
+func (mem *memoryImpl) lock() error {
+	if err := mem.ctx.Err(); err != nil {
+		return err
+	}
+	mem.mutex.Lock()
+	return nil
+}
+
+// checkRole makes sure that the caller has `role` of user's wallet as checkRole does
+func (mem *memoryImpl) checkRole(callerID, userID string, role Role) error {
+	if callerID == "" {
+		return ErrPermissionDenied
+	}
+
+	w, ok := mem.wallets[userID]
+	if !ok {
+		return ErrWalletNotFound
+	}
+
+	if mem.source != nil && w.sourceID != "" && w.sourceID != *mem.source {
+		return ErrPermissionDenied
+	}
+	if w.ownerID == "" {
+		return ErrPermissionDenied
+	} else if w.ownerID == callerID {
+		return nil
+	}
+
+	memberRole, ok := w.members[callerID]
+	if !ok || !memberRole.covers(role) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// checkCategory makes sure that the category is one of the categories of user's wallet
+func (mem *memoryImpl) checkCategory(userID, category string) error {
+	if category == "" {
+		return nil
+	}
+	if !mem.wallets[userID].categories[category] {
+		return ErrCategoryNotFound
+	}
+	return nil
+}
+
+// lookupRate looks up rates stored in memory as storedRates does
+func (mem *memoryImpl) lookupRate(baseCode, quoteCode string, date int64) (*Rate, error) {
+	var latest *Rate
+	for key, value := range mem.rates {
+		if key.base != baseCode || key.quote != quoteCode || key.date > date {
+			continue
+		}
+		if latest == nil || key.date > latest.Date {
+			latest = &Rate{Base: key.base, Quote: key.quote, Date: key.date, Value: value}
+		}
+	}
+	if latest == nil {
+		return nil, ErrRateNotFound
+	}
+	return latest, nil
+}
+
+// applyBalancePatches checks all patches before any of them is applied,
+// and patches that decrease the balance are only allowed if the overdraft policy allows them
+func (mem *memoryImpl) applyBalancePatches(patches []balancePatch) error {
+	sort.Slice(patches, func(i, j int) bool {
+		return patches[i].userID < patches[j].userID
+	})
+
+	balances := map[string]int64{}
+	for _, patch := range patches {
+		w, ok := mem.wallets[patch.userID]
+		if !ok {
+			return ErrWalletNotFound
+		}
+		balance, ok := balances[patch.userID]
+		if !ok {
+			balance = w.balance
+		}
+		balance += patch.amount
+		if patch.amount < int64(0) && !w.allows(balance) {
+			return ErrInsufficientBalance
+		}
+		balances[patch.userID] = balance
+	}
+
+	for userID, balance := range balances {
+		mem.wallets[userID].balance = balance
+	}
+	return nil
+}
+
+// postTransaction appends the transaction with its postings, and patches cached balances of wallets
+func (mem *memoryImpl) postTransaction(entry *journalEntry) (int64, error) {
+	sums := map[string]int64{}
+	patches := []balancePatch{}
+	for _, p := range entry.postings {
+		sums[p.currency] += p.amount
+		if isWalletAccount(p.account) {
+			patches = append(patches, balancePatch{userID: walletUserID(p.account), amount: p.amount})
+		}
+	}
+	for _, sum := range sums {
+		if sum != int64(0) {
+			return int64(0), errUnbalancedTransaction
+		}
+	}
+
+	if !entry.balanceCached {
+		if err := mem.applyBalancePatches(patches); err != nil {
+			return int64(0), err
+		}
+	}
+
+	mem.lastTransactionID++
+	txn := &memoryTransaction{
+		id:        mem.lastTransactionID,
+		reason:    entry.reason,
+		timestamp: entry.timestamp,
+		category:  entry.category,
+		tags:      entry.tags,
+		createdBy: entry.createdBy,
+		postings:  []*posting{},
+	}
+	txn.originalAmount, txn.originalCurrency, txn.rate, txn.rateDate = entry.conversion.stored()
+	for _, p := range entry.postings {
+		mem.lastPostingID++
+		txn.postings = append(txn.postings, &posting{id: mem.lastPostingID, account: p.account, amount: p.amount, currency: p.currency})
+	}
+	mem.transactions = append(mem.transactions, txn)
+	return txn.id, nil
+}
+
+// getTransaction gets the transaction that the posting of user's wallet belongs to as getTransactionPostings does
+// the caller should be an editor of all wallets that the transaction posts to
+func (mem *memoryImpl) getTransaction(callerID, userID string, postingID int64) (*memoryTransaction, error) {
+	if err := mem.checkRole(callerID, userID, RoleEditor); err != nil {
+		return nil, err
+	}
+
+	var found *memoryTransaction
+	for _, txn := range mem.transactions {
+		for _, p := range txn.postings {
+			if p.id == postingID && p.account == walletAccount(userID) {
+				found = txn
+			}
+		}
+	}
+	if found == nil {
+		return nil, ErrLogNotFound
+	}
+
+	for _, p := range found.postings {
+		if !isWalletAccount(p.account) || p.account == walletAccount(userID) {
+			continue
+		}
+		if err := mem.checkRole(callerID, walletUserID(p.account), RoleEditor); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// walletLogs gets all logs of user's wallet in order of timestamps
+func (mem *memoryImpl) walletLogs(userID string) []*logRow {
+	rows := []*logRow{}
+	for _, txn := range mem.transactions {
+		for _, p := range txn.postings {
+			if p.account == walletAccount(userID) {
+				rows = append(rows, txn.logRow(p))
+			}
+		}
+	}
+
+	// postings are appended in order of IDs, so logs at the same time remain in that order
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].timestamp < rows[j].timestamp
+	})
+	return rows
+}
+
+func (mem *memoryImpl) Create(callerID, userID string, options ...CreateOption) error {
+	if callerID == "" {
+		return ErrPermissionDenied
+	}
+	option := initCreateOption(options...)
+	currency, err := money.GetCurrency(option.currency)
+	if err != nil {
+		return ErrInvalidCurrency
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if _, ok := mem.wallets[userID]; ok {
+		return ErrWalletExist
+	}
+
+	mem.wallets[userID] = &memoryWallet{
+		userID:     userID,
+		ownerID:    callerID,
+		sourceID:   option.sourceID,
+		currency:   currency.Code,
+		overdraft:  Overdraft{Policy: OverdraftAllow},
+		members:    map[string]Role{},
+		categories: map[string]bool{},
+		budgets:    map[string]int64{},
+		imports:    map[string]int64{},
+		keys:       map[string]int64{},
+	}
+	return nil
+}
+
+func (mem *memoryImpl) Delete(callerID, userID string) error {
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
+	// history of the wallet is kept in the journal, but it's no longer attached to the wallet name
+	for _, txn := range mem.transactions {
+		for _, p := range txn.postings {
+			if p.account == walletAccount(userID) {
+				p.account = equityClosed
+			}
+		}
+	}
+	delete(mem.wallets, userID)
+	return nil
+}
+
+func (mem *memoryImpl) EmptyBalance(callerID, userID string) error {
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
+	w := mem.wallets[userID]
+	if w.balance == int64(0) {
+		return nil
+	}
+
+	_, err := mem.postTransaction(&journalEntry{
+		reason:    emptyBalanceReason,
+		timestamp: time.Now().Unix(),
+		createdBy: callerID,
+		postings: []posting{
+			{account: walletAccount(userID), amount: -1 * w.balance, currency: w.currency},
+			{account: equityAdjustment, amount: w.balance, currency: w.currency},
+		},
+	})
+	return err
+}
+
+func (mem *memoryImpl) GetBalance(callerID, userID string) (int64, error) {
+	if err := mem.lock(); err != nil {
+		return int64(0), err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return int64(0), err
+	}
+	return mem.wallets[userID].balance, nil
+}
+
+func (mem *memoryImpl) GetCurrency(callerID, userID string) (string, error) {
+	if err := mem.lock(); err != nil {
+		return "", err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return "", err
+	}
+	return mem.wallets[userID].currency, nil
+}
+
+func (mem *memoryImpl) GetBalanceLogs(callerID, userID string, options ...GetLogsOption) ([]*BalanceLog, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	option := initOption(options...)
+	endTime := option.endTime
+	if option.endTime == int64(0) {
+		endTime = time.Now().Unix()
+	}
+
+	balanceLogs := []*BalanceLog{}
+	for _, row := range mem.walletLogs(userID) {
+		if row.timestamp < option.startTime || row.timestamp > endTime {
+			continue
+		}
+		if option.category != "" && row.category != option.category {
+			continue
+		}
+		balanceLogs = append(balanceLogs, row.toBalanceLog())
+	}
+	return balanceLogs, nil
+}
+
+// record deposits or spends `amount`, which is signed as BalanceLog.Amount, as Deposit and Spend do
+func (mem *memoryImpl) record(callerID, userID string, amount int64, reason string, options ...RecordOption) error {
+	option := initRecordOption(options...)
+	tags, err := joinTags(option.tags)
+	if err != nil {
+		return err
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleEditor); err != nil {
+		return err
+	}
+
+	// the request with the same key is recorded already, so nothing is recorded again
+	w := mem.wallets[userID]
+	if _, ok := w.keys[option.idempotencyKey]; ok && option.idempotencyKey != "" {
+		return ErrDuplicateRequest
+	}
+
+	if err := mem.checkCategory(userID, option.category); err != nil {
+		return err
+	}
+
+	currency := w.currency
+
+	// convert the amount into the currency of the wallet if it's recorded in another currency
+	walletAmount := amount
+	var c *conversion
+	if option.currency != "" {
+		converted, rate, err := convert(mem.lookupRate, walletAmount, option.currency, currency, option.timestamp)
+		if err != nil {
+			return err
+		}
+		if rate.Base != rate.Quote {
+			c = &conversion{amount: walletAmount, currency: rate.Base, rate: rate}
+			walletAmount = converted
+		}
+	}
+
+	transactionID, err := mem.postTransaction(&journalEntry{
+		reason:     reason,
+		timestamp:  option.timestamp,
+		category:   option.category,
+		tags:       tags,
+		createdBy:  callerID,
+		postings:   recordPostings(userID, currency, walletAmount, c),
+		conversion: c,
+	})
+	if err != nil {
+		return err
+	}
+
+	if option.idempotencyKey != "" {
+		w.keys[option.idempotencyKey] = transactionID
+	}
+	return nil
+}
+
+func (mem *memoryImpl) Deposit(callerID, userID string, amount int64, reason string, options ...RecordOption) error {
+	return mem.record(callerID, userID, amount, reason, options...)
+}
+
+func (mem *memoryImpl) Spend(callerID, userID string, amount int64, reason string, options ...RecordOption) error {
+	return mem.record(callerID, userID, -1*amount, reason, options...)
+}
+
+func (mem *memoryImpl) Transfer(callerID, fromUserID, toUserID string, amount int64, reason string, options ...RecordOption) error {
+	if fromUserID == toUserID {
+		return ErrInvalidTransfer
+	}
+	// money only moves from the source wallet, where the idempotency key is recorded
+	if amount <= int64(0) {
+		return ErrInvalidAmount
+	}
+	option := initRecordOption(options...)
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, fromUserID, RoleEditor); err != nil {
+		return err
+	}
+	if err := mem.checkRole(callerID, toUserID, RoleEditor); err != nil {
+		return err
+	}
+
+	// the request with the same key is recorded already, so nothing is recorded again
+	from := mem.wallets[fromUserID]
+	if _, ok := from.keys[option.idempotencyKey]; ok && option.idempotencyKey != "" {
+		return ErrDuplicateRequest
+	}
+
+	currency := from.currency
+	toCurrency := mem.wallets[toUserID].currency
+
+	timestamp := time.Now().Unix()
+	postings := []posting{
+		{account: walletAccount(fromUserID), amount: -1 * amount, currency: currency},
+		{account: walletAccount(toUserID), amount: amount, currency: currency},
+	}
+
+	// the money is converted through equityExchange if currencies of wallets are different
+	var c *conversion
+	if toCurrency != currency {
+		converted, rate, err := convert(mem.lookupRate, amount, currency, toCurrency, timestamp)
+		if err != nil {
+			return err
+		}
+		c = &conversion{amount: amount, currency: currency, rate: rate}
+		postings = []posting{
+			{account: walletAccount(fromUserID), amount: -1 * amount, currency: currency},
+			{account: equityExchange, amount: amount, currency: currency},
+			{account: equityExchange, amount: -1 * converted, currency: toCurrency},
+			{account: walletAccount(toUserID), amount: converted, currency: toCurrency},
+		}
+	}
+
+	transactionID, err := mem.postTransaction(&journalEntry{
+		reason:     reason,
+		timestamp:  timestamp,
+		createdBy:  callerID,
+		postings:   postings,
+		conversion: c,
+	})
+	if err != nil {
+		return err
+	}
+
+	if option.idempotencyKey != "" {
+		from.keys[option.idempotencyKey] = transactionID
+	}
+	return nil
+}
+
+func (mem *memoryImpl) GetReceipt(callerID, userID, key string) (*Receipt, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	transactionID, ok := mem.wallets[userID].keys[key]
+	if !ok {
+		return nil, ErrLogNotFound
+	}
+
+	// balances are sums of postings up to the keyed transaction as getBalanceAfterPosting does
+	var receipt *Receipt
+	balances := map[string]int64{}
+	for _, txn := range mem.transactions {
+		for _, p := range txn.postings {
+			balances[p.account] += p.amount
+		}
+		if txn.id != transactionID {
+			continue
+		}
+		for _, p := range txn.postings {
+			if p.account == walletAccount(userID) {
+				receipt = &Receipt{Log: txn.logRow(p).toBalanceLog(), Balance: balances[p.account]}
+			}
+		}
+		break
+	}
+	if receipt == nil {
+		return nil, ErrLogNotFound
+	}
+	if receipt.Log.CounterpartyID != "" {
+		receipt.CounterpartyBalance = balances[walletAccount(receipt.Log.CounterpartyID)]
+	}
+	return receipt, nil
+}
+
+func (mem *memoryImpl) GetLastLog(callerID, userID string) (*BalanceLog, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	// the last log is the one with the largest ID, which is the last one appended
+	for i := len(mem.transactions) - 1; i >= 0; i-- {
+		txn := mem.transactions[i]
+		if txn.createdBy != callerID {
+			continue
+		}
+		for j := len(txn.postings) - 1; j >= 0; j-- {
+			if p := txn.postings[j]; p.account == walletAccount(userID) {
+				return txn.logRow(p).toBalanceLog(), nil
+			}
+		}
+	}
+	return nil, ErrLogNotFound
+}
+
+func (mem *memoryImpl) UpdateLog(callerID, userID string, logID int64, amount int64, reason string) error {
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	txn, err := mem.getTransaction(callerID, userID, logID)
+	if err != nil {
+		return err
+	}
+
+	// transactions that are not converted have two postings in the same currency,
+	// so the other posting simply gets the opposite amount to keep the transaction balanced
+	if len(txn.postings) != 2 {
+		return ErrLogNotEditable
+	}
+
+	amounts := map[int64]int64{}
+	patches := []balancePatch{}
+	for _, p := range txn.postings {
+		amounts[p.id] = amount
+		if p.id != logID {
+			amounts[p.id] = -1 * amount
+		}
+		if isWalletAccount(p.account) {
+			patches = append(patches, balancePatch{userID: walletUserID(p.account), amount: amounts[p.id] - p.amount})
+		}
+	}
+
+	if err := mem.applyBalancePatches(patches); err != nil {
+		return err
+	}
+
+	for _, p := range txn.postings {
+		p.amount = amounts[p.id]
+	}
+	txn.reason = reason
+	return nil
+}
+
+func (mem *memoryImpl) DeleteLog(callerID, userID string, logID int64) error {
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	txn, err := mem.getTransaction(callerID, userID, logID)
+	if err != nil {
+		return err
+	}
+
+	patches := []balancePatch{}
+	for _, p := range txn.postings {
+		if isWalletAccount(p.account) {
+			patches = append(patches, balancePatch{userID: walletUserID(p.account), amount: -1 * p.amount})
+		}
+	}
+
+	if err := mem.applyBalancePatches(patches); err != nil {
+		return err
+	}
+
+	for i, t := range mem.transactions {
+		if t == txn {
+			mem.transactions = append(mem.transactions[:i], mem.transactions[i+1:]...)
+			break
+		}
+	}
+
+	// imports of the transaction are deleted with it, so that the entry can be imported again
+	for _, w := range mem.wallets {
+		for hash, transactionID := range w.imports {
+			if transactionID == txn.id {
+				delete(w.imports, hash)
+			}
+		}
+	}
+	return nil
+}
+
+func (mem *memoryImpl) IsWalletExist(userID string) bool {
+	if err := mem.lock(); err != nil {
+		return false
+	}
+	defer mem.mutex.Unlock()
+
+	_, ok := mem.wallets[userID]
+	return ok
+}
+
+func (mem *memoryImpl) Authorize(callerID, userID string, role Role) error {
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	return mem.checkRole(callerID, userID, role)
+}
+
+func (mem *memoryImpl) AddMember(callerID, userID, memberID string, role Role) error {
+	// the ownership can't be transferred by adding a member
+	if role != RoleEditor && role != RoleViewer {
+		return ErrInvalidRole
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
+	// the owner has all roles already
+	if memberID == "" || memberID == callerID {
+		return ErrInvalidRole
+	}
+
+	mem.wallets[userID].members[memberID] = role
+	return nil
+}
+
+func (mem *memoryImpl) RemoveMember(callerID, userID, memberID string) error {
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
+	w := mem.wallets[userID]
+	if _, ok := w.members[memberID]; !ok {
+		return ErrMemberNotFound
+	}
+	delete(w.members, memberID)
+	return nil
+}
+
+func (mem *memoryImpl) SetOwner(userID, ownerID string) error {
+	if ownerID == "" {
+		return ErrInvalidRole
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	w, ok := mem.wallets[userID]
+	if !ok {
+		return ErrWalletNotFound
+	}
+	w.ownerID = ownerID
+	delete(w.members, ownerID)
+	return nil
+}
+
+func (mem *memoryImpl) GetMembers(callerID, userID string) ([]*Member, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	w := mem.wallets[userID]
+	memberIDs := []string{}
+	for memberID := range w.members {
+		memberIDs = append(memberIDs, memberID)
+	}
+	sort.Strings(memberIDs)
+
+	members := []*Member{
+		&Member{
+			MemberID: w.ownerID,
+			Role:     RoleOwner,
+		},
+	}
+	for _, memberID := range memberIDs {
+		members = append(members, &Member{MemberID: memberID, Role: w.members[memberID]})
+	}
+	return members, nil
+}
+
+func (mem *memoryImpl) AddCategory(callerID, userID, category string) error {
+	if category == "" {
+		return ErrCategoryNotFound
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleEditor); err != nil {
+		return err
+	}
+
+	w := mem.wallets[userID]
+	if w.categories[category] {
+		return ErrCategoryExist
+	}
+	w.categories[category] = true
+	return nil
+}
+
+func (mem *memoryImpl) RemoveCategory(callerID, userID, category string) error {
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleEditor); err != nil {
+		return err
+	}
+
+	w := mem.wallets[userID]
+	if !w.categories[category] {
+		return ErrCategoryNotFound
+	}
+	delete(w.categories, category)
+	return nil
+}
+
+func (mem *memoryImpl) GetCategories(callerID, userID string) ([]string, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	categories := []string{}
+	for category := range mem.wallets[userID].categories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
+
+func (mem *memoryImpl) SetBudget(callerID, userID, category string, limit int64) error {
+	if limit < int64(0) {
+		return ErrInvalidBudget
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleEditor); err != nil {
+		return err
+	}
+
+	if err := mem.checkCategory(userID, category); err != nil {
+		return err
+	}
+
+	w := mem.wallets[userID]
+	if limit == int64(0) {
+		delete(w.budgets, category)
+	} else {
+		w.budgets[category] = limit
+	}
+	return nil
+}
+
+func (mem *memoryImpl) SetOverdraft(callerID, userID string, policy OverdraftPolicy, limit int64) error {
+	if !policy.IsValid() {
+		return ErrInvalidOverdraft
+	}
+	if policy == OverdraftLimit && limit <= int64(0) {
+		return ErrInvalidOverdraft
+	} else if policy != OverdraftLimit {
+		limit = int64(0)
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
+	mem.wallets[userID].overdraft = Overdraft{Policy: policy, Limit: limit}
+	return nil
+}
+
+func (mem *memoryImpl) GetOverdraft(callerID, userID string) (*Overdraft, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	overdraft := mem.wallets[userID].overdraft
+	return &overdraft, nil
+}
+
+func (mem *memoryImpl) SetRate(baseCode, quoteCode string, timestamp int64, rate string) error {
+	r, err := newRate(baseCode, quoteCode, timestamp, rate)
+	if err != nil {
+		return err
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	mem.rates[rateKey{base: r.Base, quote: r.Quote, date: r.Date}] = r.Value
+	return nil
+}
+
+func (mem *memoryImpl) GetRate(baseCode, quoteCode string, timestamp int64) (*Rate, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	return getLatestRate(mem.lookupRate, baseCode, quoteCode, timestamp)
+}
+
+func (mem *memoryImpl) Convert(amount int64, from, to string, timestamp int64) (int64, *Rate, error) {
+	if err := mem.lock(); err != nil {
+		return int64(0), nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	return convert(mem.lookupRate, amount, from, to, timestamp)
+}
+
+func (mem *memoryImpl) ImportRates(reader io.Reader) (int, error) {
+	rates, err := parseRates(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := mem.lock(); err != nil {
+		return 0, err
+	}
+	defer mem.mutex.Unlock()
+
+	for _, rate := range rates {
+		mem.rates[rateKey{base: rate.Base, quote: rate.Quote, date: rate.Date}] = rate.Value
+	}
+	return len(rates), nil
+}
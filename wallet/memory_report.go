@@ -0,0 +1,475 @@
+package wallet
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+)
+
+// memoryGroupKey gets the group key of the log as groupByKeys does, days are based on Asia/Taipei zone
+func memoryGroupKey(txn *memoryTransaction, groupBy GroupBy) string {
+	switch groupBy {
+	case GroupByDay:
+		return base.ParseToyyymmdd(txn.timestamp)
+	case GroupByWeek:
+		start, _ := base.GetWeekRange(time.Unix(txn.timestamp, 0))
+		return base.ParseToyyymmdd(start)
+	case GroupByMonth:
+		return base.ParseToyyymmdd(txn.timestamp)[:len("2006/01")]
+	case GroupByReason:
+		return txn.reason
+	}
+	return txn.category
+}
+
+// externalPostings gets postings to user's wallet whose other side is equityExternal in the time range,
+// so transfers, emptying wallets and adjustments are not included
+func (mem *memoryImpl) externalPostings(userID string, start, end int64, each func(txn *memoryTransaction, p *posting)) {
+	for _, txn := range mem.transactions {
+		if txn.timestamp < start || txn.timestamp >= end || !txn.hasPosting(equityExternal) {
+			continue
+		}
+		for _, p := range txn.postings {
+			if p.account == walletAccount(userID) {
+				each(txn, p)
+			}
+		}
+	}
+}
+
+func (mem *memoryImpl) GetBudgets(callerID, userID string) ([]*Budget, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	w := mem.wallets[userID]
+	budgets := []*Budget{}
+	for category, limit := range w.budgets {
+		budgets = append(budgets, &Budget{Category: category, Limit: limit})
+	}
+	sort.Slice(budgets, func(i, j int) bool {
+		return budgets[i].Category < budgets[j].Category
+	})
+
+	startTime, endTime := base.GetMonthRange(time.Now())
+	mem.externalPostings(userID, startTime, endTime, func(txn *memoryTransaction, p *posting) {
+		if p.amount >= int64(0) {
+			return
+		}
+		for _, budget := range budgets {
+			if budget.Category == "" || budget.Category == txn.category {
+				budget.Spent += -1 * p.amount
+			}
+		}
+	})
+	return budgets, nil
+}
+
+func (mem *memoryImpl) Summarize(callerID, userID string, timeRange TimeRange, groupBy GroupBy) (*Summary, error) {
+	if !groupBy.IsValid() || timeRange.Start >= timeRange.End {
+		return nil, ErrInvalidReport
+	}
+
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{
+		TimeRange: timeRange,
+		GroupBy:   groupBy,
+		Groups:    []*SummaryGroup{},
+	}
+	groups := map[string]*SummaryGroup{}
+	mem.externalPostings(userID, timeRange.Start, timeRange.End, func(txn *memoryTransaction, p *posting) {
+		key := memoryGroupKey(txn, groupBy)
+		group, ok := groups[key]
+		if !ok {
+			group = &SummaryGroup{Key: key}
+			groups[key] = group
+			summary.Groups = append(summary.Groups, group)
+		}
+
+		if p.amount > int64(0) {
+			group.Income += p.amount
+			summary.Income += p.amount
+		} else {
+			group.Expense += -1 * p.amount
+			summary.Expense += -1 * p.amount
+		}
+	})
+
+	// periods are sorted in time order, and other groups by the expense as groupByOrders does
+	sort.Slice(summary.Groups, func(i, j int) bool {
+		a, b := summary.Groups[i], summary.Groups[j]
+		if groupBy == GroupByReason || groupBy == GroupByCategory {
+			if a.Expense != b.Expense {
+				return a.Expense > b.Expense
+			}
+			if a.Income != b.Income {
+				return a.Income > b.Income
+			}
+		}
+		return a.Key < b.Key
+	})
+	return summary, nil
+}
+
+func (mem *memoryImpl) ImportEntries(callerID, userID string, entries []*ImportEntry) (*ImportResult, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleEditor); err != nil {
+		return nil, err
+	}
+
+	w := mem.wallets[userID]
+
+	// entries are checked against the overdraft policy before any of them is imported,
+	// so that the import is as atomic as it is in a single database transaction
+	result := &ImportResult{}
+	imports := []*ImportEntry{}
+	hashes := []string{}
+	occurrences := map[string]int{}
+	balance := w.balance
+	for _, entry := range entries {
+		if entry.Amount == int64(0) {
+			result.Skipped++
+			continue
+		}
+
+		key := getImportHash(entry, 0)
+		occurrences[key]++
+		hash := getImportHash(entry, occurrences[key])
+		if _, ok := w.imports[hash]; ok {
+			result.Skipped++
+			continue
+		}
+
+		balance += entry.Amount
+		if entry.Amount < int64(0) && !w.allows(balance) {
+			return nil, ErrInsufficientBalance
+		}
+		imports = append(imports, entry)
+		hashes = append(hashes, hash)
+	}
+
+	for i, entry := range imports {
+		// categories of statements are added to the wallet, so that logs can still be filtered by them
+		if entry.Category != "" {
+			w.categories[entry.Category] = true
+		}
+
+		transactionID, err := mem.postTransaction(&journalEntry{
+			reason:    entry.Reason,
+			timestamp: entry.Timestamp,
+			category:  entry.Category,
+			createdBy: callerID,
+			postings:  recordPostings(userID, w.currency, entry.Amount, nil),
+		})
+		if err != nil {
+			logrus.WithField("err", err).Error("mem.postTransaction failed in ImportEntries")
+			return nil, err
+		}
+		w.imports[hashes[i]] = transactionID
+		result.Imported++
+	}
+	return result, nil
+}
+
+func (mem *memoryImpl) ExportLogs(callerID, userID string, timeRange TimeRange, format ExportFormat, writer io.Writer) error {
+	if !format.IsValid() {
+		return ErrInvalidExportFormat
+	}
+	if timeRange.Start >= timeRange.End {
+		return ErrInvalidReport
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleViewer); err != nil {
+		return err
+	}
+
+	// the running balance includes logs before the time range, which are the opening balance of journals
+	opening := int64(0)
+	exportRows := []*exportRow{}
+	balanceLogs := []*BalanceLog{}
+	for _, row := range mem.walletLogs(userID) {
+		if row.timestamp < timeRange.Start {
+			opening += row.amount
+			continue
+		} else if row.timestamp >= timeRange.End {
+			continue
+		}
+
+		balance := opening + row.amount
+		if len(exportRows) != 0 {
+			balance = exportRows[len(exportRows)-1].balance + row.amount
+		}
+		exportRows = append(exportRows, &exportRow{logRow: *row, balance: balance})
+		balanceLogs = append(balanceLogs, row.toBalanceLog())
+	}
+
+	if format == ExportLedger || format == ExportBeancount {
+		return writeJournal(writer, userID, mem.wallets[userID].currency, opening, balanceLogs, timeRange, format)
+	}
+	return writeCSV(writer, exportRows)
+}
+
+// reconcile compares the cached balance with the journal of the wallet, and repairs the drift if needed
+func (mem *memoryImpl) reconcile(callerID, userID string, repair bool) (*Drift, error) {
+	w, ok := mem.wallets[userID]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+
+	drift := &Drift{UserID: userID, Balance: w.balance}
+	for _, row := range mem.walletLogs(userID) {
+		drift.Journal += row.amount
+	}
+
+	if drift.Amount() == int64(0) || !repair {
+		return drift, nil
+	}
+
+	// the balance is what users have seen, so the journal is adjusted to agree with it
+	if _, err := mem.postTransaction(&journalEntry{
+		reason:    reconcileReason,
+		timestamp: time.Now().Unix(),
+		createdBy: callerID,
+		postings: []posting{
+			{account: walletAccount(userID), amount: drift.Amount(), currency: w.currency},
+			{account: equityAdjustment, amount: -1 * drift.Amount(), currency: w.currency},
+		},
+		balanceCached: true,
+	}); err != nil {
+		return nil, err
+	}
+	drift.Repaired = true
+	return drift, nil
+}
+
+func (mem *memoryImpl) Reconcile(callerID, userID string, repair bool) (*Drift, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if err := mem.checkRole(callerID, userID, RoleOwner); err != nil {
+		return nil, err
+	}
+	return mem.reconcile(callerID, userID, repair)
+}
+
+func (mem *memoryImpl) ReconcileAll(repair bool, userIDs ...string) ([]*Drift, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	if len(userIDs) == 0 {
+		for userID := range mem.wallets {
+			userIDs = append(userIDs, userID)
+		}
+		sort.Strings(userIDs)
+	}
+
+	drifts := []*Drift{}
+	for _, userID := range userIDs {
+		drift, err := mem.reconcile("", userID, repair)
+		if err != nil {
+			return nil, err
+		}
+		if drift.Amount() != int64(0) {
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts, nil
+}
+
+func (mem *memoryImpl) Snapshot() (*Snapshot, error) {
+	if err := mem.lock(); err != nil {
+		return nil, err
+	}
+	defer mem.mutex.Unlock()
+
+	snapshot := &Snapshot{
+		Wallets:      []*WalletSnapshot{},
+		Transactions: []*TransactionSnapshot{},
+		Rates:        []*Rate{},
+	}
+	for _, w := range mem.wallets {
+		ws := &WalletSnapshot{
+			UserID:          w.userID,
+			OwnerID:         w.ownerID,
+			SourceID:        w.sourceID,
+			Currency:        w.currency,
+			Balance:         w.balance,
+			OverdraftPolicy: w.overdraft.Policy,
+			OverdraftLimit:  w.overdraft.Limit,
+			Members:         []*Member{},
+			Categories:      []string{},
+			Budgets:         map[string]int64{},
+			Imports:         map[string]int64{},
+		}
+		for memberID, role := range w.members {
+			ws.Members = append(ws.Members, &Member{MemberID: memberID, Role: role})
+		}
+		sort.Slice(ws.Members, func(i, j int) bool {
+			return ws.Members[i].MemberID < ws.Members[j].MemberID
+		})
+		for category := range w.categories {
+			ws.Categories = append(ws.Categories, category)
+		}
+		sort.Strings(ws.Categories)
+		for category, limit := range w.budgets {
+			ws.Budgets[category] = limit
+		}
+		for hash, transactionID := range w.imports {
+			ws.Imports[hash] = transactionID
+		}
+		snapshot.Wallets = append(snapshot.Wallets, ws)
+	}
+	sort.Slice(snapshot.Wallets, func(i, j int) bool {
+		return snapshot.Wallets[i].UserID < snapshot.Wallets[j].UserID
+	})
+
+	for _, txn := range mem.transactions {
+		ts := &TransactionSnapshot{
+			ID:               txn.id,
+			Reason:           txn.reason,
+			Timestamp:        txn.timestamp,
+			Category:         txn.category,
+			Tags:             splitTags(txn.tags),
+			CreatedBy:        txn.createdBy,
+			OriginalAmount:   txn.originalAmount,
+			OriginalCurrency: txn.originalCurrency,
+			Rate:             txn.rate,
+			RateDate:         txn.rateDate,
+			Postings:         []*PostingSnapshot{},
+		}
+		for _, p := range txn.postings {
+			ts.Postings = append(ts.Postings, &PostingSnapshot{Account: p.account, Amount: p.amount, Currency: p.currency})
+		}
+		snapshot.Transactions = append(snapshot.Transactions, ts)
+	}
+
+	for key, value := range mem.rates {
+		snapshot.Rates = append(snapshot.Rates, &Rate{Base: key.base, Quote: key.quote, Date: key.date, Value: value})
+	}
+	sort.Slice(snapshot.Rates, func(i, j int) bool {
+		a, b := snapshot.Rates[i], snapshot.Rates[j]
+		if a.Base != b.Base {
+			return a.Base < b.Base
+		}
+		if a.Quote != b.Quote {
+			return a.Quote < b.Quote
+		}
+		return a.Date < b.Date
+	})
+	return snapshot, nil
+}
+
+func (mem *memoryImpl) Restore(snapshot *Snapshot) error {
+	if err := snapshot.Validate(); err != nil {
+		return err
+	}
+
+	if err := mem.lock(); err != nil {
+		return err
+	}
+	defer mem.mutex.Unlock()
+
+	if len(mem.wallets) != 0 || len(mem.transactions) != 0 || len(mem.rates) != 0 {
+		return ErrStorageNotEmpty
+	}
+
+	for _, ws := range snapshot.Wallets {
+		w := &memoryWallet{
+			userID:     ws.UserID,
+			ownerID:    ws.OwnerID,
+			sourceID:   ws.SourceID,
+			currency:   ws.Currency,
+			balance:    ws.Balance,
+			overdraft:  Overdraft{Policy: ws.OverdraftPolicy, Limit: ws.OverdraftLimit},
+			members:    map[string]Role{},
+			categories: map[string]bool{},
+			budgets:    map[string]int64{},
+			imports:    map[string]int64{},
+			keys:       map[string]int64{},
+		}
+		for _, member := range ws.Members {
+			w.members[member.MemberID] = member.Role
+		}
+		for _, category := range ws.Categories {
+			w.categories[category] = true
+		}
+		for category, limit := range ws.Budgets {
+			w.budgets[category] = limit
+		}
+		mem.wallets[w.userID] = w
+	}
+
+	for _, rate := range snapshot.Rates {
+		mem.rates[rateKey{base: rate.Base, quote: rate.Quote, date: rate.Date}] = rate.Value
+	}
+
+	// transactions get new IDs, so imports are mapped to them
+	transactionIDs := map[int64]int64{}
+	for _, txn := range snapshot.Transactions {
+		// tags are checked by Validate already
+		tags, _ := joinTags(txn.Tags)
+		entry := &journalEntry{
+			reason:    txn.Reason,
+			timestamp: txn.Timestamp,
+			category:  txn.Category,
+			tags:      tags,
+			createdBy: txn.CreatedBy,
+			postings:  []posting{},
+			// balances of wallets are restored as they are, and Validate has checked them against postings
+			balanceCached: true,
+		}
+		if txn.OriginalCurrency != "" {
+			entry.conversion = &conversion{
+				amount:   txn.OriginalAmount,
+				currency: txn.OriginalCurrency,
+				rate:     &Rate{Value: txn.Rate, Date: txn.RateDate},
+			}
+		}
+		for _, p := range txn.Postings {
+			entry.postings = append(entry.postings, posting{account: p.Account, amount: p.Amount, currency: p.Currency})
+		}
+
+		transactionID, err := mem.postTransaction(entry)
+		if err != nil {
+			return err
+		}
+		transactionIDs[txn.ID] = transactionID
+	}
+
+	for _, ws := range snapshot.Wallets {
+		for hash, transactionID := range ws.Imports {
+			mem.wallets[ws.UserID].imports[hash] = transactionIDs[transactionID]
+		}
+	}
+	return nil
+}
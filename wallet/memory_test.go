@@ -0,0 +1,16 @@
+package wallet_test
+
+import (
+	"testing"
+
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+	"github.com/andy/guachi-pay-line-bot/wallet/wallettest"
+)
+
+func TestMemoryWallet(t *testing.T) {
+	wallettest.Run(t, func(t *testing.T) wl.Wallet {
+		return wl.NewMemoryWallet()
+	}, wallettest.WithDrift(func(t *testing.T, wallet wl.Wallet, userID string, amount int64) {
+		wl.AddMemoryBalance(wallet, userID, amount)
+	}))
+}
@@ -0,0 +1,68 @@
+package wallet
+
+import (
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// UsersWallet overdraft related statements
+	// OverdraftForbid is stored with zero limit, so that it shares the same condition with OverdraftLimit
+	withdrawWallet = `
+		UPDATE "UsersWallet" SET balance = balance + $1
+		WHERE
+			"userID" = $2
+			AND ("overdraftPolicy" = 'allow' OR balance + $1 >= -1 * "overdraftLimit");
+	`
+	patchOverdraft = `UPDATE "UsersWallet" SET "overdraftPolicy" = $1, "overdraftLimit" = $2 WHERE "userID" = $3;`
+	getOverdraft   = `SELECT "overdraftPolicy", "overdraftLimit" FROM "UsersWallet" WHERE "userID" = $1`
+)
+
+func (im *impl) SetOverdraft(callerID, userID string, policy OverdraftPolicy, limit int64) error {
+	if !policy.IsValid() {
+		return ErrInvalidOverdraft
+	}
+	if policy == OverdraftLimit && limit <= int64(0) {
+		return ErrInvalidOverdraft
+	} else if policy != OverdraftLimit {
+		limit = int64(0)
+	}
+
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in SetOverdraft")
+		return err
+	}
+	defer execRollBack(tx)
+
+	if err := im.checkRole(tx, callerID, userID, RoleOwner); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(patchOverdraft, string(policy), limit, userID); err != nil {
+		logrus.WithField("err", err).Error("tx.Exec(patchOverdraft) failed in SetOverdraft")
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in SetOverdraft")
+		return err
+	}
+	return nil
+}
+
+func (im *impl) GetOverdraft(callerID, userID string) (*Overdraft, error) {
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	overdraft := &Overdraft{}
+	if err := im.db.QueryRow(getOverdraft, userID).Scan(&overdraft.Policy, &overdraft.Limit); err == sql.ErrNoRows {
+		return nil, ErrWalletNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("im.db.QueryRow(getOverdraft) failed in GetOverdraft")
+		return nil, err
+	}
+	return overdraft, nil
+}
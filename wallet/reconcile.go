@@ -0,0 +1,141 @@
+package wallet
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+)
+
+const (
+	// reconciliation related statements
+	getJournalBalance = `SELECT COALESCE(SUM(amount), 0) FROM "LedgerPosting" WHERE account = $1`
+	getAllWallets     = `SELECT "userID" FROM "UsersWallet" ORDER BY "userID"`
+)
+
+// reconcile compares the cached balance with the journal of the wallet, and repairs the drift if needed
+func reconcile(tx *db.Tx, callerID, userID string, repair bool) (*Drift, error) {
+	drift := &Drift{UserID: userID}
+	currency := ""
+	// the balance is locked, so that no posting is written during reconciliation
+	if err := tx.QueryRow(getBalanceForUpdate, userID).Scan(&drift.Balance, &currency); err == sql.ErrNoRows {
+		return nil, ErrWalletNotFound
+	} else if err != nil {
+		logrus.WithField("err", err).Error("tx.QueryRow(getBalanceForUpdate) failed in reconcile")
+		return nil, err
+	}
+
+	if err := tx.QueryRow(getJournalBalance, walletAccount(userID)).Scan(&drift.Journal); err != nil {
+		logrus.WithField("err", err).Error("tx.QueryRow(getJournalBalance) failed in reconcile")
+		return nil, err
+	}
+
+	if drift.Amount() == int64(0) || !repair {
+		return drift, nil
+	}
+
+	// the balance is what users have seen, so the journal is adjusted to agree with it
+	if _, err := postTransaction(tx, &journalEntry{
+		reason:    reconcileReason,
+		timestamp: time.Now().Unix(),
+		createdBy: callerID,
+		postings: []posting{
+			{account: walletAccount(userID), amount: drift.Amount(), currency: currency},
+			{account: equityAdjustment, amount: -1 * drift.Amount(), currency: currency},
+		},
+		balanceCached: true,
+	}); err != nil {
+		return nil, err
+	}
+	drift.Repaired = true
+	return drift, nil
+}
+
+func (im *impl) Reconcile(callerID, userID string, repair bool) (*Drift, error) {
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in Reconcile")
+		return nil, err
+	}
+	defer execRollBack(tx)
+
+	if err := im.checkRole(tx, callerID, userID, RoleOwner); err != nil {
+		return nil, err
+	}
+
+	drift, err := reconcile(tx, callerID, userID, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in Reconcile")
+		return nil, err
+	}
+	return drift, nil
+}
+
+func (im *impl) ReconcileAll(repair bool, userIDs ...string) ([]*Drift, error) {
+	if len(userIDs) == 0 {
+		ids, err := im.getAllWallets()
+		if err != nil {
+			return nil, err
+		}
+		userIDs = ids
+	}
+
+	drifts := []*Drift{}
+	for _, userID := range userIDs {
+		drift, err := im.reconcileWallet(userID, repair)
+		if err != nil {
+			return nil, err
+		}
+		if drift.Amount() != int64(0) {
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts, nil
+}
+
+func (im *impl) getAllWallets() ([]string, error) {
+	rows, err := im.db.Query(getAllWallets)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query(getAllWallets) failed in getAllWallets")
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := []string{}
+	for rows.Next() {
+		userID := ""
+		if err := rows.Scan(&userID); err != nil {
+			logrus.WithField("err", err).Error("rows.Scan failed in getAllWallets")
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// reconcileWallet reconciles a wallet in its own transaction, so that wallets are not locked all together
+func (im *impl) reconcileWallet(userID string, repair bool) (*Drift, error) {
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in reconcileWallet")
+		return nil, err
+	}
+	defer execRollBack(tx)
+
+	drift, err := reconcile(tx, "", userID, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in reconcileWallet")
+		return nil, err
+	}
+	return drift, nil
+}
@@ -0,0 +1,107 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+)
+
+const (
+	// summarizeLogs aggregates postings to the wallet account whose other side is equityExternal,
+	// so transfers, emptying wallets and adjustments are not counted as income or expense
+	// the group key expression is filled by groupByKeys, and the order by groupByOrders
+	summarizeLogs = `
+		SELECT
+			%s AS key,
+			COALESCE(SUM(CASE WHEN posting.amount > 0 THEN posting.amount ELSE 0 END), 0) AS income,
+			COALESCE(SUM(CASE WHEN posting.amount < 0 THEN -posting.amount ELSE 0 END), 0) AS expense
+		FROM
+			"LedgerPosting" posting
+		JOIN
+			"LedgerTransaction" txn
+		ON
+			txn.id = posting."transactionID"
+		JOIN
+			"LedgerPosting" external
+		ON
+			external."transactionID" = posting."transactionID" AND external.account = $2
+		WHERE
+			posting.account = $1 AND txn.timestamp >= $3 AND txn.timestamp < $4
+		GROUP BY
+			key
+		ORDER BY
+			%s
+	`
+)
+
+var (
+	// groupByKeys are expressions of group keys in each dialect, days are based on Asia/Taipei zone
+	groupByKeys = map[db.Dialect]map[GroupBy]string{
+		db.DialectPostgres: {
+			GroupByDay:      `to_char(to_timestamp(txn.timestamp) AT TIME ZONE 'Asia/Taipei', 'YYYY/MM/DD')`,
+			GroupByWeek:     `to_char(date_trunc('week', to_timestamp(txn.timestamp) AT TIME ZONE 'Asia/Taipei'), 'YYYY/MM/DD')`,
+			GroupByMonth:    `to_char(to_timestamp(txn.timestamp) AT TIME ZONE 'Asia/Taipei', 'YYYY/MM')`,
+			GroupByReason:   `txn.reason`,
+			GroupByCategory: `txn.category`,
+		},
+		// SQLite doesn't know time zones, and Asia/Taipei is always UTC+8 since it stopped daylight saving time in 1979
+		// `weekday 0` moves to the next Sunday unless it's already Sunday, so 6 days before it is the Monday
+		db.DialectSQLite: {
+			GroupByDay:      `strftime('%Y/%m/%d', txn.timestamp + 28800, 'unixepoch')`,
+			GroupByWeek:     `strftime('%Y/%m/%d', txn.timestamp + 28800, 'unixepoch', 'weekday 0', '-6 days')`,
+			GroupByMonth:    `strftime('%Y/%m', txn.timestamp + 28800, 'unixepoch')`,
+			GroupByReason:   `txn.reason`,
+			GroupByCategory: `txn.category`,
+		},
+	}
+	// groupByOrders sorts periods in time order, and other groups by the expense
+	groupByOrders = map[GroupBy]string{
+		GroupByDay:      `key`,
+		GroupByWeek:     `key`,
+		GroupByMonth:    `key`,
+		GroupByReason:   `expense DESC, income DESC, key`,
+		GroupByCategory: `expense DESC, income DESC, key`,
+	}
+)
+
+func (im *impl) Summarize(callerID, userID string, timeRange TimeRange, groupBy GroupBy) (*Summary, error) {
+	if !groupBy.IsValid() || timeRange.Start >= timeRange.End {
+		return nil, ErrInvalidReport
+	}
+
+	if err := im.checkRole(im.db, callerID, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(summarizeLogs, groupByKeys[im.db.Dialect][groupBy], groupByOrders[groupBy])
+	rows, err := im.db.Query(query, walletAccount(userID), equityExternal, timeRange.Start, timeRange.End)
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Query(summarizeLogs) failed in Summarize")
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := &Summary{
+		TimeRange: timeRange,
+		GroupBy:   groupBy,
+		Groups:    []*SummaryGroup{},
+	}
+	for rows.Next() {
+		group := &SummaryGroup{}
+		if err := rows.Scan(&group.Key, &group.Income, &group.Expense); err != nil {
+			logrus.WithField("err", err).Error("rows.Scan failed in Summarize")
+			return nil, err
+		}
+		// groups never overlap, so totals are the sum of them
+		summary.Income += group.Income
+		summary.Expense += group.Expense
+		summary.Groups = append(summary.Groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithField("err", err).Error("rows.Err failed in Summarize")
+		return nil, err
+	}
+	return summary, nil
+}
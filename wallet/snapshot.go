@@ -0,0 +1,407 @@
+package wallet
+
+import (
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/andy/guachi-pay-line-bot/db"
+	"github.com/andy/guachi-pay-line-bot/money"
+)
+
+const (
+	// snapshot related statements
+	selectSnapshotWallets = `
+		SELECT
+			"userID", balance, "ownerID", "sourceID", currency, "overdraftPolicy", "overdraftLimit"
+		FROM
+			"UsersWallet"
+		ORDER BY
+			"userID"
+	`
+	selectSnapshotMembers    = `SELECT "userID", "memberID", role FROM "UsersWalletMember" ORDER BY "userID", "memberID"`
+	selectSnapshotCategories = `SELECT "userID", name FROM "UsersWalletCategory" ORDER BY "userID", name`
+	selectSnapshotBudgets    = `SELECT "userID", category, "monthlyLimit" FROM "UsersWalletBudget"`
+	selectSnapshotImports    = `SELECT "userID", hash, "transactionID" FROM "LedgerImport"`
+	selectSnapshotRates      = `SELECT base, quote, date, rate FROM "ExchangeRate" ORDER BY base, quote, date`
+	selectSnapshotTxns       = `
+		SELECT
+			id, reason, timestamp, category, tags, "createdBy", "originalAmount", "originalCurrency", rate, "rateDate"
+		FROM
+			"LedgerTransaction"
+		ORDER BY
+			id
+	`
+	selectSnapshotPostings = `
+		SELECT
+			"transactionID", account, amount, currency
+		FROM
+			"LedgerPosting"
+		ORDER BY
+			"transactionID", id
+	`
+	// the storage is empty if there are no wallets, transactions or rates
+	checkIfStorageUsed = `
+		SELECT 1 FROM "UsersWallet"
+		UNION ALL SELECT 1 FROM "LedgerTransaction"
+		UNION ALL SELECT 1 FROM "ExchangeRate"
+		LIMIT 1
+	`
+)
+
+// Validate checks that the snapshot is consistent, so that it can be restored into any storage
+// (1) wallets are unique, and their currencies and overdraft policies are valid
+// (2) postings of each transaction sum to zero in each currency, and wallet accounts are posted in the currency of the wallet
+// (3) the balance of each wallet is the sum of postings to its account
+func (snapshot *Snapshot) Validate() error {
+	wallets := map[string]*WalletSnapshot{}
+	for _, w := range snapshot.Wallets {
+		if _, ok := wallets[w.UserID]; ok || w.UserID == "" {
+			logrus.WithField("userID", w.UserID).Error("duplicate wallet is found in Validate")
+			return ErrInvalidSnapshot
+		}
+		if _, err := money.GetCurrency(w.Currency); err != nil {
+			logrus.WithField("userID", w.UserID).Error("invalid currency is found in Validate")
+			return ErrInvalidSnapshot
+		}
+		if !w.OverdraftPolicy.IsValid() {
+			logrus.WithField("userID", w.UserID).Error("invalid overdraft policy is found in Validate")
+			return ErrInvalidSnapshot
+		}
+		for _, member := range w.Members {
+			if member.Role != RoleEditor && member.Role != RoleViewer {
+				logrus.WithField("userID", w.UserID).Error("invalid role is found in Validate")
+				return ErrInvalidSnapshot
+			}
+		}
+		wallets[w.UserID] = w
+	}
+
+	journals := map[string]int64{}
+	transactionIDs := map[int64]bool{}
+	for _, txn := range snapshot.Transactions {
+		if transactionIDs[txn.ID] || len(txn.Postings) == 0 {
+			logrus.WithField("transactionID", txn.ID).Error("duplicate or empty transaction is found in Validate")
+			return ErrInvalidSnapshot
+		}
+		transactionIDs[txn.ID] = true
+		if _, err := joinTags(txn.Tags); err != nil {
+			logrus.WithField("transactionID", txn.ID).Error("invalid tag is found in Validate")
+			return ErrInvalidSnapshot
+		}
+
+		sums := map[string]int64{}
+		for _, p := range txn.Postings {
+			sums[p.Currency] += p.Amount
+			if !isWalletAccount(p.Account) {
+				continue
+			}
+			w, ok := wallets[walletUserID(p.Account)]
+			if !ok || w.Currency != p.Currency {
+				logrus.WithField("transactionID", txn.ID).Error("posting to unknown wallet is found in Validate")
+				return ErrInvalidSnapshot
+			}
+			journals[w.UserID] += p.Amount
+		}
+		for _, sum := range sums {
+			if sum != int64(0) {
+				logrus.WithField("transactionID", txn.ID).Error("unbalanced transaction is found in Validate")
+				return ErrInvalidSnapshot
+			}
+		}
+	}
+
+	for _, w := range snapshot.Wallets {
+		if journals[w.UserID] != w.Balance {
+			logrus.WithFields(logrus.Fields{
+				"userID":  w.UserID,
+				"balance": w.Balance,
+				"logs":    journals[w.UserID],
+			}).Error("balance doesn't match logs in Validate")
+			return ErrInvalidSnapshot
+		}
+		for _, transactionID := range w.Imports {
+			if !transactionIDs[transactionID] {
+				logrus.WithField("userID", w.UserID).Error("import of unknown transaction is found in Validate")
+				return ErrInvalidSnapshot
+			}
+		}
+	}
+	return nil
+}
+
+// queryEach runs the query, and calls `scan` with each row
+func queryEach(tx *db.Tx, query string, scan func(rows *sql.Rows) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (im *impl) Snapshot() (*Snapshot, error) {
+	// all tables are read from the same snapshot of the database, so that balances agree with postings
+	tx, err := im.db.BeginTx(im.db.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.BeginTx failed in Snapshot")
+		return nil, err
+	}
+	defer execRollBack(tx)
+
+	snapshot := &Snapshot{
+		Wallets:      []*WalletSnapshot{},
+		Transactions: []*TransactionSnapshot{},
+		Rates:        []*Rate{},
+	}
+	wallets := map[string]*WalletSnapshot{}
+	if err := queryEach(tx, selectSnapshotWallets, func(rows *sql.Rows) error {
+		w := &WalletSnapshot{
+			Members:    []*Member{},
+			Categories: []string{},
+			Budgets:    map[string]int64{},
+			Imports:    map[string]int64{},
+		}
+		if err := rows.Scan(&w.UserID, &w.Balance, &w.OwnerID, &w.SourceID, &w.Currency, &w.OverdraftPolicy, &w.OverdraftLimit); err != nil {
+			return err
+		}
+		snapshot.Wallets = append(snapshot.Wallets, w)
+		wallets[w.UserID] = w
+		return nil
+	}); err != nil {
+		logrus.WithField("err", err).Error("queryEach(selectSnapshotWallets) failed in Snapshot")
+		return nil, err
+	}
+
+	if err := queryEach(tx, selectSnapshotMembers, func(rows *sql.Rows) error {
+		userID, member := "", &Member{}
+		if err := rows.Scan(&userID, &member.MemberID, &member.Role); err != nil {
+			return err
+		}
+		if w, ok := wallets[userID]; ok {
+			w.Members = append(w.Members, member)
+		}
+		return nil
+	}); err != nil {
+		logrus.WithField("err", err).Error("queryEach(selectSnapshotMembers) failed in Snapshot")
+		return nil, err
+	}
+
+	if err := queryEach(tx, selectSnapshotCategories, func(rows *sql.Rows) error {
+		userID, category := "", ""
+		if err := rows.Scan(&userID, &category); err != nil {
+			return err
+		}
+		if w, ok := wallets[userID]; ok {
+			w.Categories = append(w.Categories, category)
+		}
+		return nil
+	}); err != nil {
+		logrus.WithField("err", err).Error("queryEach(selectSnapshotCategories) failed in Snapshot")
+		return nil, err
+	}
+
+	if err := queryEach(tx, selectSnapshotBudgets, func(rows *sql.Rows) error {
+		userID, category, limit := "", "", int64(0)
+		if err := rows.Scan(&userID, &category, &limit); err != nil {
+			return err
+		}
+		if w, ok := wallets[userID]; ok {
+			w.Budgets[category] = limit
+		}
+		return nil
+	}); err != nil {
+		logrus.WithField("err", err).Error("queryEach(selectSnapshotBudgets) failed in Snapshot")
+		return nil, err
+	}
+
+	if err := queryEach(tx, selectSnapshotImports, func(rows *sql.Rows) error {
+		userID, hash, transactionID := "", "", int64(0)
+		if err := rows.Scan(&userID, &hash, &transactionID); err != nil {
+			return err
+		}
+		if w, ok := wallets[userID]; ok {
+			w.Imports[hash] = transactionID
+		}
+		return nil
+	}); err != nil {
+		logrus.WithField("err", err).Error("queryEach(selectSnapshotImports) failed in Snapshot")
+		return nil, err
+	}
+
+	if err := queryEach(tx, selectSnapshotRates, func(rows *sql.Rows) error {
+		rate := &Rate{}
+		if err := rows.Scan(&rate.Base, &rate.Quote, &rate.Date, &rate.Value); err != nil {
+			return err
+		}
+		snapshot.Rates = append(snapshot.Rates, rate)
+		return nil
+	}); err != nil {
+		logrus.WithField("err", err).Error("queryEach(selectSnapshotRates) failed in Snapshot")
+		return nil, err
+	}
+
+	transactions := map[int64]*TransactionSnapshot{}
+	if err := queryEach(tx, selectSnapshotTxns, func(rows *sql.Rows) error {
+		txn := &TransactionSnapshot{Postings: []*PostingSnapshot{}}
+		tags := ""
+		if err := rows.Scan(
+			&txn.ID, &txn.Reason, &txn.Timestamp, &txn.Category, &tags, &txn.CreatedBy,
+			&txn.OriginalAmount, &txn.OriginalCurrency, &txn.Rate, &txn.RateDate,
+		); err != nil {
+			return err
+		}
+		txn.Tags = splitTags(tags)
+		snapshot.Transactions = append(snapshot.Transactions, txn)
+		transactions[txn.ID] = txn
+		return nil
+	}); err != nil {
+		logrus.WithField("err", err).Error("queryEach(selectSnapshotTxns) failed in Snapshot")
+		return nil, err
+	}
+
+	if err := queryEach(tx, selectSnapshotPostings, func(rows *sql.Rows) error {
+		transactionID, p := int64(0), &PostingSnapshot{}
+		if err := rows.Scan(&transactionID, &p.Account, &p.Amount, &p.Currency); err != nil {
+			return err
+		}
+		if txn, ok := transactions[transactionID]; ok {
+			txn.Postings = append(txn.Postings, p)
+		}
+		return nil
+	}); err != nil {
+		logrus.WithField("err", err).Error("queryEach(selectSnapshotPostings) failed in Snapshot")
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in Snapshot")
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (im *impl) Restore(snapshot *Snapshot) error {
+	if err := snapshot.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := im.db.Begin()
+	if err != nil {
+		logrus.WithField("err", err).Error("im.db.Begin failed in Restore")
+		return err
+	}
+	defer execRollBack(tx)
+
+	used := 0
+	if err := tx.QueryRow(checkIfStorageUsed).Scan(&used); err == nil {
+		return ErrStorageNotEmpty
+	} else if err != sql.ErrNoRows {
+		logrus.WithField("err", err).Error("tx.QueryRow(checkIfStorageUsed) failed in Restore")
+		return err
+	}
+
+	for _, w := range snapshot.Wallets {
+		if _, err := tx.Exec(createWallet, w.UserID, w.Balance, w.OwnerID, w.SourceID, w.Currency); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(createWallet) failed in Restore")
+			return err
+		}
+		if _, err := tx.Exec(patchOverdraft, w.OverdraftPolicy, w.OverdraftLimit, w.UserID); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(patchOverdraft) failed in Restore")
+			return err
+		}
+		for _, member := range w.Members {
+			if _, err := tx.Exec(upsertMember, w.UserID, member.MemberID, member.Role); err != nil {
+				logrus.WithField("err", err).Error("tx.Exec(upsertMember) failed in Restore")
+				return err
+			}
+		}
+		for _, category := range w.Categories {
+			if _, err := tx.Exec(insertCategory, w.UserID, category); err != nil {
+				logrus.WithField("err", err).Error("tx.Exec(insertCategory) failed in Restore")
+				return err
+			}
+		}
+		for category, limit := range w.Budgets {
+			if _, err := tx.Exec(upsertBudget, w.UserID, category, limit); err != nil {
+				logrus.WithField("err", err).Error("tx.Exec(upsertBudget) failed in Restore")
+				return err
+			}
+		}
+	}
+
+	for _, rate := range snapshot.Rates {
+		if _, err := tx.Exec(upsertRate, rate.Base, rate.Quote, rate.Date, rate.Value); err != nil {
+			logrus.WithField("err", err).Error("tx.Exec(upsertRate) failed in Restore")
+			return err
+		}
+	}
+
+	// transactions get new IDs, so imports are mapped to them
+	transactionIDs := map[int64]int64{}
+	for _, txn := range snapshot.Transactions {
+		tags, err := joinTags(txn.Tags)
+		if err != nil {
+			return ErrInvalidSnapshot
+		}
+		entry := &journalEntry{
+			reason:    txn.Reason,
+			timestamp: txn.Timestamp,
+			category:  txn.Category,
+			tags:      tags,
+			createdBy: txn.CreatedBy,
+			postings:  []posting{},
+			// balances of wallets are restored as they are, and they are checked against postings below
+			balanceCached: true,
+		}
+		if txn.OriginalCurrency != "" {
+			entry.conversion = &conversion{
+				amount:   txn.OriginalAmount,
+				currency: txn.OriginalCurrency,
+				rate:     &Rate{Value: txn.Rate, Date: txn.RateDate},
+			}
+		}
+		for _, p := range txn.Postings {
+			entry.postings = append(entry.postings, posting{account: p.Account, amount: p.Amount, currency: p.Currency})
+		}
+
+		transactionID, err := postTransaction(tx, entry)
+		if err != nil {
+			return err
+		}
+		transactionIDs[txn.ID] = transactionID
+	}
+
+	for _, w := range snapshot.Wallets {
+		for hash, transactionID := range w.Imports {
+			if _, err := tx.Exec(insertImport, w.UserID, hash, transactionIDs[transactionID]); err != nil {
+				logrus.WithField("err", err).Error("tx.Exec(insertImport) failed in Restore")
+				return err
+			}
+		}
+	}
+
+	// balances are checked against what is actually written before committing
+	for _, w := range snapshot.Wallets {
+		drift, err := reconcile(tx, "", w.UserID, false)
+		if err != nil {
+			return err
+		}
+		if drift.Amount() != int64(0) {
+			logrus.WithField("drift", drift).Error("balance doesn't match logs in Restore")
+			return ErrInvalidSnapshot
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithField("err", err).Error("tx.Commit() failed in Restore")
+		return err
+	}
+	return nil
+}
@@ -1,7 +1,12 @@
 package wallet
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"time"
+
+	"github.com/andy/guachi-pay-line-bot/money"
 )
 
 var (
@@ -9,39 +14,492 @@ var (
 	ErrWalletNotFound = fmt.Errorf("the wallet doesn't exist")
 	// ErrWalletExist occurs when trying to create a wallet that has already been created
 	ErrWalletExist = fmt.Errorf("the wallet has already been created")
+	// ErrPermissionDenied occurs when the caller doesn't have the required role of the wallet
+	ErrPermissionDenied = fmt.Errorf("permission denied to operate the wallet")
+	// ErrInvalidRole occurs when trying to assign a role that is not allowed to a member
+	ErrInvalidRole = fmt.Errorf("invalid role is found")
+	// ErrMemberNotFound occurs when trying to remove a member who is not in the wallet
+	ErrMemberNotFound = fmt.Errorf("the member doesn't exist")
+	// ErrInvalidTransfer occurs when trying to transfer money from a wallet to itself
+	ErrInvalidTransfer = fmt.Errorf("can't transfer money to the same wallet")
+	// ErrInvalidAmount occurs when the amount to transfer isn't positive
+	ErrInvalidAmount = fmt.Errorf("invalid amount is found")
+	// ErrCategoryNotFound occurs when the category is not one of the categories of the wallet
+	ErrCategoryNotFound = fmt.Errorf("the category doesn't exist")
+	// ErrCategoryExist occurs when trying to add a category that has already been added
+	ErrCategoryExist = fmt.Errorf("the category has already been added")
+	// ErrInvalidTag occurs when the tag is empty or contains `,`
+	ErrInvalidTag = fmt.Errorf("invalid tag is found")
+	// ErrInvalidBudget occurs when the limit of the budget is negative
+	ErrInvalidBudget = fmt.Errorf("invalid budget is found")
+	// ErrLogNotFound occurs when trying to do operation to the non-exist balance log
+	ErrLogNotFound = fmt.Errorf("the balance log doesn't exist")
+	// ErrInsufficientBalance occurs when spending makes the balance lower than the overdraft policy allows
+	ErrInsufficientBalance = fmt.Errorf("the balance is insufficient")
+	// ErrInvalidOverdraft occurs when the overdraft policy or its limit is invalid
+	ErrInvalidOverdraft = fmt.Errorf("invalid overdraft policy is found")
+	// ErrInvalidCurrency occurs when the currency isn't supported by the money package
+	ErrInvalidCurrency = fmt.Errorf("invalid currency is found")
+	// ErrCurrencyMismatch occurs when moving money between wallets of different currencies
+	ErrCurrencyMismatch = fmt.Errorf("currencies of wallets are different")
+	// ErrRateNotFound occurs when there is no exchange rate between the currencies on or before the day
+	ErrRateNotFound = fmt.Errorf("the exchange rate doesn't exist")
+	// ErrInvalidRate occurs when the exchange rate can't be parsed or it isn't positive
+	ErrInvalidRate = fmt.Errorf("invalid exchange rate is found")
+	// ErrLogNotEditable occurs when updating a log that is converted from another currency
+	ErrLogNotEditable = fmt.Errorf("the balance log can't be updated")
+	// ErrInvalidReport occurs when the time range of the report is empty or the grouping isn't supported
+	ErrInvalidReport = fmt.Errorf("invalid report is found")
+	// ErrInvalidExportFormat occurs when the format of exported logs isn't supported
+	ErrInvalidExportFormat = fmt.Errorf("invalid export format is found")
+	// ErrInvalidSnapshot occurs when the snapshot is inconsistent, ex: balances don't match logs
+	ErrInvalidSnapshot = fmt.Errorf("invalid snapshot is found")
+	// ErrStorageNotEmpty occurs when restoring a snapshot into storage that already has wallets, logs or rates
+	ErrStorageNotEmpty = fmt.Errorf("the storage isn't empty")
+	// ErrDuplicateRequest occurs when the request with the same idempotency key is recorded already,
+	// nothing is recorded again, and the result of the first request is got by GetReceipt
+	ErrDuplicateRequest = fmt.Errorf("the request has already been recorded")
+)
+
+// Role defines what a member is allowed to do with the wallet
+type Role string
+
+const (
+	// RoleOwner is allowed to do anything, including deleting the wallet and managing members
+	RoleOwner Role = "owner"
+	// RoleEditor is allowed to deposit to and spend from the wallet
+	RoleEditor Role = "editor"
+	// RoleViewer is only allowed to see the balance and balance logs
+	RoleViewer Role = "viewer"
+)
+
+var (
+	roleLevels = map[Role]int{
+		RoleViewer: 1,
+		RoleEditor: 2,
+		RoleOwner:  3,
+	}
+)
+
+// IsValid checks if the role is one of the defined roles
+func (role Role) IsValid() bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// covers checks if the role is allowed to do what `required` is allowed to do
+func (role Role) covers(required Role) bool {
+	return roleLevels[role] >= roleLevels[required]
+}
+
+// OverdraftPolicy defines how low the balance of the wallet is allowed to be
+type OverdraftPolicy string
+
+const (
+	// OverdraftAllow allows the balance to be any negative number, it's the default policy
+	OverdraftAllow OverdraftPolicy = "allow"
+	// OverdraftForbid doesn't allow the balance to be negative, ex: cash envelopes
+	OverdraftForbid OverdraftPolicy = "forbid"
+	// OverdraftLimit allows the balance to be negative down to -limit, ex: credit cards
+	OverdraftLimit OverdraftPolicy = "limit"
+)
+
+// IsValid checks if the policy is one of the defined policies
+func (policy OverdraftPolicy) IsValid() bool {
+	return policy == OverdraftAllow || policy == OverdraftForbid || policy == OverdraftLimit
+}
+
+// Overdraft is the overdraft policy of the wallet
+type Overdraft struct {
+	Policy OverdraftPolicy
+	// Limit is only meaningful when Policy is OverdraftLimit
+	Limit int64
+}
+
+// Receipt is the log recorded by the request with the idempotency key, and balances right after it
+type Receipt struct {
+	Log *BalanceLog
+	// Balance is the balance of the wallet right after the log, so the balance before it is Balance - Log.Amount
+	Balance int64
+	// CounterpartyBalance is the balance of Log.CounterpartyID right after the log if it's a transfer
+	CounterpartyBalance int64
+}
+
+// Drift is the difference between the cached balance of the wallet and the sum of its logs
+type Drift struct {
+	UserID  string
+	Balance int64
+	// Journal is the sum of amounts of all logs of the wallet
+	Journal int64
+	// Repaired means an adjustment log is written, so that the sum of logs agrees with the balance
+	Repaired bool
+}
+
+// Amount is how much the balance is more than the sum of logs
+func (drift *Drift) Amount() int64 {
+	return drift.Balance - drift.Journal
+}
+
+// Budget is the monthly limit of spending
+type Budget struct {
+	// Category is empty if the budget is for the whole wallet
+	Category string
+	Limit    int64
+	// Spent is how much has been spent in this month, transfers are not counted
+	Spent int64
+}
+
+// GroupBy defines how logs are grouped in the report
+type GroupBy string
+
+const (
+	// GroupByDay groups logs by the day, and the key is like 2019/05/20
+	GroupByDay GroupBy = "day"
+	// GroupByWeek groups logs by the week starting on Monday, and the key is the Monday like 2019/05/20
+	GroupByWeek GroupBy = "week"
+	// GroupByMonth groups logs by the month, and the key is like 2019/05
+	GroupByMonth GroupBy = "month"
+	// GroupByReason groups logs by the reason
+	GroupByReason GroupBy = "reason"
+	// GroupByCategory groups logs by the category, and the key is empty for logs without category
+	GroupByCategory GroupBy = "category"
 )
 
+// IsValid checks if the grouping is supported
+func (groupBy GroupBy) IsValid() bool {
+	switch groupBy {
+	case GroupByDay, GroupByWeek, GroupByMonth, GroupByReason, GroupByCategory:
+		return true
+	}
+	return false
+}
+
+// TimeRange is the unix timestamp range [Start, End)
+type TimeRange struct {
+	Start int64
+	End   int64
+}
+
+// ImportEntry is an entry of bank statements that is going to be imported as a log
+type ImportEntry struct {
+	Timestamp int64
+	Reason    string
+	// Amount is signed as BalanceLog.Amount, and it's in the currency of the wallet
+	Amount int64
+	// Category is added to the wallet if it's not one of its categories, and it's empty if the entry doesn't have one
+	Category string
+}
+
+// ImportResult is how many entries are imported, and how many are skipped as they were imported before
+type ImportResult struct {
+	Imported int
+	Skipped  int
+}
+
+// ExportFormat defines the file format of exported logs
+type ExportFormat string
+
+const (
+	// ExportCSV exports logs as CSV with a header line,
+	// and every line is timestamp, reason, category, tags, amount, currency, counterparty and the running balance
+	ExportCSV ExportFormat = "csv"
+	// ExportLedger exports logs as a ledger-cli journal, categories are mapped to Income:<category> and Expenses:<category>
+	ExportLedger ExportFormat = "ledger"
+	// ExportBeancount exports logs as a beancount file with accounts mapped as ExportLedger does
+	ExportBeancount ExportFormat = "beancount"
+)
+
+// IsValid checks if the format is supported
+func (format ExportFormat) IsValid() bool {
+	switch format {
+	case ExportCSV, ExportLedger, ExportBeancount:
+		return true
+	}
+	return false
+}
+
+// SummaryGroup is the income and expense of a group of logs
+type SummaryGroup struct {
+	Key     string
+	Income  int64
+	Expense int64
+}
+
+// Net is how much the group increases the balance
+func (group *SummaryGroup) Net() int64 {
+	return group.Income - group.Expense
+}
+
+// Summary is the report of income and expense of the wallet in the time range
+// only deposits and spending are counted, transfers and adjustments are not
+type Summary struct {
+	TimeRange TimeRange
+	GroupBy   GroupBy
+	Income    int64
+	// Expense is positive, ex: spending 100 makes Expense 100
+	Expense int64
+	Groups  []*SummaryGroup
+}
+
+// Net is how much the income is more than the expense
+func (summary *Summary) Net() int64 {
+	return summary.Income - summary.Expense
+}
+
+// Member ...
+type Member struct {
+	// MemberID is the LINE user ID of the member
+	MemberID string `json:"memberID"`
+	Role     Role   `json:"role"`
+}
+
+// Rate is the exchange rate of a day, ex: 1 USD = 31.5 TWD
+type Rate struct {
+	Base  string `json:"base"`
+	Quote string `json:"quote"`
+	// Date is the unix timestamp of the beginning of the day that the rate is for
+	Date int64 `json:"date"`
+	// Value is how many Quote one Base is worth, it's a decimal like 31.5
+	Value string `json:"rate"`
+}
+
+// Conversion describes how the log is converted from another currency
+type Conversion struct {
+	// Amount is minor units of Currency, and it's signed as BalanceLog.Amount
+	Amount   int64
+	Currency string
+	// Rate is the exchange rate used by the conversion, Rate.Base is Currency
+	Rate *Rate
+}
+
 // BalanceLog ...
 type BalanceLog struct {
+	// ID is stable, and it's used to update or delete the log
+	// it's the ID of the posting to the wallet in the journal
+	ID     int64
 	Amount int64
 	Reason string
 	// format: 2019/05/20 12:00:00
 	Timestamp string
+	// CounterpartyID is the other wallet of the transfer, it's empty if the log is not a transfer
+	CounterpartyID string
+	// Category is empty if the log doesn't belong to any category
+	Category string
+	Tags     []string
+	// Conversion is nil unless the log is recorded in another currency
+	Conversion *Conversion
+}
+
+// WalletSnapshot is a wallet with all its settings and members
+type WalletSnapshot struct {
+	UserID   string `json:"userID"`
+	OwnerID  string `json:"ownerID"`
+	SourceID string `json:"sourceID"`
+	Currency string `json:"currency"`
+	// Balance is the cached balance, it should be the sum of postings to the wallet account
+	Balance         int64           `json:"balance"`
+	OverdraftPolicy OverdraftPolicy `json:"overdraftPolicy"`
+	OverdraftLimit  int64           `json:"overdraftLimit"`
+	// Members don't include the owner
+	Members    []*Member `json:"members"`
+	Categories []string  `json:"categories"`
+	// Budgets are monthly limits, and the key is the category, empty for the whole wallet
+	Budgets map[string]int64 `json:"budgets"`
+	// Imports are hashes of imported statement entries, and the value is the ID of the transaction in the snapshot
+	Imports map[string]int64 `json:"imports"`
+}
+
+// PostingSnapshot is a posting of a transaction
+type PostingSnapshot struct {
+	Account  string `json:"account"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// TransactionSnapshot is a transaction of the journal with its postings
+type TransactionSnapshot struct {
+	// ID is only used to refer to the transaction in the snapshot, transactions get new IDs when they are restored
+	ID        int64    `json:"id"`
+	Reason    string   `json:"reason"`
+	Timestamp int64    `json:"timestamp"`
+	Category  string   `json:"category"`
+	Tags      []string `json:"tags"`
+	CreatedBy string   `json:"createdBy"`
+	// the original amount is unsigned, and these fields are empty unless the transaction is converted from another currency
+	OriginalAmount   int64              `json:"originalAmount,omitempty"`
+	OriginalCurrency string             `json:"originalCurrency,omitempty"`
+	Rate             string             `json:"rate,omitempty"`
+	RateDate         int64              `json:"rateDate,omitempty"`
+	Postings         []*PostingSnapshot `json:"postings"`
+}
+
+// Snapshot is everything that the wallet stores, it's used to back up and restore all wallets
+type Snapshot struct {
+	Wallets      []*WalletSnapshot      `json:"wallets"`
+	Transactions []*TransactionSnapshot `json:"transactions"`
+	Rates        []*Rate                `json:"rates"`
+}
+
+// Converter converts amounts between currencies with exchange rates stored locally
+type Converter interface {
+	// SetRate stores the rate of the day that `timestamp` is in, ex: SetRate("USD", "TWD", now, "31.5")
+	SetRate(base, quote string, timestamp int64, rate string) error
+	// GetRate will get the latest rate on or before the day that `timestamp` is in,
+	// the rate of the opposite direction is inverted if there is no rate of this direction
+	GetRate(base, quote string, timestamp int64) (*Rate, error)
+	// ImportRates imports rates from CSV rows of date, base, quote and rate, ex: 2019/05/20,USD,TWD,31.5
+	// all rows are imported in a single transaction, and the number of rows is returned
+	ImportRates(reader io.Reader) (int, error)
+	// Convert converts `amount` minor units of `from` into minor units of `to` with the rate of GetRate
+	Convert(amount int64, from, to string, timestamp int64) (int64, *Rate, error)
 }
 
 // Wallet ...
+//
+// `callerID` is the LINE user ID of the one who operates the wallet,
+// the caller should have the required role of the wallet, otherwise ErrPermissionDenied is returned
+//
+// all amounts, including balances, limits and amounts of logs, are minor units of the currency of the wallet
 type Wallet interface {
-	// Create creates a new wallet for user
-	Create(userID string) error
-	// Delete deletes user's wallet
-	Delete(userID string) error
-	// Empty will empty user's balance to zero
-	EmptyBalance(userID string) error
+	Converter
+
+	// WithContext gets the wallet whose operations are canceled with `ctx`, ex: when the request times out
+	// it shares the storage with this wallet, and an operation that is canceled changes nothing
+	WithContext(ctx context.Context) Wallet
+	// WithSource gets the wallet that is operated from the LINE group or room, or from a 1:1 chat if `sourceID` is empty
+	// wallets created in a group or a room can only be operated from it, and ErrPermissionDenied is returned otherwise,
+	// the wallet that isn't bound to any source is for maintainers and the scheduler, and it operates any wallet
+	WithSource(sourceID string) Wallet
+	// Create creates a new wallet for user, and the caller will be the owner of it
+	Create(callerID, userID string, options ...CreateOption) error
+	// Delete deletes user's wallet, only the owner is allowed
+	// the history is kept in the journal, but it's no longer attached to the wallet name
+	Delete(callerID, userID string) error
+	// Empty will empty user's balance to zero, only the owner is allowed
+	// the history is kept, and the emptying is recorded as a log
+	EmptyBalance(callerID, userID string) error
 	// GetBalance will get balance of a user
-	GetBalance(userID string) (int64, error)
+	GetBalance(callerID, userID string) (int64, error)
+	// GetCurrency will get the currency code of user's wallet
+	GetCurrency(callerID, userID string) (string, error)
 	// GetBalanceLogs will get balanceLogs of a user
-	GetBalanceLogs(userID string, options ...GetLogsOption) ([]*BalanceLog, error)
-	// Deposit will deposit `amount` NTD to user's wallet
-	Deposit(userID string, amount int64, reason string) error
-	// Spend will spend `amount` NTD from user's wallet
-	Spend(userID string, amount int64, reason string) error
+	GetBalanceLogs(callerID, userID string, options ...GetLogsOption) ([]*BalanceLog, error)
+	// Deposit will deposit `amount` minor units of the currency of the wallet to user's wallet, editors are allowed
+	// with WithIdempotencyKey, a repeated key returns ErrDuplicateRequest, and nothing is recorded again
+	Deposit(callerID, userID string, amount int64, reason string, options ...RecordOption) error
+	// Spend will spend `amount` minor units of the currency of the wallet from user's wallet, editors are allowed
+	// ErrInsufficientBalance is returned if the overdraft policy of the wallet doesn't allow it,
+	// and a repeated idempotency key is handled as Deposit does
+	Spend(callerID, userID string, amount int64, reason string, options ...RecordOption) error
+	// Transfer will move `amount` minor units of the currency of the source wallet to another wallet in a single transaction,
+	// and it's converted if the currency of the other wallet is different,
+	// the overdraft policy of the source wallet is enforced as Spend does,
+	// the caller should be an editor of both wallets, and only WithIdempotencyKey of options applies,
+	// whose key is recorded in the source wallet, and ErrInvalidAmount is returned unless `amount` is positive
+	Transfer(callerID, fromUserID, toUserID string, amount int64, reason string, options ...RecordOption) error
+	// GetReceipt will get the receipt of the request that is recorded with the idempotency key in user's wallet,
+	// so that the repeated request that gets ErrDuplicateRequest is replied as the first one was, viewers are allowed
+	// ErrLogNotFound is returned if the log is deleted after it's recorded
+	GetReceipt(callerID, userID, key string) (*Receipt, error)
+	// GetLastLog will get the last log of user's wallet that is recorded by the caller
+	GetLastLog(callerID, userID string) (*BalanceLog, error)
+	// UpdateLog changes amount and reason of the log, and adjusts the balance in a single transaction, editors are allowed
+	// ErrLogNotEditable is returned if the log is converted from another currency
+	// `amount` is signed as BalanceLog.Amount, and both sides are updated if the log is a transfer
+	UpdateLog(callerID, userID string, logID int64, amount int64, reason string) error
+	// DeleteLog deletes the log, and reverts the balance in a single transaction, editors are allowed
+	// both sides are deleted if the log is a transfer
+	DeleteLog(callerID, userID string, logID int64) error
 	// IsWalletExist will check if user's wallet does exist
 	IsWalletExist(userID string) bool
+	// Authorize will check if the caller has `role` of user's wallet
+	Authorize(callerID, userID string, role Role) error
+	// AddMember adds a member to user's wallet or changes role of the member, only the owner is allowed
+	// `role` should be either RoleEditor or RoleViewer
+	AddMember(callerID, userID, memberID string, role Role) error
+	// RemoveMember removes a member from user's wallet, only the owner is allowed
+	RemoveMember(callerID, userID, memberID string) error
+	// SetOwner makes `ownerID` the owner of user's wallet without checking roles, it's for maintainers only
+	// wallets created before ownership was introduced have no owner, and nobody can operate them until it's set
+	SetOwner(userID, ownerID string) error
+	// GetMembers will get all members of user's wallet, including the owner
+	GetMembers(callerID, userID string) ([]*Member, error)
+	// AddCategory adds a category to user's wallet, editors are allowed
+	AddCategory(callerID, userID, category string) error
+	// RemoveCategory removes a category from user's wallet, editors are allowed
+	// logs that belong to the category will remain unchanged
+	RemoveCategory(callerID, userID, category string) error
+	// GetCategories will get all categories of user's wallet
+	GetCategories(callerID, userID string) ([]string, error)
+	// SetBudget sets the monthly limit of the category, editors are allowed
+	// empty category means the limit is for the whole wallet, and zero limit removes the budget
+	SetBudget(callerID, userID, category string, limit int64) error
+	// GetBudgets will get all budgets of user's wallet with spending of this month
+	GetBudgets(callerID, userID string) ([]*Budget, error)
+	// Summarize will get income and expense of user's wallet in the time range, grouped by `groupBy`
+	Summarize(callerID, userID string, timeRange TimeRange, groupBy GroupBy) (*Summary, error)
+	// ImportEntries imports entries as logs of user's wallet in a single transaction, editors are allowed
+	// entries that were imported before are skipped, they are detected by hashes of their date, amount and reason
+	// the overdraft policy is enforced as Spend does, entry by entry in the given order,
+	// and ErrInsufficientBalance is returned without importing any entry if one of them is refused
+	ImportEntries(callerID, userID string, entries []*ImportEntry) (*ImportResult, error)
+	// ExportLogs writes logs of user's wallet in the time range to `writer` in the format
+	// the running balance is the balance right after the log, including logs before the time range
+	ExportLogs(callerID, userID string, timeRange TimeRange, format ExportFormat, writer io.Writer) error
+	// SetOverdraft sets the overdraft policy of user's wallet, only the owner is allowed
+	// `limit` should be positive for OverdraftLimit, and it's ignored for other policies
+	SetOverdraft(callerID, userID string, policy OverdraftPolicy, limit int64) error
+	// GetOverdraft will get the overdraft policy of user's wallet
+	GetOverdraft(callerID, userID string) (*Overdraft, error)
+	// Reconcile compares the balance of user's wallet with the sum of its logs, only the owner is allowed
+	// if `repair` is true, the drift is repaired by an adjustment log, and the balance remains unchanged
+	Reconcile(callerID, userID string, repair bool) (*Drift, error)
+	// ReconcileAll reconciles wallets as Reconcile does without checking roles, it's for maintainers only
+	// all wallets are reconciled if `userIDs` is empty, and only wallets with drift are returned
+	ReconcileAll(repair bool, userIDs ...string) ([]*Drift, error)
+	// Snapshot will get everything that the wallet stores without checking roles, it's for maintainers only
+	Snapshot() (*Snapshot, error)
+	// Restore loads the snapshot in a single transaction without checking roles, it's for maintainers only
+	// the snapshot is validated by Snapshot.Validate, and ErrStorageNotEmpty is returned unless the storage is empty
+	Restore(snapshot *Snapshot) error
+}
+
+type createOption struct {
+	sourceID string
+	currency string
+}
+
+// CreateOption define optional params of creating a wallet
+type CreateOption func(*createOption)
+
+// WithSourceID means the wallet is attached to a LINE group or room, and it is only operated from it, see Wallet.WithSource
+func WithSourceID(sourceID string) CreateOption {
+	return func(opt *createOption) {
+		opt.sourceID = sourceID
+	}
+}
+
+// WithCurrency sets the currency of the wallet, it's money.DefaultCurrency if it's not set
+func WithCurrency(currency string) CreateOption {
+	return func(opt *createOption) {
+		opt.currency = currency
+	}
+}
+
+func initCreateOption(options ...CreateOption) createOption {
+	opt := createOption{
+		currency: money.DefaultCurrency,
+	}
+	for _, f := range options {
+		f(&opt)
+	}
+	return opt
 }
 
 type getLogsOption struct {
 	startTime int64
 	endTime   int64
+	category  string
 }
 
 // GetLogsOption define optional params of getting balance
@@ -61,6 +519,13 @@ func WithEndTime(endTime int64) GetLogsOption {
 	}
 }
 
+// WithCategory means getting balance that belongs to the category
+func WithCategory(category string) GetLogsOption {
+	return func(opt *getLogsOption) {
+		opt.category = category
+	}
+}
+
 func initOption(options ...GetLogsOption) getLogsOption {
 	opt := getLogsOption{}
 	for _, f := range options {
@@ -68,3 +533,63 @@ func initOption(options ...GetLogsOption) getLogsOption {
 	}
 	return opt
 }
+
+type recordOption struct {
+	category       string
+	tags           []string
+	timestamp      int64
+	currency       string
+	idempotencyKey string
+}
+
+// RecordOption define optional params of depositing, spending and transferring
+type RecordOption func(*recordOption)
+
+// InCategory means the log belongs to the category, which should be one of the categories of the wallet
+func InCategory(category string) RecordOption {
+	return func(opt *recordOption) {
+		opt.category = category
+	}
+}
+
+// WithTags means the log is tagged with tags, which should not contain `,`
+func WithTags(tags ...string) RecordOption {
+	return func(opt *recordOption) {
+		opt.tags = append(opt.tags, tags...)
+	}
+}
+
+// WithTimestamp means the log is recorded at the unix timestamp instead of now
+func WithTimestamp(timestamp int64) RecordOption {
+	return func(opt *recordOption) {
+		opt.timestamp = timestamp
+	}
+}
+
+// InCurrency means `amount` is in the currency, and it's converted into the currency of the wallet
+// with the rate of the day that the log is recorded on
+func InCurrency(currency string) RecordOption {
+	return func(opt *recordOption) {
+		opt.currency = currency
+	}
+}
+
+// WithIdempotencyKey means the log is recorded once for the key in the wallet, ex: the ID of the LINE message,
+// so that a redelivered or repeated request doesn't record the money twice, and it gets ErrDuplicateRequest
+func WithIdempotencyKey(key string) RecordOption {
+	return func(opt *recordOption) {
+		opt.idempotencyKey = key
+	}
+}
+
+func initRecordOption(options ...RecordOption) recordOption {
+	opt := recordOption{}
+	for _, f := range options {
+		f(&opt)
+	}
+
+	if opt.timestamp == int64(0) {
+		opt.timestamp = time.Now().Unix()
+	}
+	return opt
+}
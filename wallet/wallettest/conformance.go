@@ -0,0 +1,950 @@
+// Package wallettest is the conformance test suite of wallet.Wallet, every backend should pass it
+package wallettest
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+const (
+	ownerID  = "owner"
+	editorID = "editor"
+	viewerID = "viewer"
+	guestID  = "guest"
+	userID   = "guachi"
+	otherID  = "pay"
+)
+
+var (
+	location, _ = time.LoadLocation("Asia/Taipei")
+	// day is the day that logs with timestamps are recorded on, it's in the past, so they are returned by default
+	day = time.Date(2019, time.May, 20, 12, 0, 0, 0, location).Unix()
+)
+
+// NewWallet creates an empty wallet of the backend for each test
+type NewWallet func(t *testing.T) wl.Wallet
+
+// Drift makes the cached balance of user's wallet `amount` more than the sum of its logs, as a partial write would,
+// it's done behind the wallet, as the wallet never does it itself
+type Drift func(t *testing.T, wallet wl.Wallet, userID string, amount int64)
+
+type runOption struct {
+	drift Drift
+}
+
+// RunOption define optional params of running conformance tests
+type RunOption func(*runOption)
+
+// WithDrift means repairing drift is tested as well, otherwise only wallets without drift are reconciled
+func WithDrift(drift Drift) RunOption {
+	return func(opt *runOption) {
+		opt.drift = drift
+	}
+}
+
+// Run runs all conformance tests against wallets created by `newWallet`
+func Run(t *testing.T, newWallet NewWallet, options ...RunOption) {
+	opt := runOption{}
+	for _, f := range options {
+		f(&opt)
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, wallet wl.Wallet)
+	}{
+		{"CreateAndDelete", testCreateAndDelete},
+		{"WalletExist", testWalletExist},
+		{"WalletNotFound", testWalletNotFound},
+		{"EmptyBalance", testEmptyBalance},
+		{"DepositAndSpend", testDepositAndSpend},
+		{"Overdraft", testOverdraft},
+		{"LogTimeRange", testLogTimeRange},
+		{"Permission", testPermission},
+		{"SetOwner", testSetOwner},
+		{"Source", testSource},
+		{"Transfer", testTransfer},
+		{"UpdateAndDeleteLog", testUpdateAndDeleteLog},
+		{"ImportEntries", testImportEntries},
+		{"ConcurrentDeposits", testConcurrentDeposits},
+		{"CanceledContext", testCanceledContext},
+		{"IdempotencyKey", testIdempotencyKey},
+		{"Categories", testCategories},
+		{"SetOverdraft", testSetOverdraft},
+		{"Summarize", testSummarize},
+		{"SummarizeTimeZone", testSummarizeTimeZone},
+		{"GetBudgets", testGetBudgets},
+		{"ExportLogs", testExportLogs},
+		{"Rates", testRates},
+		{"ImportRates", testImportRates},
+		{"Convert", testConvert},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newWallet(t))
+		})
+	}
+
+	t.Run("Reconcile", func(t *testing.T) {
+		testReconcile(t, newWallet(t), opt.drift)
+	})
+
+	// the restored wallet is created after the snapshot is taken, as backends may share the same database
+	t.Run("SnapshotAndRestore", func(t *testing.T) {
+		testSnapshotAndRestore(t, newWallet)
+	})
+}
+
+func mustCreate(t *testing.T, wallet wl.Wallet, userID string, options ...wl.CreateOption) {
+	t.Helper()
+	if err := wallet.Create(ownerID, userID, options...); err != nil {
+		t.Fatalf("Create(%s) failed: %v", userID, err)
+	}
+}
+
+func expectBalance(t *testing.T, wallet wl.Wallet, userID string, expected int64) {
+	t.Helper()
+	balance, err := wallet.GetBalance(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetBalance(%s) failed: %v", userID, err)
+	}
+	if balance != expected {
+		t.Fatalf("balance of %s is %d, expected %d", userID, balance, expected)
+	}
+}
+
+func expectErr(t *testing.T, name string, err, expected error) {
+	t.Helper()
+	if err != expected {
+		t.Fatalf("%s returned %v, expected %v", name, err, expected)
+	}
+}
+
+func getLogs(t *testing.T, wallet wl.Wallet, userID string, options ...wl.GetLogsOption) []*wl.BalanceLog {
+	t.Helper()
+	logs, err := wallet.GetBalanceLogs(ownerID, userID, options...)
+	if err != nil {
+		t.Fatalf("GetBalanceLogs(%s) failed: %v", userID, err)
+	}
+	return logs
+}
+
+func testCreateAndDelete(t *testing.T, wallet wl.Wallet) {
+	if wallet.IsWalletExist(userID) {
+		t.Fatal("the wallet exists before it's created")
+	}
+	mustCreate(t, wallet, userID, wl.WithCurrency("usd"))
+	if !wallet.IsWalletExist(userID) {
+		t.Fatal("the wallet doesn't exist after it's created")
+	}
+
+	currency, err := wallet.GetCurrency(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetCurrency failed: %v", err)
+	}
+	if currency != "USD" {
+		t.Fatalf("currency is %s, expected USD", currency)
+	}
+	expectErr(t, "Create without caller", wallet.Create("", otherID), wl.ErrPermissionDenied)
+	expectErr(t, "Create in unknown currency", wallet.Create(ownerID, otherID, wl.WithCurrency("XXX")), wl.ErrInvalidCurrency)
+
+	if err := wallet.Deposit(ownerID, userID, 100, "lunch"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	expectErr(t, "Delete by others", wallet.Delete(guestID, userID), wl.ErrPermissionDenied)
+	if err := wallet.Delete(ownerID, userID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if wallet.IsWalletExist(userID) {
+		t.Fatal("the wallet exists after it's deleted")
+	}
+
+	// the wallet created again with the same name starts over
+	mustCreate(t, wallet, userID)
+	expectBalance(t, wallet, userID, 0)
+	if logs := getLogs(t, wallet, userID); len(logs) != 0 {
+		t.Fatalf("%d logs are found in the new wallet", len(logs))
+	}
+}
+
+func testWalletExist(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	expectErr(t, "Create again", wallet.Create(ownerID, userID), wl.ErrWalletExist)
+	expectErr(t, "Create by others", wallet.Create(guestID, userID), wl.ErrWalletExist)
+}
+
+func testWalletNotFound(t *testing.T, wallet wl.Wallet) {
+	_, err := wallet.GetBalance(ownerID, userID)
+	expectErr(t, "GetBalance", err, wl.ErrWalletNotFound)
+	_, err = wallet.GetCurrency(ownerID, userID)
+	expectErr(t, "GetCurrency", err, wl.ErrWalletNotFound)
+	_, err = wallet.GetBalanceLogs(ownerID, userID)
+	expectErr(t, "GetBalanceLogs", err, wl.ErrWalletNotFound)
+	expectErr(t, "Deposit", wallet.Deposit(ownerID, userID, 100, "lunch"), wl.ErrWalletNotFound)
+	expectErr(t, "Spend", wallet.Spend(ownerID, userID, 100, "lunch"), wl.ErrWalletNotFound)
+	expectErr(t, "EmptyBalance", wallet.EmptyBalance(ownerID, userID), wl.ErrWalletNotFound)
+	expectErr(t, "Delete", wallet.Delete(ownerID, userID), wl.ErrWalletNotFound)
+	expectErr(t, "Authorize", wallet.Authorize(ownerID, userID, wl.RoleViewer), wl.ErrWalletNotFound)
+
+	mustCreate(t, wallet, userID)
+	expectErr(t, "Transfer", wallet.Transfer(ownerID, userID, otherID, 100, "gift"), wl.ErrWalletNotFound)
+	expectBalance(t, wallet, userID, 0)
+}
+
+func testEmptyBalance(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	if err := wallet.EmptyBalance(ownerID, userID); err != nil {
+		t.Fatalf("EmptyBalance of the empty wallet failed: %v", err)
+	}
+	if logs := getLogs(t, wallet, userID); len(logs) != 0 {
+		t.Fatalf("%d logs are found after emptying the empty wallet", len(logs))
+	}
+
+	if err := wallet.Deposit(ownerID, userID, 300, "salary"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	if err := wallet.Spend(ownerID, userID, 500, "rent"); err != nil {
+		t.Fatalf("Spend failed: %v", err)
+	}
+	if err := wallet.EmptyBalance(ownerID, userID); err != nil {
+		t.Fatalf("EmptyBalance failed: %v", err)
+	}
+	expectBalance(t, wallet, userID, 0)
+
+	// the history is kept, and the emptying is recorded as a log
+	logs := getLogs(t, wallet, userID)
+	if len(logs) != 3 || logs[2].Amount != 200 {
+		t.Fatalf("logs after emptying are unexpected: %+v", logs)
+	}
+	drift, err := wallet.Reconcile(ownerID, userID, false)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if drift.Amount() != 0 {
+		t.Fatalf("drift is %d after emptying", drift.Amount())
+	}
+}
+
+func testDepositAndSpend(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	if err := wallet.AddCategory(ownerID, userID, "food"); err != nil {
+		t.Fatalf("AddCategory failed: %v", err)
+	}
+
+	if err := wallet.Deposit(ownerID, userID, 1000, "salary"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	if err := wallet.Spend(ownerID, userID, 150, "lunch", wl.InCategory("food"), wl.WithTags("work", "friday")); err != nil {
+		t.Fatalf("Spend failed: %v", err)
+	}
+	expectErr(t, "Spend in unknown category", wallet.Spend(ownerID, userID, 1, "lunch", wl.InCategory("fun")), wl.ErrCategoryNotFound)
+	expectErr(t, "Spend with invalid tag", wallet.Spend(ownerID, userID, 1, "lunch", wl.WithTags("a,b")), wl.ErrInvalidTag)
+	expectBalance(t, wallet, userID, 850)
+
+	logs := getLogs(t, wallet, userID)
+	if len(logs) != 2 {
+		t.Fatalf("%d logs are found, expected 2", len(logs))
+	}
+	if logs[0].Amount != 1000 || logs[0].Reason != "salary" || logs[0].Category != "" {
+		t.Fatalf("the deposit log is unexpected: %+v", logs[0])
+	}
+	spending := logs[1]
+	if spending.Amount != -150 || spending.Reason != "lunch" || spending.Category != "food" || strings.Join(spending.Tags, ",") != "work,friday" {
+		t.Fatalf("the spending log is unexpected: %+v", spending)
+	}
+	if spending.CounterpartyID != "" || spending.Conversion != nil {
+		t.Fatalf("the spending log is a transfer or converted: %+v", spending)
+	}
+
+	last, err := wallet.GetLastLog(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetLastLog failed: %v", err)
+	}
+	if last.ID != spending.ID {
+		t.Fatalf("the last log is %d, expected %d", last.ID, spending.ID)
+	}
+	_, err = wallet.GetLastLog(guestID, userID)
+	expectErr(t, "GetLastLog by others", err, wl.ErrPermissionDenied)
+
+	if food := getLogs(t, wallet, userID, wl.WithCategory("food")); len(food) != 1 || food[0].ID != spending.ID {
+		t.Fatalf("logs in the category are unexpected: %+v", food)
+	}
+}
+
+func testOverdraft(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	if err := wallet.Deposit(ownerID, userID, 100, "salary"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftForbid, 0); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	expectErr(t, "Spend more than the balance", wallet.Spend(ownerID, userID, 101, "rent"), wl.ErrInsufficientBalance)
+	expectBalance(t, wallet, userID, 100)
+	if logs := getLogs(t, wallet, userID); len(logs) != 1 {
+		t.Fatalf("%d logs are found after the refused spending", len(logs))
+	}
+
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftLimit, 50); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	if err := wallet.Spend(ownerID, userID, 150, "rent"); err != nil {
+		t.Fatalf("Spend within the limit failed: %v", err)
+	}
+	expectErr(t, "Spend over the limit", wallet.Spend(ownerID, userID, 1, "rent"), wl.ErrInsufficientBalance)
+	expectBalance(t, wallet, userID, -50)
+}
+
+func testSetOverdraft(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	if err := wallet.AddMember(ownerID, userID, editorID, wl.RoleEditor); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	expectOverdraft(t, wallet, wl.OverdraftAllow, 0)
+
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftLimit, 500); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	expectOverdraft(t, wallet, wl.OverdraftLimit, 500)
+
+	// invalid policies change nothing
+	expectErr(t, "SetOverdraft with unknown policy", wallet.SetOverdraft(ownerID, userID, wl.OverdraftPolicy("credit"), 100), wl.ErrInvalidOverdraft)
+	expectErr(t, "SetOverdraft with zero limit", wallet.SetOverdraft(ownerID, userID, wl.OverdraftLimit, 0), wl.ErrInvalidOverdraft)
+	expectErr(t, "SetOverdraft with negative limit", wallet.SetOverdraft(ownerID, userID, wl.OverdraftLimit, -100), wl.ErrInvalidOverdraft)
+	expectErr(t, "SetOverdraft by editor", wallet.SetOverdraft(editorID, userID, wl.OverdraftForbid, 0), wl.ErrPermissionDenied)
+	expectErr(t, "SetOverdraft of unknown wallet", wallet.SetOverdraft(ownerID, otherID, wl.OverdraftForbid, 0), wl.ErrWalletNotFound)
+	expectOverdraft(t, wallet, wl.OverdraftLimit, 500)
+
+	// the limit is ignored for other policies
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftForbid, 300); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	expectOverdraft(t, wallet, wl.OverdraftForbid, 0)
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftAllow, 300); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	expectOverdraft(t, wallet, wl.OverdraftAllow, 0)
+
+	if _, err := wallet.GetOverdraft(editorID, userID); err != nil {
+		t.Fatalf("GetOverdraft by editor failed: %v", err)
+	}
+	_, err := wallet.GetOverdraft(guestID, userID)
+	expectErr(t, "GetOverdraft by guest", err, wl.ErrPermissionDenied)
+}
+
+func expectOverdraft(t *testing.T, wallet wl.Wallet, policy wl.OverdraftPolicy, limit int64) {
+	t.Helper()
+	overdraft, err := wallet.GetOverdraft(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetOverdraft failed: %v", err)
+	}
+	if overdraft.Policy != policy || overdraft.Limit != limit {
+		t.Fatalf("the overdraft policy is %+v, expected %s with limit %d", *overdraft, policy, limit)
+	}
+}
+
+func testLogTimeRange(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	for i := int64(0); i < 3; i++ {
+		if err := wallet.Deposit(ownerID, userID, 100+i, "salary", wl.WithTimestamp(day+i*86400)); err != nil {
+			t.Fatalf("Deposit failed: %v", err)
+		}
+	}
+	// logs recorded now are later than logs above
+	if err := wallet.Spend(ownerID, userID, 10, "coffee"); err != nil {
+		t.Fatalf("Spend failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		options  []wl.GetLogsOption
+		expected []int64
+	}{
+		{"all", nil, []int64{100, 101, 102, -10}},
+		{"start", []wl.GetLogsOption{wl.WithStartTime(day + 86400)}, []int64{101, 102, -10}},
+		{"end", []wl.GetLogsOption{wl.WithEndTime(day + 86400)}, []int64{100, 101}},
+		{"range", []wl.GetLogsOption{wl.WithStartTime(day + 1), wl.WithEndTime(day + 2*86400 - 1)}, []int64{101}},
+		{"empty", []wl.GetLogsOption{wl.WithStartTime(day - 86400), wl.WithEndTime(day - 1)}, []int64{}},
+	}
+	for _, tt := range tests {
+		logs := getLogs(t, wallet, userID, tt.options...)
+		amounts := []int64{}
+		for _, log := range logs {
+			amounts = append(amounts, log.Amount)
+		}
+		if len(amounts) != len(tt.expected) {
+			t.Fatalf("%s: amounts of logs are %v, expected %v", tt.name, amounts, tt.expected)
+		}
+		for i := range amounts {
+			if amounts[i] != tt.expected[i] {
+				t.Fatalf("%s: amounts of logs are %v, expected %v", tt.name, amounts, tt.expected)
+			}
+		}
+	}
+
+	if logs := getLogs(t, wallet, userID); logs[0].Timestamp != "2019/05/20 12:00" {
+		t.Fatalf("the timestamp of the log is %s, expected 2019/05/20 12:00", logs[0].Timestamp)
+	}
+}
+
+func testPermission(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	if err := wallet.AddMember(ownerID, userID, editorID, wl.RoleEditor); err != nil {
+		t.Fatalf("AddMember(editor) failed: %v", err)
+	}
+	if err := wallet.AddMember(ownerID, userID, viewerID, wl.RoleViewer); err != nil {
+		t.Fatalf("AddMember(viewer) failed: %v", err)
+	}
+	expectErr(t, "AddMember as owner", wallet.AddMember(ownerID, userID, guestID, wl.RoleOwner), wl.ErrInvalidRole)
+	expectErr(t, "AddMember by editor", wallet.AddMember(editorID, userID, guestID, wl.RoleViewer), wl.ErrPermissionDenied)
+
+	members, err := wallet.GetMembers(viewerID, userID)
+	if err != nil {
+		t.Fatalf("GetMembers failed: %v", err)
+	}
+	if len(members) != 3 || members[0].MemberID != ownerID || members[0].Role != wl.RoleOwner ||
+		members[1].MemberID != editorID || members[2].MemberID != viewerID {
+		t.Fatalf("members are unexpected: %+v %+v %+v", members[0], members[1], members[2])
+	}
+
+	if err := wallet.Deposit(editorID, userID, 100, "salary"); err != nil {
+		t.Fatalf("Deposit by editor failed: %v", err)
+	}
+	expectErr(t, "Deposit by viewer", wallet.Deposit(viewerID, userID, 100, "salary"), wl.ErrPermissionDenied)
+	expectErr(t, "Deposit by guest", wallet.Deposit(guestID, userID, 100, "salary"), wl.ErrPermissionDenied)
+	expectErr(t, "EmptyBalance by editor", wallet.EmptyBalance(editorID, userID), wl.ErrPermissionDenied)
+	if _, err := wallet.GetBalance(viewerID, userID); err != nil {
+		t.Fatalf("GetBalance by viewer failed: %v", err)
+	}
+	_, err = wallet.GetBalance(guestID, userID)
+	expectErr(t, "GetBalance by guest", err, wl.ErrPermissionDenied)
+	_, err = wallet.GetBalance("", userID)
+	expectErr(t, "GetBalance without caller", err, wl.ErrPermissionDenied)
+
+	if err := wallet.RemoveMember(ownerID, userID, editorID); err != nil {
+		t.Fatalf("RemoveMember failed: %v", err)
+	}
+	expectErr(t, "RemoveMember again", wallet.RemoveMember(ownerID, userID, editorID), wl.ErrMemberNotFound)
+	expectErr(t, "Deposit by removed editor", wallet.Deposit(editorID, userID, 100, "salary"), wl.ErrPermissionDenied)
+	expectBalance(t, wallet, userID, 100)
+}
+
+func testSetOwner(t *testing.T, wallet wl.Wallet) {
+	// wallets created before ownership was introduced have no owner, and they are restored as they are
+	if err := wallet.Restore(&wl.Snapshot{
+		Wallets: []*wl.WalletSnapshot{{UserID: userID, Currency: "TWD", OverdraftPolicy: wl.OverdraftAllow}},
+	}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	// reading the wallet doesn't claim it, and nobody is allowed until the owner is set
+	_, err := wallet.GetBalance(guestID, userID)
+	expectErr(t, "GetBalance of the wallet without owner", err, wl.ErrPermissionDenied)
+	expectErr(t, "Deposit to the wallet without owner", wallet.Deposit(ownerID, userID, 100, "salary"), wl.ErrPermissionDenied)
+
+	expectErr(t, "SetOwner of unknown wallet", wallet.SetOwner(otherID, ownerID), wl.ErrWalletNotFound)
+	expectErr(t, "SetOwner to nobody", wallet.SetOwner(userID, ""), wl.ErrInvalidRole)
+	if err := wallet.SetOwner(userID, ownerID); err != nil {
+		t.Fatalf("SetOwner failed: %v", err)
+	}
+	if err := wallet.Deposit(ownerID, userID, 100, "salary"); err != nil {
+		t.Fatalf("Deposit by the owner failed: %v", err)
+	}
+
+	// the new owner is no longer a member
+	if err := wallet.AddMember(ownerID, userID, editorID, wl.RoleEditor); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	if err := wallet.SetOwner(userID, editorID); err != nil {
+		t.Fatalf("SetOwner to the member failed: %v", err)
+	}
+	members, err := wallet.GetMembers(editorID, userID)
+	if err != nil {
+		t.Fatalf("GetMembers failed: %v", err)
+	}
+	if len(members) != 1 || members[0].MemberID != editorID || members[0].Role != wl.RoleOwner {
+		t.Fatalf("members are unexpected: %+v", members[0])
+	}
+	expectErr(t, "Deposit by the previous owner", wallet.Deposit(ownerID, userID, 100, "salary"), wl.ErrPermissionDenied)
+}
+
+func testSource(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID, wl.WithSourceID("group"))
+	mustCreate(t, wallet, otherID)
+
+	// the wallet of the group is only operated from the group
+	if err := wallet.WithSource("group").Deposit(ownerID, userID, 100, "salary"); err != nil {
+		t.Fatalf("Deposit from the group failed: %v", err)
+	}
+	expectErr(t, "Deposit from 1:1 chat", wallet.WithSource("").Deposit(ownerID, userID, 100, "salary"), wl.ErrPermissionDenied)
+	_, err := wallet.WithSource("room").GetBalance(ownerID, userID)
+	expectErr(t, "GetBalance from another room", err, wl.ErrPermissionDenied)
+	expectErr(t, "Transfer from 1:1 chat", wallet.WithSource("").Transfer(ownerID, otherID, userID, 50, "gift"), wl.ErrPermissionDenied)
+
+	// personal wallets are operated from anywhere, and maintainers aren't bound to any source
+	if err := wallet.WithSource("group").Transfer(ownerID, userID, otherID, 50, "gift"); err != nil {
+		t.Fatalf("Transfer from the group failed: %v", err)
+	}
+	expectBalance(t, wallet, userID, 50)
+	expectBalance(t, wallet.WithSource(""), otherID, 50)
+}
+
+func testCategories(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	mustCreate(t, wallet, otherID)
+	if err := wallet.AddMember(ownerID, userID, editorID, wl.RoleEditor); err != nil {
+		t.Fatalf("AddMember(editor) failed: %v", err)
+	}
+	if err := wallet.AddMember(ownerID, userID, viewerID, wl.RoleViewer); err != nil {
+		t.Fatalf("AddMember(viewer) failed: %v", err)
+	}
+	expectCategories(t, wallet, userID, "")
+
+	// categories are sorted by name
+	for _, category := range []string{"transport", "food", "rent"} {
+		if err := wallet.AddCategory(editorID, userID, category); err != nil {
+			t.Fatalf("AddCategory(%s) failed: %v", category, err)
+		}
+	}
+	expectErr(t, "AddCategory again", wallet.AddCategory(ownerID, userID, "food"), wl.ErrCategoryExist)
+	expectErr(t, "AddCategory without name", wallet.AddCategory(ownerID, userID, ""), wl.ErrCategoryNotFound)
+	expectErr(t, "AddCategory by viewer", wallet.AddCategory(viewerID, userID, "fun"), wl.ErrPermissionDenied)
+	expectErr(t, "AddCategory to unknown wallet", wallet.AddCategory(ownerID, guestID, "fun"), wl.ErrWalletNotFound)
+	expectCategories(t, wallet, userID, "food,rent,transport")
+	// categories belong to wallets
+	expectCategories(t, wallet, otherID, "")
+	if err := wallet.AddCategory(ownerID, otherID, "food"); err != nil {
+		t.Fatalf("AddCategory to another wallet failed: %v", err)
+	}
+
+	if err := wallet.Spend(ownerID, userID, 100, "bus", wl.InCategory("transport")); err != nil {
+		t.Fatalf("Spend failed: %v", err)
+	}
+	expectErr(t, "RemoveCategory by viewer", wallet.RemoveCategory(viewerID, userID, "transport"), wl.ErrPermissionDenied)
+	if err := wallet.RemoveCategory(editorID, userID, "transport"); err != nil {
+		t.Fatalf("RemoveCategory failed: %v", err)
+	}
+	expectErr(t, "RemoveCategory again", wallet.RemoveCategory(ownerID, userID, "transport"), wl.ErrCategoryNotFound)
+	expectCategories(t, wallet, userID, "food,rent")
+	expectCategories(t, wallet, otherID, "food")
+
+	// logs that belong to the removed category remain unchanged, but new logs can't be in it
+	if logs := getLogs(t, wallet, userID, wl.WithCategory("transport")); len(logs) != 1 || logs[0].Category != "transport" {
+		t.Fatalf("logs of the removed category are unexpected: %+v", logs)
+	}
+	expectErr(t, "Spend in the removed category", wallet.Spend(ownerID, userID, 100, "bus", wl.InCategory("transport")), wl.ErrCategoryNotFound)
+
+	if _, err := wallet.GetCategories(viewerID, userID); err != nil {
+		t.Fatalf("GetCategories by viewer failed: %v", err)
+	}
+	_, err := wallet.GetCategories(guestID, userID)
+	expectErr(t, "GetCategories by guest", err, wl.ErrPermissionDenied)
+}
+
+func expectCategories(t *testing.T, wallet wl.Wallet, userID, expected string) {
+	t.Helper()
+	categories, err := wallet.GetCategories(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetCategories(%s) failed: %v", userID, err)
+	}
+	if strings.Join(categories, ",") != expected {
+		t.Fatalf("categories of %s are %v, expected %s", userID, categories, expected)
+	}
+}
+
+func testTransfer(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	mustCreate(t, wallet, otherID)
+	if err := wallet.Deposit(ownerID, userID, 500, "salary"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+
+	expectErr(t, "Transfer to itself", wallet.Transfer(ownerID, userID, userID, 100, "gift"), wl.ErrInvalidTransfer)
+	expectErr(t, "Transfer nothing", wallet.Transfer(ownerID, userID, otherID, 0, "gift"), wl.ErrInvalidAmount)
+	expectErr(t, "Transfer a negative amount", wallet.Transfer(ownerID, userID, otherID, -5, "gift"), wl.ErrInvalidAmount)
+	expectBalance(t, wallet, otherID, 0)
+	if logs := getLogs(t, wallet, userID); len(logs) != 1 {
+		t.Fatalf("invalid transfers are recorded: %+v", logs)
+	}
+	if err := wallet.Transfer(ownerID, userID, otherID, 200, "gift"); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+	expectBalance(t, wallet, userID, 300)
+	expectBalance(t, wallet, otherID, 200)
+
+	logs := getLogs(t, wallet, otherID)
+	if len(logs) != 1 || logs[0].Amount != 200 || logs[0].CounterpartyID != userID {
+		t.Fatalf("logs of the receiver are unexpected: %+v", logs)
+	}
+
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftForbid, 0); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	expectErr(t, "Transfer more than the balance", wallet.Transfer(ownerID, userID, otherID, 301, "gift"), wl.ErrInsufficientBalance)
+	expectBalance(t, wallet, otherID, 200)
+
+	// both sides are deleted
+	if err := wallet.DeleteLog(ownerID, otherID, logs[0].ID); err != nil {
+		t.Fatalf("DeleteLog failed: %v", err)
+	}
+	expectBalance(t, wallet, userID, 500)
+	expectBalance(t, wallet, otherID, 0)
+	if logs := getLogs(t, wallet, userID); len(logs) != 1 {
+		t.Fatalf("%d logs of the sender are found after deleting the transfer", len(logs))
+	}
+}
+
+func testUpdateAndDeleteLog(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	if err := wallet.Spend(ownerID, userID, 100, "lunch"); err != nil {
+		t.Fatalf("Spend failed: %v", err)
+	}
+	last, err := wallet.GetLastLog(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetLastLog failed: %v", err)
+	}
+
+	if err := wallet.UpdateLog(ownerID, userID, last.ID, -80, "dinner"); err != nil {
+		t.Fatalf("UpdateLog failed: %v", err)
+	}
+	expectBalance(t, wallet, userID, -80)
+	logs := getLogs(t, wallet, userID)
+	if len(logs) != 1 || logs[0].ID != last.ID || logs[0].Amount != -80 || logs[0].Reason != "dinner" {
+		t.Fatalf("logs after updating are unexpected: %+v", logs)
+	}
+	expectErr(t, "UpdateLog of unknown log", wallet.UpdateLog(ownerID, userID, last.ID+1000, -80, "dinner"), wl.ErrLogNotFound)
+
+	if err := wallet.DeleteLog(ownerID, userID, last.ID); err != nil {
+		t.Fatalf("DeleteLog failed: %v", err)
+	}
+	expectBalance(t, wallet, userID, 0)
+	expectErr(t, "DeleteLog again", wallet.DeleteLog(ownerID, userID, last.ID), wl.ErrLogNotFound)
+	_, err = wallet.GetLastLog(ownerID, userID)
+	expectErr(t, "GetLastLog after deleting", err, wl.ErrLogNotFound)
+}
+
+func testImportEntries(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	entries := []*wl.ImportEntry{
+		{Timestamp: day, Reason: "coffee", Amount: -60, Category: "food"},
+		{Timestamp: day, Reason: "coffee", Amount: -60, Category: "food"},
+		{Timestamp: day, Reason: "salary", Amount: 1000},
+		{Timestamp: day, Reason: "nothing", Amount: 0},
+	}
+
+	result, err := wallet.ImportEntries(ownerID, userID, entries)
+	if err != nil {
+		t.Fatalf("ImportEntries failed: %v", err)
+	}
+	if result.Imported != 3 || result.Skipped != 1 {
+		t.Fatalf("the first import is unexpected: %+v", result)
+	}
+	expectBalance(t, wallet, userID, 880)
+
+	// entries imported before are skipped
+	result, err = wallet.ImportEntries(ownerID, userID, entries)
+	if err != nil {
+		t.Fatalf("ImportEntries again failed: %v", err)
+	}
+	if result.Imported != 0 || result.Skipped != 4 {
+		t.Fatalf("the second import is unexpected: %+v", result)
+	}
+	categories, err := wallet.GetCategories(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetCategories failed: %v", err)
+	}
+	if len(categories) != 1 || categories[0] != "food" {
+		t.Fatalf("categories are unexpected: %v", categories)
+	}
+
+	// the entry of the deleted log is imported again
+	logs := getLogs(t, wallet, userID)
+	if err := wallet.DeleteLog(ownerID, userID, logs[0].ID); err != nil {
+		t.Fatalf("DeleteLog failed: %v", err)
+	}
+	result, err = wallet.ImportEntries(ownerID, userID, entries)
+	if err != nil {
+		t.Fatalf("ImportEntries after deleting failed: %v", err)
+	}
+	if result.Imported != 1 || result.Skipped != 3 {
+		t.Fatalf("the import after deleting is unexpected: %+v", result)
+	}
+	expectBalance(t, wallet, userID, 880)
+
+	// nothing is imported if any entry is refused
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftForbid, 0); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	_, err = wallet.ImportEntries(ownerID, userID, []*wl.ImportEntry{
+		{Timestamp: day, Reason: "bonus", Amount: 100},
+		{Timestamp: day, Reason: "rent", Amount: -2000},
+	})
+	expectErr(t, "ImportEntries over the balance", err, wl.ErrInsufficientBalance)
+	expectBalance(t, wallet, userID, 880)
+
+	// entries are checked in the given order, so the deposit before the spending covers it
+	result, err = wallet.ImportEntries(ownerID, userID, []*wl.ImportEntry{
+		{Timestamp: day, Reason: "bonus", Amount: 200},
+		{Timestamp: day, Reason: "rent", Amount: -1000},
+	})
+	if err != nil {
+		t.Fatalf("ImportEntries within the balance failed: %v", err)
+	}
+	if result.Imported != 2 || result.Skipped != 0 {
+		t.Fatalf("the import within the balance is unexpected: %+v", result)
+	}
+	expectBalance(t, wallet, userID, 80)
+
+	// the limit allows the balance to be negative down to -limit
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftLimit, 500); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	result, err = wallet.ImportEntries(ownerID, userID, []*wl.ImportEntry{
+		{Timestamp: day, Reason: "card", Amount: -580},
+	})
+	if err != nil {
+		t.Fatalf("ImportEntries within the limit failed: %v", err)
+	}
+	if result.Imported != 1 {
+		t.Fatalf("the import within the limit is unexpected: %+v", result)
+	}
+	expectBalance(t, wallet, userID, -500)
+
+	_, err = wallet.ImportEntries(ownerID, userID, []*wl.ImportEntry{
+		{Timestamp: day, Reason: "refund", Amount: 30, Category: "shopping"},
+		{Timestamp: day, Reason: "card", Amount: -40},
+	})
+	expectErr(t, "ImportEntries over the limit", err, wl.ErrInsufficientBalance)
+	expectBalance(t, wallet, userID, -500)
+	categories, err = wallet.GetCategories(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetCategories failed: %v", err)
+	}
+	if len(categories) != 1 {
+		t.Fatalf("categories of the refused import are added: %v", categories)
+	}
+}
+
+func testConcurrentDeposits(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- wallet.Deposit(ownerID, userID, 10, "allowance")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent Deposit failed: %v", err)
+		}
+	}
+	expectBalance(t, wallet, userID, n*10)
+	if logs := getLogs(t, wallet, userID); len(logs) != n {
+		t.Fatalf("%d logs are found, expected %d", len(logs), n)
+	}
+
+	drifts, err := wallet.ReconcileAll(false)
+	if err != nil {
+		t.Fatalf("ReconcileAll failed: %v", err)
+	}
+	if len(drifts) != 0 {
+		t.Fatalf("drift is found after concurrent deposits: %+v", drifts[0])
+	}
+}
+
+func testCanceledContext(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := wallet.WithContext(ctx).Deposit(ownerID, userID, 100, "allowance"); err == nil {
+		t.Fatalf("Deposit with the canceled context succeeded")
+	}
+	expectBalance(t, wallet, userID, 0)
+
+	// the wallet with a live context shares the storage
+	if err := wallet.WithContext(context.Background()).Deposit(ownerID, userID, 100, "allowance"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	expectBalance(t, wallet, userID, 100)
+}
+
+func testIdempotencyKey(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+
+	if err := wallet.Deposit(ownerID, userID, 100, "allowance", wl.WithIdempotencyKey("event-1")); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	err := wallet.Deposit(ownerID, userID, 100, "allowance", wl.WithIdempotencyKey("event-1"))
+	expectErr(t, "Deposit again", err, wl.ErrDuplicateRequest)
+	expectBalance(t, wallet, userID, 100)
+
+	// the repeated request is replied with the receipt of the first one, even if the balance changes later
+	if err := wallet.Deposit(ownerID, userID, 5, "coin"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	expectReceipt(t, wallet, userID, "event-1", 100, 100, 0)
+	_, err = wallet.GetReceipt(ownerID, userID, "event-0")
+	expectErr(t, "GetReceipt of unknown key", err, wl.ErrLogNotFound)
+	_, err = wallet.GetReceipt(guestID, userID, "event-1")
+	expectErr(t, "GetReceipt by guest", err, wl.ErrPermissionDenied)
+
+	// the key is kept after the log is deleted, so the repeated request isn't recorded again
+	logs := getLogs(t, wallet, userID)
+	if err := wallet.DeleteLog(ownerID, userID, logs[0].ID); err != nil {
+		t.Fatalf("DeleteLog failed: %v", err)
+	}
+	err = wallet.Deposit(ownerID, userID, 100, "allowance", wl.WithIdempotencyKey("event-1"))
+	expectErr(t, "Deposit after the log is deleted", err, wl.ErrDuplicateRequest)
+	expectBalance(t, wallet, userID, 5)
+	_, err = wallet.GetReceipt(ownerID, userID, "event-1")
+	expectErr(t, "GetReceipt of the deleted log", err, wl.ErrLogNotFound)
+
+	// a failed request records nothing, so it can be retried with the same key
+	if err := wallet.SetOverdraft(ownerID, userID, wl.OverdraftForbid, 0); err != nil {
+		t.Fatalf("SetOverdraft failed: %v", err)
+	}
+	err = wallet.Spend(ownerID, userID, 50, "lunch", wl.WithIdempotencyKey("event-2"))
+	expectErr(t, "Spend", err, wl.ErrInsufficientBalance)
+	if err := wallet.Deposit(ownerID, userID, 75, "allowance"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	if err := wallet.Spend(ownerID, userID, 50, "lunch", wl.WithIdempotencyKey("event-2")); err != nil {
+		t.Fatalf("Spend failed: %v", err)
+	}
+	err = wallet.Spend(ownerID, userID, 50, "lunch", wl.WithIdempotencyKey("event-2"))
+	expectErr(t, "Spend again", err, wl.ErrDuplicateRequest)
+	expectBalance(t, wallet, userID, 30)
+	expectReceipt(t, wallet, userID, "event-2", -50, 30, 0)
+
+	// keys belong to wallets, and editors still need the role to repeat the request
+	err = wallet.Deposit(guestID, userID, 100, "allowance", wl.WithIdempotencyKey("event-1"))
+	expectErr(t, "Deposit", err, wl.ErrPermissionDenied)
+
+	// the key of the transfer is recorded in the source wallet
+	mustCreate(t, wallet, otherID)
+	if err := wallet.Transfer(ownerID, userID, otherID, 10, "gift", wl.WithIdempotencyKey("event-3")); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+	err = wallet.Transfer(ownerID, userID, otherID, 10, "gift", wl.WithIdempotencyKey("event-3"))
+	expectErr(t, "Transfer again", err, wl.ErrDuplicateRequest)
+	expectBalance(t, wallet, userID, 20)
+	expectBalance(t, wallet, otherID, 10)
+	expectReceipt(t, wallet, userID, "event-3", -10, 20, 10)
+	if err := wallet.Transfer(ownerID, otherID, userID, 10, "gift", wl.WithIdempotencyKey("event-3")); err != nil {
+		t.Fatalf("Transfer back failed: %v", err)
+	}
+	expectBalance(t, wallet, userID, 30)
+}
+
+func expectReceipt(t *testing.T, wallet wl.Wallet, userID, key string, amount, balance, counterpartyBalance int64) {
+	t.Helper()
+	receipt, err := wallet.GetReceipt(ownerID, userID, key)
+	if err != nil {
+		t.Fatalf("GetReceipt(%s) failed: %v", key, err)
+	}
+	if receipt.Log.Amount != amount || receipt.Balance != balance || receipt.CounterpartyBalance != counterpartyBalance {
+		t.Fatalf("the receipt of %s is %+v with balances %d and %d", key, *receipt.Log, receipt.Balance, receipt.CounterpartyBalance)
+	}
+}
+
+func testSnapshotAndRestore(t *testing.T, newWallet NewWallet) {
+	wallet := newWallet(t)
+	mustCreate(t, wallet, userID)
+	mustCreate(t, wallet, otherID, wl.WithCurrency("USD"))
+	if err := wallet.SetRate("USD", "TWD", day, "30"); err != nil {
+		t.Fatalf("SetRate failed: %v", err)
+	}
+	if err := wallet.AddMember(ownerID, userID, viewerID, wl.RoleViewer); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	if err := wallet.Deposit(ownerID, userID, 3000, "salary"); err != nil {
+		t.Fatalf("Deposit failed: %v", err)
+	}
+	if err := wallet.Spend(ownerID, userID, 500, "souvenir", wl.InCurrency("USD")); err != nil {
+		t.Fatalf("Spend in USD failed: %v", err)
+	}
+	if err := wallet.Transfer(ownerID, userID, otherID, 1500, "travel"); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+	if _, err := wallet.ImportEntries(ownerID, otherID, []*wl.ImportEntry{{Timestamp: day, Reason: "coffee", Amount: -300}}); err != nil {
+		t.Fatalf("ImportEntries failed: %v", err)
+	}
+
+	// logs are compared by exported CSV, as IDs of logs are changed by restoring
+	timeRange := wl.TimeRange{Start: 0, End: time.Now().Unix() + 1}
+	balances := map[string]int64{}
+	exports := map[string]string{}
+	for _, id := range []string{userID, otherID} {
+		balance, err := wallet.GetBalance(ownerID, id)
+		if err != nil {
+			t.Fatalf("GetBalance failed: %v", err)
+		}
+		balances[id] = balance
+
+		var buffer bytes.Buffer
+		if err := wallet.ExportLogs(ownerID, id, timeRange, wl.ExportCSV, &buffer); err != nil {
+			t.Fatalf("ExportLogs failed: %v", err)
+		}
+		exports[id] = buffer.String()
+	}
+
+	snapshot, err := wallet.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	restored := newWallet(t)
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	expectErr(t, "Restore again", restored.Restore(snapshot), wl.ErrStorageNotEmpty)
+
+	for _, id := range []string{userID, otherID} {
+		expectBalance(t, restored, id, balances[id])
+
+		var buffer bytes.Buffer
+		if err := restored.ExportLogs(ownerID, id, timeRange, wl.ExportCSV, &buffer); err != nil {
+			t.Fatalf("ExportLogs of the restored wallet failed: %v", err)
+		}
+		if buffer.String() != exports[id] {
+			t.Fatalf("restored logs of %s are different:\n%s\nexpected:\n%s", id, buffer.String(), exports[id])
+		}
+	}
+
+	if err := restored.Authorize(viewerID, userID, wl.RoleViewer); err != nil {
+		t.Fatalf("the member isn't restored: %v", err)
+	}
+	rate, err := restored.GetRate("TWD", "USD", day)
+	if err != nil {
+		t.Fatalf("GetRate of the restored wallet failed: %v", err)
+	}
+	if rate.Base != "TWD" || rate.Quote != "USD" {
+		t.Fatalf("the restored rate is unexpected: %+v", rate)
+	}
+
+	// imports are restored, so the same entry is skipped
+	result, err := restored.ImportEntries(ownerID, otherID, []*wl.ImportEntry{{Timestamp: day, Reason: "coffee", Amount: -300}})
+	if err != nil {
+		t.Fatalf("ImportEntries of the restored wallet failed: %v", err)
+	}
+	if result.Skipped != 1 {
+		t.Fatalf("the restored import is unexpected: %+v", result)
+	}
+}
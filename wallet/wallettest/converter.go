@@ -0,0 +1,145 @@
+package wallettest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+func mustSetRate(t *testing.T, wallet wl.Wallet, base, quote string, timestamp int64, rate string) {
+	t.Helper()
+	if err := wallet.SetRate(base, quote, timestamp, rate); err != nil {
+		t.Fatalf("SetRate(%s, %s, %s) failed: %v", base, quote, rate, err)
+	}
+}
+
+// expectRate expects the rate got at `timestamp` is `value` of the day that `date` is in
+func expectRate(t *testing.T, wallet wl.Wallet, base, quote string, timestamp int64, value string, date int64) {
+	t.Helper()
+	rate, err := wallet.GetRate(base, quote, timestamp)
+	if err != nil {
+		t.Fatalf("GetRate(%s, %s) failed: %v", base, quote, err)
+	}
+	if rate.Base != base || rate.Quote != quote || rate.Value != value || rate.Date != date {
+		t.Fatalf("GetRate(%s, %s) is %+v, expected %s on %d", base, quote, *rate, value, date)
+	}
+}
+
+func testRates(t *testing.T, wallet wl.Wallet) {
+	// the rate is for the day in Asia/Taipei, and currencies are normalized
+	mustSetRate(t, wallet, "usd", "元", taipei(2019, time.May, 20, 23, 59, 59), "32.000")
+	may20 := taipei(2019, time.May, 20, 0, 0, 0)
+	expectRate(t, wallet, "USD", "TWD", may20, "32", may20)
+	_, err := wallet.GetRate("USD", "TWD", may20-1)
+	expectErr(t, "GetRate before the first rate", err, wl.ErrRateNotFound)
+
+	// the latest rate on or before the day is got, and the rate of the same day is replaced
+	may25 := taipei(2019, time.May, 25, 0, 0, 0)
+	mustSetRate(t, wallet, "USD", "TWD", may25, "31")
+	mustSetRate(t, wallet, "USD", "TWD", may25+3600, "31.5")
+	expectRate(t, wallet, "USD", "TWD", may25-1, "32", may20)
+	expectRate(t, wallet, "USD", "TWD", may25, "31.5", may25)
+	expectRate(t, wallet, "USD", "TWD", day+365*86400, "31.5", may25)
+
+	// the rate of the opposite direction is inverted, unless the direction has its own rate
+	expectRate(t, wallet, "TWD", "USD", may20+3600, "0.03125", may20)
+	mustSetRate(t, wallet, "TWD", "USD", may25, "0.0325")
+	expectRate(t, wallet, "TWD", "USD", may25, "0.0325", may25)
+	expectRate(t, wallet, "TWD", "USD", may25-1, "0.03125", may20)
+
+	// the same currency is always 1
+	expectRate(t, wallet, "TWD", "TWD", may20+3600, "1", may20)
+
+	expectErr(t, "SetRate of the same currency", wallet.SetRate("TWD", "NTD", day, "1"), wl.ErrInvalidRate)
+	expectErr(t, "SetRate with zero rate", wallet.SetRate("USD", "TWD", day, "0"), wl.ErrInvalidRate)
+	expectErr(t, "SetRate with negative rate", wallet.SetRate("USD", "TWD", day, "-31"), wl.ErrInvalidRate)
+	expectErr(t, "SetRate with invalid rate", wallet.SetRate("USD", "TWD", day, "31,5"), wl.ErrInvalidRate)
+	expectErr(t, "SetRate in unknown currency", wallet.SetRate("XXX", "TWD", day, "31"), wl.ErrInvalidCurrency)
+	_, err = wallet.GetRate("USD", "XXX", day)
+	expectErr(t, "GetRate in unknown currency", err, wl.ErrInvalidCurrency)
+	_, err = wallet.GetRate("USD", "JPY", day)
+	expectErr(t, "GetRate without rates", err, wl.ErrRateNotFound)
+	expectRate(t, wallet, "USD", "TWD", may25, "31.5", may25)
+}
+
+func testImportRates(t *testing.T, wallet wl.Wallet) {
+	// the header is skipped, and both date layouts are allowed
+	count, err := wallet.ImportRates(strings.NewReader("date,base,quote,rate\n" +
+		"2019/05/20,USD,TWD,32\n" +
+		"2019-05-21, usd, jpy, 110.50\n" +
+		"2019/05/22,USD,TWD,31.5\n"))
+	if err != nil {
+		t.Fatalf("ImportRates failed: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("%d rates are imported, expected 3", count)
+	}
+	may20, may21, may22 := taipei(2019, time.May, 20, 0, 0, 0), taipei(2019, time.May, 21, 0, 0, 0), taipei(2019, time.May, 22, 0, 0, 0)
+	expectRate(t, wallet, "USD", "TWD", may22-1, "32", may20)
+	expectRate(t, wallet, "USD", "TWD", may22, "31.5", may22)
+	expectRate(t, wallet, "USD", "JPY", may21, "110.5", may21)
+	_, err = wallet.GetRate("USD", "JPY", may21-1)
+	expectErr(t, "GetRate before the imported rate", err, wl.ErrRateNotFound)
+
+	// rates of the same day are replaced
+	count, err = wallet.ImportRates(strings.NewReader("2019/05/20,USD,TWD,33\n"))
+	if err != nil || count != 1 {
+		t.Fatalf("ImportRates again returned %d, %v", count, err)
+	}
+	expectRate(t, wallet, "USD", "TWD", may20, "33", may20)
+
+	// nothing is imported if any row is invalid
+	tests := []struct {
+		name     string
+		csv      string
+		expected error
+	}{
+		{"zero rate", "2019/05/23,USD,TWD,30\n2019/05/24,USD,TWD,0\n", wl.ErrInvalidRate},
+		{"invalid date", "2019/05/23,USD,TWD,30\n2019/13/24,USD,TWD,30\n", wl.ErrInvalidRate},
+		{"unknown currency", "2019/05/23,USD,TWD,30\n2019/05/24,USD,XXX,30\n", wl.ErrInvalidCurrency},
+		{"missing column", "2019/05/23,USD,TWD,30\n2019/05/24,USD,TWD\n", wl.ErrInvalidRate},
+	}
+	for _, tt := range tests {
+		count, err := wallet.ImportRates(strings.NewReader(tt.csv))
+		expectErr(t, "ImportRates with "+tt.name, err, tt.expected)
+		if count != 0 {
+			t.Fatalf("ImportRates with %s returned %d", tt.name, count)
+		}
+	}
+	expectRate(t, wallet, "USD", "TWD", taipei(2019, time.May, 25, 0, 0, 0), "31.5", may22)
+}
+
+func expectConvert(t *testing.T, wallet wl.Wallet, amount int64, from, to string, expected int64, value string) {
+	t.Helper()
+	converted, rate, err := wallet.Convert(amount, from, to, day)
+	if err != nil {
+		t.Fatalf("Convert(%d %s to %s) failed: %v", amount, from, to, err)
+	}
+	if converted != expected || rate.Value != value {
+		t.Fatalf("Convert(%d %s to %s) is %d with %s, expected %d with %s", amount, from, to, converted, rate.Value, expected, value)
+	}
+}
+
+func testConvert(t *testing.T, wallet wl.Wallet) {
+	mustSetRate(t, wallet, "USD", "TWD", day, "32")
+	mustSetRate(t, wallet, "JPY", "TWD", day, "0.2875")
+
+	// amounts are minor units, and they are rounded half away from zero
+	expectConvert(t, wallet, 1050, "USD", "TWD", 336, "32")
+	expectConvert(t, wallet, -1050, "USD", "TWD", -336, "32")
+	expectConvert(t, wallet, 1, "USD", "TWD", 0, "32")
+	expectConvert(t, wallet, 2, "USD", "TWD", 1, "32")
+	expectConvert(t, wallet, 100, "TWD", "USD", 313, "0.03125")
+	expectConvert(t, wallet, -100, "TWD", "USD", -313, "0.03125")
+	expectConvert(t, wallet, 1000, "JPY", "TWD", 288, "0.2875")
+	expectConvert(t, wallet, 100, "TWD", "NTD", 100, "1")
+
+	_, _, err := wallet.Convert(100, "JPY", "USD", day)
+	expectErr(t, "Convert without rates", err, wl.ErrRateNotFound)
+	_, _, err = wallet.Convert(100, "USD", "TWD", day-86400)
+	expectErr(t, "Convert before the rate", err, wl.ErrRateNotFound)
+	_, _, err = wallet.Convert(100, "XXX", "TWD", day)
+	expectErr(t, "Convert in unknown currency", err, wl.ErrInvalidCurrency)
+}
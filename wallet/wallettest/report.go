@@ -0,0 +1,387 @@
+package wallettest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andy/guachi-pay-line-bot/base"
+	wl "github.com/andy/guachi-pay-line-bot/wallet"
+)
+
+// taipei gets the unix timestamp of the time in Asia/Taipei zone, as days, weeks and months are based on it
+func taipei(year int, month time.Month, day, hour, min, sec int) int64 {
+	return time.Date(year, month, day, hour, min, sec, 0, location).Unix()
+}
+
+func mustDeposit(t *testing.T, wallet wl.Wallet, userID string, amount int64, reason string, options ...wl.RecordOption) {
+	t.Helper()
+	if err := wallet.Deposit(ownerID, userID, amount, reason, options...); err != nil {
+		t.Fatalf("Deposit(%s) failed: %v", reason, err)
+	}
+}
+
+func mustSpend(t *testing.T, wallet wl.Wallet, userID string, amount int64, reason string, options ...wl.RecordOption) {
+	t.Helper()
+	if err := wallet.Spend(ownerID, userID, amount, reason, options...); err != nil {
+		t.Fatalf("Spend(%s) failed: %v", reason, err)
+	}
+}
+
+func mustAddCategory(t *testing.T, wallet wl.Wallet, userID, category string) {
+	t.Helper()
+	if err := wallet.AddCategory(ownerID, userID, category); err != nil {
+		t.Fatalf("AddCategory(%s) failed: %v", category, err)
+	}
+}
+
+// formatGroups formats groups as key:income/expense, so that differences are easy to read
+func formatGroups(groups []*wl.SummaryGroup) string {
+	texts := []string{}
+	for _, group := range groups {
+		texts = append(texts, fmt.Sprintf("%s:%d/%d", group.Key, group.Income, group.Expense))
+	}
+	return strings.Join(texts, " ")
+}
+
+func expectSummary(t *testing.T, wallet wl.Wallet, timeRange wl.TimeRange, groupBy wl.GroupBy, income, expense int64, groups string) {
+	t.Helper()
+	summary, err := wallet.Summarize(ownerID, userID, timeRange, groupBy)
+	if err != nil {
+		t.Fatalf("Summarize(%s) failed: %v", groupBy, err)
+	}
+	if summary.GroupBy != groupBy || summary.TimeRange != timeRange {
+		t.Fatalf("Summarize(%s) is for %s in %+v", groupBy, summary.GroupBy, summary.TimeRange)
+	}
+	if summary.Income != income || summary.Expense != expense {
+		t.Fatalf("Summarize(%s) is %d/%d, expected %d/%d", groupBy, summary.Income, summary.Expense, income, expense)
+	}
+	if formatGroups(summary.Groups) != groups {
+		t.Fatalf("groups of Summarize(%s) are %s, expected %s", groupBy, formatGroups(summary.Groups), groups)
+	}
+}
+
+func testSummarize(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	mustCreate(t, wallet, otherID)
+	mustAddCategory(t, wallet, userID, "food")
+
+	mustDeposit(t, wallet, userID, 7, "coin", wl.WithTimestamp(day-86400))
+	mustDeposit(t, wallet, userID, 1000, "salary", wl.WithTimestamp(day))
+	mustSpend(t, wallet, userID, 100, "lunch", wl.WithTimestamp(day), wl.InCategory("food"))
+	mustSpend(t, wallet, userID, 50, "coffee", wl.WithTimestamp(day+3600), wl.InCategory("food"))
+	mustSpend(t, wallet, userID, 30, "book", wl.WithTimestamp(day+86400))
+	mustSpend(t, wallet, userID, 20, "coffee", wl.WithTimestamp(day+86400), wl.InCategory("food"))
+	mustDeposit(t, wallet, userID, 9, "coin", wl.WithTimestamp(day+2*86400))
+	// transfers and emptying wallets are neither income nor expense
+	if err := wallet.Transfer(ownerID, userID, otherID, 200, "gift"); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+	if err := wallet.EmptyBalance(ownerID, otherID); err != nil {
+		t.Fatalf("EmptyBalance failed: %v", err)
+	}
+
+	// the range excludes the first and the last logs
+	timeRange := wl.TimeRange{Start: day - 3600, End: day + 2*86400}
+	expectSummary(t, wallet, timeRange, wl.GroupByDay, 1000, 200, "2019/05/20:1000/150 2019/05/21:0/50")
+	expectSummary(t, wallet, timeRange, wl.GroupByMonth, 1000, 200, "2019/05:1000/200")
+	// other groups are sorted by the expense, then the income and the key
+	expectSummary(t, wallet, timeRange, wl.GroupByReason, 1000, 200, "lunch:0/100 coffee:0/70 book:0/30 salary:1000/0")
+	expectSummary(t, wallet, timeRange, wl.GroupByCategory, 1000, 200, "food:0/170 :1000/30")
+
+	// the range of the transfer has nothing
+	now := time.Now().Unix()
+	expectSummary(t, wallet, wl.TimeRange{Start: now - 3600, End: now + 3600}, wl.GroupByDay, 0, 0, "")
+
+	_, err := wallet.Summarize(ownerID, userID, wl.TimeRange{Start: day, End: day}, wl.GroupByDay)
+	expectErr(t, "Summarize in the empty range", err, wl.ErrInvalidReport)
+	_, err = wallet.Summarize(ownerID, userID, timeRange, wl.GroupBy("year"))
+	expectErr(t, "Summarize by unknown grouping", err, wl.ErrInvalidReport)
+	_, err = wallet.Summarize(guestID, userID, timeRange, wl.GroupByDay)
+	expectErr(t, "Summarize by guest", err, wl.ErrPermissionDenied)
+	_, err = wallet.Summarize(ownerID, guestID, timeRange, wl.GroupByDay)
+	expectErr(t, "Summarize of unknown wallet", err, wl.ErrWalletNotFound)
+}
+
+// testSummarizeTimeZone records logs right before and after midnight in Asia/Taipei,
+// which is 16:00 in UTC, so periods based on UTC are found different
+func testSummarizeTimeZone(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+
+	// 2019/05/20 is Monday, and 2019/05/26 is Sunday
+	mustSpend(t, wallet, userID, 1, "a", wl.WithTimestamp(taipei(2019, time.May, 19, 23, 59, 59)))
+	mustSpend(t, wallet, userID, 2, "b", wl.WithTimestamp(taipei(2019, time.May, 20, 0, 0, 0)))
+	mustSpend(t, wallet, userID, 4, "c", wl.WithTimestamp(taipei(2019, time.May, 26, 23, 59, 59)))
+	mustSpend(t, wallet, userID, 8, "d", wl.WithTimestamp(taipei(2019, time.May, 27, 0, 0, 0)))
+	mustSpend(t, wallet, userID, 16, "e", wl.WithTimestamp(taipei(2019, time.May, 31, 23, 59, 59)))
+	mustSpend(t, wallet, userID, 32, "f", wl.WithTimestamp(taipei(2019, time.June, 1, 0, 0, 0)))
+	// 2019/12/30 is Monday, so the week of the new year starts in the last year
+	mustSpend(t, wallet, userID, 64, "g", wl.WithTimestamp(taipei(2019, time.December, 31, 23, 59, 59)))
+	mustSpend(t, wallet, userID, 128, "h", wl.WithTimestamp(taipei(2020, time.January, 1, 0, 0, 0)))
+	mustSpend(t, wallet, userID, 256, "i", wl.WithTimestamp(taipei(2020, time.January, 5, 23, 59, 59)))
+	mustSpend(t, wallet, userID, 512, "j", wl.WithTimestamp(taipei(2020, time.January, 6, 0, 0, 0)))
+
+	timeRange := wl.TimeRange{Start: taipei(2019, time.May, 1, 0, 0, 0), End: taipei(2020, time.February, 1, 0, 0, 0)}
+	expectSummary(t, wallet, timeRange, wl.GroupByDay, 0, 1023,
+		"2019/05/19:0/1 2019/05/20:0/2 2019/05/26:0/4 2019/05/27:0/8 2019/05/31:0/16 2019/06/01:0/32 "+
+			"2019/12/31:0/64 2020/01/01:0/128 2020/01/05:0/256 2020/01/06:0/512")
+	expectSummary(t, wallet, timeRange, wl.GroupByWeek, 0, 1023,
+		"2019/05/13:0/1 2019/05/20:0/6 2019/05/27:0/56 2019/12/30:0/448 2020/01/06:0/512")
+	expectSummary(t, wallet, timeRange, wl.GroupByMonth, 0, 1023,
+		"2019/05:0/31 2019/06:0/32 2019/12:0/64 2020/01:0/896")
+
+	// the range starts and ends at midnight in Asia/Taipei
+	timeRange = wl.TimeRange{Start: taipei(2019, time.May, 20, 0, 0, 0), End: taipei(2019, time.May, 27, 0, 0, 0)}
+	expectSummary(t, wallet, timeRange, wl.GroupByWeek, 0, 6, "2019/05/20:0/6")
+}
+
+func testGetBudgets(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID)
+	mustCreate(t, wallet, otherID)
+	mustAddCategory(t, wallet, userID, "food")
+	mustAddCategory(t, wallet, userID, "fun")
+
+	budgets, err := wallet.GetBudgets(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetBudgets failed: %v", err)
+	}
+	if len(budgets) != 0 {
+		t.Fatalf("budgets are found before they are set: %+v", budgets[0])
+	}
+
+	for category, limit := range map[string]int64{"": 1000, "food": 300, "fun": 200} {
+		if err := wallet.SetBudget(ownerID, userID, category, limit); err != nil {
+			t.Fatalf("SetBudget(%s) failed: %v", category, err)
+		}
+	}
+	expectErr(t, "SetBudget with negative limit", wallet.SetBudget(ownerID, userID, "food", -1), wl.ErrInvalidBudget)
+	expectErr(t, "SetBudget by guest", wallet.SetBudget(guestID, userID, "food", 100), wl.ErrPermissionDenied)
+	// zero limit removes the budget
+	if err := wallet.SetBudget(ownerID, userID, "fun", 0); err != nil {
+		t.Fatalf("SetBudget(fun, 0) failed: %v", err)
+	}
+	if err := wallet.SetBudget(ownerID, userID, "food", 500); err != nil {
+		t.Fatalf("SetBudget(food) again failed: %v", err)
+	}
+
+	// only spending of this month in Asia/Taipei is counted, and transfers and deposits are not
+	start, _ := base.GetMonthRange(time.Now())
+	mustSpend(t, wallet, userID, 400, "rent", wl.WithTimestamp(start-1), wl.InCategory("food"))
+	mustSpend(t, wallet, userID, 100, "lunch", wl.WithTimestamp(start), wl.InCategory("food"))
+	mustSpend(t, wallet, userID, 50, "book")
+	mustSpend(t, wallet, userID, 20, "movie", wl.InCategory("fun"))
+	mustDeposit(t, wallet, userID, 30, "refund", wl.InCategory("food"))
+	if err := wallet.Transfer(ownerID, userID, otherID, 70, "gift"); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+
+	budgets, err = wallet.GetBudgets(ownerID, userID)
+	if err != nil {
+		t.Fatalf("GetBudgets failed: %v", err)
+	}
+	texts := []string{}
+	for _, budget := range budgets {
+		texts = append(texts, fmt.Sprintf("%s:%d/%d", budget.Category, budget.Spent, budget.Limit))
+	}
+	if strings.Join(texts, " ") != ":170/1000 food:100/500" {
+		t.Fatalf("budgets are %s, expected :170/1000 food:100/500", strings.Join(texts, " "))
+	}
+
+	_, err = wallet.GetBudgets(guestID, userID)
+	expectErr(t, "GetBudgets by guest", err, wl.ErrPermissionDenied)
+}
+
+func expectExport(t *testing.T, wallet wl.Wallet, timeRange wl.TimeRange, format wl.ExportFormat, expected string) {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := wallet.ExportLogs(ownerID, userID, timeRange, format, &buffer); err != nil {
+		t.Fatalf("ExportLogs(%s) failed: %v", format, err)
+	}
+	if buffer.String() != expected {
+		t.Fatalf("ExportLogs(%s) wrote:\n%s\nexpected:\n%s", format, buffer.String(), expected)
+	}
+}
+
+func testExportLogs(t *testing.T, wallet wl.Wallet) {
+	mustCreate(t, wallet, userID, wl.WithCurrency("USD"))
+	mustCreate(t, wallet, otherID, wl.WithCurrency("USD"))
+	mustAddCategory(t, wallet, userID, "food")
+
+	mustDeposit(t, wallet, userID, 100000, "salary", wl.WithTimestamp(day-86400))
+	mustSpend(t, wallet, userID, 1250, `"lunch"`, wl.WithTimestamp(day), wl.InCategory("food"), wl.WithTags("work", "friday"))
+	mustDeposit(t, wallet, userID, 300, "refund", wl.WithTimestamp(day+60), wl.InCategory("food"))
+	mustSpend(t, wallet, userID, 99, "parking", wl.WithTimestamp(day+86400))
+	// the transfer is recorded now, so it's out of the range
+	if err := wallet.Transfer(ownerID, userID, otherID, 2000, "gift"); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+
+	timeRange := wl.TimeRange{Start: day - 3600, End: day + 2*86400}
+	expectExport(t, wallet, timeRange, wl.ExportCSV, ""+
+		"timestamp,reason,category,tags,amount,currency,counterparty,balance\n"+
+		"2019/05/20 12:00,\"\"\"lunch\"\"\",food,\"work,friday\",-12.50,USD,,987.50\n"+
+		"2019/05/20 12:01,refund,food,,3.00,USD,,990.50\n"+
+		"2019/05/21 12:00,parking,,,-0.99,USD,,989.51\n")
+	expectExport(t, wallet, timeRange, wl.ExportLedger, ""+
+		"2019/05/20 * 期初餘額\n"+
+		"    Assets:Wallet:guachi  1000.00 USD\n"+
+		"    Equity:Opening-Balances  -1000.00 USD\n"+
+		"\n"+
+		"2019/05/20 * \"lunch\"  ; :work:friday:\n"+
+		"    Assets:Wallet:guachi  -12.50 USD\n"+
+		"    Expenses:food  12.50 USD\n"+
+		"\n"+
+		"2019/05/20 * refund\n"+
+		"    Assets:Wallet:guachi  3.00 USD\n"+
+		"    Income:food  -3.00 USD\n"+
+		"\n"+
+		"2019/05/21 * parking\n"+
+		"    Assets:Wallet:guachi  -0.99 USD\n"+
+		"    Expenses:Uncategorized  0.99 USD\n"+
+		"\n")
+	expectExport(t, wallet, timeRange, wl.ExportBeancount, ""+
+		"2019-05-20 open Assets:Wallet:Guachi\n"+
+		"2019-05-20 open Equity:Opening-Balances\n"+
+		"2019-05-20 open Expenses:Food\n"+
+		"2019-05-20 open Expenses:Uncategorized\n"+
+		"2019-05-20 open Income:Food\n"+
+		"\n"+
+		"2019-05-20 * \"期初餘額\"\n"+
+		"  Assets:Wallet:Guachi  1000.00 USD\n"+
+		"  Equity:Opening-Balances  -1000.00 USD\n"+
+		"\n"+
+		"2019-05-20 * \"\\\"lunch\\\"\" #work #friday\n"+
+		"  Assets:Wallet:Guachi  -12.50 USD\n"+
+		"  Expenses:Food  12.50 USD\n"+
+		"\n"+
+		"2019-05-20 * \"refund\"\n"+
+		"  Assets:Wallet:Guachi  3.00 USD\n"+
+		"  Income:Food  -3.00 USD\n"+
+		"\n"+
+		"2019-05-21 * \"parking\"\n"+
+		"  Assets:Wallet:Guachi  -0.99 USD\n"+
+		"  Expenses:Uncategorized  0.99 USD\n"+
+		"\n")
+
+	// the counterparty of the transfer is exported as the other wallet
+	now := time.Now().Unix()
+	timeRange = wl.TimeRange{Start: now - 3600, End: now + 3600}
+	var buffer bytes.Buffer
+	if err := wallet.ExportLogs(ownerID, userID, timeRange, wl.ExportCSV, &buffer); err != nil {
+		t.Fatalf("ExportLogs of the transfer failed: %v", err)
+	}
+	if lines := strings.Split(buffer.String(), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[1], ",gift,,,-20.00,USD,pay,969.51") {
+		t.Fatalf("the exported transfer is unexpected:\n%s", buffer.String())
+	}
+	buffer.Reset()
+	if err := wallet.ExportLogs(ownerID, userID, timeRange, wl.ExportLedger, &buffer); err != nil {
+		t.Fatalf("ExportLogs of the transfer failed: %v", err)
+	}
+	if !strings.Contains(buffer.String(), "    Assets:Wallet:pay  20.00 USD\n") {
+		t.Fatalf("the exported transfer is unexpected:\n%s", buffer.String())
+	}
+
+	// nothing is written in the empty range but the header of CSV
+	timeRange = wl.TimeRange{Start: day - 7*86400, End: day - 6*86400}
+	expectExport(t, wallet, timeRange, wl.ExportCSV, "timestamp,reason,category,tags,amount,currency,counterparty,balance\n")
+	expectExport(t, wallet, timeRange, wl.ExportLedger, "")
+	expectExport(t, wallet, timeRange, wl.ExportBeancount, "")
+
+	expectErr(t, "ExportLogs in unknown format", wallet.ExportLogs(ownerID, userID, timeRange, wl.ExportFormat("qif"), &buffer), wl.ErrInvalidExportFormat)
+	expectErr(t, "ExportLogs in the empty range", wallet.ExportLogs(ownerID, userID, wl.TimeRange{Start: day, End: day}, wl.ExportCSV, &buffer), wl.ErrInvalidReport)
+	expectErr(t, "ExportLogs by guest", wallet.ExportLogs(guestID, userID, timeRange, wl.ExportCSV, &buffer), wl.ErrPermissionDenied)
+}
+
+func expectDrift(t *testing.T, name string, drift *wl.Drift, userID string, balance, journal int64, repaired bool) {
+	t.Helper()
+	if drift.UserID != userID || drift.Balance != balance || drift.Journal != journal || drift.Repaired != repaired {
+		t.Fatalf("%s is %+v, expected %s with %d/%d repaired %v", name, *drift, userID, balance, journal, repaired)
+	}
+}
+
+func reconcile(t *testing.T, wallet wl.Wallet, userID string, repair bool) *wl.Drift {
+	t.Helper()
+	drift, err := wallet.Reconcile(ownerID, userID, repair)
+	if err != nil {
+		t.Fatalf("Reconcile(%s) failed: %v", userID, err)
+	}
+	return drift
+}
+
+func reconcileAll(t *testing.T, wallet wl.Wallet, repair bool, userIDs ...string) []*wl.Drift {
+	t.Helper()
+	drifts, err := wallet.ReconcileAll(repair, userIDs...)
+	if err != nil {
+		t.Fatalf("ReconcileAll failed: %v", err)
+	}
+	return drifts
+}
+
+// testReconcile makes drift with `drift`, and only wallets without drift are reconciled if it's nil
+func testReconcile(t *testing.T, wallet wl.Wallet, drift Drift) {
+	mustCreate(t, wallet, userID)
+	mustCreate(t, wallet, otherID)
+	mustDeposit(t, wallet, userID, 100, "salary")
+	if err := wallet.AddMember(ownerID, userID, editorID, wl.RoleEditor); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+
+	expectDrift(t, "Reconcile without drift", reconcile(t, wallet, userID, true), userID, 100, 100, false)
+	if drifts := reconcileAll(t, wallet, true); len(drifts) != 0 {
+		t.Fatalf("ReconcileAll without drift returned %+v", drifts[0])
+	}
+	if logs := getLogs(t, wallet, userID); len(logs) != 1 {
+		t.Fatalf("%d logs are found after reconciling without drift", len(logs))
+	}
+	_, err := wallet.Reconcile(editorID, userID, false)
+	expectErr(t, "Reconcile by editor", err, wl.ErrPermissionDenied)
+	_, err = wallet.Reconcile(ownerID, guestID, false)
+	expectErr(t, "Reconcile of unknown wallet", err, wl.ErrWalletNotFound)
+	_, err = wallet.ReconcileAll(false, userID, guestID)
+	expectErr(t, "ReconcileAll of unknown wallet", err, wl.ErrWalletNotFound)
+
+	if drift == nil {
+		return
+	}
+	drift(t, wallet, userID, 30)
+	drift(t, wallet, otherID, -5)
+
+	// drift is only reported unless it's repaired
+	expectDrift(t, "Reconcile", reconcile(t, wallet, userID, false), userID, 130, 100, false)
+	drifts := reconcileAll(t, wallet, false)
+	if len(drifts) != 2 {
+		t.Fatalf("ReconcileAll found %d wallets with drift, expected 2", len(drifts))
+	}
+	expectDrift(t, "ReconcileAll", drifts[0], userID, 130, 100, false)
+	expectDrift(t, "ReconcileAll", drifts[1], otherID, -5, 0, false)
+	if drifts := reconcileAll(t, wallet, false, otherID); len(drifts) != 1 || drifts[0].UserID != otherID {
+		t.Fatalf("ReconcileAll of the wallet returned %d drifts", len(drifts))
+	}
+	if logs := getLogs(t, wallet, userID); len(logs) != 1 {
+		t.Fatalf("%d logs are found after reconciling without repairing", len(logs))
+	}
+
+	// the balance is what users have seen, so it remains, and the adjustment log makes the journal agree with it
+	expectDrift(t, "Reconcile with repairing", reconcile(t, wallet, userID, true), userID, 130, 100, true)
+	expectBalance(t, wallet, userID, 130)
+	if logs := getLogs(t, wallet, userID); len(logs) != 2 || logs[1].Amount != 30 {
+		t.Fatalf("logs after repairing are unexpected: %+v", logs)
+	}
+	expectDrift(t, "Reconcile after repairing", reconcile(t, wallet, userID, false), userID, 130, 130, false)
+
+	drifts = reconcileAll(t, wallet, true)
+	if len(drifts) != 1 {
+		t.Fatalf("ReconcileAll with repairing found %d wallets with drift, expected 1", len(drifts))
+	}
+	expectDrift(t, "ReconcileAll with repairing", drifts[0], otherID, -5, 0, true)
+	expectBalance(t, wallet, otherID, -5)
+	if drifts := reconcileAll(t, wallet, false); len(drifts) != 0 {
+		t.Fatalf("ReconcileAll after repairing returned %+v", drifts[0])
+	}
+
+	// the adjustment is neither income nor expense
+	now := time.Now().Unix()
+	expectSummary(t, wallet, wl.TimeRange{Start: now - 3600, End: now + 3600}, wl.GroupByDay, 100, 0, base.ParseToyyymmdd(now)+":100/0")
+}